@@ -0,0 +1,403 @@
+// Package css implements a simple, forgiving CSS parser and serializer suitable
+// for manipulating stylesheets in epubs. Comments are not preserved.
+package css
+
+import (
+	"errors"
+	"strings"
+)
+
+// Stylesheet is a parsed CSS stylesheet.
+type Stylesheet struct {
+	Rules []*Rule
+}
+
+// Rule is a style rule or an at-rule.
+type Rule struct {
+	// AtRule is the lowercase name of an at-rule without the @ (e.g. media,
+	// font-face, import), or empty for style rules.
+	AtRule string
+	// Prelude is the selector list for style rules, or the prelude for at-rules.
+	Prelude string
+	// Block is false for at-rules without a block (e.g. @import or @charset).
+	Block bool
+	// Declarations contains the declarations in the block.
+	Declarations []*Declaration
+	// Rules contains nested rules in the block (e.g. for @media).
+	Rules []*Rule
+}
+
+// Declaration is a single property declaration.
+type Declaration struct {
+	Property  string // lowercase, except for custom properties
+	Value     string
+	Important bool
+}
+
+// Parse parses a stylesheet. An error will only be returned for unterminated
+// strings, comments, and blocks.
+func Parse(css string) (*Stylesheet, error) {
+	p := &parser{s: css}
+	rules := p.rules()
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Stylesheet{Rules: rules}, nil
+}
+
+// ParseDeclarations parses a declaration list (e.g. the contents of a style
+// attribute).
+func ParseDeclarations(css string) ([]*Declaration, error) {
+	p := &parser{s: css}
+	decls, _ := p.blockContents(false)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return decls, nil
+}
+
+// Selectors splits the prelude of a style rule into individual selectors.
+func (r *Rule) Selectors() []string {
+	if r.AtRule != "" {
+		return nil
+	}
+	var sels []string
+	for _, sel := range splitTopLevel(r.Prelude, ',') {
+		if sel = strings.TrimSpace(sel); sel != "" {
+			sels = append(sels, sel)
+		}
+	}
+	return sels
+}
+
+// SetSelectors sets the prelude of a style rule from individual selectors.
+func (r *Rule) SetSelectors(sels []string) {
+	r.Prelude = strings.Join(sels, ", ")
+}
+
+// Get gets the last declaration for a property, or nil if not found.
+func (r *Rule) Get(property string) *Declaration {
+	for i := len(r.Declarations) - 1; i >= 0; i-- {
+		if r.Declarations[i].Property == property {
+			return r.Declarations[i]
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every rule in the stylesheet, including nested ones, in
+// order. If fn returns false, the rule's nested rules are skipped.
+func (s *Stylesheet) Walk(fn func(r *Rule) bool) {
+	walk(s.Rules, fn)
+}
+
+func walk(rules []*Rule, fn func(r *Rule) bool) {
+	for _, r := range rules {
+		if fn(r) {
+			walk(r.Rules, fn)
+		}
+	}
+}
+
+// Filter removes rules (including nested ones) for which fn returns false.
+func (s *Stylesheet) Filter(fn func(r *Rule) bool) {
+	s.Rules = filter(s.Rules, fn)
+}
+
+func filter(rules []*Rule, fn func(r *Rule) bool) []*Rule {
+	res := rules[:0]
+	for _, r := range rules {
+		if fn(r) {
+			r.Rules = filter(r.Rules, fn)
+			res = append(res, r)
+		}
+	}
+	for i := len(res); i < len(rules); i++ {
+		rules[i] = nil
+	}
+	return res
+}
+
+type parser struct {
+	s   string
+	i   int
+	err error
+}
+
+func (p *parser) eof() bool {
+	return p.i >= len(p.s)
+}
+
+// space skips whitespace, comments, and (if top is true) CDO/CDC tokens.
+func (p *parser) space(top bool) {
+	for !p.eof() {
+		switch {
+		case isSpace(p.s[p.i]):
+			p.i++
+		case strings.HasPrefix(p.s[p.i:], "/*"):
+			p.comment()
+		case top && strings.HasPrefix(p.s[p.i:], "<!--"):
+			p.i += 4
+		case top && strings.HasPrefix(p.s[p.i:], "-->"):
+			p.i += 3
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) comment() {
+	if j := strings.Index(p.s[p.i+2:], "*/"); j == -1 {
+		p.fail("unterminated comment")
+		p.i = len(p.s)
+	} else {
+		p.i += 2 + j + 2
+	}
+}
+
+func (p *parser) fail(msg string) {
+	if p.err == nil {
+		p.err = errors.New(msg)
+	}
+}
+
+// until reads until one of the stop characters is found outside of strings,
+// parens, and brackets, stripping comments and trimming whitespace. The stop
+// character is not consumed, and is 0 if EOF was reached.
+func (p *parser) until(stops string) (string, byte) {
+	var b strings.Builder
+	var depth int
+	for !p.eof() {
+		c := p.s[p.i]
+		switch {
+		case depth == 0 && strings.IndexByte(stops, c) != -1:
+			return strings.TrimSpace(b.String()), c
+		case c == '/' && strings.HasPrefix(p.s[p.i:], "/*"):
+			p.comment()
+			b.WriteByte(' ')
+			continue
+		case c == '"' || c == '\'':
+			b.WriteString(p.str())
+			continue
+		case c == '\\' && p.i+1 < len(p.s):
+			b.WriteString(p.s[p.i : p.i+2])
+			p.i += 2
+			continue
+		case c == '(' || c == '[':
+			depth++
+		case (c == ')' || c == ']') && depth > 0:
+			depth--
+		}
+		b.WriteByte(c)
+		p.i++
+	}
+	return strings.TrimSpace(b.String()), 0
+}
+
+// str reads a string token, including the quotes.
+func (p *parser) str() string {
+	q, st := p.s[p.i], p.i
+	for p.i++; !p.eof(); p.i++ {
+		switch p.s[p.i] {
+		case '\\':
+			p.i++
+		case '\n':
+			p.fail("unterminated string")
+			return p.s[st:p.i]
+		case q:
+			p.i++
+			return p.s[st:p.i]
+		}
+	}
+	p.fail("unterminated string")
+	return p.s[st:]
+}
+
+// rules reads the top-level list of rules.
+func (p *parser) rules() []*Rule {
+	var rules []*Rule
+	for {
+		p.space(true)
+		if p.eof() {
+			return rules
+		}
+		if p.s[p.i] == '}' {
+			p.i++ // stray closing brace
+			continue
+		}
+		if r := p.rule(); r != nil {
+			rules = append(rules, r)
+		}
+	}
+}
+
+// rule reads a single rule, returning nil if it is invalid.
+func (p *parser) rule() *Rule {
+	r := &Rule{}
+	if p.s[p.i] == '@' {
+		p.i++
+		st := p.i
+		for !p.eof() && isIdent(p.s[p.i]) {
+			p.i++
+		}
+		r.AtRule = strings.ToLower(p.s[st:p.i])
+	}
+
+	prelude, stop := p.until(";{}")
+	r.Prelude = collapseSpace(prelude)
+	if r.AtRule == "" {
+		r.SetSelectors(r.Selectors())
+	}
+
+	switch stop {
+	case '{':
+		p.i++
+		r.Block = true
+		r.Declarations, r.Rules = p.blockContents(true)
+	case ';':
+		p.i++
+		if r.AtRule == "" {
+			return nil // invalid style rule
+		}
+	case '}':
+		if r.AtRule == "" {
+			return nil // invalid style rule; the brace belongs to the parent
+		}
+	case 0:
+		if r.AtRule == "" {
+			return nil // invalid style rule
+		}
+	}
+	return r
+}
+
+// blockContents reads declarations and nested rules until the closing brace,
+// which is consumed if inBlock is true.
+func (p *parser) blockContents(inBlock bool) ([]*Declaration, []*Rule) {
+	var decls []*Declaration
+	var rules []*Rule
+	for {
+		p.space(false)
+		if p.eof() {
+			if inBlock {
+				p.fail("unterminated block")
+			}
+			return decls, rules
+		}
+		switch p.s[p.i] {
+		case '}':
+			if inBlock {
+				p.i++
+				return decls, rules
+			}
+			p.i++
+			continue
+		case ';':
+			p.i++
+			continue
+		case '@':
+			if r := p.rule(); r != nil {
+				rules = append(rules, r)
+			}
+			continue
+		}
+
+		st := p.i
+		text, stop := p.until(";{}")
+		if stop == '{' {
+			p.i = st
+			if r := p.rule(); r != nil {
+				rules = append(rules, r)
+			}
+			continue
+		}
+		if d := parseDeclaration(text); d != nil {
+			decls = append(decls, d)
+		}
+	}
+}
+
+func parseDeclaration(text string) *Declaration {
+	i := strings.IndexByte(text, ':')
+	if i <= 0 {
+		return nil
+	}
+	d := &Declaration{
+		Property: strings.TrimSpace(text[:i]),
+		Value:    collapseSpace(text[i+1:]),
+	}
+	if !strings.HasPrefix(d.Property, "--") {
+		d.Property = strings.ToLower(d.Property)
+	}
+	if j := strings.LastIndexByte(d.Value, '!'); j != -1 && strings.EqualFold(strings.TrimSpace(d.Value[j+1:]), "important") {
+		d.Value, d.Important = strings.TrimSpace(d.Value[:j]), true
+	}
+	return d
+}
+
+// splitTopLevel splits s at sep outside of strings, parens, and brackets.
+func splitTopLevel(s string, sep byte) []string {
+	var res []string
+	var depth, st int
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' || c == '\'':
+			for i++; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case c == '(' || c == '[':
+			depth++
+		case (c == ')' || c == ']') && depth > 0:
+			depth--
+		case c == sep && depth == 0:
+			res = append(res, s[st:i])
+			st = i + 1
+		}
+	}
+	return append(res, s[st:])
+}
+
+// collapseSpace replaces runs of whitespace outside of strings with a single
+// space.
+func collapseSpace(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case isSpace(c):
+			for i+1 < len(s) && isSpace(s[i+1]) {
+				i++
+			}
+			b.WriteByte(' ')
+		case c == '\\' && i+1 < len(s):
+			b.WriteString(s[i : i+2])
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				j = len(s) - 1
+			}
+			b.WriteString(s[i : j+1])
+			i = j
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isIdent(c byte) bool {
+	return c == '-' || c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
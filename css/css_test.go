@@ -0,0 +1,74 @@
+package css
+
+import "testing"
+
+func TestStylesheet(t *testing.T) {
+	for _, c := range []struct {
+		in, pretty, minified string
+	}{
+		{"", "", ""},
+		{
+			"@charset \"utf-8\";\n/* comment */ body  >  p , h1 { color : red ; margin:0 auto }",
+			"@charset \"utf-8\";\nbody > p, h1 {\n    color: red;\n    margin: 0 auto;\n}\n",
+			"@charset \"utf-8\";body>p,h1{color:red;margin:0 auto}",
+		},
+		{
+			"@media screen and (min-width: 10px) { p.a { font-size: 1em !important } }",
+			"@media screen and (min-width: 10px) {\n    p.a {\n        font-size: 1em !important;\n    }\n}\n",
+			"@media screen and (min-width: 10px){p.a{font-size:1em!important}}",
+		},
+		{
+			"@font-face { font-family: \"A ; B\"; src: url(data:font/ttf;base64,AAAA) format('truetype') }",
+			"@font-face {\n    font-family: \"A ; B\";\n    src: url(data:font/ttf;base64,AAAA) format('truetype');\n}\n",
+			"@font-face{font-family:\"A ; B\";src:url(data:font/ttf;base64,AAAA) format('truetype')}",
+		},
+		{
+			"a[title=\"x , y\"]::before { content: \"}\" } } invalid; .b {}",
+			"a[title=\"x , y\"]::before {\n    content: \"}\";\n}\n.b {}\n",
+			"a[title=\"x , y\"]::before{content:\"}\"}.b{}",
+		},
+		{
+			"@page { margin: 1em; @top-center { content: \"x\" } }",
+			"@page {\n    margin: 1em;\n    @top-center {\n        content: \"x\";\n    }\n}\n",
+			"@page{margin:1em;@top-center{content:\"x\"}}",
+		},
+	} {
+		ss, err := Parse(c.in)
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %v", c.in, err)
+			continue
+		}
+		if s := ss.String(); s != c.pretty {
+			t.Errorf("%#v: expected pretty %#v, got %#v", c.in, c.pretty, s)
+		}
+		if s := ss.Minified(); s != c.minified {
+			t.Errorf("%#v: expected minified %#v, got %#v", c.in, c.minified, s)
+		}
+	}
+
+	for _, in := range []string{"a { color: red", "/* test", "a { content: \"test }"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("%#v: expected error", in)
+		}
+	}
+}
+
+func TestDeclarations(t *testing.T) {
+	decls, err := ParseDeclarations(" font-family: Arial ; COLOR: Green !IMPORTANT; --Custom: 1;; invalid ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s, e := FormatDeclarations(decls, false), "font-family: Arial; color: Green !important; --Custom: 1"; s != e {
+		t.Errorf("expected %#v, got %#v", e, s)
+	}
+	if s, e := FormatDeclarations(decls, true), "font-family:Arial;color:Green!important;--Custom:1"; s != e {
+		t.Errorf("expected %#v, got %#v", e, s)
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	r := &Rule{Prelude: "a, b:not(.c, .d), e[f=\",\"]"}
+	if sels := r.Selectors(); len(sels) != 3 || sels[1] != "b:not(.c, .d)" || sels[2] != "e[f=\",\"]" {
+		t.Errorf("unexpected selectors %#v", sels)
+	}
+}
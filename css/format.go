@@ -0,0 +1,163 @@
+package css
+
+import "strings"
+
+// String formats the stylesheet with one declaration per line.
+func (s *Stylesheet) String() string {
+	var b strings.Builder
+	for _, r := range s.Rules {
+		r.format(&b, 0, false)
+	}
+	return b.String()
+}
+
+// Minified formats the stylesheet with as little whitespace as possible.
+func (s *Stylesheet) Minified() string {
+	var b strings.Builder
+	for _, r := range s.Rules {
+		r.format(&b, 0, true)
+	}
+	return b.String()
+}
+
+// String formats the declaration.
+func (d *Declaration) String() string {
+	if d.Important {
+		return d.Property + ": " + d.Value + " !important"
+	}
+	return d.Property + ": " + d.Value
+}
+
+// FormatDeclarations formats a declaration list (e.g. for a style attribute).
+func FormatDeclarations(decls []*Declaration, minify bool) string {
+	var b strings.Builder
+	for i, d := range decls {
+		if i != 0 {
+			if minify {
+				b.WriteByte(';')
+			} else {
+				b.WriteString("; ")
+			}
+		}
+		if minify {
+			d.minified(&b)
+		} else {
+			b.WriteString(d.String())
+		}
+	}
+	return b.String()
+}
+
+func (r *Rule) format(b *strings.Builder, depth int, minify bool) {
+	indent := strings.Repeat("    ", depth)
+	if !minify {
+		b.WriteString(indent)
+	}
+	if r.AtRule != "" {
+		b.WriteString("@" + r.AtRule)
+		if r.Prelude != "" {
+			b.WriteByte(' ')
+			if minify {
+				b.WriteString(minifyPrelude(r.Prelude, false))
+			} else {
+				b.WriteString(r.Prelude)
+			}
+		}
+		if !r.Block {
+			b.WriteByte(';')
+			if !minify {
+				b.WriteByte('\n')
+			}
+			return
+		}
+	} else if minify {
+		b.WriteString(minifyPrelude(r.Prelude, true))
+	} else {
+		b.WriteString(r.Prelude)
+	}
+
+	if minify {
+		b.WriteByte('{')
+		for i, d := range r.Declarations {
+			if i != 0 {
+				b.WriteByte(';')
+			}
+			d.minified(b)
+		}
+		if len(r.Declarations) != 0 && len(r.Rules) != 0 {
+			b.WriteByte(';')
+		}
+		for _, c := range r.Rules {
+			c.format(b, depth+1, true)
+		}
+		b.WriteByte('}')
+		return
+	}
+
+	if len(r.Declarations) == 0 && len(r.Rules) == 0 {
+		b.WriteString(" {}\n")
+		return
+	}
+	b.WriteString(" {\n")
+	for _, d := range r.Declarations {
+		b.WriteString(indent + "    " + d.String() + ";\n")
+	}
+	for _, c := range r.Rules {
+		c.format(b, depth+1, false)
+	}
+	b.WriteString(indent + "}\n")
+}
+
+func (d *Declaration) minified(b *strings.Builder) {
+	b.WriteString(d.Property)
+	b.WriteByte(':')
+	b.WriteString(minifyValue(d.Value))
+	if d.Important {
+		b.WriteString("!important")
+	}
+}
+
+// minifyPrelude removes unnecessary whitespace from a selector list or an
+// at-rule prelude.
+func minifyPrelude(s string, selector bool) string {
+	if selector {
+		return removeSpaceAround(collapseSpace(s), ",>+~")
+	}
+	return removeSpaceAround(collapseSpace(s), ",")
+}
+
+// minifyValue removes unnecessary whitespace from a property value.
+func minifyValue(s string) string {
+	return removeSpaceAround(collapseSpace(s), ",")
+}
+
+// removeSpaceAround removes single spaces around the specified characters
+// outside of strings. The input should have already been passed through
+// collapseSpace.
+func removeSpaceAround(s string, chars string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			b.WriteString(s[i : i+2])
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				j = len(s) - 1
+			}
+			b.WriteString(s[i : j+1])
+			i = j
+		case c == ' ' && ((i+1 < len(s) && strings.IndexByte(chars, s[i+1]) != -1) || (i > 0 && strings.IndexByte(chars, s[i-1]) != -1)):
+			// skip
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
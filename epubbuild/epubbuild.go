@@ -0,0 +1,389 @@
+// Package epubbuild generates EPUB 3 books from source files.
+package epubbuild
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pgaskin/epubtool/epubtransform"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Book is a book to build.
+type Book struct {
+	Metadata Metadata
+	Chapters []*Chapter // in spine order
+	// Modified is the dcterms:modified date. If it is zero, the current time is
+	// used.
+	Modified time.Time
+	// Warnings is set to the problems found while building the book (e.g.
+	// references to missing files).
+	Warnings []string
+}
+
+// Chapter is a content document.
+type Chapter struct {
+	// Source is the path to the source file, which relative references are
+	// resolved from.
+	Source string
+	// Doc is the parsed document. It will be modified when the book is built.
+	Doc *html.Node
+}
+
+// Input returns an InputFunc which builds the book. The package document, nav,
+// NCX, and cover page (if there is a cover) are generated, the chapters are
+// converted to XHTML, and the local files referenced by them (and by the
+// stylesheets) are copied into the book.
+func (b *Book) Input() epubtransform.InputFunc {
+	return func(epubdir string) error {
+		return b.build(epubdir)
+	}
+}
+
+// The layout of the built book (relative to the epub root).
+const (
+	contentDir = "OEBPS"
+	opfName    = "content.opf"
+	navName    = "nav.xhtml"
+	ncxName    = "toc.ncx"
+	coverName  = "text/cover.xhtml"
+)
+
+// resourceDirs are the directories resources are placed in by extension.
+var resourceDirs = map[string]string{
+	".css": "styles",
+	".png": "images", ".jpg": "images", ".jpeg": "images", ".gif": "images", ".svg": "images", ".webp": "images",
+	".ttf": "fonts", ".otf": "fonts", ".woff": "fonts", ".woff2": "fonts",
+	".mp3": "media", ".m4a": "media", ".aac": "media", ".mp4": "media", ".ogg": "media", ".oga": "media", ".opus": "media", ".wav": "media", ".webm": "media",
+	".js": "scripts",
+}
+
+// builder contains the state while building a book. Destination paths are
+// slash-separated and relative to the content directory.
+type builder struct {
+	book     *Book
+	dir      string            // the content directory
+	used     map[string]bool   // destination paths
+	chapters map[string]string // chapter source -> destination
+	res      map[string]string // resource source -> destination
+	queue    []string          // resource sources which haven't been copied yet
+}
+
+type builtChapter struct {
+	dest  string
+	title string
+	toc   []epubtransform.TOCEntry
+	cover bool
+}
+
+func (b *Book) build(epubdir string) error {
+	if len(b.Chapters) == 0 {
+		return errors.New("no chapters")
+	}
+	if b.Metadata.Title == "" {
+		return errors.New("no title")
+	}
+	meta := b.Metadata
+	if meta.Language == "" {
+		meta.Language = "en"
+	}
+	if meta.Identifier == "" {
+		u, err := util.NewUUID()
+		if err != nil {
+			return util.Wrap(err, "generate identifier")
+		}
+		meta.Identifier = "urn:uuid:" + u
+	}
+	modified := b.Modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	b.Warnings = nil
+
+	bd := &builder{
+		book:     b,
+		dir:      filepath.Join(epubdir, contentDir),
+		used:     map[string]bool{opfName: true, navName: true, ncxName: true},
+		chapters: map[string]string{},
+		res:      map[string]string{},
+	}
+
+	if err := os.MkdirAll(filepath.Join(epubdir, "META-INF"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(epubdir, "mimetype"), []byte("application/epub+zip"), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(epubdir, "META-INF", "container.xml"), []byte(containerXML), 0644); err != nil {
+		return err
+	}
+
+	// the cover page is generated like the other chapters so the image is
+	// handled the same way as other resources
+	chapters := b.Chapters
+	var cover string
+	if meta.Cover != "" {
+		abs, err := filepath.Abs(meta.Cover)
+		if err != nil {
+			return err
+		}
+		if !isFile(abs) {
+			return fmt.Errorf("cover image %#v does not exist", meta.Cover)
+		}
+		doc, err := html.Parse(strings.NewReader(fmt.Sprintf(coverXHTML, html.EscapeString((&url.URL{Path: filepath.Base(abs)}).String()))))
+		if err != nil {
+			return err
+		}
+		cover = bd.resource(abs)
+		bd.used[coverName] = true
+		chapters = append([]*Chapter{{Source: filepath.Join(filepath.Dir(abs), "cover.xhtml"), Doc: doc}}, chapters...)
+	}
+
+	built := make([]builtChapter, len(chapters))
+	for i, ch := range chapters {
+		if i == 0 && cover != "" {
+			built[i] = builtChapter{dest: coverName, title: "Cover", cover: true}
+			continue
+		}
+		abs, err := filepath.Abs(ch.Source)
+		if err != nil {
+			return err
+		}
+		if _, ok := bd.chapters[abs]; ok {
+			return fmt.Errorf("duplicate chapter %#v", ch.Source)
+		}
+		base := strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs))
+		built[i].dest = bd.unique(path.Join("text", base+".xhtml"))
+		bd.chapters[abs] = built[i].dest
+	}
+
+	var css []string
+	for _, fn := range meta.Stylesheets {
+		abs, err := filepath.Abs(fn)
+		if err != nil {
+			return err
+		}
+		if !isFile(abs) {
+			return fmt.Errorf("stylesheet %#v does not exist", fn)
+		}
+		css = append(css, bd.resource(abs))
+	}
+
+	items := map[string]string{} // destination -> properties
+	if cover != "" {
+		items[cover] = "cover-image"
+	}
+	for i, ch := range chapters {
+		c := &built[i]
+		abs, err := filepath.Abs(ch.Source)
+		if err != nil {
+			return err
+		}
+		bd.rewriteDoc(abs, c.dest, ch.Doc)
+
+		if !c.cover {
+			head := ensureHead(ch.Doc)
+			for _, s := range css {
+				head.AppendChild(&html.Node{Type: html.ElementNode, Data: "link", DataAtom: atom.Link, Attr: []html.Attribute{
+					{Key: "rel", Val: "stylesheet"},
+					{Key: "type", Val: "text/css"},
+					{Key: "href", Val: epubtransform.RelativeRef(c.dest, s, "")},
+				}})
+			}
+			c.title, c.toc = chapterTOC(ch.Doc, c.dest)
+			if c.title == "" {
+				c.title = strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs))
+			}
+		}
+		setTitle(ch.Doc, c.title)
+
+		buf, err := renderXHTML(ch.Doc, meta.Language)
+		if err != nil {
+			return util.Wrap(err, "render %#v", ch.Source)
+		}
+		if err := bd.write(c.dest, buf); err != nil {
+			return err
+		}
+		items[c.dest] = strings.Join(epubtransform.DetectProperties("application/xhtml+xml", buf), " ")
+	}
+
+	for len(bd.queue) != 0 {
+		src := bd.queue[0]
+		bd.queue = bd.queue[1:]
+		dest := bd.res[src]
+		buf, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(filepath.Ext(src), ".css") {
+			buf = []byte(bd.rewriteCSS(src, dest, string(buf)))
+		}
+		if err := bd.write(dest, buf); err != nil {
+			return err
+		}
+		if _, ok := items[dest]; !ok {
+			items[dest] = ""
+		}
+	}
+
+	return bd.writePackage(meta, modified, built, items)
+}
+
+// unique returns a destination path which hasn't been used yet based on dest,
+// and marks it as used.
+func (bd *builder) unique(dest string) string {
+	ext := path.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for i := 2; bd.used[strings.ToLower(dest)]; i++ {
+		dest = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	bd.used[strings.ToLower(dest)] = true
+	return dest
+}
+
+// resource returns the destination of a resource, adding it to the queue if it
+// hasn't been seen yet.
+func (bd *builder) resource(src string) string {
+	if dest, ok := bd.res[src]; ok {
+		return dest
+	}
+	name := filepath.Base(src)
+	dir, ok := resourceDirs[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		dir = "misc"
+	}
+	dest := bd.unique(path.Join(dir, name))
+	bd.res[src] = dest
+	bd.queue = append(bd.queue, src)
+	return dest
+}
+
+func (bd *builder) write(dest string, buf []byte) error {
+	fn := filepath.Join(bd.dir, filepath.FromSlash(dest))
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, buf, 0644)
+}
+
+func (bd *builder) warn(format string, a ...interface{}) {
+	bd.book.Warnings = append(bd.book.Warnings, fmt.Sprintf(format, a...))
+}
+
+// ref rewrites a reference from the source file src (which will be written to
+// dest). References to chapters are rewritten to point to the chapter, and
+// other local files are added as resources. If the reference can't be
+// rewritten, it is returned as-is.
+func (bd *builder) ref(src, dest, raw string) string {
+	if raw == "" || strings.HasPrefix(raw, "#") || strings.HasPrefix(raw, "/") || epubtransform.RefSchemeRe.MatchString(raw) {
+		return raw
+	}
+	p, fragment := raw, ""
+	if i := strings.IndexByte(p, '#'); i != -1 {
+		p, fragment = p[:i], p[i+1:]
+	}
+	if i := strings.IndexByte(p, '?'); i != -1 {
+		p = p[:i]
+	}
+	if u, err := url.PathUnescape(p); err == nil {
+		p = u
+	}
+	target := filepath.Join(filepath.Dir(src), filepath.FromSlash(p))
+
+	if ch, ok := bd.chapters[target]; ok {
+		return epubtransform.RelativeRef(dest, ch, fragment)
+	}
+	if !isFile(target) {
+		bd.warn("%s: could not find %#v", src, raw)
+		return raw
+	}
+	switch strings.ToLower(filepath.Ext(target)) {
+	case ".html", ".xhtml", ".htm", ".md", ".markdown":
+		bd.warn("%s: %#v is not a chapter", src, raw)
+		return raw
+	}
+	return epubtransform.RelativeRef(dest, bd.resource(target), fragment)
+}
+
+// refAttrs are the attributes which contain references.
+var refAttrs = map[string]bool{"href": true, "src": true, "poster": true, "data": true, "xlink:href": true}
+
+// rewriteDoc rewrites the references in a document.
+func (bd *builder) rewriteDoc(src, dest string, doc *html.Node) {
+	util.Walk(doc, func(n *html.Node) bool {
+		if n.Type != html.ElementNode {
+			return true
+		}
+		for i, a := range n.Attr {
+			key := a.Key
+			if a.Namespace != "" {
+				key = a.Namespace + ":" + key
+			}
+			switch {
+			case refAttrs[key]:
+				n.Attr[i].Val = bd.ref(src, dest, strings.TrimSpace(a.Val))
+			case key == "style":
+				n.Attr[i].Val = bd.rewriteCSS(src, dest, a.Val)
+			}
+		}
+		if n.DataAtom == atom.Style {
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.TextNode {
+					c.Data = bd.rewriteCSS(src, dest, c.Data)
+				}
+			}
+		}
+		return true
+	}, nil)
+}
+
+// rewriteCSS rewrites the references in a stylesheet.
+func (bd *builder) rewriteCSS(src, dest, css string) string {
+	return epubtransform.CSSURLRe.ReplaceAllStringFunc(css, func(m string) string {
+		sm := epubtransform.CSSURLRe.FindStringSubmatch(m)
+		for i := 1; i < len(sm); i++ {
+			if sm[i] != "" {
+				n := strings.Replace(bd.ref(src, dest, sm[i]), `"`, `\"`, -1)
+				if i <= 3 {
+					return `url("` + n + `")`
+				}
+				return `@import "` + n + `"`
+			}
+		}
+		return m
+	})
+}
+
+func isFile(fn string) bool {
+	fi, err := os.Stat(fn)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+const containerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="` + contentDir + `/` + opfName + `" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const coverXHTML = `<!DOCTYPE html>
+<html>
+<head>
+<title>Cover</title>
+<style>body { margin: 0; padding: 0; text-align: center; } img { max-width: 100%%; max-height: 100%%; }</style>
+</head>
+<body epub:type="cover">
+<img src="%s" alt="Cover"/>
+</body>
+</html>
+`
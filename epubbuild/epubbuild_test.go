@@ -0,0 +1,157 @@
+package epubbuild
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pgaskin/epubtool/epubtransform"
+)
+
+func TestNaturalLess(t *testing.T) {
+	s := []string{"ch10.md", "ch2.md", "ch1.md", "ch02b.md", "appendix.md", "ch1a.md"}
+	sort.Slice(s, func(i, j int) bool {
+		return naturalLess(s[i], s[j])
+	})
+	if exp := []string{"appendix.md", "ch1.md", "ch1a.md", "ch2.md", "ch02b.md", "ch10.md"}; !reflect.DeepEqual(s, exp) {
+		t.Errorf("expected %q, got %q", exp, s)
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubbuild-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	exp := &Metadata{
+		Title:       "Title",
+		Authors:     []string{"A"},
+		Date:        "2020-01-02",
+		Subjects:    []string{"X", "Y"},
+		SeriesIndex: "1.5",
+		Cover:       filepath.Join(td, "img", "cover.jpg"),
+	}
+	for fn, str := range map[string]string{
+		"metadata.yaml": "title: Title\nauthor: A\ndate: 2020-01-02\nsubject: [X, Y]\nseries_index: 1.5\ncover: img/cover.jpg\n",
+		"metadata.toml": "title = \"Title\"\nauthor = \"A\"\ndate = 2020-01-02T00:00:00Z\nsubject = [\"X\", \"Y\"]\nseries_index = 1.5\ncover = \"img/cover.jpg\"\n",
+	} {
+		fn = filepath.Join(td, fn)
+		if err := ioutil.WriteFile(fn, []byte(str), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := ReadMetadata(fn); err != nil {
+			t.Errorf("%s: unexpected error: %v", fn, err)
+		} else if !reflect.DeepEqual(m, exp) {
+			t.Errorf("%s: expected %+v, got %+v", fn, exp, m)
+		}
+		if err := ioutil.WriteFile(fn, []byte(str+"titel = \"x\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadMetadata(fn); err == nil {
+			t.Errorf("%s: expected error for unknown key", fn)
+		}
+	}
+}
+
+func TestFromMarkdown(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubbuild-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	for fn, str := range map[string]string{
+		"2.md":      "# Two\n\n## Sub\n\n![x](img/x.png)\n",
+		"10.md":     "# Ten\n\nSee [two](2.md#sub).\n",
+		"img/x.png": "\x89PNG\r\n\x1a\n",
+	} {
+		fn = filepath.Join(td, filepath.FromSlash(fn))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(str), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := FromMarkdown(td, Metadata{Title: "Test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := epubtransform.New(epubtransform.Transform{
+		Raw: func(epubdir string) error {
+			pkg, err := epubtransform.ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			var spine []string
+			for _, it := range pkg.SpineItems() {
+				spine = append(spine, it.Path)
+			}
+			if exp := []string{"OEBPS/text/2.xhtml", "OEBPS/text/10.xhtml"}; !reflect.DeepEqual(spine, exp) {
+				t.Errorf("expected spine %q, got %q", exp, spine)
+			}
+			if it := pkg.ItemByPath("OEBPS/images/x.png"); it == nil || it.MediaType != "image/png" {
+				t.Errorf("expected image in manifest, got %+v", it)
+			}
+
+			for fn, substr := range map[string]string{
+				"OEBPS/text/10.xhtml": `<a href="2.xhtml#sub">two</a>`,
+				"OEBPS/text/2.xhtml":  `<img src="../images/x.png" alt="x"/>`,
+				"OEBPS/nav.xhtml":     `<a href="text/2.xhtml#sub">Sub</a>`,
+			} {
+				buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(fn)))
+				if err != nil {
+					return err
+				}
+				if !strings.Contains(string(buf), substr) {
+					t.Errorf("%s: expected %q in:\n%s", fn, substr, buf)
+				}
+			}
+			return nil
+		},
+	}).Run(b.Input(), nil, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(b.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", b.Warnings)
+	}
+}
+
+func TestFromHTML(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubbuild-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	fn := filepath.Join(td, "a.html")
+	if err := ioutil.WriteFile(fn, []byte("<html lang=fr><head><meta charset=windows-1252><title>T\xe9st</title></head><body><p>One<o:p></o:p><br><p>Two <b>&amp;</body>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := FromHTML([]string{fn}, Metadata{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Metadata.Title != "Tést" || b.Metadata.Language != "fr" {
+		t.Errorf("expected metadata from the first file, got %+v", b.Metadata)
+	}
+
+	buf, err := renderXHTML(b.Chapters[0].Doc, "en")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html lang="fr" xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="fr"><head><title>Tést</title></head><body><p>One<br/></p><p>Two <b>&amp;</b></p></body></html>
+`; string(buf) != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, buf)
+	}
+}
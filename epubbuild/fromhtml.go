@@ -0,0 +1,119 @@
+package epubbuild
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-zglob"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// FromHTML creates a book from HTML files in spine order. The encoding of each
+// file is detected from the BOM or meta element (defaulting to UTF-8). If
+// meta.Title, meta.Language, or meta.Authors are empty, they are taken from the
+// title element, lang attribute, and author meta elements of the first file.
+func FromHTML(files []string, meta Metadata) (*Book, error) {
+	b := &Book{Metadata: meta}
+	for _, fn := range files {
+		doc, err := parseHTMLFile(fn)
+		if err != nil {
+			return nil, util.Wrap(err, "parse %#v", fn)
+		}
+		b.Chapters = append(b.Chapters, &Chapter{Source: fn, Doc: doc})
+	}
+
+	if len(b.Chapters) != 0 {
+		doc := b.Chapters[0].Doc
+		if b.Metadata.Title == "" {
+			if t := util.FindElement(doc, atom.Title); t != nil {
+				b.Metadata.Title = textContent(t)
+			}
+		}
+		if b.Metadata.Language == "" {
+			if root := util.FindElement(doc, atom.Html); root != nil {
+				b.Metadata.Language = util.GetAttr(root, "lang")
+			}
+		}
+		if len(b.Metadata.Authors) == 0 {
+			util.Walk(doc, func(n *html.Node) bool {
+				if n.Type == html.ElementNode && n.DataAtom == atom.Meta && strings.EqualFold(util.GetAttr(n, "name"), "author") {
+					if a := strings.TrimSpace(util.GetAttr(n, "content")); a != "" {
+						b.Metadata.Authors = append(b.Metadata.Authors, a)
+					}
+				}
+				return true
+			}, nil)
+		}
+	}
+	return b, nil
+}
+
+func parseHTMLFile(fn string) (*html.Node, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	// DetermineEncoding only looks at the beginning of the file, and defaults
+	// to windows-1252 if it's ASCII
+	if e, name, certain := charset.DetermineEncoding(buf, "text/html"); (certain || name != "windows-1252" || !utf8.Valid(buf)) && name != "utf-8" {
+		if buf, err = e.NewDecoder().Bytes(buf); err != nil {
+			return nil, util.Wrap(err, "decode %s", name)
+		}
+	}
+	return html.Parse(bytes.NewReader(bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf"))))
+}
+
+// ReadFileList reads a list of files (one per line, relative to the list). Blank
+// lines and lines starting with # are ignored.
+func ReadFileList(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(fn), filepath.FromSlash(line))
+		}
+		files = append(files, line)
+	}
+	return files, sc.Err()
+}
+
+// ExpandGlobs replaces the patterns containing glob characters (which can
+// include ** to match any number of directories) with the files matching them
+// in natural sort order. Other paths are left as-is.
+func ExpandGlobs(patterns []string) ([]string, error) {
+	var files []string
+	for _, p := range patterns {
+		if !strings.ContainsAny(p, "*?[") {
+			files = append(files, p)
+			continue
+		}
+		m, err := zglob.Glob(p)
+		if err != nil {
+			return nil, util.Wrap(err, "glob %#v", p)
+		}
+		sort.SliceStable(m, func(i, j int) bool {
+			return naturalLess(m[i], m[j])
+		})
+		files = append(files, m...)
+	}
+	return files, nil
+}
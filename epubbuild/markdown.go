@@ -0,0 +1,118 @@
+package epubbuild
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pgaskin/epubtool/util"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"golang.org/x/net/html"
+)
+
+// MarkdownExtensions are the extensions of the files FromMarkdown uses as
+// chapters.
+var MarkdownExtensions = []string{".md", ".markdown"}
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote, extension.DefinitionList),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	goldmark.WithRendererOptions(gmhtml.WithXHTML(), gmhtml.WithUnsafe()),
+)
+
+// FromMarkdown creates a book from a directory of Markdown files (with GitHub
+// Flavored Markdown, footnotes, and definition lists). If meta.Chapters is
+// empty, the Markdown files directly in the directory are used in natural sort
+// order (i.e. numbers are compared by value). If meta.Title is empty, the name
+// of the directory is used.
+func FromMarkdown(dir string, meta Metadata) (*Book, error) {
+	chapters := meta.Chapters
+	if len(chapters) == 0 {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			for _, ext := range MarkdownExtensions {
+				if strings.EqualFold(filepath.Ext(fi.Name()), ext) {
+					chapters = append(chapters, filepath.Join(dir, fi.Name()))
+				}
+			}
+		}
+		sort.SliceStable(chapters, func(i, j int) bool {
+			return naturalLess(filepath.Base(chapters[i]), filepath.Base(chapters[j]))
+		})
+		if len(chapters) == 0 {
+			return nil, fmt.Errorf("no markdown files in %#v", dir)
+		}
+	}
+
+	if meta.Title == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		meta.Title = filepath.Base(abs)
+	}
+
+	b := &Book{Metadata: meta}
+	for _, fn := range chapters {
+		src, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.WriteString("<!DOCTYPE html><html><head><title></title></head><body>\n")
+		if err := markdown.Convert(src, &buf); err != nil {
+			return nil, util.Wrap(err, "convert %#v", fn)
+		}
+		buf.WriteString("</body></html>")
+		doc, err := html.Parse(&buf)
+		if err != nil {
+			return nil, util.Wrap(err, "parse %#v", fn)
+		}
+		b.Chapters = append(b.Chapters, &Chapter{Source: fn, Doc: doc})
+	}
+	return b, nil
+}
+
+// naturalLess compares strings, treating runs of digits as numbers.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digits(a), digits(b)
+		if da != 0 && db != 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digits returns the number of leading ASCII digits in s.
+func digits(s string) int {
+	var n int
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
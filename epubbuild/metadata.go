@@ -0,0 +1,194 @@
+package epubbuild
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pgaskin/epubtool/util"
+	"gopkg.in/yaml.v2"
+)
+
+// Metadata is the metadata for a book.
+type Metadata struct {
+	Title       string
+	Authors     []string
+	Language    string
+	Identifier  string // a urn:uuid is generated if empty
+	Date        string
+	Publisher   string
+	Description string
+	Rights      string
+	Subjects    []string
+	Series      string
+	SeriesIndex string
+
+	Cover       string   // the path to the cover image
+	Stylesheets []string // paths to stylesheets linked from every content document
+	Chapters    []string // paths to the source files in spine order, if they aren't found automatically
+}
+
+// metadataFile is the format of a metadata file.
+type metadataFile struct {
+	Title       string     `yaml:"title" toml:"title"`
+	Author      stringList `yaml:"author" toml:"author"`
+	Language    string     `yaml:"language" toml:"language"`
+	Identifier  string     `yaml:"identifier" toml:"identifier"`
+	Date        scalar     `yaml:"date" toml:"date"`
+	Publisher   string     `yaml:"publisher" toml:"publisher"`
+	Description string     `yaml:"description" toml:"description"`
+	Rights      string     `yaml:"rights" toml:"rights"`
+	Subject     stringList `yaml:"subject" toml:"subject"`
+	Series      string     `yaml:"series" toml:"series"`
+	SeriesIndex scalar     `yaml:"series_index" toml:"series_index"`
+	Cover       string     `yaml:"cover" toml:"cover"`
+	CSS         stringList `yaml:"css" toml:"css"`
+	Chapters    stringList `yaml:"chapters" toml:"chapters"`
+}
+
+// MetadataFiles are the names of the files FindMetadata looks for.
+var MetadataFiles = []string{"metadata.yaml", "metadata.yml", "metadata.toml", "book.yaml", "book.yml", "book.toml"}
+
+// FindMetadata returns the path to the first file in MetadataFiles which exists
+// in dir, or an empty string if there aren't any.
+func FindMetadata(dir string) string {
+	for _, name := range MetadataFiles {
+		if fn := filepath.Join(dir, name); isFile(fn) {
+			return fn
+		}
+	}
+	return ""
+}
+
+// ReadMetadata reads metadata from a YAML (.yaml/.yml) or TOML (.toml) file.
+// The keys are the same as the field names of Metadata, but lowercase with
+// underscores between words, and singular (author, subject, css, and chapters
+// can be a string or a list). Relative paths are resolved from the directory
+// containing the file. Unknown keys are an error.
+func ReadMetadata(fn string) (*Metadata, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var m metadataFile
+	switch ext := strings.ToLower(filepath.Ext(fn)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(buf, &m); err != nil {
+			return nil, util.Wrap(err, "parse %#v", fn)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(buf), &m)
+		if err != nil {
+			return nil, util.Wrap(err, "parse %#v", fn)
+		}
+		if u := md.Undecoded(); len(u) != 0 {
+			keys := make([]string, len(u))
+			for i, k := range u {
+				keys[i] = k.String()
+			}
+			sort.Strings(keys)
+			return nil, fmt.Errorf("parse %#v: unknown keys %s", fn, strings.Join(keys, ", "))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported metadata file extension %#v", ext)
+	}
+
+	dir := filepath.Dir(fn)
+	resolve := func(ps ...string) []string {
+		for i, p := range ps {
+			if p != "" && !filepath.IsAbs(p) {
+				ps[i] = filepath.Join(dir, filepath.FromSlash(p))
+			}
+		}
+		return ps
+	}
+	return &Metadata{
+		Title:       m.Title,
+		Authors:     m.Author,
+		Language:    m.Language,
+		Identifier:  m.Identifier,
+		Date:        string(m.Date),
+		Publisher:   m.Publisher,
+		Description: m.Description,
+		Rights:      m.Rights,
+		Subjects:    m.Subject,
+		Series:      m.Series,
+		SeriesIndex: string(m.SeriesIndex),
+		Cover:       resolve(m.Cover)[0],
+		Stylesheets: resolve(m.CSS...),
+		Chapters:    resolve(m.Chapters...),
+	}, nil
+}
+
+// stringList is a list of strings which can also be unmarshaled from a single
+// string.
+type stringList []string
+
+func (s *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err == nil {
+		*s = stringList{v}
+		return nil
+	}
+	var l []string
+	if err := unmarshal(&l); err != nil {
+		return errors.New("expected a string or a list of strings")
+	}
+	*s = l
+	return nil
+}
+
+func (s *stringList) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*s = stringList{v}
+		return nil
+	case []interface{}:
+		l := make(stringList, len(v))
+		for i, x := range v {
+			var ok bool
+			if l[i], ok = x.(string); !ok {
+				return errors.New("expected a string or an array of strings")
+			}
+		}
+		*s = l
+		return nil
+	}
+	return errors.New("expected a string or an array of strings")
+}
+
+// scalar is a string which can also be unmarshaled from a number or date.
+type scalar string
+
+func (s *scalar) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return errors.New("expected a string or a number")
+	}
+	*s = scalar(v)
+	return nil
+}
+
+func (s *scalar) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*s = scalar(v)
+	case int64, float64:
+		*s = scalar(fmt.Sprint(v))
+	case time.Time:
+		if h, m, sec := v.Clock(); h == 0 && m == 0 && sec == 0 && v.Nanosecond() == 0 {
+			*s = scalar(v.Format("2006-01-02"))
+		} else {
+			*s = scalar(v.Format(time.RFC3339))
+		}
+	default:
+		return errors.New("expected a string, number, or date")
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package epubbuild
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/epubtransform"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// chapterTOC returns the title of a chapter (the first heading, or the title
+// element if there aren't any) and the table of contents entries for the
+// highest two heading levels used in it (or nil if there aren't any headings).
+// Ids are added to the headings if necessary.
+func chapterTOC(doc *html.Node, dest string) (string, []epubtransform.TOCEntry) {
+	var hs []heading
+	for _, h := range headings(doc) {
+		if textContent(h.node) != "" {
+			hs = append(hs, h)
+		}
+	}
+	if len(hs) == 0 {
+		var title string
+		if t := util.FindElement(doc, atom.Title); t != nil {
+			title = textContent(t)
+		}
+		return title, nil
+	}
+
+	top, sub := hs[0].level, 7
+	for _, h := range hs {
+		if h.level < top {
+			top = h.level
+		}
+	}
+	for _, h := range hs {
+		if h.level > top && h.level < sub {
+			sub = h.level
+		}
+	}
+
+	var toc []epubtransform.TOCEntry
+	for i, h := range hs {
+		e := epubtransform.TOCEntry{Title: textContent(h.node), Path: path.Join(contentDir, dest)}
+		if i != 0 {
+			e.Fragment = ensureID(doc, h.node)
+		}
+		switch {
+		case h.level == top:
+			toc = append(toc, e)
+		case h.level == sub && len(toc) != 0:
+			toc[len(toc)-1].Children = append(toc[len(toc)-1].Children, e)
+		}
+	}
+	return textContent(hs[0].node), toc
+}
+
+var itemIDInvalidRe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// itemID generates a unique manifest item id from a path.
+func itemID(dest string, ids map[string]bool) string {
+	base := strings.Trim(itemIDInvalidRe.ReplaceAllString(path.Base(dest), "_"), "_.-")
+	if base == "" || !(base[0] == '_' || (base[0] >= 'a' && base[0] <= 'z') || (base[0] >= 'A' && base[0] <= 'Z')) {
+		base = "id_" + base
+	}
+	id := base
+	for i := 2; ids[id]; i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	ids[id] = true
+	return id
+}
+
+// writePackage writes the package document, nav, and NCX. The items are the
+// destinations of all files in the content directory and their properties.
+func (bd *builder) writePackage(meta Metadata, modified time.Time, chapters []builtChapter, items map[string]string) error {
+	var toc []epubtransform.TOCEntry
+	for _, c := range chapters {
+		if c.cover {
+			continue
+		}
+		if c.toc != nil {
+			toc = append(toc, c.toc...)
+		} else {
+			toc = append(toc, epubtransform.TOCEntry{Title: c.title, Path: path.Join(contentDir, c.dest)})
+		}
+	}
+
+	ids := map[string]bool{"bookid": true, "nav": true, "ncx": true}
+	order := make([]string, 0, len(items))
+	for _, c := range chapters {
+		order = append(order, c.dest)
+	}
+	var res []string
+	for dest := range items {
+		if !isChapter(chapters, dest) {
+			res = append(res, dest)
+		}
+	}
+	sort.Strings(res)
+	order = append(order, res...)
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	pkg := doc.CreateElement("package")
+	pkg.CreateAttr("xmlns", "http://www.idpf.org/2007/opf")
+	pkg.CreateAttr("version", "3.0")
+	pkg.CreateAttr("unique-identifier", "bookid")
+	pkg.CreateAttr("xml:lang", meta.Language)
+
+	md := pkg.CreateElement("metadata")
+	md.CreateAttr("xmlns:dc", "http://purl.org/dc/elements/1.1/")
+	el := md.CreateElement("dc:identifier")
+	el.CreateAttr("id", "bookid")
+	el.SetText(meta.Identifier)
+	md.CreateElement("dc:title").SetText(meta.Title)
+	for i, a := range meta.Authors {
+		id := fmt.Sprintf("creator%d", i+1)
+		ids[id] = true
+		el := md.CreateElement("dc:creator")
+		el.CreateAttr("id", id)
+		el.SetText(a)
+		el = md.CreateElement("meta")
+		el.CreateAttr("refines", "#"+id)
+		el.CreateAttr("property", "role")
+		el.CreateAttr("scheme", "marc:relators")
+		el.SetText("aut")
+	}
+	md.CreateElement("dc:language").SetText(meta.Language)
+	for _, x := range []struct{ tag, value string }{
+		{"dc:date", meta.Date},
+		{"dc:publisher", meta.Publisher},
+		{"dc:description", meta.Description},
+		{"dc:rights", meta.Rights},
+	} {
+		if x.value != "" {
+			md.CreateElement(x.tag).SetText(x.value)
+		}
+	}
+	for _, s := range meta.Subjects {
+		md.CreateElement("dc:subject").SetText(s)
+	}
+	el = md.CreateElement("meta")
+	el.CreateAttr("property", "dcterms:modified")
+	el.SetText(modified.UTC().Format("2006-01-02T15:04:05Z"))
+
+	mf := pkg.CreateElement("manifest")
+	el = mf.CreateElement("item")
+	el.CreateAttr("id", "nav")
+	el.CreateAttr("href", navName)
+	el.CreateAttr("media-type", "application/xhtml+xml")
+	el.CreateAttr("properties", "nav")
+	el = mf.CreateElement("item")
+	el.CreateAttr("id", "ncx")
+	el.CreateAttr("href", ncxName)
+	el.CreateAttr("media-type", "application/x-dtbncx+xml")
+	itemIDs := map[string]string{}
+	for _, dest := range order {
+		buf, err := ioutil.ReadFile(filepath.Join(bd.dir, filepath.FromSlash(dest)))
+		if err != nil {
+			return err
+		}
+		itemIDs[dest] = itemID(dest, ids)
+		el := mf.CreateElement("item")
+		el.CreateAttr("id", itemIDs[dest])
+		el.CreateAttr("href", epubtransform.RelativeRef(opfName, dest, ""))
+		el.CreateAttr("media-type", epubtransform.SniffMediaType(dest, buf))
+		if p := items[dest]; p != "" {
+			el.CreateAttr("properties", p)
+		}
+		if items[dest] == "cover-image" {
+			el := md.CreateElement("meta")
+			el.CreateAttr("name", "cover")
+			el.CreateAttr("content", itemIDs[dest])
+		}
+	}
+	if meta.Series != "" {
+		el := md.CreateElement("meta")
+		el.CreateAttr("name", "calibre:series")
+		el.CreateAttr("content", meta.Series)
+		if meta.SeriesIndex != "" {
+			el := md.CreateElement("meta")
+			el.CreateAttr("name", "calibre:series_index")
+			el.CreateAttr("content", meta.SeriesIndex)
+		}
+	}
+
+	sp := pkg.CreateElement("spine")
+	sp.CreateAttr("toc", "ncx")
+	for _, c := range chapters {
+		sp.CreateElement("itemref").CreateAttr("idref", itemIDs[c.dest])
+	}
+
+	doc.Indent(2)
+	if err := doc.WriteToFile(filepath.Join(bd.dir, opfName)); err != nil {
+		return err
+	}
+
+	nav := epubtransform.Nav{
+		Title:      meta.Title,
+		Language:   meta.Language,
+		Identifier: meta.Identifier,
+		Authors:    meta.Authors,
+		TOC:        toc,
+	}
+	var start bool
+	for _, c := range chapters {
+		if c.cover {
+			nav.Landmarks = append(nav.Landmarks, epubtransform.Landmark{Type: "cover", Title: "Cover", Path: path.Join(contentDir, c.dest)})
+		} else if !start {
+			nav.Landmarks = append(nav.Landmarks, epubtransform.Landmark{Type: "bodymatter", Title: "Start", Path: path.Join(contentDir, c.dest)})
+			start = true
+		}
+	}
+	epubdir := filepath.Dir(bd.dir)
+	if err := epubtransform.WriteNav(epubdir, path.Join(contentDir, navName), nav); err != nil {
+		return err
+	}
+	return epubtransform.WriteNCX(epubdir, path.Join(contentDir, ncxName), nav)
+}
+
+func isChapter(chapters []builtChapter, dest string) bool {
+	for _, c := range chapters {
+		if c.dest == dest {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package epubbuild
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Namespaces used in XHTML content documents.
+const (
+	nsXHTML  = "http://www.w3.org/1999/xhtml"
+	nsEPUB   = "http://www.idpf.org/2007/ops"
+	nsSVG    = "http://www.w3.org/2000/svg"
+	nsMathML = "http://www.w3.org/1998/Math/MathML"
+	nsXLink  = "http://www.w3.org/1999/xlink"
+)
+
+var xmlNameRe = regexp.MustCompile(`^(?:(xml|xmlns|epub|xlink):)?[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+
+// renderXHTML renders a parsed HTML document as a well-formed XHTML document.
+// Everything outside the html element, comments, and charset declarations (the
+// output is always UTF-8) are removed, the namespaces are declared, elements and
+// attributes with invalid names or unknown prefixes (e.g. o:p from
+// word processors) are removed (keeping the contents), and the contents of
+// script and style elements are wrapped in CDATA sections if necessary.
+func renderXHTML(doc *html.Node, lang string) ([]byte, error) {
+	root := util.FindElement(doc, atom.Html)
+	if root == nil {
+		return nil, fmt.Errorf("no html element")
+	}
+
+	for c := doc.FirstChild; c != nil; {
+		n := c.NextSibling
+		if c != root {
+			doc.RemoveChild(c)
+		}
+		c = n
+	}
+
+	util.SetAttr(root, "xmlns", nsXHTML)
+	util.SetAttr(root, "xmlns:epub", nsEPUB)
+	if lang != "" && util.GetAttr(root, "lang") == "" {
+		util.SetAttr(root, "lang", lang)
+	}
+	if l := util.GetAttr(root, "lang"); l != "" {
+		util.SetAttr(root, "xml:lang", l)
+	}
+
+	var unwrap []*html.Node
+	util.Walk(root, func(n *html.Node) bool {
+		switch n.Type {
+		case html.CommentNode:
+			unwrap = append(unwrap, n)
+		case html.ElementNode:
+			attr := n.Attr[:0]
+			for _, a := range n.Attr {
+				if a.Namespace != "" {
+					a.Key = a.Namespace + ":" + a.Key
+					a.Namespace = ""
+				}
+				if xmlNameRe.MatchString(a.Key) {
+					attr = append(attr, a)
+				}
+			}
+			n.Attr = attr
+			if !xmlNameRe.MatchString(n.Data) || strings.Contains(n.Data, ":") {
+				unwrap = append(unwrap, n)
+			} else if n.DataAtom == atom.Meta && (util.GetAttr(n, "charset") != "" || strings.EqualFold(util.GetAttr(n, "http-equiv"), "content-type")) {
+				unwrap = append(unwrap, n)
+			}
+			switch {
+			case n.Namespace == "svg" && (n.Parent == nil || n.Parent.Namespace != "svg"):
+				util.SetAttr(n, "xmlns", nsSVG)
+				util.SetAttr(n, "xmlns:xlink", nsXLink)
+			case n.Namespace == "math" && (n.Parent == nil || n.Parent.Namespace != "math"):
+				util.SetAttr(n, "xmlns", nsMathML)
+			case n.Namespace == "" && (n.DataAtom == atom.Script || n.DataAtom == atom.Style):
+				if c := n.FirstChild; c != nil && c.Type == html.TextNode && strings.ContainsAny(c.Data, "<&") && !strings.Contains(c.Data, "]]>") {
+					c.Data = "/*<![CDATA[*/" + c.Data + "/*]]>*/"
+				}
+			}
+		}
+		return true
+	}, nil)
+	for _, n := range unwrap {
+		for n.FirstChild != nil {
+			c := n.FirstChild
+			n.RemoveChild(c)
+			n.Parent.InsertBefore(c, n)
+		}
+		n.Parent.RemoveChild(n)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE html>\n")
+	if err := html.Render(&buf, root); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// textContent returns the text of a node with whitespace collapsed.
+func textContent(n *html.Node) string {
+	return strings.Join(strings.Fields(util.TextContent(n)), " ")
+}
+
+// ensureHead returns the head element of a document, creating the html and head
+// elements if necessary (this should always exist after html.Parse).
+func ensureHead(doc *html.Node) *html.Node {
+	if head := util.FindElement(doc, atom.Head); head != nil {
+		return head
+	}
+	root := util.FindElement(doc, atom.Html)
+	if root == nil {
+		root = &html.Node{Type: html.ElementNode, Data: "html", DataAtom: atom.Html}
+		doc.AppendChild(root)
+	}
+	head := &html.Node{Type: html.ElementNode, Data: "head", DataAtom: atom.Head}
+	root.InsertBefore(head, root.FirstChild)
+	return head
+}
+
+// setTitle sets the title element of a document if it is empty.
+func setTitle(doc *html.Node, title string) {
+	head := ensureHead(doc)
+	t := util.FindElement(head, atom.Title)
+	if t == nil {
+		t = &html.Node{Type: html.ElementNode, Data: "title", DataAtom: atom.Title}
+		head.InsertBefore(t, head.FirstChild)
+	}
+	if textContent(t) == "" {
+		for t.FirstChild != nil {
+			t.RemoveChild(t.FirstChild)
+		}
+		t.AppendChild(&html.Node{Type: html.TextNode, Data: title})
+	}
+}
+
+// heading is a heading in a content document.
+type heading struct {
+	level int
+	node  *html.Node
+}
+
+// headings returns the h1-h6 elements of a document.
+func headings(doc *html.Node) []heading {
+	var hs []heading
+	util.Walk(doc, func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.Namespace == "" {
+			switch n.DataAtom {
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				hs = append(hs, heading{int(n.Data[1] - '0'), n})
+			}
+		}
+		return true
+	}, nil)
+	return hs
+}
+
+// ensureID returns the id of an element, generating a unique one from its text
+// if it doesn't have one.
+func ensureID(doc, n *html.Node) string {
+	if id := util.GetAttr(n, "id"); id != "" {
+		return id
+	}
+	ids := map[string]bool{}
+	util.Walk(doc, func(c *html.Node) bool {
+		if c.Type == html.ElementNode {
+			if id := util.GetAttr(c, "id"); id != "" {
+				ids[id] = true
+			}
+		}
+		return true
+	}, nil)
+	base := slug(textContent(n))
+	if base == "" {
+		base = "h"
+	} else if !unicode.IsLetter(rune(base[0])) {
+		base = "h-" + base
+	}
+	id := base
+	for i := 2; ids[id]; i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	util.SetAttr(n, "id", id)
+	return id
+}
+
+// slug converts text into a lowercase ASCII identifier.
+func slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() != 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/pflag"
+
+	"github.com/pgaskin/epubtool/epubbuild"
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"build", "b", "Generate a book from Markdown or HTML files.", buildMain})
+}
+
+func buildMain(args []string, fs *pflag.FlagSet) int {
+	fromHTML := fs.Bool("from-html", false, "Build from HTML files instead of a directory of Markdown files")
+	spine := fs.String("spine", "", "With --from-html, read the HTML files (or globs) from a file (one per line) instead of the arguments")
+	metadata := fs.StringP("metadata", "m", "", "YAML or TOML metadata file (default: metadata.{yaml,yml,toml} or book.{yaml,yml,toml} in the source directory)")
+	title := fs.StringP("title", "t", "", "Set the title")
+	authors := fs.StringArrayP("author", "a", nil, "Set the authors (can be specified multiple times)")
+	language := fs.StringP("language", "l", "", "Set the language (default: en)")
+	identifier := fs.String("identifier", "", "Set the unique identifier (default: a random urn:uuid)")
+	cover := fs.String("cover", "", "Set the cover image")
+	stylesheets := fs.StringArray("css", nil, "Set the stylesheets to link from every chapter (can be specified multiple times)")
+	force := fs.BoolP("force", "f", false, "Overwrite the output file if it exists")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	var valid bool
+	switch {
+	case !*fromHTML:
+		valid = fs.NArg() == 3 && *spine == ""
+	case *spine != "":
+		valid = fs.NArg() == 2
+	default:
+		valid = fs.NArg() >= 3
+	}
+	if *help || !valid {
+		buildHelp(args, fs)
+		return 2
+	}
+
+	of := fs.Arg(fs.NArg() - 1)
+	srcs := fs.Args()[1 : fs.NArg()-1]
+	if *spine != "" {
+		var err error
+		if srcs, err = epubbuild.ReadFileList(*spine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: read spine: %v\n", err)
+			return 1
+		}
+	}
+	if len(srcs) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no input files\n")
+		return 2
+	}
+	srcdir := srcs[0]
+	if *spine != "" {
+		srcdir = filepath.Dir(*spine)
+	} else if *fromHTML {
+		srcdir = filepath.Dir(srcdir)
+	}
+
+	if *metadata == "" {
+		*metadata = epubbuild.FindMetadata(srcdir)
+	}
+	var meta epubbuild.Metadata
+	if *metadata != "" {
+		m, err := epubbuild.ReadMetadata(*metadata)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: read metadata: %v\n", err)
+			return 1
+		}
+		meta = *m
+	}
+	if *title != "" {
+		meta.Title = *title
+	}
+	if len(*authors) != 0 {
+		meta.Authors = *authors
+	}
+	if *language != "" {
+		meta.Language = *language
+	}
+	if *identifier != "" {
+		meta.Identifier = *identifier
+	}
+	if *cover != "" {
+		meta.Cover = *cover
+	}
+	if len(*stylesheets) != 0 {
+		meta.Stylesheets = *stylesheets
+	}
+
+	var book *epubbuild.Book
+	var err error
+	if *fromHTML {
+		var files []string
+		if files, err = epubbuild.ExpandGlobs(srcs); err == nil && len(files) == 0 {
+			err = errors.New("no html files")
+		} else if err == nil {
+			book, err = epubbuild.FromHTML(files, meta)
+		}
+	} else {
+		book, err = epubbuild.FromMarkdown(srcdir, meta)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if sde := os.Getenv("SOURCE_DATE_EPOCH"); sde != "" {
+		if book.Modified, err = parseTimestamp(sde); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid SOURCE_DATE_EPOCH %#v: %v\n", sde, err)
+			return 2
+		}
+	}
+
+	out := et.FileOutput(of)
+	if *force {
+		out = et.ReplaceOutput(of, et.FileOutput)
+	}
+	if err := et.New().Run(book.Input(), out, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	for _, w := range book.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+	fmt.Printf("Built %#v (%d chapters)\n", of, len(book.Chapters))
+	return 0
+}
+
+func buildHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] source_dir output_file\n       %s --from-html [options] html_file... output_file\n       %s --from-html --spine list_file [options] output_file\n\nOptions:\n", args[0], args[0], args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+Chapters:
+  Unless the chapters are listed in the metadata file, the Markdown files directly
+  in source_dir are used in natural sort order (e.g. 2.md before 10.md). With
+  --from-html, the HTML files are used in the order they are specified, and
+  globs (which can include **) are expanded in natural sort order. Images,
+  stylesheets, fonts, and other local files referenced by the chapters are
+  copied into the book, and links between chapters are preserved.
+
+Metadata:
+  The metadata file can contain the following keys (the flags take precedence,
+  and with --from-html, the title, language, and authors default to the ones in
+  the first HTML file):
+    title, author, language, identifier, date, publisher, description, rights,
+    subject, series, series_index, cover, css, chapters (Markdown only)
+  The author, subject, css, and chapters keys can be a string or a list. Paths
+  are relative to the metadata file.
+`)
+}
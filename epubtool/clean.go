@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"clean", "c", "Find and remove orphaned, missing, and duplicate resources in a book.", cleanMain})
+}
+
+func cleanMain(args []string, fs *pflag.FlagSet) int {
+	removeUnlisted := fs.Bool("remove-unlisted", false, "Delete files which are not in the manifest")
+	keepMissing := fs.Bool("keep-missing", false, "Do not remove manifest items whose files are missing")
+	removeUnreferenced := fs.Bool("remove-unreferenced", false, "Remove resources which are not referenced")
+	dedupe := fs.Bool("dedupe", false, "Replace duplicate files with references to the first one")
+	all := fs.BoolP("all", "a", false, "Same as --remove-unlisted --remove-unreferenced --dedupe")
+	dryRun := fs.Bool("dry-run", false, "Only show the problems found (do not actually overwrite file)")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 {
+		cleanHelp(args, fs)
+		return 2
+	}
+
+	if *all {
+		*removeUnlisted, *removeUnreferenced, *dedupe = true, true, true
+	}
+
+	fn := fs.Arg(1)
+	var report et.CleanReport
+	pipeline := et.New(et.TransformClean(et.CleanOptions{
+		RemoveUnlisted:     *removeUnlisted,
+		RemoveMissing:      !*keepMissing,
+		RemoveUnreferenced: *removeUnreferenced,
+		Dedupe:             *dedupe,
+	}, &report))
+
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+
+	if err := pipeline.Run(et.AutoInput(fn), out, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if report.Empty() {
+		fmt.Printf("\nNo problems found.\n")
+		return 0
+	}
+	section := func(title string, skipped bool, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		if skipped || *dryRun {
+			title += " (not removed)"
+		}
+		fmt.Printf("\n%s:\n", title)
+		for _, line := range lines {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	var dups []string
+	for _, group := range report.Duplicates {
+		dups = append(dups, group[0]+" <- "+strings.Join(group[1:], ", "))
+	}
+	section("Files not in the manifest", !*removeUnlisted, report.Unlisted)
+	section("Missing manifest items", *keepMissing, report.Missing)
+	section("Unreferenced resources", !*removeUnreferenced, report.Unreferenced)
+	section("Duplicate files", !*dedupe, dups)
+	return 0
+}
+
+func cleanHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+By default, only manifest items whose files are missing are removed, and the
+other problems are only shown. Resources are unreferenced if they can't be
+reached from the spine, nav, ncx, cover, or guide by an attribute (including
+srcset and object params) or stylesheet url (including image-set), so resources
+only used by scripts will be removed. Duplicate content documents are never
+removed.
+`)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"diff", "df", "Compare two books.", diffMain})
+}
+
+func diffMain(args []string, fs *pflag.FlagSet) int {
+	context := fs.IntP("unified", "U", 3, "Number of lines of context")
+	exact := fs.Bool("exact", false, "Do not ignore formatting differences in XML, HTML, and CSS")
+	brief := fs.BoolP("brief", "q", false, "Only show which files differ")
+	jsonOut := fs.BoolP("json", "j", false, "Output the differences as JSON")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 3 || *context < 0 {
+		diffHelp(args, fs)
+		return 2
+	}
+
+	diffs, err := et.Diff(et.AutoInput(fs.Arg(1)), et.AutoInput(fs.Arg(2)), et.DiffOptions{
+		Context: *context,
+		Exact:   *exact,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	if *jsonOut {
+		if diffs == nil {
+			diffs = []et.Difference{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diffs); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 2
+		}
+	} else {
+		for _, d := range diffs {
+			a, b := "a/"+d.Path, "b/"+d.Path
+			switch d.Status {
+			case "added":
+				a = "/dev/null"
+			case "removed":
+				b = "/dev/null"
+			}
+			switch {
+			case *brief:
+				fmt.Printf("%-8s %s\n", d.Status, d.Path)
+			case d.Binary:
+				fmt.Printf("Binary files %s and %s differ (%d -> %d bytes, sha256 %.12s -> %.12s)\n", a, b, d.OldSize, d.NewSize, d.OldSHA256, d.NewSHA256)
+			default:
+				fmt.Printf("--- %s\n+++ %s\n%s", a, b, d.Diff)
+			}
+		}
+	}
+
+	if len(diffs) != 0 {
+		return 1
+	}
+	return 0
+}
+
+func diffHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (old_epub_file|old_epub_dir) (new_epub_file|new_epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nThe exit status is 0 if the books are the same, 1 if they differ, and 2 if\nan error occurred.\n")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"export", "ex", "Export a book to a single HTML, text, or Markdown file.", exportMain})
+}
+
+func exportMain(args []string, fs *pflag.FlagSet) int {
+	format := fs.String("format", "", "Output format: html, text, or markdown (default: from the output extension, or html)")
+	force := fs.BoolP("force", "f", false, "Overwrite the output file if it exists")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() < 2 || fs.NArg() > 3 {
+		exportHelp(args, fs)
+		return 2
+	}
+
+	of := fs.Arg(2)
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(of)) {
+		case ".txt":
+			*format = "text"
+		case ".md", ".markdown":
+			*format = "markdown"
+		default:
+			*format = "html"
+		}
+	}
+	var ef et.ExportFormat
+	switch strings.ToLower(*format) {
+	case "html", "htm":
+		ef = et.ExportHTML
+	case "text", "txt":
+		ef = et.ExportText
+	case "markdown", "md":
+		ef = et.ExportMarkdown
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %#v\n", *format)
+		return 2
+	}
+
+	if of != "" && of != "-" && !*force {
+		if _, err := os.Stat(of); err == nil {
+			fmt.Fprintf(os.Stderr, "Error: output file %#v already exists (use --force to overwrite)\n", of)
+			return 1
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := et.Export(et.AutoInput(fs.Arg(1)), &buf, ef); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if of == "" || of == "-" {
+		if _, err := buf.WriteTo(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if err := ioutil.WriteFile(of, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: write output: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func exportHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir) [output_file]\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+The spine documents are concatenated in order. If the output file is omitted or
+is -, the output is written to stdout.
+
+Formats:
+  html      A self-contained HTML file. Stylesheets are inlined, images and fonts
+            are embedded as data URIs, links between chapters are rewritten to
+            point within the file, and scripts are removed.
+  text      The visible text, with blank lines between paragraphs.
+  markdown  The visible text with headings, lists, blockquotes, emphasis,
+            preformatted text, and external links.
+`)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"sync"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"grep", "g", "Search the text of books.", grepMain})
+}
+
+func grepMain(args []string, fs *pflag.FlagSet) int {
+	ignoreCase := fs.BoolP("ignore-case", "i", false, "Ignore case")
+	fixed := fs.BoolP("fixed-strings", "F", false, "Treat the pattern as a literal string instead of a regular expression")
+	context := fs.IntP("context", "C", 40, "Number of characters of context to show before and after each match")
+	filesWithMatches := fs.BoolP("files-with-matches", "l", false, "Only show the books which match")
+	count := fs.BoolP("count", "c", false, "Only show the number of matches in each book")
+	jobs := fs.IntP("jobs", "j", runtime.NumCPU(), "Number of books to search at once")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() < 3 || *context < 0 || *jobs < 1 || (*filesWithMatches && *count) {
+		grepHelp(args, fs)
+		return 2
+	}
+
+	pattern := fs.Arg(1)
+	if *fixed {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid pattern: %v\n", err)
+		return 2
+	}
+
+	type result struct {
+		matches []et.SearchMatch
+		err     error
+	}
+	books := fs.Args()[2:]
+	results := make([]chan result, len(books))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	for n := 0; n < *jobs; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				matches, err := et.Search(et.AutoInput(books[i]), re, *context)
+				results[i] <- result{matches, err}
+			}
+		}()
+	}
+	go func() {
+		for i := range books {
+			queue <- i
+		}
+		close(queue)
+		wg.Wait()
+	}()
+
+	var found, failed bool
+	for i, book := range books {
+		r := <-results[i]
+		if r.err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", book, r.err)
+			failed = true
+			continue
+		}
+		if len(r.matches) != 0 {
+			found = true
+		}
+		switch {
+		case *count:
+			fmt.Printf("%s: %d\n", book, len(r.matches))
+		case *filesWithMatches:
+			if len(r.matches) != 0 {
+				fmt.Println(book)
+			}
+		default:
+			for _, m := range r.matches {
+				fmt.Printf("%s: %s", book, m.Path)
+				if m.Chapter != "" {
+					fmt.Printf(" (%s)", m.Chapter)
+				}
+				fmt.Printf(": %s[%s]%s\n", m.Before, m.Match, m.After)
+			}
+		}
+	}
+	if failed || !found {
+		return 1
+	}
+	return 0
+}
+
+func grepHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] pattern (epub_file|epub_dir)...\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+The pattern is a Go regular expression (https://golang.org/s/re2syntax) which
+is matched against each paragraph of the visible text of the spine documents,
+with the whitespace collapsed. Each match is shown with the book, file, table
+of contents entry, and context, with the matched text in square brackets.
+
+The exit status is 0 if there were any matches, and 1 if there weren't or an
+error occurred.
+`)
+}
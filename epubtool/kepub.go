@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"kepub", "k", "Convert books to Kobo kepubs.", kepubMain})
+}
+
+func kepubMain(args []string, fs *pflag.FlagSet) int {
+	output := fs.StringP("output", "o", "", "Directory to write the kepubs to (default: the directory of each book)")
+	skipExisting := fs.BoolP("skip-existing", "u", false, "Skip books which have already been converted")
+	skipPre := fs.Bool("skip-preformatted", false, "Do not add spans to preformatted text")
+	force := fs.BoolP("force", "f", false, "Overwrite existing kepubs")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() < 2 || (*skipExisting && *force) {
+		kepubHelp(args, fs)
+		return 2
+	}
+
+	if *output != "" {
+		if err := os.MkdirAll(*output, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: create output dir: %v\n", err)
+			return 1
+		}
+	}
+
+	var failed int
+	for _, fn := range fs.Args()[1:] {
+		name := filepath.Base(strings.TrimRight(fn, `/\`))
+		if strings.HasSuffix(strings.ToLower(name), ".kepub.epub") {
+			fmt.Printf("Skipping %#v (already a kepub)\n", fn)
+			continue
+		}
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".kepub.epub"
+
+		of := filepath.Join(filepath.Dir(strings.TrimRight(fn, `/\`)), name)
+		if *output != "" {
+			of = filepath.Join(*output, name)
+		}
+
+		out := et.FileOutput(of)
+		if _, err := os.Stat(of); err == nil {
+			switch {
+			case *skipExisting:
+				fmt.Printf("Skipping %#v (%#v already exists)\n", fn, of)
+				continue
+			case *force:
+				out = et.ReplaceOutput(of, et.FileOutput)
+			default:
+				fmt.Fprintf(os.Stderr, "Error: %s: output file %#v already exists (use --force to overwrite or --skip-existing to skip)\n", fn, of)
+				failed++
+				continue
+			}
+		}
+
+		if err := et.New(et.TransformKepub(et.KepubOptions{
+			SkipPreformatted: *skipPre,
+		})).Run(et.AutoInput(fn), out, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", fn, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Converted %#v to %#v\n", fn, of)
+	}
+
+	if failed != 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d of %d books could not be converted\n", failed, fs.NArg()-1)
+		return 1
+	}
+	return 0
+}
+
+func kepubHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)...\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nThe kepubs are named after the books, with the extension replaced with\n.kepub.epub.\n")
+}
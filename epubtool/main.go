@@ -3,10 +3,13 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
 )
 
 var commands []*command
@@ -63,3 +66,28 @@ func globalHelp() {
 	fmt.Fprintf(os.Stderr, "  %-20s %s\n", "help", "Show help for all commands")
 	fmt.Fprintf(os.Stderr, "\nOptions:\n  -h, --help   Show this help text\n")
 }
+
+// manifestSizeTransform returns a transform which sums the sizes of the files in
+// the manifest with the specified media types.
+func manifestSizeTransform(size *int64, mediaTypes ...string) et.Transform {
+	return et.Transform{
+		Desc: "measure file sizes",
+		Raw: func(epubdir string) error {
+			pkg, err := et.ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			*size = 0
+			for _, it := range pkg.Manifest {
+				for _, mt := range mediaTypes {
+					if it.MediaType == mt {
+						if fi, err := os.Stat(filepath.Join(epubdir, filepath.FromSlash(it.Path))); err == nil {
+							*size += fi.Size()
+						}
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
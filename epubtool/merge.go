@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"merge", "m", "Merge multiple books into one.", mergeMain})
+}
+
+func mergeMain(args []string, fs *pflag.FlagSet) int {
+	title := fs.StringP("title", "t", "", "Set the title (default: the title of the first book)")
+	authors := fs.StringArrayP("author", "a", nil, "Set the authors (can be specified multiple times) (default: the authors of the first book)")
+	language := fs.StringP("language", "l", "", "Set the language (default: the language of the first book)")
+	identifier := fs.String("identifier", "", "Set the unique identifier (default: derived from the identifiers of the books)")
+	force := fs.BoolP("force", "f", false, "Overwrite the output file if it exists")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() < 4 {
+		mergeHelp(args, fs)
+		return 2
+	}
+
+	of := fs.Arg(fs.NArg() - 1)
+	var inputs []et.InputFunc
+	for _, fn := range fs.Args()[1 : fs.NArg()-1] {
+		inputs = append(inputs, et.AutoInput(fn))
+	}
+
+	out := et.FileOutput(of)
+	if *force {
+		out = et.ReplaceOutput(of, et.FileOutput)
+	}
+	if err := et.Merge(inputs, out, et.MergeOptions{
+		Title:      *title,
+		Authors:    *authors,
+		Language:   *language,
+		Identifier: *identifier,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Merged %d books into %#v\n", len(inputs), of)
+	return 0
+}
+
+func mergeHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)... output_file\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+The spines are combined in the order the books are specified. The files of each
+book are put in their own directory (book1, book2, etc) to prevent collisions.
+The table of contents has an entry for each book (with the book's title)
+containing the original entries. The rest of the metadata is copied from the
+first book.
+`)
+}
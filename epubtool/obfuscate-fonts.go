@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"obfuscate-fonts", "ob", "Obfuscate or de-obfuscate a book's fonts.", obfuscateFontsMain})
+}
+
+func obfuscateFontsMain(args []string, fs *pflag.FlagSet) int {
+	algorithm := fs.StringP("algorithm", "a", "idpf", "Obfuscation algorithm (idpf or adobe)")
+	remove := fs.Bool("remove", false, "Remove font obfuscation instead")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	alg, ok := et.ObfuscationAlgorithms[*algorithm]
+	if *help || fs.NArg() != 2 || !ok {
+		obfuscateFontsHelp(args, fs)
+		return 2
+	}
+	if *remove {
+		alg = ""
+	}
+
+	fn := fs.Arg(1)
+	pipeline := et.New(et.TransformObfuscateFonts(alg))
+
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+
+	if err := pipeline.Run(et.AutoInput(fn), out, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func obfuscateFontsHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nObfuscated fonts are always de-obfuscated while a book is being transformed,\nand re-obfuscated using the current unique identifier when it is written.\n")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"optimize-css", "oc", "Optimize a book's stylesheets.", optimizeCSSMain})
+}
+
+func optimizeCSSMain(args []string, fs *pflag.FlagSet) int {
+	keepUnused := fs.Bool("keep-unused", false, "Don't remove selectors which don't match anything in the content documents")
+	noMerge := fs.Bool("no-merge", false, "Don't merge duplicate rules")
+	noMinify := fs.Bool("no-minify", false, "Don't minify stylesheets")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 || (*keepUnused && *noMerge && *noMinify) {
+		optimizeCSSHelp(args, fs)
+		return 2
+	}
+
+	fn := fs.Arg(1)
+	var before, after int64
+	pipeline := et.New(manifestSizeTransform(&before, "text/css"))
+
+	if !*keepUnused {
+		pipeline = append(pipeline, et.TransformCSSRemoveUnused())
+	}
+	if !*noMerge {
+		pipeline = append(pipeline, et.TransformCSSMergeRules())
+	}
+	if !*noMinify {
+		pipeline = append(pipeline, et.TransformCSSMinify())
+	}
+	pipeline = append(pipeline, manifestSizeTransform(&after, "text/css"))
+
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+
+	if err := pipeline.Run(et.AutoInput(fn), out, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Stylesheets: %d bytes -> %d bytes\n", before, after)
+	return 0
+}
+
+func optimizeCSSHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"optimize-fonts", "of", "Subset a book's fonts and remove unused ones.", optimizeFontsMain})
+}
+
+func optimizeFontsMain(args []string, fs *pflag.FlagSet) int {
+	keepUnused := fs.Bool("keep-unused", false, "Do not remove unused fonts and @font-face rules")
+	noSubset := fs.Bool("no-subset", false, "Do not subset fonts")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 || (*keepUnused && *noSubset) {
+		optimizeFontsHelp(args, fs)
+		return 2
+	}
+
+	fn := fs.Arg(1)
+	var before, after int64
+	transforms := []et.Transform{manifestSizeTransform(&before, et.FontMediaTypes...)}
+	if !*keepUnused {
+		transforms = append(transforms, et.TransformRemoveUnusedFonts())
+	}
+	if !*noSubset {
+		transforms = append(transforms, et.TransformSubsetFonts())
+	}
+	transforms = append(transforms, manifestSizeTransform(&after, et.FontMediaTypes...))
+	pipeline := et.New(transforms...)
+
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+
+	if err := pipeline.Run(et.AutoInput(fn), out, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Fonts: %d bytes -> %d bytes\n", before, after)
+	return 0
+}
+
+func optimizeFontsHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nOnly TrueType fonts can be subset. Other fonts (e.g. CFF-based OpenType or\nWOFF) are only removed if unused.\n")
+}
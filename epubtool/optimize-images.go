@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"optimize-images", "oi", "Scale down and recompress a book's images.", optimizeImagesMain})
+}
+
+func optimizeImagesMain(args []string, fs *pflag.FlagSet) int {
+	maxSize := fs.IntP("max-size", "s", 0, "Maximum width and height of images")
+	maxWidth := fs.Int("max-width", 0, "Maximum width of images (overrides --max-size)")
+	maxHeight := fs.Int("max-height", 0, "Maximum height of images (overrides --max-size)")
+	quality := fs.IntP("quality", "q", 0, "Re-encode JPEG images with the specified quality (1-100)")
+	pngToJPEG := fs.BoolP("png-to-jpeg", "j", false, "Convert PNG images without transparency to JPEG")
+	grayscale := fs.BoolP("grayscale", "g", false, "Convert images to grayscale")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 || *quality < 0 || *quality > 100 || (*maxSize <= 0 && *maxWidth <= 0 && *maxHeight <= 0 && *quality == 0 && !*pngToJPEG && !*grayscale) {
+		optimizeImagesHelp(args, fs)
+		return 2
+	}
+
+	opts := et.ImageOptions{
+		MaxWidth:    *maxSize,
+		MaxHeight:   *maxSize,
+		JPEGQuality: *quality,
+		PNGToJPEG:   *pngToJPEG,
+		Grayscale:   *grayscale,
+	}
+	if *maxWidth > 0 {
+		opts.MaxWidth = *maxWidth
+	}
+	if *maxHeight > 0 {
+		opts.MaxHeight = *maxHeight
+	}
+
+	fn := fs.Arg(1)
+	var before, after int64
+	pipeline := et.New(
+		manifestSizeTransform(&before, "image/png", "image/jpeg"),
+		et.TransformOptimizeImages(opts),
+		manifestSizeTransform(&after, "image/png", "image/jpeg"),
+	)
+
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+
+	if err := pipeline.Run(et.AutoInput(fn), out, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Images: %d bytes -> %d bytes\n", before, after)
+	return 0
+}
+
+func optimizeImagesHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+}
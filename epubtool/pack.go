@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 
 	et "github.com/pgaskin/epubtool/epubtransform"
+	"github.com/pgaskin/epubtool/util"
 )
 
 func init() {
@@ -16,28 +19,128 @@ func init() {
 }
 
 func packMain(args []string, fs *pflag.FlagSet) int {
-	// TODO: custom output file
+	output := fs.StringP("output", "o", "", "Output file (- for stdout), or an existing directory to write to (default: beside the input)")
+	force := fs.BoolP("force", "f", false, "Overwrite existing output files")
+	reproducible := fs.BoolP("reproducible", "r", false, "Make the output only depend on the contents of the book")
+	mtime := fs.String("mtime", "", "Timestamp for files in reproducible mode (unix time or RFC 3339) (default $SOURCE_DATE_EPOCH or 1980-01-01)")
+	level := fs.IntP("compression-level", "l", 0, "Deflate compression level (1-9, 0 for default, -1 to store uncompressed)")
+	noExclude := fs.Bool("no-exclude", false, "Don't exclude junk files or files matching patterns in .epubignore")
+	warnUnlisted := fs.BoolP("warn-unlisted", "w", false, "Warn about files which are not in the manifest")
 	help := fs.BoolP("help", "h", false, "Show this help text")
 	fs.Parse(args)
 
-	if *help || fs.NArg() != 2 {
+	if *help || fs.NArg() < 2 || *level < -1 || *level > 9 || (*mtime != "" && !*reproducible) {
 		packHelp(args, fs)
 		return 2
 	}
 
-	f := fs.Arg(1)
-	of := strings.TrimRight(filepath.Clean(f), "/\\") + ".epub"
+	opts := et.PackOptions{
+		Reproducible:     *reproducible,
+		CompressionLevel: *level,
+		Exclude:          !*noExclude,
+	}
+	if *reproducible {
+		if *mtime == "" {
+			*mtime = os.Getenv("SOURCE_DATE_EPOCH")
+		}
+		if *mtime != "" {
+			t, err := parseTimestamp(*mtime)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid timestamp %#v: %v\n", *mtime, err)
+				return 2
+			}
+			opts.ModTime = t
+		}
+	}
+
+	var outputDir bool
+	if *output == "-" {
+		if fs.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Error: only one input can be written to stdout\n")
+			return 2
+		}
+	} else if *output != "" {
+		if fi, err := os.Stat(*output); err == nil && fi.IsDir() {
+			outputDir = true
+		} else if fs.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Error: output must be an existing directory if multiple inputs are specified\n")
+			return 2
+		}
+	}
+
+	pipeline := et.New()
+	if *warnUnlisted {
+		pipeline = append(pipeline, et.Transform{
+			Desc: "check for unlisted files",
+			Raw: func(epubdir string) error {
+				unlisted, err := et.UnlistedFiles(epubdir)
+				if err != nil {
+					return err
+				}
+				var ig *util.Ignore
+				if opts.Exclude {
+					if ig, err = et.PackIgnore(epubdir); err != nil {
+						return err
+					}
+				}
+				for _, fn := range unlisted {
+					if ig == nil || !ig.Match(fn, false) {
+						fmt.Fprintf(os.Stderr, "Warning: %#v is not in the manifest\n", fn)
+					}
+				}
+				return nil
+			},
+		})
+	}
+
+	status := 0
+	for _, f := range fs.Args()[1:] {
+		of := strings.TrimRight(filepath.Clean(f), "/\\") + ".epub"
+		if outputDir {
+			of = filepath.Join(*output, filepath.Base(of))
+		} else if *output != "" {
+			of = *output
+		}
+
+		var out et.OutputFunc
+		if of == "-" {
+			fmt.Fprintf(os.Stderr, "Packing %#v to stdout\n", f)
+			out = et.WriterOutput(os.Stdout, opts)
+		} else {
+			fmt.Printf("Packing %#v to %#v\n", f, of)
+			out = et.FileOutputOpts(of, opts)
+			if *force {
+				out = et.ReplaceOutput(of, func(path string) et.OutputFunc {
+					return et.FileOutputOpts(path, opts)
+				})
+			}
+		}
 
-	fmt.Printf("Packing %#v to %#v\n", f, of)
+		if err := pipeline.Run(et.DirInput(f), out, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			status = 1
+		}
+	}
+	return status
+}
 
-	if err := et.New().Run(et.DirInput(f), et.FileOutput(of), false); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		return 1
+// parseTimestamp parses a unix timestamp or a RFC 3339 date.
+func parseTimestamp(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), nil
 	}
-	return 0
+	return time.Parse(time.RFC3339, s)
 }
 
 func packHelp(args []string, fs *pflag.FlagSet) {
-	fmt.Fprintf(os.Stderr, "Usage: %s [options] epub_dir\n\nOptions:\n", args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] epub_dir...\n\nOptions:\n", args[0])
 	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+Exclusions:
+  Unless --no-exclude is specified, junk files (e.g. .DS_Store, Thumbs.db, editor
+  backups, .git, __MACOSX) are not packed. Additional patterns can be specified
+  in a .epubignore file in the root of epub_dir, which uses the same syntax as a
+  .gitignore file. Patterns starting with ! will re-include previously excluded
+  files.
+`)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"page-list", "pl", "Add a page list with page breaks from the source or estimated ones.", pageListMain})
+}
+
+func pageListMain(args []string, fs *pflag.FlagSet) int {
+	charsPerPage := fs.IntP("chars-per-page", "n", 1500, "Number of characters (not including whitespace) per generated page")
+	selector := fs.StringP("selector", "s", "", "CSS selector for elements marking the pages of the source (e.g. span.pagenum)")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 || *charsPerPage <= 0 {
+		pageListHelp(args, fs)
+		return 2
+	}
+
+	fn := fs.Arg(1)
+	var report et.PageListReport
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+	if err := et.New(et.TransformPageList(et.PageListOptions{
+		CharactersPerPage: *charsPerPage,
+		Selector:          *selector,
+	}, &report)).Run(et.AutoInput(fn), out, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	switch report.Source {
+	case "existing":
+		fmt.Printf("Using existing page breaks\n")
+	case "selector":
+		fmt.Printf("Using page breaks from elements matching %s\n", *selector)
+	case "generated":
+		fmt.Printf("Using page breaks every %d characters\n", *charsPerPage)
+	}
+	if n := len(report.Pages); n != 0 {
+		fmt.Printf("Pages: %d (%s to %s)\n", n, report.Pages[0].Name, report.Pages[n-1].Name)
+	} else {
+		fmt.Printf("Pages: 0\n")
+	}
+	return 0
+}
+
+func pageListHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+If the book already has page breaks (elements with epub:type="pagebreak" or
+role="doc-pagebreak"), they are used as-is. Otherwise, the elements matching
+the selector (if specified) are converted into page breaks, and if there aren't
+any, page breaks are inserted at the start of the first word after every page
+worth of visible text. The page number is taken from the aria-label or title
+attribute, the text, or the number at the end of the id of each page break.
+
+The page list is added to the EPUB 3 navigation document and the NCX, replacing
+any existing one.
+`)
+}
@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/beevik/etree"
 	"github.com/pgaskin/epubtool/epubtransform"
+	"github.com/pgaskin/epubtool/util"
 	"github.com/spf13/pflag"
 )
 
@@ -23,17 +29,35 @@ func init() {
 func renameMain(args []string, fs *pflag.FlagSet) int {
 	dryRun := fs.Bool("dry-run", false, "Dry run")
 	overwrite := fs.Bool("overwrite", false, "Allow overwriting output files (DANGEROUS)")
+	collision := fs.String("collision", "error", "How to handle duplicate or existing output files (error, counter, hash, skip, dedupe)")
 	clean := fs.BoolP("clean", "c", false, "Replace [^A-Za-z0-9()_. -] with _")
 	pattern := fs.StringP("pattern", "p", "{{.creator}} - {{.title}} {{if .series}}({{.series}} {{.series_index}}){{end}}.epub", "Pattern to rename files to")
 	output := fs.StringP("output", "o", "", "Directory to copy output files to (must exist) (same as source if blank)")
+	journalPath := fs.String("journal", "", "File to write the undo journal to (default epubtool-rename-TIMESTAMP.json in the current directory)")
+	undo := fs.String("undo", "", "Revert the renames recorded in a journal file")
 	help := fs.BoolP("help", "h", false, "Show this help text")
 	fs.Parse(args)
 
+	if *undo != "" {
+		if *help || fs.NArg() != 1 {
+			renameHelp(args, fs)
+			return 2
+		}
+		return renameUndo(*undo)
+	}
+
 	if *help || fs.NArg() < 2 || *pattern == "" {
 		renameHelp(args, fs)
 		return 2
 	}
 
+	switch *collision {
+	case "error", "counter", "hash", "skip", "dedupe":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown collision strategy %#v.\n", *collision)
+		return 2
+	}
+
 	if strings.Contains(*pattern, "/") || strings.Contains(*pattern, "\\") {
 		fmt.Fprintf(os.Stderr, "Error: directory creation is not supported yet.\n")
 		return 2
@@ -48,6 +72,7 @@ func renameMain(args []string, fs *pflag.FlagSet) int {
 	}
 
 	fmt.Printf("Reading metadata:\n")
+	var files []string
 	meta := map[string]map[string]interface{}{}
 	for _, fn := range fs.Args()[1:] {
 		fmt.Printf("... %s\n", fn)
@@ -55,6 +80,7 @@ func renameMain(args []string, fs *pflag.FlagSet) int {
 			fmt.Printf("    Warning: already processed, ignoring\n")
 			continue
 		}
+		files = append(files, fn)
 		meta[fn] = map[string]interface{}{}
 		if err := epubtransform.New(epubtransform.Transform{
 			OPFDoc: func(opf *etree.Document) error {
@@ -80,9 +106,9 @@ func renameMain(args []string, fs *pflag.FlagSet) int {
 
 	fmt.Printf("Generating filenames:\n")
 	filenames := map[string]string{}
-	seen := map[string]bool{}
 	buf := bytes.NewBuffer(nil)
-	for fn, m := range meta {
+	for _, fn := range files {
+		m := meta[fn]
 		fmt.Printf("... %#v\n", filepath.Base(fn))
 		buf.Reset()
 		if err := tmpl.Execute(buf, m); err != nil {
@@ -95,11 +121,6 @@ func renameMain(args []string, fs *pflag.FlagSet) int {
 			filenames[fn] = cleanRe.ReplaceAllString(filenames[fn], "")
 		}
 		filenames[fn] = fnRepl.Replace(filenames[fn])
-		if seen[filenames[fn]] {
-			fmt.Fprintf(os.Stderr, "    Error: pattern results in duplicate filename\n")
-			return 1
-		}
-		seen[filenames[fn]] = true
 
 		fmt.Printf("    %#v\n", filenames[fn])
 		if !strings.HasSuffix(filenames[fn], ".epub") {
@@ -107,8 +128,11 @@ func renameMain(args []string, fs *pflag.FlagSet) int {
 		}
 	}
 
-	fmt.Printf("Renaming books:\n")
-	for a, b := range filenames {
+	fmt.Printf("Planning renames:\n")
+	var pairs [][2]string
+	for _, a := range files {
+		b := filenames[a]
+
 		var err error
 		if a, err = filepath.Abs(a); err != nil {
 			fmt.Fprintf(os.Stderr, "    Error: could not resolve absolute path to source: %v\n", err)
@@ -117,70 +141,460 @@ func renameMain(args []string, fs *pflag.FlagSet) int {
 
 		if *output != "" {
 			b = filepath.Join(*output, b)
-			fmt.Printf("... Copy %#v -> %#v\n", a, b)
 		} else {
 			b = filepath.Join(filepath.Dir(a), b)
-			fmt.Printf("... Move %#v -> %#v\n", a, b)
 		}
 
 		if b, err = filepath.Abs(b); err != nil {
-			fmt.Fprintf(os.Stderr, "    Error: could not resolve absolute path to destination: %v\n", err)
+			fmt.Fprintf(os.Stderr, "... %#v\n    Error: could not resolve absolute path to destination: %v\n", a, err)
 			return 1
 		}
+		pairs = append(pairs, [2]string{a, b})
+	}
+
+	journal := &renameJournal{Time: time.Now()}
+	if journal.Entries, err = planRenames(pairs, *collision, *overwrite, *output != "", journal.Time); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if *dryRun || len(journal.Entries) == 0 {
+		return 0
+	}
+
+	if *journalPath == "" {
+		*journalPath = fmt.Sprintf("epubtool-rename-%s.json", journal.Time.Format("20060102T150405"))
+	}
+	if p, err := filepath.Abs(*journalPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not resolve absolute path to journal: %v\n", err)
+		return 1
+	} else {
+		journal.path = p
+	}
+
+	fmt.Printf("Writing journal to %#v\n", journal.path)
+	if err := journal.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not write journal: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Renaming books:\n")
+	if err := journal.Do(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func renameUndo(fn string) int {
+	journal, err := loadRenameJournal(fn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read journal: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Reverting renames from %#v:\n", journal.path)
+	if !journal.Undo() {
+		fmt.Fprintf(os.Stderr, "Error: could not revert all renames\n")
+		return 1
+	}
+	return 0
+}
+
+// planRenames plans moving (or copying) each source to its destination,
+// resolving collisions using the specified strategy. Sources which are moved
+// away are available as destinations, and the entries are ordered so they are
+// moved before being overwritten (with cycles broken using a temporary name).
+func planRenames(pairs [][2]string, strategy string, overwrite, copy bool, t time.Time) ([]*renameJournalEntry, error) {
+	vacated := map[string]bool{}
+	if !copy {
+		for _, p := range pairs {
+			if p[0] != p[1] {
+				vacated[p[0]] = true
+			}
+		}
+	}
+
+	var entries []*renameJournalEntry
+	planned := map[string]string{}
+	for _, p := range pairs {
+		a, b := p[0], p[1]
+		if copy {
+			fmt.Printf("... Copy %#v -> %#v\n", a, b)
+		} else {
+			fmt.Printf("... Move %#v -> %#v\n", a, b)
+		}
 
 		if a == b {
 			fmt.Printf("    Warning: file already has desired name, skipping\n")
 			continue
 		}
 
-		if !*overwrite {
-			if _, err := os.Stat(b); !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "    Error: path %#v already exists (err=%v)\n", b, err)
-				return 1
+		if r, err := resolveRenameCollision(strategy, a, b, planned, vacated, overwrite); err != nil {
+			fmt.Fprintf(os.Stderr, "    Error: %v\n", err)
+			return nil, fmt.Errorf("could not plan rename of %#v", a)
+		} else if r == "" {
+			delete(vacated, a)
+			continue
+		} else if r != b {
+			fmt.Printf("    Renamed to %#v to avoid collision\n", filepath.Base(r))
+			b = r
+		}
+		planned[b] = a
+
+		var backup string
+		if vacated[b] {
+			fmt.Printf("    Note: %#v is renamed first\n", filepath.Base(b))
+		} else if _, err := os.Stat(b); err == nil {
+			if backup, err = renameBackupPath(b, "backup", t); err != nil {
+				return nil, err
 			}
+			fmt.Printf("    Warning: overwriting existing file (moving it to %#v)\n", filepath.Base(backup))
+		}
+
+		entries = append(entries, &renameJournalEntry{
+			From:   a,
+			To:     b,
+			Copy:   copy,
+			Backup: backup,
+			State:  renamePlanned,
+		})
+	}
+
+	// a source which was going to be moved away may have been skipped after
+	// another file was planned to replace it
+	moved := map[string]bool{}
+	for _, e := range entries {
+		if !e.Copy {
+			moved[e.From] = true
+		}
+	}
+	for _, e := range entries {
+		if _, err := os.Stat(e.To); err == nil && e.Backup == "" && !moved[e.To] {
+			return nil, fmt.Errorf("%#v is no longer being renamed, so it can't be replaced by %#v", e.To, e.From)
 		}
+	}
+
+	return orderRenames(entries, t)
+}
 
-		if !*dryRun {
-			in, err := os.OpenFile(a, os.O_RDONLY, 0)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "    Error: could not open file %#v: %v\n", a, err)
-				return 1
+// orderRenames orders entries so sources are moved away before being replaced.
+// Cycles (e.g. swapping two names) are broken by moving one of the sources to a
+// temporary name first.
+func orderRenames(entries []*renameJournalEntry, t time.Time) ([]*renameJournalEntry, error) {
+	var ordered []*renameJournalEntry
+	pending := entries
+	for len(pending) != 0 {
+		from := map[string]bool{}
+		for _, e := range pending {
+			if !e.Copy {
+				from[e.From] = true
+			}
+		}
+		var rest []*renameJournalEntry
+		for _, e := range pending {
+			if from[e.To] {
+				rest = append(rest, e)
+			} else {
+				ordered = append(ordered, e)
+			}
+		}
+		if len(rest) == len(pending) {
+			for _, e := range rest {
+				if e.Copy {
+					continue
+				}
+				tmp, err := renameBackupPath(e.From, "temp", t)
+				if err != nil {
+					return nil, err
+				}
+				fmt.Printf("... Move %#v -> %#v first to break a cycle\n", e.From, filepath.Base(tmp))
+				ordered = append(ordered, &renameJournalEntry{From: e.From, To: tmp, State: renamePlanned})
+				e.From = tmp
+				break
 			}
-			out, err := os.OpenFile(b, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "    Error: could not create file %#v: %v\n", b, err)
-				in.Close()
-				return 1
+		}
+		pending = rest
+	}
+	return ordered, nil
+}
+
+// resolveRenameCollision checks if dst collides with an existing file or
+// another planned destination, and resolves it using the specified strategy.
+// If src should be skipped, an empty string is returned.
+func resolveRenameCollision(strategy, src, dst string, planned map[string]string, vacated map[string]bool, overwrite bool) (string, error) {
+	other, err := renameCollision(dst, planned, vacated)
+	if err != nil {
+		return "", err
+	} else if other == "" {
+		return dst, nil
+	} else if other == dst && overwrite {
+		return dst, nil
+	}
+
+	switch strategy {
+	case "error":
+		if other != dst {
+			return "", fmt.Errorf("pattern results in duplicate filename (same as %#v)", other)
+		}
+		return "", fmt.Errorf("path %#v already exists", dst)
+	case "skip":
+		fmt.Printf("    Warning: %#v is already taken, skipping\n", dst)
+		return "", nil
+	case "dedupe":
+		if a, err := hashFile(src); err != nil {
+			return "", err
+		} else if b, err := hashFile(other); err != nil {
+			return "", err
+		} else if a == b {
+			fmt.Printf("    Warning: identical to %#v, treating as already done\n", other)
+			return "", nil
+		}
+		return resolveRenameCollision("counter", src, dst, planned, vacated, false)
+	case "counter":
+		base, ext := util.SplitExt(dst)
+		for i := 2; ; i++ {
+			r := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			if other, err := renameCollision(r, planned, vacated); err != nil {
+				return "", err
+			} else if other == "" {
+				return r, nil
 			}
+		}
+	case "hash":
+		h, err := hashFile(src)
+		if err != nil {
+			return "", err
+		}
+		base, ext := util.SplitExt(dst)
+		return resolveRenameCollision("counter", src, fmt.Sprintf("%s [%s]%s", base, h[:8], ext), planned, vacated, false)
+	default:
+		return "", fmt.Errorf("unknown collision strategy %#v", strategy)
+	}
+}
 
-			if _, err := io.Copy(out, in); err != nil {
-				fmt.Fprintf(os.Stderr, "    Error: could not write file: %v\n", err)
-				out.Close()
-				in.Close()
-				os.Remove(b)
-				return 1
+// renameCollision returns the source planned to be renamed to dst, dst itself
+// if it already exists and isn't going to be moved away, or an empty string if
+// it is available.
+func renameCollision(dst string, planned map[string]string, vacated map[string]bool) (string, error) {
+	if src, ok := planned[dst]; ok {
+		return src, nil
+	}
+	if vacated[dst] {
+		return "", nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return "", nil
+}
+
+func hashFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", util.Wrap(err, "could not hash %#v", fn)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+const (
+	renamePlanned = "planned"
+	renameDone    = "done"
+	renameUndone  = "undone"
+)
+
+// renameJournal records the planned and completed moves for a rename so they
+// can be reverted.
+type renameJournal struct {
+	Time    time.Time             `json:"time"`
+	Entries []*renameJournalEntry `json:"entries"`
+	path    string
+}
+
+type renameJournalEntry struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Copy   bool   `json:"copy,omitempty"`
+	Backup string `json:"backup,omitempty"` // where the existing file at To is moved to
+	State  string `json:"state"`
+}
+
+// renameBackupPath gets an unused hidden path next to fn to move it to (e.g.
+// before it is overwritten).
+func renameBackupPath(fn, kind string, t time.Time) (string, error) {
+	dir, base := filepath.Split(fn)
+	for i := 1; ; i++ {
+		b := filepath.Join(dir, fmt.Sprintf(".%s.epubtool-%s-%s", base, kind, t.Format("20060102T150405")))
+		if i != 1 {
+			b += fmt.Sprintf("-%d", i)
+		}
+		if _, err := os.Lstat(b); os.IsNotExist(err) {
+			return b, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+func loadRenameJournal(fn string) (*renameJournal, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var j renameJournal
+	if err := json.Unmarshal(buf, &j); err != nil {
+		return nil, err
+	}
+	if j.path, err = filepath.Abs(fn); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Save atomically writes the journal to disk.
+func (j *renameJournal) Save() error {
+	buf, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(j.path), ".epubtool-rename-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), j.path)
+}
+
+// Do performs the planned entries in order, saving the journal after each one.
+// If one fails, the completed ones are reverted.
+func (j *renameJournal) Do() error {
+	for _, e := range j.Entries {
+		if e.State != renamePlanned {
+			continue
+		}
+		if e.Copy {
+			fmt.Printf("... Copy %#v -> %#v\n", e.From, e.To)
+		} else {
+			fmt.Printf("... Move %#v -> %#v\n", e.From, e.To)
+		}
+		if err := e.Do(); err != nil {
+			fmt.Fprintf(os.Stderr, "    Error: %v\n", err)
+			fmt.Printf("Reverting completed renames:\n")
+			if !j.Undo() {
+				return fmt.Errorf("could not revert all renames, see %#v", j.path)
 			}
+			return fmt.Errorf("rename failed, all completed renames were reverted")
+		}
+		if j.path != "" {
+			if err := j.Save(); err != nil {
+				return fmt.Errorf("could not update journal: %w", err)
+			}
+		}
+	}
+	return nil
+}
 
-			if err := out.Close(); err != nil {
-				fmt.Fprintf(os.Stderr, "    Error: could not close output file: %v\n", err)
-				in.Close()
-				return 1
+// Undo reverts the completed entries in reverse order, returning false if any
+// could not be reverted.
+func (j *renameJournal) Undo() bool {
+	ok := true
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		e := j.Entries[i]
+		if e.State != renameDone {
+			continue
+		}
+		fmt.Printf("... Revert %#v -> %#v\n", e.To, e.From)
+		if err := e.Undo(); err != nil {
+			fmt.Fprintf(os.Stderr, "    Error: %v\n", err)
+			ok = false
+			continue
+		}
+		if j.path != "" {
+			if err := j.Save(); err != nil {
+				fmt.Fprintf(os.Stderr, "    Error: could not update journal: %v\n", err)
+				ok = false
 			}
-			in.Close()
-			if *output == "" {
-				if err := os.Remove(a); err != nil {
-					fmt.Fprintf(os.Stderr, "    Error: could not delete %#v: %v\n", a, err)
-					return 1
-				}
+		}
+	}
+	return ok
+}
+
+// Do performs the entry. If there is a backup path, the existing destination is
+// moved there first, and moved back if the entry fails.
+func (e *renameJournalEntry) Do() error {
+	if e.State != renamePlanned {
+		return fmt.Errorf("entry is already %s", e.State)
+	}
+	if e.Backup != "" {
+		if err := util.Move(e.To, e.Backup); err != nil {
+			return fmt.Errorf("could not move existing file %#v aside: %w", e.To, err)
+		}
+	}
+	var err error
+	if e.Copy {
+		if err = util.CopyFileSync(e.From, e.To); err != nil {
+			os.Remove(e.To)
+			err = fmt.Errorf("could not copy %#v: %w", e.From, err)
+		}
+	} else {
+		if err = util.Move(e.From, e.To); err != nil {
+			err = fmt.Errorf("could not move %#v: %w", e.From, err)
+		}
+	}
+	if err != nil {
+		if e.Backup != "" {
+			if rerr := util.Move(e.Backup, e.To); rerr != nil {
+				return fmt.Errorf("%v (and could not restore existing file from %#v: %v)", err, e.Backup, rerr)
 			}
 		}
+		return err
 	}
+	e.State = renameDone
+	return nil
+}
 
-	return 0
+// Undo reverts the entry, restoring the overwritten file if there was one.
+func (e *renameJournalEntry) Undo() error {
+	if e.State != renameDone {
+		return fmt.Errorf("entry is %s, not %s", e.State, renameDone)
+	}
+	if e.Copy {
+		if err := os.Remove(e.To); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove copy %#v: %w", e.To, err)
+		}
+	} else {
+		if err := util.Move(e.To, e.From); err != nil {
+			return fmt.Errorf("could not move %#v back: %w", e.To, err)
+		}
+	}
+	if e.Backup != "" {
+		if err := util.Move(e.Backup, e.To); err != nil {
+			return fmt.Errorf("could not restore overwritten file from %#v: %w", e.Backup, err)
+		}
+	}
+	e.State = renameUndone
+	return nil
 }
 
 func renameHelp(args []string, fs *pflag.FlagSet) {
-	fmt.Fprintf(os.Stderr, "Usage: %s [options] epub_file...\n\nOptions:\n", args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] epub_file...\n       %s --undo journal_file\n\nOptions:\n", args[0], args[0])
 	fs.PrintDefaults()
 	fmt.Fprintf(os.Stderr, `
 Pattern:
@@ -191,5 +605,26 @@ Pattern:
   creator        The content of dc:creator
   series         The content of meta[name=calibre:series]
   series_index   The content of meta[name=calibre:series_index]
+
+Collisions:
+  If the pattern results in duplicate filenames, or a file already exists with
+  the generated name (and --overwrite isn't specified), the collision strategy
+  is used:
+
+  error          Stop without renaming anything
+  counter        Append a counter, i.e. "name (2).epub"
+  hash           Append a short hash of the contents, i.e. "name [0123abcd].epub"
+  skip           Leave the file as-is
+  dedupe         Leave the file as-is if it is identical to the other one,
+                 otherwise append a counter
+
+Journal:
+  Before renaming, a journal of the planned moves is written. Moves are done
+  using an atomic rename where possible, falling back to copying and deleting
+  if the destination is on another filesystem.
+  If a rename fails, the completed ones are reverted. To revert a successful
+  run, pass the journal to --undo. Files overwritten with --overwrite are moved
+  to a hidden backup next to them (recorded in the journal) so they can be
+  restored, and need to be deleted manually.
 `)
 }
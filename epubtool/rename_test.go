@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRenameJournal(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtool-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	p := func(name string) string {
+		return filepath.Join(td, name)
+	}
+	write := func(files map[string]string) {
+		for name, contents := range files {
+			if err := ioutil.WriteFile(p(name), []byte(contents), 0644); err != nil {
+				t.Fatalf("write %s: %v", name, err)
+			}
+		}
+	}
+	check := func(what string, files map[string]string) {
+		t.Helper()
+		for name, contents := range files {
+			buf, err := ioutil.ReadFile(p(name))
+			if contents == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("%s: expected %s to not exist, got err=%v", what, name, err)
+				}
+			} else if err != nil || string(buf) != contents {
+				t.Errorf("%s: expected %s to have contents %q, got %q (err=%v)", what, name, contents, buf, err)
+			}
+		}
+	}
+	plan := func(entries ...*renameJournalEntry) *renameJournal {
+		t.Helper()
+		j := &renameJournal{Time: time.Now(), Entries: entries, path: p("journal.json")}
+		for _, e := range entries {
+			e.From, e.To, e.State = p(e.From), p(e.To), renamePlanned
+			if e.Backup != "" {
+				e.Backup = p(e.Backup)
+			}
+		}
+		if err := j.Save(); err != nil {
+			t.Fatalf("save journal: %v", err)
+		}
+		return j
+	}
+
+	// a successful run with an overwrite, then undoing it from the saved journal
+	write(map[string]string{"a": "A", "b": "old B", "c": "C"})
+	j := plan(
+		&renameJournalEntry{From: "a", To: "b", Backup: ".b.bak"},
+		&renameJournalEntry{From: "c", To: "d", Copy: true},
+	)
+	if err := j.Do(); err != nil {
+		t.Fatalf("do: unexpected error: %v", err)
+	}
+	check("do", map[string]string{"a": "", "b": "A", ".b.bak": "old B", "c": "C", "d": "C"})
+
+	if j, err = loadRenameJournal(p("journal.json")); err != nil {
+		t.Fatalf("load journal: %v", err)
+	}
+	for _, e := range j.Entries {
+		if e.State != renameDone {
+			t.Errorf("expected saved entry %s -> %s to be %s, got %s", e.From, e.To, renameDone, e.State)
+		}
+	}
+	if !j.Undo() {
+		t.Errorf("undo: expected success")
+	}
+	check("undo", map[string]string{"a": "A", "b": "old B", ".b.bak": "", "c": "C", "d": ""})
+
+	// a failed run is rolled back, including the overwritten file
+	j = plan(
+		&renameJournalEntry{From: "a", To: "b", Backup: ".b.bak"},
+		&renameJournalEntry{From: "c", To: "e"},
+		&renameJournalEntry{From: "missing", To: "f"},
+	)
+	if err := j.Do(); err == nil {
+		t.Errorf("do: expected error")
+	}
+	check("rollback", map[string]string{"a": "A", "b": "old B", ".b.bak": "", "c": "C", "e": "", "f": ""})
+	for _, e := range j.Entries {
+		if e.State == renameDone {
+			t.Errorf("expected entry %s -> %s to not be done after rollback", e.From, e.To)
+		}
+	}
+
+	// a failed move restores the overwritten file immediately
+	e := &renameJournalEntry{From: p("missing"), To: p("b"), Backup: p(".b.bak"), State: renamePlanned}
+	if err := e.Do(); err == nil {
+		t.Errorf("do: expected error")
+	}
+	check("failed entry", map[string]string{"b": "old B", ".b.bak": ""})
+}
+
+func TestRenameBackupPath(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtool-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	tm := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	fn := filepath.Join(td, "book.epub")
+	if b, err := renameBackupPath(fn, "backup", tm); err != nil || b != filepath.Join(td, ".book.epub.epubtool-backup-20200102T150405") {
+		t.Errorf("unexpected backup path %q (err=%v)", b, err)
+	} else if err := ioutil.WriteFile(b, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := renameBackupPath(fn, "backup", tm); err != nil || b != filepath.Join(td, ".book.epub.epubtool-backup-20200102T150405-2") {
+		t.Errorf("unexpected backup path %q (err=%v)", b, err)
+	}
+}
+
+func TestPlanRenames(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtool-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	p := func(name string) string {
+		return filepath.Join(td, name)
+	}
+	reset := func(files map[string]string) {
+		t.Helper()
+		names, _ := filepath.Glob(p("*"))
+		names2, _ := filepath.Glob(p(".*"))
+		for _, fn := range append(names, names2...) {
+			os.Remove(fn)
+		}
+		for name, contents := range files {
+			if err := ioutil.WriteFile(p(name), []byte(contents), 0644); err != nil {
+				t.Fatalf("write %s: %v", name, err)
+			}
+		}
+	}
+	tm := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	plan := func(strategy string, overwrite bool, pairs ...string) ([]string, error) {
+		t.Helper()
+		var ps [][2]string
+		for i := 0; i < len(pairs); i += 2 {
+			ps = append(ps, [2]string{p(pairs[i]), p(pairs[i+1])})
+		}
+		entries, err := planRenames(ps, strategy, overwrite, false, tm)
+		var res []string
+		for _, e := range entries {
+			from, _ := filepath.Rel(td, e.From)
+			to, _ := filepath.Rel(td, e.To)
+			s := from + " -> " + to
+			if e.Backup != "" {
+				b, _ := filepath.Rel(td, e.Backup)
+				s += " (" + b + ")"
+			}
+			res = append(res, s)
+		}
+		return res, err
+	}
+
+	for _, c := range []struct {
+		what      string
+		files     map[string]string
+		strategy  string
+		overwrite bool
+		pairs     []string
+		exp       []string
+		err       bool
+	}{
+		{"no collision", map[string]string{"a": "A"}, "error", false,
+			[]string{"a", "b"}, []string{"a -> b"}, false},
+		{"existing", map[string]string{"a": "A", "b": "B"}, "error", false,
+			[]string{"a", "b"}, nil, true},
+		{"duplicate", map[string]string{"a": "A", "c": "C"}, "error", false,
+			[]string{"a", "b", "c", "b"}, nil, true},
+		{"counter", map[string]string{"a.epub": "A", "c.epub": "C", "b.epub": "B"}, "counter", false,
+			[]string{"a.epub", "b.epub", "c.epub", "b.epub"}, []string{"a.epub -> b (2).epub", "c.epub -> b (3).epub"}, false},
+		{"hash", map[string]string{"a.epub": "A", "b.epub": "B"}, "hash", false,
+			[]string{"a.epub", "b.epub"}, []string{"a.epub -> b [559aead0].epub"}, false},
+		{"skip", map[string]string{"a": "A", "b": "B"}, "skip", false,
+			[]string{"a", "b"}, nil, false},
+		{"dedupe identical", map[string]string{"a.epub": "A", "b.epub": "A"}, "dedupe", false,
+			[]string{"a.epub", "b.epub"}, nil, false},
+		{"dedupe different", map[string]string{"a.epub": "A", "b.epub": "B"}, "dedupe", false,
+			[]string{"a.epub", "b.epub"}, []string{"a.epub -> b (2).epub"}, false},
+		{"overwrite", map[string]string{"a": "A", "b": "B"}, "error", true,
+			[]string{"a", "b"}, []string{"a -> b (.b.epubtool-backup-20200102T150405)"}, false},
+		{"chain", map[string]string{"a": "A", "b": "B"}, "error", false,
+			[]string{"a", "b", "b", "c"}, []string{"b -> c", "a -> b"}, false},
+		{"swap", map[string]string{"a": "A", "b": "B"}, "error", false,
+			[]string{"a", "b", "b", "a"}, []string{"a -> .a.epubtool-temp-20200102T150405", "b -> a", ".a.epubtool-temp-20200102T150405 -> b"}, false},
+		{"chain with skipped source", map[string]string{"a": "A", "b": "B", "c": "C"}, "skip", false,
+			[]string{"a", "b", "b", "c"}, nil, true},
+	} {
+		reset(c.files)
+		res, err := plan(c.strategy, c.overwrite, c.pairs...)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %q", c.what, res)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.what, err)
+		} else if !reflect.DeepEqual(res, c.exp) {
+			t.Errorf("%s: expected %q, got %q", c.what, c.exp, res)
+		}
+	}
+
+	// the ordered entries can actually be done
+	reset(map[string]string{"a": "A", "b": "B", "c": "C"})
+	entries, err := planRenames([][2]string{{p("a"), p("b")}, {p("b"), p("a")}, {p("c"), p("d")}}, "error", false, false, tm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (&renameJournal{Time: tm, Entries: entries}).Do(); err != nil {
+		t.Fatalf("do: unexpected error: %v", err)
+	}
+	for name, contents := range map[string]string{"a": "B", "b": "A", "d": "C"} {
+		if buf, err := ioutil.ReadFile(p(name)); err != nil || string(buf) != contents {
+			t.Errorf("expected %s to have contents %q, got %q (err=%v)", name, contents, buf, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"replace", "re", "Find and replace text in a book.", replaceMain})
+}
+
+func replaceMain(args []string, fs *pflag.FlagSet) int {
+	rules := fs.StringP("rules", "R", "", "Read the rules from a YAML or TOML file")
+	literal := fs.BoolP("fixed-strings", "F", false, "Treat the find and replace arguments as literal strings instead of a regular expression and template")
+	ignoreCase := fs.BoolP("ignore-case", "i", false, "Ignore case when matching the find argument")
+	scope := fs.StringArray("scope", nil, "Only change the content documents with the specified manifest id or matching the specified glob (can be specified multiple times)")
+	dryRun := fs.Bool("dry-run", false, "Show the replacements without changing the book")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || !((fs.NArg() == 2 && *rules != "") || (fs.NArg() == 4 && *rules == "")) {
+		replaceHelp(args, fs)
+		return 2
+	}
+
+	var opts et.ReplaceOptions
+	if *rules != "" {
+		r, err := et.ReadReplaceRules(*rules)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: read rules: %v\n", err)
+			return 1
+		}
+		opts.Rules = r
+	} else {
+		opts.Rules = []et.ReplaceRule{{
+			Find:       fs.Arg(2),
+			Replace:    fs.Arg(3),
+			Literal:    *literal,
+			IgnoreCase: *ignoreCase,
+		}}
+	}
+	opts.Scope = *scope
+
+	fn := fs.Arg(1)
+	var report et.ReplaceReport
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+	if err := et.New(et.TransformReplace(opts, &report)).Run(et.AutoInput(fn), out, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if *dryRun {
+		for _, c := range report.Changes {
+			fmt.Printf("%s: %s[%s -> %s]%s\n", c.Path, c.Before, c.Old, c.New, c.After)
+		}
+		if len(report.Changes) != 0 {
+			fmt.Println()
+		}
+	}
+	var paths []string
+	var total int
+	for p, n := range report.Counts {
+		paths = append(paths, p)
+		total += n
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Printf("%s: %d replacements\n", p, report.Counts[p])
+	}
+	if *dryRun {
+		fmt.Printf("Would make %d replacements in %d files\n", total, len(paths))
+	} else {
+		fmt.Printf("Made %d replacements in %d files\n", total, len(paths))
+	}
+	return 0
+}
+
+func replaceHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir) find replace\n       %s --rules rules_file [options] (epub_file|epub_dir)\n\nOptions:\n", args[0], args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+Only the text of the content documents is changed (not tags, attributes, the
+head, scripts, or stylesheets). Since each text node is changed separately,
+matches can't span elements (e.g. "te<i>xt</i>").
+
+The find argument is a Go regular expression (https://golang.org/s/re2syntax),
+and $1 or ${name} in the replace argument are expanded to submatches.
+
+Rules files have a list of rules which are applied in order. For example:
+
+    # rules.toml
+    [[rules]]
+    find = '\bteh\b'
+    replace = 'the'
+
+    [[rules]]
+    find = '(\w)- (\w)'
+    replace = '${1}${2}'
+
+    [[rules]]
+    find = 'Copyright ©'
+    replace = '©'
+    literal = true
+    ignore_case = true
+`)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"split-documents", "sd", "Split a book's large content documents into smaller ones.", splitDocumentsMain})
+}
+
+func splitDocumentsMain(args []string, fs *pflag.FlagSet) int {
+	maxSize := fs.IntP("max-size", "s", 260, "Maximum size of content documents in KB")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 || *maxSize <= 0 {
+		splitDocumentsHelp(args, fs)
+		return 2
+	}
+
+	fn := fs.Arg(1)
+	var before, after int
+	pipeline := et.New(
+		spineLengthTransform(&before),
+		et.TransformSplitDocuments(*maxSize*1024),
+		spineLengthTransform(&after),
+	)
+
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+
+	if err := pipeline.Run(et.AutoInput(fn), out, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Spine items: %d -> %d\n", before, after)
+	return 0
+}
+
+func splitDocumentsHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+Documents are split at headings or paragraphs, and the new files are added to
+the manifest and spine after the original one. Links to moved fragments are
+updated.
+`)
+}
+
+// spineLengthTransform counts the spine items.
+func spineLengthTransform(n *int) et.Transform {
+	return et.Transform{
+		Desc: "count spine items",
+		Raw: func(epubdir string) error {
+			pkg, err := et.ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			*n = len(pkg.Spine)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"split", "sp", "Split a book into multiple books.", splitMain})
+}
+
+func splitMain(args []string, fs *pflag.FlagSet) int {
+	at := fs.StringArray("at", nil, "Start a new part at a spine item (manifest id or path relative to the epub root) instead of at each top-level TOC entry (can be specified multiple times)")
+	output := fs.StringP("output", "o", "", "Directory to write the parts to (default: the directory of the book)")
+	linkTemplate := fs.String("link-template", "", "Replace links to other parts with the URL from this template instead of removing them (see below)")
+	force := fs.BoolP("force", "f", false, "Overwrite existing output files")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 {
+		splitHelp(args, fs)
+		return 2
+	}
+
+	fn := strings.TrimRight(fs.Arg(1), `/\`)
+	dir := filepath.Dir(fn)
+	if *output != "" {
+		if err := os.MkdirAll(*output, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: create output dir: %v\n", err)
+			return 1
+		}
+		dir = *output
+	}
+	base := strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+	name := func(part et.SplitPart) string {
+		return fmt.Sprintf("%s-%d.epub", base, part.Index)
+	}
+
+	opts := et.SplitOptions{At: *at}
+	if *linkTemplate != "" {
+		tmpl, err := template.New("").Option("missingkey=error").Parse(*linkTemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not parse link template: %v.\n", err)
+			return 2
+		}
+		link := func(part et.SplitPart, path, fragment string) (string, error) {
+			var buf bytes.Buffer
+			err := tmpl.Execute(&buf, map[string]interface{}{
+				"part":     part.Index,
+				"file":     name(part),
+				"path":     path,
+				"fragment": fragment,
+			})
+			return buf.String(), err
+		}
+		if _, err := link(et.SplitPart{Index: 1}, "", ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not execute link template: %v.\n", err)
+			return 2
+		}
+		opts.Link = func(part et.SplitPart, path, fragment string) string {
+			s, _ := link(part, path, fragment)
+			return s
+		}
+	}
+
+	var written []string
+	parts, err := et.Split(et.AutoInput(fs.Arg(1)), func(part et.SplitPart) et.OutputFunc {
+		of := filepath.Join(dir, name(part))
+		written = append(written, of)
+		if *force {
+			return et.ReplaceOutput(of, et.FileOutput)
+		}
+		return et.FileOutput(of)
+	}, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	for i, part := range parts {
+		fmt.Printf("Wrote %#v (%d spine items", written[i], len(part.Spine))
+		if part.Title != "" {
+			fmt.Printf(", %#v", part.Title)
+		}
+		fmt.Printf(")\n")
+	}
+	return 0
+}
+
+func splitHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+The parts are named after the book with the part number appended (e.g.
+book-1.epub). Spine items before the first split point (e.g. the cover) are
+included in the first part. Each part only contains the resources it
+references, and has its own table of contents, title (the original title
+followed by the part's TOC entry or number), and identifier. The calibre series
+is set to the original series (or title), with the part number as the index.
+
+Links to documents in other parts are removed, unless --link-template is
+specified, in which case they are replaced with the result of applying it using
+https://golang.org/pkg/text/template/. The template is used as-is in documents
+at any depth, so it should usually be an absolute URL. The following fields are
+available:
+
+  .part      The number of the part containing the target
+  .file      The file name of the part containing the target (e.g. book-2.epub)
+  .path      The path of the target relative to the epub root
+  .fragment  The fragment of the link, if any (without the #)
+
+For example, to link to the parts hosted on a website:
+
+  --link-template 'https://example.com/books/{{.file}}'
+`)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"stats", "st", "Show word counts, reading time, and other statistics for a book.", statsMain})
+}
+
+func statsMain(args []string, fs *pflag.FlagSet) int {
+	wpm := fs.Int("wpm", 250, "Reading speed in words per minute")
+	cjkCPM := fs.Int("cjk-cpm", 500, "Reading speed for Chinese and Japanese text in characters per minute")
+	charsPerPage := fs.Int("chars-per-page", 1500, "Number of characters (not including whitespace) per page")
+	jsonOut := fs.BoolP("json", "j", false, "Output the statistics as JSON")
+	chapters := fs.BoolP("chapters", "c", false, "Show the counts for each chapter")
+	calibre := fs.Bool("calibre", false, "Store the word, character, and page counts in the book as calibre custom columns (#words, #characters, and #pages)")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 || *wpm <= 0 || *cjkCPM <= 0 || *charsPerPage <= 0 {
+		statsHelp(args, fs)
+		return 2
+	}
+
+	fn := fs.Arg(1)
+	stats, err := et.ReadStats(et.AutoInput(fn), et.StatsOptions{
+		WordsPerMinute:         *wpm,
+		CJKCharactersPerMinute: *cjkCPM,
+		CharactersPerPage:      *charsPerPage,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	} else {
+		if *chapters {
+			for _, c := range stats.Chapters {
+				if c.Title != "" {
+					fmt.Printf("%s (%s): %d words, %d characters\n", c.Path, c.Title, c.Words, c.Characters)
+				} else {
+					fmt.Printf("%s: %d words, %d characters\n", c.Path, c.Words, c.Characters)
+				}
+			}
+			fmt.Printf("\n")
+		}
+		fmt.Printf("Words: %d\n", stats.Words)
+		fmt.Printf("Characters: %d\n", stats.Characters)
+		fmt.Printf("Images: %d\n", stats.Images)
+		fmt.Printf("Reading time: %dh%02dm\n", stats.ReadingMinutes/60, stats.ReadingMinutes%60)
+		fmt.Printf("Pages: %d\n", stats.Pages)
+		fmt.Printf("Size: %d bytes\n", stats.Size)
+
+		var mediaTypes []string
+		for mt := range stats.MediaTypes {
+			mediaTypes = append(mediaTypes, mt)
+		}
+		sort.Slice(mediaTypes, func(i, j int) bool {
+			if a, b := stats.MediaTypes[mediaTypes[i]], stats.MediaTypes[mediaTypes[j]]; a != b {
+				return a > b
+			}
+			return mediaTypes[i] < mediaTypes[j]
+		})
+		for _, mt := range mediaTypes {
+			fmt.Printf("  %s: %d bytes\n", mt, stats.MediaTypes[mt])
+		}
+	}
+
+	if *calibre {
+		if err := et.New(
+			et.TransformCalibreColumn("words", "Words", stats.Words),
+			et.TransformCalibreColumn("characters", "Characters", stats.Characters),
+			et.TransformCalibreColumn("pages", "Pages", stats.Pages),
+		).Run(et.AutoInput(fn), et.AutoOutput(fn), false); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: store calibre metadata: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func statsHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+Only the visible text of the spine documents is counted. Chinese and Japanese
+characters are counted as one word each. The size is the uncompressed size of
+the manifest items.
+
+The calibre custom columns are stored in the same format calibre uses when
+saving to disk, so they are imported if columns with the same labels exist in
+the library.
+`)
+}
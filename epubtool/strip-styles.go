@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"strip-styles", "ss", "Remove publisher-forced styling from a book.", stripStylesMain})
+}
+
+func stripStylesMain(args []string, fs *pflag.FlagSet) int {
+	presets := fs.StringSliceP("preset", "p", nil, "Presets to apply (see below)")
+	properties := fs.StringSlice("property", nil, "Additional CSS properties to remove")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 || (len(*presets) == 0 && len(*properties) == 0) {
+		stripStylesHelp(args, fs)
+		return 2
+	}
+
+	var filters []et.StyleFilter
+	for _, p := range *presets {
+		f, ok := et.StylePresets[p]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown preset %#v\n", p)
+			return 2
+		}
+		filters = append(filters, f)
+	}
+	if len(*properties) != 0 {
+		filters = append(filters, et.StyleFilterProperties(*properties...))
+	}
+
+	fn := fs.Arg(1)
+
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+
+	if err := et.New(et.TransformStripStyles(filters...)).Run(et.AutoInput(fn), out, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func stripStylesHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+
+	var names []string
+	for name := range et.StylePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "\nPresets:\n  %s\n", strings.Join(names, ", "))
+}
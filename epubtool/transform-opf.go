@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/pflag"
 
 	et "github.com/pgaskin/epubtool/epubtransform"
+	"github.com/pgaskin/epubtool/util"
 )
 
 func init() {
@@ -14,11 +15,14 @@ func init() {
 }
 
 func transformOPFMain(args []string, fs *pflag.FlagSet) int {
-	// TODO: more metadata, generate uuid, remove metadata
+	// TODO: more metadata, remove metadata
 	title := fs.StringP("title", "t", "", "Set dc:title")
 	creator := fs.StringP("creator", "c", "", "Set dc:creator")
 	description := fs.StringP("description", "d", "", "Set dc:description")
 	publisher := fs.StringP("publisher", "p", "", "Set dc:publisher")
+	identifier := fs.String("identifier", "", "Set the unique identifier (obfuscated fonts will be updated)")
+	generateUUID := fs.Bool("generate-uuid", false, "Set the unique identifier to a new random urn:uuid")
+	syncManifest := fs.Bool("sync-manifest", false, "Add unlisted files to the manifest (detecting media types and properties)")
 	series := fs.String("series", "", "Set calibre:series meta")
 	seriesIndex := fs.Float64("series-index", 0, "Set calibre:series_index meta")
 	dump := fs.Bool("dump", false, "Show OPF after transformations")
@@ -28,7 +32,7 @@ func transformOPFMain(args []string, fs *pflag.FlagSet) int {
 	help := fs.BoolP("help", "h", false, "Show this help text")
 	fs.Parse(args)
 
-	if *help || fs.NArg() != 2 || !(*title != "" || *creator != "" || *description != "" || *series != "" || *seriesIndex >= 0 || len(*meta) > 0 || *dump) {
+	if *help || fs.NArg() != 2 || (*identifier != "" && *generateUUID) || !(*title != "" || *creator != "" || *description != "" || *identifier != "" || *generateUUID || *syncManifest || *series != "" || *seriesIndex >= 0 || len(*meta) > 0 || *dump) {
 		transformOPFHelp(args, fs)
 		return 2
 	}
@@ -48,6 +52,17 @@ func transformOPFMain(args []string, fs *pflag.FlagSet) int {
 	if *publisher != "" {
 		pipeline = append(pipeline, et.TransformPublisher(*publisher))
 	}
+	if *generateUUID {
+		u, err := util.NewUUID()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: generate uuid: %v\n", err)
+			return 1
+		}
+		*identifier = "urn:uuid:" + u
+	}
+	if *identifier != "" {
+		pipeline = append(pipeline, et.TransformIdentifier(*identifier))
+	}
 	for name, content := range *meta {
 		txt := fmt.Sprintf("set meta[name=%#v][content=%#v]", name, content)
 		if content == "" {
@@ -61,6 +76,9 @@ func transformOPFMain(args []string, fs *pflag.FlagSet) int {
 	if *seriesIndex > 0 {
 		pipeline = append(pipeline, et.TransformOPFMetaElementContent(fmt.Sprintf("set series index to %v", *seriesIndex), "calibre:series_index", fmt.Sprint(*seriesIndex)))
 	}
+	if *syncManifest {
+		pipeline = append(pipeline, et.TransformSyncManifest())
+	}
 	if *beautify > 0 {
 		pipeline = append(pipeline, et.TransformOPFBeautify(*beautify))
 	}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+
+	et "github.com/pgaskin/epubtool/epubtransform"
+)
+
+func init() {
+	commands = append(commands, &command{"typography", "ty", "Fix quotes, dashes, ellipses, and spacing in a book's text.", typographyMain})
+}
+
+func typographyMain(args []string, fs *pflag.FlagSet) int {
+	noQuotes := fs.Bool("no-quotes", false, "Don't convert straight quotes to curly ones")
+	noDashes := fs.Bool("no-dashes", false, "Don't convert -- and --- to em dashes")
+	noEllipses := fs.Bool("no-ellipses", false, "Don't convert ... to ellipses")
+	noFrenchSpacing := fs.Bool("no-french-spacing", false, "Don't use non-breaking spaces around punctuation in French text")
+	noWhitespace := fs.Bool("no-whitespace", false, "Don't collapse repeated spaces")
+	removeSoftHyphens := fs.Bool("remove-soft-hyphens", false, "Remove soft hyphens")
+	hyphenate := fs.String("hyphenate", "", "Insert soft hyphens using the specified TeX hyphenation patterns file (e.g. hyph-en-us.pat.txt)")
+	language := fs.StringP("language", "l", "", "Override the language of the text (default: from the content documents or the OPF)")
+	dryRun := fs.Bool("dry-run", false, "Do not actually overwrite file")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+	fs.Parse(args)
+
+	if *help || fs.NArg() != 2 {
+		typographyHelp(args, fs)
+		return 2
+	}
+
+	opts := et.TypographyOptions{
+		Quotes:            !*noQuotes,
+		Dashes:            !*noDashes,
+		Ellipses:          !*noEllipses,
+		FrenchSpacing:     !*noFrenchSpacing,
+		Whitespace:        !*noWhitespace,
+		RemoveSoftHyphens: *removeSoftHyphens,
+		Language:          *language,
+	}
+	if *hyphenate != "" {
+		h, err := et.ReadHyphenationPatterns(*hyphenate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: read hyphenation patterns: %v\n", err)
+			return 1
+		}
+		opts.Hyphenator = h
+	}
+
+	fn := fs.Arg(1)
+	var report et.TypographyReport
+	var out et.OutputFunc
+	if !*dryRun {
+		out = et.AutoOutput(fn)
+	}
+	if err := et.New(et.TransformTypography(opts, &report)).Run(et.AutoInput(fn), out, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var paths []string
+	var total int
+	for p, n := range report.Counts {
+		paths = append(paths, p)
+		total += n
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Printf("%s: %d text nodes changed\n", p, report.Counts[p])
+	}
+	fmt.Printf("Changed %d text nodes in %d files\n", total, len(paths))
+	return 0
+}
+
+func typographyHelp(args []string, fs *pflag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|epub_dir)\n\nOptions:\n", args[0])
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+Only the text of the content documents is changed (not tags, attributes, the
+head, scripts, stylesheets, or code). Quotes are converted using the style for
+the language of the text (e.g. “” for English, „“ for German, and « » for
+French).
+
+Hyphenation patterns can be downloaded from
+https://github.com/hyphenation/tex-hyphen/tree/master/hyph-utf8/tex/generic/hyph-utf8/patterns/txt.
+`)
+}
@@ -16,33 +16,73 @@ func init() {
 }
 
 func unpackMain(args []string, fs *pflag.FlagSet) int {
-	// TODO: custom output dir
+	output := fs.StringP("output", "o", "", "Output directory, or an existing directory to unpack into if multiple inputs are specified (default: the input name in the current directory)")
+	force := fs.BoolP("force", "f", false, "Overwrite existing output directories")
 	help := fs.BoolP("help", "h", false, "Show this help text")
 	fs.Parse(args)
 
-	if *help || fs.NArg() != 2 {
+	if *help || fs.NArg() < 2 {
 		unpackHelp(args, fs)
 		return 2
 	}
 
-	f := fs.Arg(1)
-	fp, fe := util.SplitExt(f)
-	if fe != ".epub" {
-		fmt.Fprintf(os.Stderr, "Error: %s is not an epub file\n", f)
-		return 1
+	if fs.NArg() > 2 && *output != "" {
+		if fi, err := os.Stat(*output); err != nil || !fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "Error: output must be an existing directory if multiple inputs are specified\n")
+			return 2
+		}
 	}
 
-	fn := filepath.Base(fp)
-	fmt.Printf("Unpacking %#v to %#v\n", f, fn)
+	status := 0
+	var stdin bool
+	for _, f := range fs.Args()[1:] {
+		var in et.InputFunc
+		var fn string
+		if f == "-" {
+			if stdin {
+				fmt.Fprintf(os.Stderr, "Error: stdin can only be read once\n")
+				status = 1
+				continue
+			}
+			if *output == "" || fs.NArg() > 2 {
+				fmt.Fprintf(os.Stderr, "Error: an output directory must be specified when unpacking from stdin\n")
+				status = 1
+				continue
+			}
+			stdin = true
+			in, f = et.ReaderInput(os.Stdin), "stdin"
+		} else {
+			fp, fe := util.SplitExt(f)
+			if fe != ".epub" {
+				fmt.Fprintf(os.Stderr, "Error: %s is not an epub file\n", f)
+				status = 1
+				continue
+			}
+			in, fn = et.FileInput(f), filepath.Base(fp)
+		}
 
-	if err := et.New().Run(et.FileInput(f), et.DirOutput(fn), false); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		return 1
+		if fs.NArg() > 2 && *output != "" {
+			fn = filepath.Join(*output, fn)
+		} else if *output != "" {
+			fn = *output
+		}
+
+		fmt.Printf("Unpacking %#v to %#v\n", f, fn)
+
+		out := et.DirOutput(fn)
+		if *force {
+			out = et.ReplaceOutput(fn, et.DirOutput)
+		}
+
+		if err := et.New().Run(in, out, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			status = 1
+		}
 	}
-	return 0
+	return status
 }
 
 func unpackHelp(args []string, fs *pflag.FlagSet) {
-	fmt.Fprintf(os.Stderr, "Usage: %s [options] epub_file\n\nOptions:\n", args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] (epub_file|-)...\n\nOptions:\n", args[0])
 	fs.PrintDefaults()
 }
@@ -0,0 +1,263 @@
+package epubtransform
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// CleanOptions controls what TransformClean removes.
+type CleanOptions struct {
+	RemoveUnlisted     bool // delete files which are not in the manifest
+	RemoveMissing      bool // remove manifest items whose files do not exist
+	RemoveUnreferenced bool // remove manifest items which are not referenced
+	Dedupe             bool // replace duplicate files with references to the first one
+}
+
+// CleanReport contains the problems found by TransformClean. All paths are
+// slash-separated and relative to the epub root.
+type CleanReport struct {
+	Unlisted     []string   // files which are not in the manifest
+	Missing      []string   // manifest items whose files do not exist
+	Unreferenced []string   // manifest items which are not reachable from the spine, nav, ncx, cover, or guide
+	Duplicates   [][]string // groups of identical manifest items (the first one is kept)
+}
+
+// Empty checks if no problems were found.
+func (r *CleanReport) Empty() bool {
+	return len(r.Unlisted) == 0 && len(r.Missing) == 0 && len(r.Unreferenced) == 0 && len(r.Duplicates) == 0
+}
+
+// TransformClean finds unlisted files, missing manifest items, unreferenced
+// resources, and duplicate files, and removes them as specified by opts. If
+// report is not nil, it is set to the problems found before anything was
+// removed.
+func TransformClean(opts CleanOptions, report *CleanReport) Transform {
+	return Transform{
+		Desc: "clean up resources",
+		Raw: func(epubdir string) error {
+			r, err := findCleanProblems(epubdir)
+			if err != nil {
+				return err
+			}
+			if report != nil {
+				*report = *r
+			}
+
+			remove := map[string]bool{}
+			if opts.RemoveMissing {
+				for _, relpath := range r.Missing {
+					remove[relpath] = true
+				}
+			}
+			if opts.RemoveUnreferenced {
+				for _, relpath := range r.Unreferenced {
+					remove[relpath] = true
+				}
+			}
+			renames := map[string]string{}
+			if opts.Dedupe {
+				for _, group := range r.Duplicates {
+					for _, relpath := range group[1:] {
+						renames[relpath] = group[0]
+						remove[relpath] = true
+					}
+				}
+			}
+
+			// remove the items first, so the manifest entries aren't rewritten
+			// to point to the kept file
+			if err := removeFiles(epubdir, remove); err != nil {
+				return err
+			}
+			if len(renames) != 0 {
+				if err := RewriteReferences(epubdir, renames); err != nil {
+					return err
+				}
+			}
+			if opts.RemoveUnlisted {
+				for _, relpath := range r.Unlisted {
+					if err := os.Remove(filepath.Join(epubdir, filepath.FromSlash(relpath))); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func findCleanProblems(epubdir string) (*CleanReport, error) {
+	r := &CleanReport{}
+
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Unlisted, err = UnlistedFiles(epubdir); err != nil {
+		return nil, err
+	}
+
+	exists := map[string]bool{}
+	for _, it := range pkg.Manifest {
+		if fi, err := os.Stat(filepath.Join(epubdir, filepath.FromSlash(it.Path))); err == nil && fi.Mode().IsRegular() {
+			exists[it.Path] = true
+		} else {
+			r.Missing = append(r.Missing, it.Path)
+		}
+	}
+
+	roots, keep, err := manifestRoots(epubdir, pkg)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := FindReferences(epubdir)
+	if err != nil {
+		return nil, err
+	}
+	delete(refs, pkg.Path) // the manifest references everything
+
+	reachable := map[string]bool{}
+	queue := roots
+	for len(queue) != 0 {
+		relpath := queue[0]
+		queue = queue[1:]
+		if reachable[relpath] {
+			continue
+		}
+		reachable[relpath] = true
+		queue = append(queue, refs[relpath]...)
+	}
+	for _, it := range pkg.Manifest {
+		if exists[it.Path] && !reachable[it.Path] && !keep[it.ID] {
+			r.Unreferenced = append(r.Unreferenced, it.Path)
+		}
+	}
+
+	// duplicates (content documents, items with properties, and items used by
+	// id are never removed)
+	must := func(it ManifestItem) bool {
+		return keep[it.ID] || it.Properties != "" || isMarkup(it.MediaType)
+	}
+	groups := map[[sha256.Size]byte][]ManifestItem{}
+	var order [][sha256.Size]byte
+	for _, it := range pkg.Manifest {
+		if !exists[it.Path] {
+			continue
+		}
+		h, err := hashFile(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+		if err != nil {
+			return nil, util.Wrap(err, "hash %#v", it.Path)
+		}
+		if groups[h] == nil {
+			order = append(order, h)
+		}
+		groups[h] = append(groups[h], it)
+	}
+	for _, h := range order {
+		its := groups[h]
+		if len(its) < 2 {
+			continue
+		}
+		// prefer keeping items which must be kept, then referenced ones
+		rank := func(it ManifestItem) int {
+			switch {
+			case must(it):
+				return 0
+			case reachable[it.Path]:
+				return 1
+			}
+			return 2
+		}
+		sort.SliceStable(its, func(i, j int) bool {
+			return rank(its[i]) < rank(its[j])
+		})
+		group := []string{its[0].Path}
+		for _, it := range its[1:] {
+			if !must(it) {
+				group = append(group, it.Path)
+			}
+		}
+		if len(group) > 1 {
+			r.Duplicates = append(r.Duplicates, group)
+		}
+	}
+
+	return r, nil
+}
+
+// isMarkup checks if a media type is for a content document.
+func isMarkup(mediaType string) bool {
+	return mediaType == "application/xhtml+xml" || mediaType == "text/html" || (strings.HasSuffix(mediaType, "+xml") && mediaType != "image/svg+xml")
+}
+
+// manifestRoots returns the paths of the manifest items which are used directly
+// by the OPF (i.e. the spine, nav, ncx, cover, and guide), and the ids of the
+// manifest items which are referenced by id.
+func manifestRoots(epubdir string, pkg *Package) ([]string, map[string]bool, error) {
+	op, err := getOPFPath(epubdir)
+	if err != nil {
+		return nil, nil, util.Wrap(err, "could not get opf path")
+	}
+	opf := etree.NewDocument()
+	if err := opf.ReadFromFile(op); err != nil {
+		return nil, nil, util.Wrap(err, "could not parse opf")
+	}
+
+	ids := map[string]bool{}
+	for _, id := range pkg.Spine {
+		ids[id] = true
+	}
+	if el := opf.FindElement("//package/spine"); el != nil {
+		if toc := el.SelectAttrValue("toc", ""); toc != "" {
+			ids[toc] = true
+		}
+	}
+	for _, el := range opf.FindElements("//package/metadata/meta") {
+		if el.SelectAttrValue("name", "") == "cover" {
+			ids[el.SelectAttrValue("content", "")] = true
+		}
+	}
+	for _, el := range opf.FindElements("//package/manifest/item") {
+		for _, attr := range []string{"fallback", "fallback-style", "media-overlay"} {
+			if id := el.SelectAttrValue(attr, ""); id != "" {
+				ids[id] = true
+			}
+		}
+	}
+
+	var roots []string
+	for _, it := range pkg.Manifest {
+		if ids[it.ID] || it.HasProperty("nav") || it.HasProperty("cover-image") || it.MediaType == "application/x-dtbncx+xml" {
+			roots = append(roots, it.Path)
+		}
+	}
+	for _, el := range opf.FindElements("//package/guide/reference") {
+		if target, _, ok := splitRef(pkg.Path, el.SelectAttrValue("href", "")); ok {
+			roots = append(roots, target)
+		}
+	}
+	return roots, ids, nil
+}
+
+func hashFile(fn string) ([sha256.Size]byte, error) {
+	var h [sha256.Size]byte
+	f, err := os.Open(fn)
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+	s := sha256.New()
+	if _, err := io.Copy(s, f); err != nil {
+		return h, err
+	}
+	copy(h[:], s.Sum(nil))
+	return h, nil
+}
@@ -0,0 +1,116 @@
+package epubtransform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransformClean(t *testing.T) {
+	files := map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+    <dc:title>Test</dc:title>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+    <item id="a" href="img/a.png" media-type="image/png"/>
+    <item id="b" href="img/b.png" media-type="image/png"/>
+    <item id="c" href="img/c.png" media-type="image/png"/>
+    <item id="dup" href="img/dup.png" media-type="image/png"/>
+    <item id="unused" href="img/unused.png" media-type="image/png"/>
+    <item id="missing" href="img/missing.png" media-type="image/png"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body><nav epub:type="toc"><ol><li><a href="text/ch1.xhtml">One</a></li></ol></nav></body></html>`,
+		"OEBPS/text/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><link rel="stylesheet" href="../style.css"/></head><body>
+<img src="../img/dup.png" srcset="../img/a.png 2x" alt=""/>
+<object data="../nothing.svg"><param name="src" value="../img/c.png"/></object>
+</body></html>`,
+		"OEBPS/style.css":      `body { background-image: image-set("img/b.png" 1x); }`,
+		"OEBPS/img/a.png":      "a",
+		"OEBPS/img/b.png":      "b",
+		"OEBPS/img/c.png":      "c",
+		"OEBPS/img/dup.png":    "a",
+		"OEBPS/img/unused.png": "unused",
+		"OEBPS/extra.txt":      "extra",
+	}
+
+	for _, c := range []struct {
+		opts    CleanOptions
+		exists  []string
+		removed []string
+	}{
+		{CleanOptions{RemoveMissing: true},
+			[]string{"extra.txt", "img/a.png", "img/b.png", "img/c.png", "img/dup.png", "img/unused.png"},
+			[]string{"img/missing.png"}},
+		{CleanOptions{RemoveUnlisted: true, RemoveMissing: true, RemoveUnreferenced: true, Dedupe: true},
+			[]string{"img/a.png", "img/b.png", "img/c.png"},
+			[]string{"extra.txt", "img/dup.png", "img/unused.png", "img/missing.png"}},
+	} {
+		td, err := ioutil.TempDir("", "epubtransform-test-*")
+		if err != nil {
+			t.Fatalf("create temp dir: %v", err)
+		}
+		defer os.RemoveAll(td)
+		writeTestFiles(t, td, files)
+
+		var report CleanReport
+		if err := TransformClean(c.opts, &report).Raw(td); err != nil {
+			t.Fatalf("%+v: unexpected error: %v", c.opts, err)
+		}
+		if exp := (CleanReport{
+			Unlisted:     []string{"OEBPS/extra.txt"},
+			Missing:      []string{"OEBPS/img/missing.png"},
+			Unreferenced: []string{"OEBPS/img/unused.png"},
+			Duplicates:   [][]string{{"OEBPS/img/a.png", "OEBPS/img/dup.png"}},
+		}); !reflect.DeepEqual(report, exp) {
+			t.Errorf("%+v: expected report %+v, got %+v", c.opts, exp, report)
+		}
+
+		pkg, err := ReadPackage(td)
+		if err != nil {
+			t.Fatalf("%+v: read package: %v", c.opts, err)
+		}
+		manifest := map[string]bool{}
+		for _, it := range pkg.Manifest {
+			manifest[strings.TrimPrefix(it.Path, "OEBPS/")] = true
+		}
+		for _, relpath := range c.exists {
+			if _, err := os.Stat(filepath.Join(td, "OEBPS", filepath.FromSlash(relpath))); err != nil {
+				t.Errorf("%+v: expected %s to exist: %v", c.opts, relpath, err)
+			}
+			if !manifest[relpath] && relpath != "extra.txt" {
+				t.Errorf("%+v: expected %s to be in the manifest", c.opts, relpath)
+			}
+		}
+		for _, relpath := range c.removed {
+			if _, err := os.Stat(filepath.Join(td, "OEBPS", filepath.FromSlash(relpath))); !os.IsNotExist(err) {
+				t.Errorf("%+v: expected %s to be removed", c.opts, relpath)
+			}
+			if manifest[relpath] {
+				t.Errorf("%+v: expected %s to be removed from the manifest", c.opts, relpath)
+			}
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "text", "ch1.xhtml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := map[bool]string{false: `src="../img/dup.png"`, true: `src="../img/a.png"`}[c.opts.Dedupe]; !strings.Contains(string(buf), exp) {
+			t.Errorf("%+v: expected content document to contain %s, got %s", c.opts, exp, buf)
+		}
+	}
+}
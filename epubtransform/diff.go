@@ -0,0 +1,312 @@
+package epubtransform
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/css"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// DiffOptions controls how Diff compares epubs.
+type DiffOptions struct {
+	// Context is the number of lines of context in the unified diffs.
+	Context int
+	// Exact compares text files line-by-line instead of normalizing XML, HTML,
+	// and CSS first (which ignores formatting differences).
+	Exact bool
+}
+
+// Difference is a difference between two epubs.
+type Difference struct {
+	// Path is the slash-separated path relative to the epub root, or
+	// (metadata), (manifest), or (spine).
+	Path string `json:"path"`
+	// Status is added, removed, or modified.
+	Status string `json:"status"`
+	// Binary is true if the file is compared by size and hash rather than
+	// contents.
+	Binary bool `json:"binary,omitempty"`
+	// OldSize, NewSize, OldSHA256, and NewSHA256 are set for files.
+	OldSize   int64  `json:"old_size,omitempty"`
+	NewSize   int64  `json:"new_size,omitempty"`
+	OldSHA256 string `json:"old_sha256,omitempty"`
+	NewSHA256 string `json:"new_sha256,omitempty"`
+	// Diff is the unified diff (without the file headers) for text files.
+	Diff string `json:"diff,omitempty"`
+}
+
+// Diff compares the metadata, manifest, spine, and files of two epubs.
+func Diff(a, b InputFunc, opts DiffOptions) ([]Difference, error) {
+	var diffs []Difference
+	// the epubs are opened using nested pipelines so both are available at
+	// the same time (and fonts are de-obfuscated)
+	err := New(Transform{
+		Desc: "open new epub",
+		Raw: func(adir string) error {
+			return New(Transform{
+				Desc: "compare epubs",
+				Raw: func(bdir string) error {
+					var err error
+					diffs, err = diffDirs(adir, bdir, opts)
+					return err
+				},
+			}).Run(b, nil, false)
+		},
+	}).Run(a, nil, false)
+	return diffs, err
+}
+
+func diffDirs(adir, bdir string, opts DiffOptions) ([]Difference, error) {
+	var diffs []Difference
+
+	apkg, err := ReadPackage(adir)
+	if err != nil {
+		return nil, util.Wrap(err, "old epub")
+	}
+	bpkg, err := ReadPackage(bdir)
+	if err != nil {
+		return nil, util.Wrap(err, "new epub")
+	}
+
+	amd, err := metadataLines(adir)
+	if err != nil {
+		return nil, util.Wrap(err, "old epub")
+	}
+	bmd, err := metadataLines(bdir)
+	if err != nil {
+		return nil, util.Wrap(err, "new epub")
+	}
+	for _, x := range []struct {
+		name string
+		a, b []string
+	}{
+		{"(metadata)", amd, bmd},
+		{"(manifest)", manifestLines(apkg), manifestLines(bpkg)},
+		{"(spine)", spineLines(apkg), spineLines(bpkg)},
+	} {
+		if d := util.UnifiedDiff(x.a, x.b, opts.Context); d != "" {
+			diffs = append(diffs, Difference{Path: x.name, Status: "modified", Diff: d})
+		}
+	}
+
+	afiles, err := listFiles(adir)
+	if err != nil {
+		return nil, err
+	}
+	bfiles, err := listFiles(bdir)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]bool{}
+	for f := range afiles {
+		all[f] = true
+	}
+	for f := range bfiles {
+		all[f] = true
+	}
+	paths := make([]string, 0, len(all))
+	for f := range all {
+		paths = append(paths, f)
+	}
+	sort.Strings(paths)
+
+	for _, relpath := range paths {
+		var abuf, bbuf []byte
+		if afiles[relpath] {
+			if abuf, err = ioutil.ReadFile(filepath.Join(adir, filepath.FromSlash(relpath))); err != nil {
+				return nil, err
+			}
+		}
+		if bfiles[relpath] {
+			if bbuf, err = ioutil.ReadFile(filepath.Join(bdir, filepath.FromSlash(relpath))); err != nil {
+				return nil, err
+			}
+		}
+		if afiles[relpath] && bfiles[relpath] && bytes.Equal(abuf, bbuf) {
+			continue
+		}
+
+		d := Difference{Path: relpath, Status: "modified"}
+		if !afiles[relpath] {
+			d.Status = "added"
+		} else if !bfiles[relpath] {
+			d.Status = "removed"
+		}
+		if afiles[relpath] {
+			d.OldSize, d.OldSHA256 = int64(len(abuf)), sha256Hex(abuf)
+		}
+		if bfiles[relpath] {
+			d.NewSize, d.NewSHA256 = int64(len(bbuf)), sha256Hex(bbuf)
+		}
+
+		if isTextFile(relpath, abuf) && isTextFile(relpath, bbuf) {
+			var alines, blines []string
+			if afiles[relpath] {
+				alines = textLines(relpath, abuf, opts.Exact)
+			}
+			if bfiles[relpath] {
+				blines = textLines(relpath, bbuf, opts.Exact)
+			}
+			if d.Diff = util.UnifiedDiff(alines, blines, opts.Context); d.Diff == "" && d.Status == "modified" {
+				continue // only formatting differences
+			}
+		} else {
+			d.Binary = true
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// listFiles returns the slash-separated paths relative to epubdir of the regular
+// files in it.
+func listFiles(epubdir string) (map[string]bool, error) {
+	files := map[string]bool{}
+	return files, filepath.Walk(epubdir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(epubdir, file)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(rel)] = true
+		}
+		return nil
+	})
+}
+
+func sha256Hex(buf []byte) string {
+	h := sha256.Sum256(buf)
+	return hex.EncodeToString(h[:])
+}
+
+// isTextFile checks if a file should be compared as text.
+func isTextFile(relpath string, buf []byte) bool {
+	if markup, stylesheet := isReferenceFile(relpath); markup || stylesheet {
+		return true
+	}
+	switch strings.ToLower(path.Ext(relpath)) {
+	case ".txt", ".js", ".json", ".md", "":
+		return utf8.Valid(buf) && bytes.IndexByte(buf, 0) == -1
+	}
+	return false
+}
+
+// textLines splits a text file into lines, normalizing the formatting of XML,
+// HTML, and CSS unless exact is true.
+func textLines(relpath string, buf []byte, exact bool) []string {
+	str := string(buf)
+	if !exact {
+		switch markup, stylesheet := isReferenceFile(relpath); {
+		case markup:
+			if doc := etree.NewDocument(); doc.ReadFromBytes(buf) == nil {
+				normalizeXML(&doc.Element)
+				doc.Indent(2)
+				if s, err := doc.WriteToString(); err == nil {
+					str = s
+				}
+			}
+		case stylesheet:
+			if ss, err := css.Parse(str); err == nil {
+				str = ss.String()
+			}
+		}
+	}
+	str = strings.Replace(str, "\r\n", "\n", -1)
+	return strings.Split(strings.TrimSuffix(str, "\n"), "\n")
+}
+
+var diffSpaceRe = regexp.MustCompile(`\s+`)
+
+// normalizeXML removes whitespace-only text, collapses whitespace in text, and
+// sorts attributes.
+func normalizeXML(el *etree.Element) {
+	sort.SliceStable(el.Attr, func(i, j int) bool {
+		return el.Attr[i].FullKey() < el.Attr[j].FullKey()
+	})
+	child := el.Child[:0]
+	for _, t := range el.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			if t.IsWhitespace() {
+				continue
+			}
+			t.Data = diffSpaceRe.ReplaceAllString(t.Data, " ")
+		case *etree.Element:
+			normalizeXML(t)
+		}
+		child = append(child, t)
+	}
+	el.Child = child
+}
+
+// metadataLines returns the sorted metadata elements of the OPF as lines.
+func metadataLines(epubdir string) ([]string, error) {
+	op, err := getOPFPath(epubdir)
+	if err != nil {
+		return nil, util.Wrap(err, "could not get opf path")
+	}
+	opf := etree.NewDocument()
+	if err := opf.ReadFromFile(op); err != nil {
+		return nil, util.Wrap(err, "could not parse opf")
+	}
+	var lines []string
+	if me := opf.FindElement("//package/metadata"); me != nil {
+		for _, el := range me.ChildElements() {
+			key := el.FullTag()
+			for _, attr := range []string{"name", "property", "refines", "scheme", "opf:role", "opf:scheme", "opf:event"} {
+				if v := el.SelectAttrValue(attr, ""); v != "" {
+					key += fmt.Sprintf("[%s=%s]", attr, v)
+				}
+			}
+			value := strings.Join(strings.Fields(el.Text()), " ")
+			if c := el.SelectAttr("content"); c != nil {
+				value = c.Value
+			}
+			lines = append(lines, key+": "+value)
+		}
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// manifestLines returns the sorted manifest items as lines.
+func manifestLines(pkg *Package) []string {
+	var lines []string
+	for _, it := range pkg.Manifest {
+		line := it.Path + " " + it.MediaType
+		if it.Properties != "" {
+			line += " properties=" + it.Properties
+		}
+		lines = append(lines, line+" id="+it.ID)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// spineLines returns the spine items as lines.
+func spineLines(pkg *Package) []string {
+	var lines []string
+	for _, id := range pkg.Spine {
+		if it := pkg.Item(id); it != nil {
+			lines = append(lines, it.Path)
+		} else {
+			lines = append(lines, "(missing item "+id+")")
+		}
+	}
+	return lines
+}
@@ -2,12 +2,16 @@ package epubtransform
 
 import (
 	"archive/zip"
+	"compress/flate"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pgaskin/epubtool/util"
 )
@@ -32,16 +36,16 @@ func AutoOutput(inputPath string) OutputFunc {
 		if fi, err := os.Stat(inputPath); err != nil {
 			return util.Wrap(err, "could not stat input")
 		} else if fi.IsDir() {
-			return replaceOutputWrapper(inputPath, DirOutput)(epubdir)
+			return ReplaceOutput(inputPath, DirOutput)(epubdir)
 		} else if filepath.Ext(inputPath) == ".epub" {
-			return replaceOutputWrapper(inputPath, FileOutput)(epubdir)
+			return ReplaceOutput(inputPath, FileOutput)(epubdir)
 		}
 		return errors.New("unrecognized input file")
 	}
 }
 
-// replaceOutputWrapper wraps a path-based OutputFunc generator to allow overwriting an existing output safely.
-func replaceOutputWrapper(outputPath string, fn func(path string) OutputFunc) OutputFunc {
+// ReplaceOutput wraps a path-based OutputFunc generator to allow overwriting an existing output safely.
+func ReplaceOutput(outputPath string, fn func(path string) OutputFunc) OutputFunc {
 	return func(epubdir string) error {
 		td, err := ioutil.TempDir("", "epubio-*")
 		if err != nil {
@@ -73,6 +77,26 @@ func FileInput(file string) InputFunc {
 	}
 }
 
+// ReaderInput returns an InputFunc to read an epub file from a reader (e.g. stdin).
+func ReaderInput(r io.Reader) InputFunc {
+	return func(epubdir string) error {
+		f, err := ioutil.TempFile("", "epubio-*.epub")
+		if err != nil {
+			return util.Wrap(err, "error creating temp file")
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		n, err := io.Copy(f, r)
+		if err != nil {
+			return util.Wrap(err, "error reading input")
+		}
+
+		os.RemoveAll(epubdir)
+		return util.UnzipReader(f, n, epubdir)
+	}
+}
+
 // DirOutput returns an OutputFunc to write to a directory. The destination must not exist.
 func DirOutput(dir string) OutputFunc {
 	return func(epubdir string) error {
@@ -93,6 +117,60 @@ func DirInput(dir string) InputFunc {
 
 // FileOutput returns an OutputFunc write to a epub file. The destination must not exist.
 func FileOutput(file string) OutputFunc {
+	return FileOutputOpts(file, PackOptions{})
+}
+
+// WriterOutput returns an OutputFunc to write an epub file to a writer (e.g. stdout).
+func WriterOutput(w io.Writer, opts PackOptions) OutputFunc {
+	return func(epubdir string) error {
+		return writeEPUB(w, epubdir, opts)
+	}
+}
+
+// PackOptions controls how an epub file is written.
+type PackOptions struct {
+	// Reproducible makes the output only depend on the contents of the epub. Entries
+	// are written in a consistent order (mimetype, META-INF, the OPF document, the
+	// spine, then everything else sorted by path), timestamps are set to ModTime,
+	// and permissions are normalized.
+	Reproducible bool
+	// ModTime is the timestamp of all entries if Reproducible is set. If it is zero
+	// or before 1980-01-01 00:00:00 UTC (the earliest zip timestamp), the latter is
+	// used.
+	ModTime time.Time
+	// CompressionLevel is the deflate compression level (1-9). If it is zero, the
+	// default level is used. If it is negative, entries are stored uncompressed.
+	CompressionLevel int
+	// Exclude skips files matching DefaultExcludes or the patterns in the
+	// .epubignore file in the root of the epub, if present.
+	Exclude bool
+}
+
+// DefaultExcludes is a list of .gitignore-style patterns for junk files which
+// shouldn't be packed into an epub.
+var DefaultExcludes = []string{
+	".DS_Store", "._*", ".AppleDouble/", "__MACOSX/",
+	"Thumbs.db", "ehthumbs.db", "desktop.ini",
+	"*~", "*.bak", "*.orig", "*.swp", "*.swo", ".#*", "\\#*#",
+	".git/", ".gitignore", ".svn/", ".hg/", ".idea/", ".vscode/",
+	".epubignore",
+}
+
+// PackIgnore returns the files excluded when packing epubdir with the Exclude
+// option.
+func PackIgnore(epubdir string) (*util.Ignore, error) {
+	ig, err := util.NewIgnore(DefaultExcludes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := ig.AddFile(filepath.Join(epubdir, ".epubignore")); err != nil && !os.IsNotExist(err) {
+		return nil, util.Wrap(err, "could not read .epubignore")
+	}
+	return ig, nil
+}
+
+// FileOutputOpts is like FileOutput, but with custom options.
+func FileOutputOpts(file string, opts PackOptions) OutputFunc {
 	return func(epubdir string) error {
 		f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 		if err != nil {
@@ -100,37 +178,98 @@ func FileOutput(file string) OutputFunc {
 		}
 		defer f.Close()
 
-		zw := zip.NewWriter(f)
-		defer zw.Close()
+		if err := writeEPUB(f, epubdir, opts); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+}
+
+func writeEPUB(w io.Writer, epubdir string, opts PackOptions) error {
+	if opts.CompressionLevel > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d", opts.CompressionLevel)
+	}
+
+	modTime := opts.ModTime.UTC()
+	if zipEpoch := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC); modTime.Before(zipEpoch) {
+		modTime = zipEpoch
+	}
+
+	method := zip.Deflate
+	if opts.CompressionLevel < 0 {
+		method = zip.Store
+	}
+
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	if opts.CompressionLevel > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, opts.CompressionLevel)
+		})
+	}
+
+	mfh := &zip.FileHeader{
+		Name:   "mimetype",
+		Method: zip.Store, // Do not compress mimetype
+	}
+	if opts.Reproducible {
+		// don't set Modified, since that adds an extra field (the mimetype
+		// contents must start at offset 38)
+		mfh.ModifiedDate, mfh.ModifiedTime = msDosTime(modTime)
+		mfh.SetMode(0644)
+	}
+	if mimetypeWriter, err := zw.CreateHeader(mfh); err != nil {
+		return util.Wrap(err, "error writing mimetype to epub")
+	} else if _, err = mimetypeWriter.Write([]byte("application/epub+zip")); err != nil {
+		return util.Wrap(err, "error writing mimetype to epub")
+	}
+
+	var ig *util.Ignore
+	if opts.Exclude {
+		var err error
+		if ig, err = PackIgnore(epubdir); err != nil {
+			return err
+		}
+	}
 
-		if mimetypeWriter, err := zw.CreateHeader(&zip.FileHeader{
-			Name:   "mimetype",
-			Method: zip.Store, // Do not compress mimetype
-		}); err != nil {
-			return util.Wrap(err, "error writing mimetype to epub")
-		} else if _, err = mimetypeWriter.Write([]byte("application/epub+zip")); err != nil {
-			return util.Wrap(err, "error writing mimetype to epub")
+	var files []string
+	if err := filepath.Walk(epubdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
 
-		if err := filepath.Walk(epubdir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+		relPath, err := filepath.Rel(epubdir, path)
+		if err != nil {
+			return fmt.Errorf("error getting relative path of %#v", path)
+		}
 
-			relPath, err := filepath.Rel(epubdir, path)
-			if err != nil {
-				return fmt.Errorf("error getting relative path of %#v", path)
+		// Skip excluded files and directories
+		if ig != nil && path != epubdir && ig.Match(filepath.ToSlash(relPath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
+		}
 
-			// Skip if it is trying to pack itself, is not regular file, or is mimetype
-			if path == epubdir || !info.Mode().IsRegular() || filepath.Base(path) == "mimetype" {
-				return nil
-			}
+		// Skip if it is trying to pack itself, is not regular file, or is mimetype
+		if path == epubdir || !info.Mode().IsRegular() || filepath.Base(path) == "mimetype" {
+			return nil
+		}
 
-			fw, err := zw.Create(relPath)
-			if err != nil {
-				return util.Wrap(err, `error creating file %#v in epub`, relPath)
-			}
+		files = append(files, filepath.ToSlash(relPath))
+		return nil
+	}); err != nil {
+		return util.Wrap(err, "error creating epub")
+	}
+
+	if opts.Reproducible {
+		sortPackOrder(epubdir, files)
+	}
+
+	for _, relPath := range files {
+		if err := func() error {
+			path := filepath.Join(epubdir, filepath.FromSlash(relPath))
 
 			sf, err := os.Open(path)
 			if err != nil {
@@ -138,15 +277,69 @@ func FileOutput(file string) OutputFunc {
 			}
 			defer sf.Close()
 
+			fh := &zip.FileHeader{
+				Name:   relPath,
+				Method: method,
+			}
+			if opts.Reproducible {
+				fh.Modified = modTime
+				fh.SetMode(0644)
+			} else if fi, err := sf.Stat(); err == nil {
+				fh.Modified = fi.ModTime()
+			}
+
+			fw, err := zw.CreateHeader(fh)
+			if err != nil {
+				return util.Wrap(err, `error creating file %#v in epub`, relPath)
+			}
+
 			if _, err := io.Copy(fw, sf); err != nil {
 				return util.Wrap(err, "error writing file %#v to epub", relPath)
 			}
 
 			return nil
-		}); err != nil {
+		}(); err != nil {
 			return util.Wrap(err, "error creating epub")
 		}
+	}
 
-		return nil
+	if err := zw.Close(); err != nil {
+		return util.Wrap(err, "error creating epub")
 	}
+	return nil
+}
+
+// msDosTime converts a time (which must be in UTC and at or after the zip epoch)
+// to the MS-DOS date and time used in zip headers.
+func msDosTime(t time.Time) (date, tm uint16) {
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
+
+// sortPackOrder sorts slash-separated paths relative to epubdir in the order
+// they should be written to a reproducible epub.
+func sortPackOrder(epubdir string, files []string) {
+	rank := map[string]int{}
+	if pkg, err := ReadPackage(epubdir); err == nil { // if the opf is invalid, sort everything else by path
+		rank[pkg.Path] = 1
+		for i, it := range pkg.SpineItems() {
+			if _, seen := rank[it.Path]; !seen {
+				rank[it.Path] = 2 + i
+			}
+		}
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f, "META-INF/") {
+			rank[f] = 0
+		} else if _, ok := rank[f]; !ok {
+			rank[f] = len(files) + 2
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if ri, rj := rank[files[i]], rank[files[j]]; ri != rj {
+			return ri < rj
+		}
+		return files[i] < files[j]
+	})
 }
@@ -0,0 +1,205 @@
+package epubtransform
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteEPUBReproducible(t *testing.T) {
+	files := map[string]string{
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="a" href="a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="b" href="b.xhtml" media-type="application/xhtml+xml"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+  </manifest>
+  <spine>
+    <itemref idref="b"/>
+    <itemref idref="a"/>
+  </spine>
+</package>`,
+		"OEBPS/a.xhtml":   `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>a</p></body></html>`,
+		"OEBPS/b.xhtml":   `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>b</p></body></html>`,
+		"OEBPS/style.css": `p { color: red; }`,
+		"aaa.txt":         `x`,
+		"mimetype":        `application/epub+zip`,
+	}
+
+	// write the same files to two directories in a different order, with
+	// different timestamps and permissions
+	order := []string{"aaa.txt", "OEBPS/style.css", "OEBPS/a.xhtml", "OEBPS/b.xhtml", "OEBPS/content.opf", "META-INF/container.xml", "mimetype"}
+	var bufs [2][]byte
+	for i := range bufs {
+		td, err := ioutil.TempDir("", "epubtransform-test-*")
+		if err != nil {
+			t.Fatalf("create temp dir: %v", err)
+		}
+		defer os.RemoveAll(td)
+
+		for j := range order {
+			fn := order[j]
+			if i == 1 {
+				fn = order[len(order)-1-j]
+			}
+			writeTestFiles(t, td, map[string]string{fn: files[fn]})
+			mt := time.Date(2000+i, 1, 1, 0, 0, j, 0, time.UTC)
+			if err := os.Chtimes(filepath.Join(td, filepath.FromSlash(fn)), mt, mt); err != nil {
+				t.Fatal(err)
+			}
+			if i == 1 {
+				if err := os.Chmod(filepath.Join(td, filepath.FromSlash(fn)), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		var b bytes.Buffer
+		if err := writeEPUB(&b, td, PackOptions{Reproducible: true, ModTime: time.Unix(1234567890, 0)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		bufs[i] = b.Bytes()
+	}
+	if !bytes.Equal(bufs[0], bufs[1]) {
+		t.Errorf("expected output to be identical")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(bufs[0]), int64(len(bufs[0])))
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if !f.Modified.Equal(time.Unix(1234567890, 0)) {
+			t.Errorf("%s: expected timestamp to be set, got %s", f.Name, f.Modified)
+		}
+		if f.Mode() != 0644 {
+			t.Errorf("%s: expected mode 0644, got %s", f.Name, f.Mode())
+		}
+	}
+	if exp := []string{"mimetype", "META-INF/container.xml", "OEBPS/content.opf", "OEBPS/b.xhtml", "OEBPS/a.xhtml", "OEBPS/style.css", "aaa.txt"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("expected entries %q, got %q", exp, names)
+	}
+	if f := zr.File[0]; f.Method != zip.Store || len(f.Extra) != 0 {
+		t.Errorf("expected mimetype to be stored uncompressed without extra fields")
+	}
+	if !bytes.HasPrefix(bufs[0][30:], []byte("mimetypeapplication/epub+zip")) {
+		t.Errorf("expected mimetype to be the first entry with the contents at offset 38")
+	}
+}
+
+func TestReaderWriterRoundTrip(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	files := map[string]string{
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf":      `<package/>`,
+		"OEBPS/text/ch1.xhtml":   `<html/>`,
+	}
+	writeTestFiles(t, filepath.Join(td, "in"), files)
+
+	var b bytes.Buffer
+	if err := WriterOutput(&b, PackOptions{})(filepath.Join(td, "in")); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	writeTestFiles(t, filepath.Join(td, "out"), map[string]string{"stale.txt": "x"})
+	if err := ReaderInput(&b)(filepath.Join(td, "out")); err != nil {
+		t.Fatalf("read: unexpected error: %v", err)
+	}
+
+	files["mimetype"] = "application/epub+zip"
+	res := map[string]string{}
+	if err := filepath.Walk(filepath.Join(td, "out"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Join(td, "out"), path)
+		if err != nil {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		res[filepath.ToSlash(rel)] = string(buf)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, files) {
+		t.Errorf("expected files %q, got %q", files, res)
+	}
+
+	if err := ReaderInput(bytes.NewReader([]byte("not a zip")))(filepath.Join(td, "invalid")); err == nil {
+		t.Errorf("expected error for invalid input")
+	}
+}
+
+func TestReplaceOutput(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	epubdir := filepath.Join(td, "epub")
+	writeTestFiles(t, epubdir, map[string]string{"new.txt": "new"})
+
+	t.Run("File", func(t *testing.T) {
+		out := filepath.Join(td, "book.epub")
+		writeTestFiles(t, td, map[string]string{"book.epub": "old"})
+		if err := ReplaceOutput(out, FileOutput)(epubdir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		zr, err := zip.OpenReader(out)
+		if err != nil {
+			t.Fatalf("expected output to be replaced with an epub: %v", err)
+		}
+		defer zr.Close()
+		if len(zr.File) != 2 || zr.File[0].Name != "mimetype" || zr.File[1].Name != "new.txt" {
+			t.Errorf("unexpected output contents")
+		}
+	})
+
+	t.Run("Dir", func(t *testing.T) {
+		out := filepath.Join(td, "book")
+		writeTestFiles(t, out, map[string]string{"old.txt": "old"})
+		if err := ReplaceOutput(out, DirOutput)(epubdir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(out, "old.txt")); !os.IsNotExist(err) {
+			t.Errorf("expected old output to be removed")
+		}
+		if buf, err := ioutil.ReadFile(filepath.Join(out, "new.txt")); err != nil || string(buf) != "new" {
+			t.Errorf("expected new output to be copied into place (err: %v)", err)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		out := filepath.Join(td, "keep.epub")
+		writeTestFiles(t, td, map[string]string{"keep.epub": "old"})
+		if err := ReplaceOutput(out, func(string) OutputFunc {
+			return func(string) error {
+				return errors.New("test")
+			}
+		})(epubdir); err == nil {
+			t.Errorf("expected error")
+		}
+		if buf, err := ioutil.ReadFile(out); err != nil || string(buf) != "old" {
+			t.Errorf("expected existing output to be kept on error (err: %v)", err)
+		}
+	})
+}
@@ -0,0 +1,682 @@
+package epubtransform
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ExportFormat is a format Export can write.
+type ExportFormat string
+
+// ExportFormats.
+const (
+	// ExportHTML writes a self-contained HTML file. Each spine document
+	// becomes a section, stylesheets are inlined, images and other resources
+	// are embedded as data URIs, links between documents are rewritten to
+	// point to the sections, and scripts are removed.
+	ExportHTML ExportFormat = "html"
+	// ExportText writes the visible text.
+	ExportText ExportFormat = "text"
+	// ExportMarkdown writes the visible text as Markdown, keeping headings,
+	// lists, blockquotes, emphasis, preformatted text, and external links.
+	ExportMarkdown ExportFormat = "markdown"
+)
+
+// Export concatenates the spine documents of an epub in order and writes them
+// to w in the specified format. The epub is not modified.
+func Export(input InputFunc, w io.Writer, format ExportFormat) error {
+	switch format {
+	case ExportHTML, ExportText, ExportMarkdown:
+	default:
+		return fmt.Errorf("unknown export format %#v", format)
+	}
+	return New(Transform{
+		Desc: "export " + string(format),
+		Raw: func(epubdir string) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+
+			var docs []exportDoc
+			for _, it := range pkg.SpineItems() {
+				if it.MediaType != "application/xhtml+xml" && it.MediaType != "text/html" {
+					continue
+				}
+				f, err := os.Open(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+				if err != nil {
+					return util.Wrap(err, "read %#v", it.Path)
+				}
+				doc, err := html.Parse(f)
+				f.Close()
+				if err != nil {
+					return util.Wrap(err, "parse %#v", it.Path)
+				}
+				docs = append(docs, exportDoc{it.Path, doc})
+			}
+
+			if format == ExportHTML {
+				return exportHTML(epubdir, pkg, docs, w)
+			}
+			return exportText(docs, w, format == ExportMarkdown)
+		},
+	}).Run(input, nil, false)
+}
+
+type exportDoc struct {
+	path string // slash-separated, relative to the epub root
+	doc  *html.Node
+}
+
+// exportIDRefAttrs are attributes containing space-separated lists of ids.
+var exportIDRefAttrs = map[string]bool{
+	"for":                   true,
+	"headers":               true,
+	"form":                  true,
+	"list":                  true,
+	"aria-activedescendant": true,
+	"aria-controls":         true,
+	"aria-describedby":      true,
+	"aria-details":          true,
+	"aria-errormessage":     true,
+	"aria-flowto":           true,
+	"aria-labelledby":       true,
+	"aria-owns":             true,
+}
+
+// exportURLFragmentRe matches references to elements in SVG presentation
+// attributes (e.g. fill="url(#gradient)").
+var exportURLFragmentRe = regexp.MustCompile(`url\(\s*#([^)\s]+)\s*\)`)
+
+type htmlExporter struct {
+	epubdir string
+	pkg     *Package
+	anchors map[string]string // section ids by spine document path
+	bodyIDs map[string]string // body element ids by spine document path
+	data    map[string]string // data URIs by path (blank if the file could not be read)
+}
+
+func exportHTML(epubdir string, pkg *Package, docs []exportDoc, w io.Writer) error {
+	e := &htmlExporter{
+		epubdir: epubdir,
+		pkg:     pkg,
+		anchors: map[string]string{},
+		bodyIDs: map[string]string{},
+		data:    map[string]string{},
+	}
+	for i, d := range docs {
+		e.anchors[d.path] = "c" + strconv.Itoa(i+1)
+		if body := util.FindElement(d.doc, atom.Body); body != nil {
+			e.bodyIDs[d.path], _ = util.LookupAttr(body, "id")
+		}
+	}
+
+	head := &html.Node{Type: html.ElementNode, Data: "head", DataAtom: atom.Head}
+	head.AppendChild(&html.Node{Type: html.ElementNode, Data: "meta", DataAtom: atom.Meta, Attr: []html.Attribute{{Key: "charset", Val: "utf-8"}}})
+	title := &html.Node{Type: html.ElementNode, Data: "title", DataAtom: atom.Title}
+	title.AppendChild(&html.Node{Type: html.TextNode, Data: pkg.Title})
+	head.AppendChild(title)
+
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+
+	seen := map[string]bool{}
+	addStyle := func(key, css string) {
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+		head.AppendChild(style)
+	}
+
+	for _, d := range docs {
+		if h := util.FindElement(d.doc, atom.Head); h != nil {
+			for c := h.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type != html.ElementNode {
+					continue
+				}
+				switch c.DataAtom {
+				case atom.Link:
+					rel, _ := util.LookupAttr(c, "rel")
+					href, _ := util.LookupAttr(c, "href")
+					if !strings.Contains(" "+strings.ToLower(rel)+" ", " stylesheet ") || strings.Contains(" "+strings.ToLower(rel)+" ", " alternate ") {
+						continue
+					}
+					if target, _, ok := splitRef(d.path, href); ok && !seen[target] {
+						buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(target)))
+						if err != nil {
+							return util.Wrap(err, "read stylesheet %#v", target)
+						}
+						addStyle(target, e.rewriteCSS(target, string(buf)))
+					}
+				case atom.Style:
+					css := e.rewriteCSS(d.path, util.TextContent(c))
+					addStyle(css, css)
+				}
+			}
+		}
+
+		section := &html.Node{Type: html.ElementNode, Data: "section", DataAtom: atom.Section}
+		var lang string
+		if root := util.FindElement(d.doc, atom.Html); root != nil {
+			lang, _ = util.LookupAttr(root, "lang")
+		}
+		attr := []html.Attribute{{Key: "id", Val: e.anchors[d.path]}}
+		if b := util.FindElement(d.doc, atom.Body); b != nil {
+			for _, a := range b.Attr {
+				if a.Namespace != "" {
+					continue
+				}
+				switch a.Key {
+				case "lang":
+					lang = a.Val
+				case "class", "dir":
+					attr = append(attr, a)
+				case "style":
+					a.Val = e.rewriteCSS(d.path, a.Val)
+					attr = append(attr, a)
+				}
+			}
+			for c := b.FirstChild; c != nil; {
+				next := c.NextSibling
+				b.RemoveChild(c)
+				section.AppendChild(c)
+				c = next
+			}
+		}
+		e.rewriteNode(d.path, section)
+		if lang != "" && lang != pkg.Language {
+			attr = append(attr, html.Attribute{Key: "lang", Val: lang})
+		}
+		section.Attr = attr
+		body.AppendChild(section)
+	}
+
+	root := &html.Node{Type: html.ElementNode, Data: "html", DataAtom: atom.Html}
+	if pkg.Language != "" {
+		util.SetAttr(root, "lang", pkg.Language)
+	}
+	root.AppendChild(head)
+	root.AppendChild(body)
+
+	doc := &html.Node{Type: html.DocumentNode}
+	doc.AppendChild(&html.Node{Type: html.DoctypeNode, Data: "html"})
+	doc.AppendChild(root)
+	if err := html.Render(w, doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// id gets the new id for an element in a spine document.
+func (e *htmlExporter) id(docpath, id string) string {
+	if id == e.bodyIDs[docpath] {
+		return e.anchors[docpath]
+	}
+	return e.anchors[docpath] + "-" + id
+}
+
+// fragmentRef gets the reference to a spine document or an element in one,
+// returning false if the target is not a spine document.
+func (e *htmlExporter) fragmentRef(target, fragment string) (string, bool) {
+	a, ok := e.anchors[target]
+	if !ok {
+		return "", false
+	}
+	if fragment == "" {
+		return "#" + a, true
+	}
+	return "#" + e.id(target, fragment), true
+}
+
+// dataURI gets a data URI for a file, returning false if it could not be read.
+func (e *htmlExporter) dataURI(target string) (string, bool) {
+	if u, ok := e.data[target]; ok {
+		return u, u != ""
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(e.epubdir, filepath.FromSlash(target)))
+	if err != nil {
+		e.data[target] = ""
+		return "", false
+	}
+	var mt string
+	if it := e.pkg.ItemByPath(target); it != nil {
+		mt = it.MediaType
+	}
+	if mt == "" {
+		mt = SniffMediaType(target, buf)
+	}
+	u := "data:" + mt + ";base64," + base64.StdEncoding.EncodeToString(buf)
+	e.data[target] = u
+	return u, true
+}
+
+// rewriteCSS replaces url()s in CSS from the file at base (a stylesheet or
+// content document) with data URIs or references to sections.
+func (e *htmlExporter) rewriteCSS(base, str string) string {
+	var b strings.Builder
+	var last int
+	// the name is only used to parse the string as a stylesheet
+	for _, ref := range findReferences("export.css", str) {
+		target, fragment, ok := splitRef(base, ref.raw)
+		if !ok {
+			continue
+		}
+		nr, ok := e.fragmentRef(target, fragment)
+		if !ok && target != base {
+			if nr, ok = e.dataURI(target); ok && fragment != "" {
+				nr += "#" + fragment
+			}
+		}
+		if !ok {
+			continue
+		}
+		b.WriteString(str[last:ref.start])
+		b.WriteString(ref.escape(nr))
+		last = ref.end
+	}
+	b.WriteString(str[last:])
+	return b.String()
+}
+
+// rewriteNode updates the ids and references in a node from a spine document,
+// and removes scripts.
+func (e *htmlExporter) rewriteNode(docpath string, n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && c.DataAtom == atom.Script {
+			n.RemoveChild(c)
+		} else {
+			e.rewriteNode(docpath, c)
+		}
+		c = next
+	}
+	if n.Type != html.ElementNode {
+		return
+	}
+	if n.DataAtom == atom.Style {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				c.Data = e.rewriteCSS(docpath, c.Data)
+			}
+		}
+	}
+
+	attr := n.Attr[:0]
+	for _, a := range n.Attr {
+		switch key := a.Key; {
+		case key == "id" || (key == "name" && n.DataAtom == atom.A):
+			a.Val = e.id(docpath, a.Val)
+		case key == "href" || key == "src" || key == "poster" || key == "data":
+			target, fragment, ok := splitRef(docpath, a.Val)
+			if !ok {
+				break
+			}
+			if nr, ok := e.fragmentRef(target, fragment); ok {
+				a.Val = nr
+			} else if a.Namespace == "" && key == "href" && (n.DataAtom == atom.A || n.DataAtom == atom.Area) {
+				continue // links to files which aren't in the spine can't be followed
+			} else if nr, ok := e.dataURI(target); ok {
+				if a.Val = nr; fragment != "" {
+					a.Val += "#" + fragment
+				}
+			}
+		case key == "srcset":
+			continue // the src is used instead
+		case key == "usemap":
+			if strings.HasPrefix(a.Val, "#") {
+				a.Val = "#" + e.id(docpath, a.Val[1:])
+			}
+		case key == "style":
+			a.Val = e.rewriteCSS(docpath, a.Val)
+		case exportIDRefAttrs[key]:
+			ids := strings.Fields(a.Val)
+			for i, id := range ids {
+				ids[i] = e.id(docpath, id)
+			}
+			a.Val = strings.Join(ids, " ")
+		case n.Namespace == "svg":
+			a.Val = exportURLFragmentRe.ReplaceAllStringFunc(a.Val, func(s string) string {
+				return "url(#" + e.id(docpath, exportURLFragmentRe.FindStringSubmatch(s)[1]) + ")"
+			})
+		}
+		attr = append(attr, a)
+	}
+	n.Attr = attr
+}
+
+func exportText(docs []exportDoc, w io.Writer, md bool) error {
+	tw := &textWriter{md: md}
+	for _, d := range docs {
+		if body := util.FindElement(d.doc, atom.Body); body != nil {
+			tw.render(body)
+			tw.brk(2)
+		}
+	}
+	if tw.b.Len() != 0 {
+		tw.b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, tw.b.String())
+	return err
+}
+
+// textWriter renders content documents as plain text or Markdown.
+type textWriter struct {
+	md     bool
+	b      strings.Builder
+	prefix []string   // line prefixes for blockquotes and list items
+	marker string     // list item marker for the next line
+	lists  []textList // the lists the current element is in
+	breaks int        // pending line breaks
+	gap    []string   // the line prefixes when the pending line breaks started
+	space  bool       // pending space
+	bol    bool       // at the beginning of a line
+	pre    int        // depth of preformatted elements
+	code   int        // depth of code elements
+}
+
+type textList struct {
+	ordered bool
+	n       int
+}
+
+var (
+	mdEscaper    = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`, `<`, `\<`)
+	mdLineStart  = regexp.MustCompile(`^(?:[#>+=|~-]|(\d+)([.)]))`)
+	htmlSpaceSep = func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\f' || r == '\r'
+	}
+)
+
+// brk ends the current line, leaving n-1 blank lines before the next text.
+func (w *textWriter) brk(n int) {
+	if w.breaks == 0 {
+		w.gap = append(w.gap[:0], w.prefix...)
+	}
+	if w.breaks < n {
+		w.breaks = n
+	}
+	w.space = false
+}
+
+// write writes inline content, starting a new line first if needed.
+func (w *textWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	if w.b.Len() == 0 {
+		w.breaks, w.bol = 0, true
+	}
+	if w.breaks != 0 {
+		// blank lines only keep the prefixes common to both sides (so they
+		// don't continue a blockquote which just ended or started)
+		gap := w.gap
+		if len(gap) > len(w.prefix) {
+			gap = gap[:len(w.prefix)]
+		}
+		for i := range gap {
+			if gap[i] != w.prefix[i] {
+				gap = gap[:i]
+				break
+			}
+		}
+		w.b.WriteByte('\n')
+		for i := 1; i < w.breaks; i++ {
+			w.b.WriteString(strings.TrimRight(strings.Join(gap, ""), " "))
+			w.b.WriteByte('\n')
+		}
+		w.breaks, w.bol = 0, true
+	}
+	if w.bol {
+		if w.marker != "" {
+			w.b.WriteString(strings.Join(w.prefix[:len(w.prefix)-1], "") + w.marker)
+			w.marker = ""
+		} else {
+			w.b.WriteString(strings.Join(w.prefix, ""))
+		}
+		w.bol = false
+	} else if w.space {
+		w.b.WriteByte(' ')
+	}
+	w.space = false
+	w.b.WriteString(s)
+}
+
+// inline writes a closing Markdown marker directly after the current text.
+func (w *textWriter) inline(s string) {
+	if !w.bol && w.breaks == 0 && w.b.Len() != 0 {
+		w.b.WriteString(s)
+	}
+}
+
+// text writes text, collapsing whitespace outside preformatted elements.
+func (w *textWriter) text(s string) {
+	if w.pre != 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i != 0 {
+				w.brk(w.breaks + 1)
+			}
+			w.write(line)
+		}
+		return
+	}
+	words := strings.FieldsFunc(s, htmlSpaceSep)
+	if len(words) == 0 {
+		if s != "" {
+			w.space = true
+		}
+		return
+	}
+	if htmlSpaceSep(rune(s[0])) {
+		w.space = true
+	}
+	t := strings.Join(words, " ")
+	if w.md && w.code == 0 {
+		t = mdEscaper.Replace(t)
+		if w.bol || w.breaks != 0 || w.b.Len() == 0 {
+			if m := mdLineStart.FindStringSubmatchIndex(t); m != nil {
+				if m[2] != -1 {
+					t = t[:m[4]] + `\` + t[m[4]:]
+				} else {
+					t = `\` + t
+				}
+			}
+		}
+	}
+	w.write(t)
+	if htmlSpaceSep(rune(s[len(s)-1])) {
+		w.space = true
+	}
+}
+
+func (w *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.render(c)
+	}
+}
+
+func (w *textWriter) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		w.children(n)
+		return
+	}
+	if _, hidden := util.LookupAttr(n, "hidden"); hidden {
+		return
+	}
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Template, atom.Rp, atom.Rt:
+		return
+
+	case atom.Br:
+		if w.md && w.pre == 0 {
+			w.inline(`\`)
+		}
+		w.brk(1)
+
+	case atom.Hr:
+		w.brk(2)
+		w.write("* * *")
+		w.brk(2)
+
+	case atom.Img:
+		if alt, _ := util.LookupAttr(n, "alt"); strings.TrimSpace(alt) != "" {
+			w.text(alt)
+		}
+
+	case atom.Math:
+		if alt, _ := util.LookupAttr(n, "alttext"); strings.TrimSpace(alt) != "" {
+			w.text(alt)
+		} else {
+			w.children(n)
+		}
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.brk(2)
+		if w.md {
+			w.write(strings.Repeat("#", int(n.Data[1]-'0')))
+			w.space = true
+		}
+		w.children(n)
+		w.brk(2)
+
+	case atom.Ul, atom.Ol:
+		if len(w.lists) == 0 {
+			w.brk(2)
+		} else {
+			w.brk(1)
+		}
+		l := textList{ordered: n.DataAtom == atom.Ol, n: 1}
+		if s, ok := util.LookupAttr(n, "start"); ok {
+			if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+				l.n = v
+			}
+		}
+		w.lists = append(w.lists, l)
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		if len(w.lists) == 0 {
+			w.brk(2)
+		} else {
+			w.brk(1)
+		}
+
+	case atom.Li:
+		w.brk(1)
+		marker := "- "
+		if len(w.lists) != 0 && w.lists[len(w.lists)-1].ordered {
+			l := &w.lists[len(w.lists)-1]
+			marker = strconv.Itoa(l.n) + ". "
+			l.n++
+		}
+		w.marker = marker
+		w.prefix = append(w.prefix, strings.Repeat(" ", len(marker)))
+		w.children(n)
+		w.prefix = w.prefix[:len(w.prefix)-1]
+		w.marker = ""
+		w.brk(1)
+
+	case atom.Blockquote:
+		w.brk(2)
+		if w.md {
+			w.prefix = append(w.prefix, "> ")
+		} else {
+			w.prefix = append(w.prefix, "    ")
+		}
+		w.children(n)
+		w.brk(2)
+		w.prefix = w.prefix[:len(w.prefix)-1]
+
+	case atom.Pre:
+		w.brk(2)
+		if w.md {
+			w.write("```")
+			w.brk(1)
+		}
+		w.pre++
+		w.children(n)
+		w.pre--
+		if w.md {
+			w.brk(1)
+			w.write("```")
+		}
+		w.brk(2)
+
+	case atom.Em, atom.I, atom.Strong, atom.B, atom.Code:
+		var marker string
+		if w.md && w.pre == 0 && w.code == 0 && strings.TrimSpace(util.TextContent(n)) != "" {
+			switch n.DataAtom {
+			case atom.Em, atom.I:
+				marker = "*"
+			case atom.Strong, atom.B:
+				marker = "**"
+			case atom.Code:
+				marker = "`"
+			}
+		}
+		if n.DataAtom == atom.Code {
+			w.code++
+		}
+		w.write(marker)
+		w.children(n)
+		w.inline(marker)
+		if n.DataAtom == atom.Code {
+			w.code--
+		}
+
+	case atom.A:
+		href, _ := util.LookupAttr(n, "href")
+		if !w.md || w.pre != 0 || !RefSchemeRe.MatchString(href) || strings.TrimSpace(util.TextContent(n)) == "" {
+			w.children(n)
+			break
+		}
+		w.write("[")
+		w.children(n)
+		w.inline("](" + strings.NewReplacer(`(`, `%28`, `)`, `%29`, ` `, `%20`).Replace(href) + ")")
+
+	case atom.Td, atom.Th:
+		w.space = true
+		w.children(n)
+		w.space = true
+
+	case atom.Tr, atom.Dt, atom.Dd:
+		if w.md {
+			w.brk(2)
+		} else {
+			w.brk(1)
+		}
+		w.children(n)
+		if w.md {
+			w.brk(2)
+		} else {
+			w.brk(1)
+		}
+
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Aside, atom.Nav, atom.Header, atom.Footer, atom.Main,
+		atom.Figure, atom.Figcaption, atom.Address, atom.Table, atom.Caption, atom.Dl, atom.Details, atom.Summary,
+		atom.Fieldset, atom.Center:
+		w.brk(2)
+		w.children(n)
+		w.brk(2)
+
+	default:
+		w.children(n)
+	}
+}
@@ -0,0 +1,40 @@
+package epubtransform
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestExportText(t *testing.T) {
+	const doc = `<html><head><title>x</title><style>p{}</style></head><body>
+<h1>Title <i>One</i></h1>
+<p>Some   *text*
+with <em>emphasis</em>, <a href="https://example.com/">a link</a>,<br/>and a break.</p>
+<blockquote><p>Quote</p><p>1. Not a list</p></blockquote>
+<ol start="2"><li>Two<ul><li>Nested</li></ul></li><li>Three</li></ol>
+<pre>  code
+    block</pre>
+<script>var x;</script>
+</body></html>`
+
+	for _, c := range []struct {
+		md  bool
+		exp string
+	}{
+		{false, "Title One\n\nSome *text* with emphasis, a link,\nand a break.\n\n    Quote\n\n    1. Not a list\n\n2. Two\n   - Nested\n3. Three\n\n  code\n    block\n"},
+		{true, "# Title *One*\n\nSome \\*text\\* with *emphasis*, [a link](https://example.com/),\\\nand a break.\n\n> Quote\n>\n> 1\\. Not a list\n\n2. Two\n   - Nested\n3. Three\n\n```\n  code\n    block\n```\n"},
+	} {
+		n, err := html.Parse(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		if err := exportText([]exportDoc{{"OEBPS/ch1.xhtml", n}}, &b, c.md); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if b.String() != c.exp {
+			t.Errorf("md=%t: expected:\n%s\ngot:\n%s", c.md, c.exp, b.String())
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package epubtransform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/pgaskin/epubtool/util"
+)
+
+// Hyphenator finds hyphenation points in words using Liang's algorithm (the
+// one used by TeX).
+type Hyphenator struct {
+	patterns   map[string][]int // letters -> the values between them (including before and after)
+	exceptions map[string][]int // word -> the positions of the hyphens
+	maxLen     int
+}
+
+// ReadHyphenationPatterns reads TeX hyphenation patterns (e.g. from
+// hyph-utf8). Both plain pattern lists (one or more per line) and files with
+// \patterns{...} and \hyphenation{...} sections are supported. Comments start
+// with %.
+func ReadHyphenationPatterns(fn string) (*Hyphenator, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	h := &Hyphenator{
+		patterns:   map[string][]int{},
+		exceptions: map[string][]int{},
+	}
+	var exceptions bool
+	for i, line := range strings.Split(string(buf), "\n") {
+		if j := strings.IndexByte(line, '%'); j != -1 {
+			line = line[:j]
+		}
+		for _, f := range strings.Fields(line) {
+			switch {
+			case strings.HasPrefix(f, `\patterns{`):
+				exceptions, f = false, strings.TrimPrefix(f, `\patterns{`)
+			case strings.HasPrefix(f, `\hyphenation{`):
+				exceptions, f = true, strings.TrimPrefix(f, `\hyphenation{`)
+			case strings.HasPrefix(f, `\`):
+				return nil, fmt.Errorf("line %d: unsupported command %#v", i+1, f)
+			}
+			if f = strings.TrimSuffix(f, "}"); f == "" {
+				continue
+			}
+			if exceptions {
+				h.addException(f)
+			} else if err := h.addPattern(f); err != nil {
+				return nil, util.Wrap(err, "line %d", i+1)
+			}
+		}
+	}
+	if len(h.patterns) == 0 {
+		return nil, fmt.Errorf("no patterns found in %#v", fn)
+	}
+	return h, nil
+}
+
+func (h *Hyphenator) addPattern(p string) error {
+	var letters []rune
+	values := []int{0}
+	for _, r := range strings.ToLower(p) {
+		if r >= '0' && r <= '9' {
+			values[len(values)-1] = int(r - '0')
+			continue
+		}
+		if r != '.' && !unicode.IsLetter(r) && r != '\'' && r != '’' {
+			return fmt.Errorf("invalid pattern %#v", p)
+		}
+		letters = append(letters, r)
+		values = append(values, 0)
+	}
+	if len(letters) == 0 {
+		return fmt.Errorf("invalid pattern %#v", p)
+	}
+	h.patterns[string(letters)] = values
+	if len(letters) > h.maxLen {
+		h.maxLen = len(letters)
+	}
+	return nil
+}
+
+func (h *Hyphenator) addException(w string) {
+	var positions []int
+	var n int
+	for _, r := range strings.ToLower(w) {
+		if r == '-' {
+			positions = append(positions, n)
+		} else {
+			n++
+		}
+	}
+	h.exceptions[strings.Replace(strings.ToLower(w), "-", "", -1)] = positions
+}
+
+// Points returns the rune offsets in word where it can be hyphenated. There
+// are always at least two letters before the first hyphen and three after the
+// last one.
+func (h *Hyphenator) Points(word string) []int {
+	const leftMin, rightMin = 2, 3
+	lw := []rune(strings.ToLower(word))
+	if len(lw) < leftMin+rightMin {
+		return nil
+	}
+	if positions, ok := h.exceptions[string(lw)]; ok {
+		return positions
+	}
+
+	w := append(append([]rune{'.'}, lw...), '.')
+	values := make([]int, len(w)+1)
+	for i := range w {
+		for j := i + 1; j <= len(w) && j-i <= h.maxLen; j++ {
+			if p, ok := h.patterns[string(w[i:j])]; ok {
+				for k, v := range p {
+					if v > values[i+k] {
+						values[i+k] = v
+					}
+				}
+			}
+		}
+	}
+
+	// values[i+1] is between lw[i-1] and lw[i]
+	var points []int
+	for i := leftMin; i <= len(lw)-rightMin; i++ {
+		if values[i+1]%2 == 1 {
+			points = append(points, i)
+		}
+	}
+	return points
+}
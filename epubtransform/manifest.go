@@ -0,0 +1,245 @@
+package epubtransform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// TransformSyncManifest adds items to the manifest for the files in the epub
+// which are not listed in it (except for the ones excluded when packing). The
+// media types are detected from the contents of the files, and for EPUB 3, the
+// properties (e.g. scripted, svg, mathml, remote-resources, nav, and
+// cover-image) are detected.
+func TransformSyncManifest() Transform {
+	return Transform{
+		Desc: "sync manifest",
+		Raw: func(epubdir string) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			unlisted, err := UnlistedFiles(epubdir)
+			if err != nil {
+				return err
+			}
+			ig, err := PackIgnore(epubdir)
+			if err != nil {
+				return err
+			}
+
+			epub3 := strings.HasPrefix(pkg.Version, "3")
+			var hasNav, hasCover bool
+			for _, it := range pkg.Manifest {
+				hasNav = hasNav || it.HasProperty("nav")
+				hasCover = hasCover || it.HasProperty("cover-image")
+			}
+
+			var items []ManifestItem
+			for _, relpath := range unlisted {
+				if ig.Match(relpath, false) {
+					continue
+				}
+				buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(relpath)))
+				if err != nil {
+					return err
+				}
+				it := ManifestItem{
+					Href:      RelativeRef(pkg.Path, relpath, ""),
+					Path:      relpath,
+					MediaType: SniffMediaType(relpath, buf),
+				}
+				if epub3 {
+					var props []string
+					for _, p := range DetectProperties(it.MediaType, buf) {
+						if p == "nav" {
+							if hasNav {
+								continue // only one nav document is allowed
+							}
+							hasNav = true
+						}
+						props = append(props, p)
+					}
+					if !hasCover && strings.HasPrefix(it.MediaType, "image/") && strings.Contains(strings.ToLower(path.Base(relpath)), "cover") {
+						props = append(props, "cover-image")
+						hasCover = true
+					}
+					it.Properties = strings.Join(props, " ")
+				}
+				items = append(items, it)
+			}
+			if len(items) == 0 {
+				return nil
+			}
+
+			return transformOPFDoc(epubdir, func(opf *etree.Document) error {
+				me := opf.FindElement("//package/manifest")
+				if me == nil {
+					return errors.New("could not find package>manifest element")
+				}
+				ids := map[string]bool{}
+				for _, el := range opf.FindElements("//*[@id]") {
+					ids[el.SelectAttrValue("id", "")] = true
+				}
+				for _, it := range items {
+					el := etree.NewElement("item")
+					el.CreateAttr("id", manifestID(it.Path, ids))
+					el.CreateAttr("href", it.Href)
+					el.CreateAttr("media-type", it.MediaType)
+					if it.Properties != "" {
+						el.CreateAttr("properties", it.Properties)
+					}
+					insertChildIndented(me, el, nil)
+				}
+				return nil
+			})
+		},
+	}
+}
+
+var manifestIDInvalidRe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// manifestID generates a unique id from a file name.
+func manifestID(relpath string, ids map[string]bool) string {
+	base := strings.Trim(manifestIDInvalidRe.ReplaceAllString(path.Base(relpath), "_"), "_.-")
+	if base == "" || !(base[0] == '_' || (base[0] >= 'a' && base[0] <= 'z') || (base[0] >= 'A' && base[0] <= 'Z')) {
+		base = "id_" + base
+	}
+	id := base
+	for i := 2; ids[id]; i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	ids[id] = true
+	return id
+}
+
+var (
+	sniffXHTMLRe = regexp.MustCompile(`(?i)<html[\s>]`)
+	sniffRootRe  = regexp.MustCompile(`<([a-zA-Z][^\s/>]*:)?(svg|ncx|smil)[\s>]`)
+)
+
+// SniffMediaType detects the media type of a file from its contents, falling
+// back to the extension.
+func SniffMediaType(relpath string, buf []byte) string {
+	ext := strings.ToLower(path.Ext(relpath))
+
+	// signatures which http.DetectContentType doesn't know about (or gets
+	// wrong for epubs)
+	switch {
+	case bytes.HasPrefix(buf, []byte("OTTO")):
+		return "font/otf"
+	case bytes.HasPrefix(buf, []byte{0, 1, 0, 0}) || bytes.HasPrefix(buf, []byte("true")):
+		return "font/ttf"
+	case bytes.HasPrefix(buf, []byte("wOFF")):
+		return "font/woff"
+	case bytes.HasPrefix(buf, []byte("wOF2")):
+		return "font/woff2"
+	}
+
+	ct := http.DetectContentType(buf)
+	if i := strings.IndexByte(ct, ';'); i != -1 {
+		ct = ct[:i]
+	}
+	switch ct {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "audio/mpeg", "audio/mp4", "video/mp4", "video/webm", "audio/ogg", "application/ogg":
+		if ct == "application/ogg" {
+			ct = "audio/ogg"
+		}
+		return ct
+	case "text/xml", "text/html", "text/plain":
+		// text, so check the content (and fall back to the extension below)
+		head := buf
+		if len(head) > 4096 {
+			head = head[:4096]
+		}
+		if sniffXHTMLRe.Match(head) {
+			return "application/xhtml+xml"
+		}
+		if m := sniffRootRe.FindSubmatch(head); m != nil {
+			switch string(m[2]) {
+			case "svg":
+				return "image/svg+xml"
+			case "ncx":
+				return "application/x-dtbncx+xml"
+			case "smil":
+				return "application/smil+xml"
+			}
+		}
+	}
+
+	switch ext {
+	case ".xhtml", ".html", ".htm":
+		return "application/xhtml+xml"
+	case ".css":
+		return "text/css"
+	case ".js":
+		return "application/javascript"
+	case ".svg":
+		return "image/svg+xml"
+	case ".ncx":
+		return "application/x-dtbncx+xml"
+	case ".smil":
+		return "application/smil+xml"
+	case ".pls":
+		return "application/pls+xml"
+	case ".otf":
+		return "font/otf"
+	case ".ttf":
+		return "font/ttf"
+	}
+	if mt := mime.TypeByExtension(ext); mt != "" {
+		if i := strings.IndexByte(mt, ';'); i != -1 {
+			mt = mt[:i]
+		}
+		return mt
+	}
+	return "application/octet-stream"
+}
+
+var (
+	propScriptedRe = regexp.MustCompile(`(?i)<(?:[a-z]+:)?(?:script|form)[\s>/]|<[^>]*\son[a-z]+\s*=\s*["']`)
+	propSVGRe      = regexp.MustCompile(`<(?:[a-zA-Z]+:)?svg[\s>/]`)
+	propMathMLRe   = regexp.MustCompile(`<(?:[a-zA-Z]+:)?math[\s>/]`)
+	propRemoteRe   = regexp.MustCompile(`(?i)(?:\ssrc\s*=\s*["']|\sdata\s*=\s*["']|url\(\s*["']?|<link\s[^>]*href\s*=\s*["'])https?://`)
+	propNavRe      = regexp.MustCompile(`<nav\s[^>]*epub:type\s*=\s*["'][^"']*\btoc\b`)
+)
+
+// DetectProperties detects the EPUB 3 manifest item properties for a file.
+func DetectProperties(mediaType string, buf []byte) []string {
+	var props []string
+	switch mediaType {
+	case "application/xhtml+xml":
+		if propScriptedRe.Match(buf) {
+			props = append(props, "scripted")
+		}
+		if propSVGRe.Match(buf) {
+			props = append(props, "svg")
+		}
+		if propMathMLRe.Match(buf) {
+			props = append(props, "mathml")
+		}
+		if propRemoteRe.Match(buf) {
+			props = append(props, "remote-resources")
+		}
+		if propNavRe.Match(buf) {
+			props = append(props, "nav")
+		}
+	case "image/svg+xml":
+		if propScriptedRe.Match(buf) {
+			props = append(props, "scripted")
+		}
+		if propRemoteRe.Match(buf) {
+			props = append(props, "remote-resources")
+		}
+	}
+	return props
+}
@@ -0,0 +1,44 @@
+package epubtransform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSniffMediaType(t *testing.T) {
+	for _, c := range []struct {
+		relpath, content, mediaType, properties string
+	}{
+		{"a.bin", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "image/png", ""},
+		{"a.png", "\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg", ""},
+		{"a", "OTTO\x00\x0a", "font/otf", ""},
+		{"a.txt", `<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"><body><p>one = two</p></body></html>`, "application/xhtml+xml", ""},
+		{"a.xhtml", `<html><body onload="x()"><m:math/></body></html>`, "application/xhtml+xml", "scripted mathml"},
+		{"a.xhtml", `<html><body><img src="http://example.com/a.png"/></body></html>`, "application/xhtml+xml", "remote-resources"},
+		{"nav.xhtml", `<html><body><nav epub:type="toc"></nav></body></html>`, "application/xhtml+xml", "nav"},
+		{"a", `<svg xmlns="http://www.w3.org/2000/svg"><script/></svg>`, "image/svg+xml", "scripted"},
+		{"toc.ncx", `<?xml version="1.0"?><ncx xmlns="http://www.daisy.org/z3986/2005/ncx/"></ncx>`, "application/x-dtbncx+xml", ""},
+		{"a.css", `p { color: red }`, "text/css", ""},
+		{"a.unknown", "\x00\x01\x02", "application/octet-stream", ""},
+	} {
+		if mt := SniffMediaType(c.relpath, []byte(c.content)); mt != c.mediaType {
+			t.Errorf("%s (%q): expected media type %s, got %s", c.relpath, c.content, c.mediaType, mt)
+		} else if props := strings.Join(DetectProperties(mt, []byte(c.content)), " "); props != c.properties {
+			t.Errorf("%s (%q): expected properties %q, got %q", c.relpath, c.content, c.properties, props)
+		}
+	}
+}
+
+func TestManifestID(t *testing.T) {
+	ids := map[string]bool{"ch1.xhtml": true}
+	for _, c := range [][2]string{
+		{"text/ch1.xhtml", "ch1.xhtml-2"},
+		{"text/ch1.xhtml", "ch1.xhtml-3"},
+		{"images/1 cover.png", "id_1_cover.png"},
+		{"a/b/-x-.css", "x-.css"},
+	} {
+		if id := manifestID(c[0], ids); id != c[1] {
+			t.Errorf("%s: expected id %q, got %q", c[0], c[1], id)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package epubtransform
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// MergeOptions controls the metadata of the book created by Merge. Blank fields
+// are taken from the first book.
+type MergeOptions struct {
+	Title      string
+	Authors    []string
+	Language   string
+	Identifier string // default: derived from the identifiers of the books
+}
+
+// The layout of merged books.
+const (
+	mergeOPF = "OEBPS/content.opf"
+	mergeNav = "OEBPS/nav.xhtml"
+	mergeNCX = "OEBPS/toc.ncx"
+)
+
+// Merge combines books into one. The files of each book are put in their own
+// directory (book1, book2, and so on) next to the package document, the
+// manifests are merged, the spines are concatenated in order, and the table of
+// contents has a top-level entry for each book containing its original entries.
+// The metadata is copied from the first book. If any of the books have
+// obfuscated fonts, all fonts are obfuscated.
+func Merge(inputs []InputFunc, output OutputFunc, opts MergeOptions) error {
+	if len(inputs) < 2 {
+		return errors.New("at least two books are required")
+	}
+
+	td, err := ioutil.TempDir("", "epubmerge-*")
+	if err != nil {
+		return util.Wrap(err, "could not create temp dir")
+	}
+	defer os.RemoveAll(td)
+
+	pe := etree.NewElement("package")
+	pe.CreateAttr("xmlns", "http://www.idpf.org/2007/opf")
+	pe.CreateAttr("version", "3.0")
+	var md *etree.Element
+	mf, sp := etree.NewElement("manifest"), etree.NewElement("spine")
+	sp.CreateAttr("toc", "ncx")
+	for _, it := range [][4]string{
+		{"nav", mergeNav, "application/xhtml+xml", "nav"},
+		{"ncx", mergeNCX, "application/x-dtbncx+xml", ""},
+	} {
+		item := mf.CreateElement("item")
+		item.CreateAttr("id", it[0])
+		item.CreateAttr("href", RelativeRef(mergeOPF, it[1], ""))
+		item.CreateAttr("media-type", it[2])
+		if it[3] != "" {
+			item.CreateAttr("properties", it[3])
+		}
+	}
+
+	var toc []TOCEntry
+	var uids []string
+	var alg string
+	for i, input := range inputs {
+		ns := fmt.Sprintf("book%d", i+1)
+		if err := New(Transform{
+			Desc: "add " + ns,
+			Raw: func(epubdir string) error {
+				pkg, err := ReadPackage(epubdir)
+				if err != nil {
+					return err
+				}
+				btoc, err := ReadTOC(epubdir, pkg)
+				if err != nil {
+					return err
+				}
+				src := etree.NewDocument()
+				if err := src.ReadFromFile(filepath.Join(epubdir, filepath.FromSlash(pkg.Path))); err != nil {
+					return util.Wrap(err, "could not parse opf")
+				}
+				uids = append(uids, pkg.UniqueIdentifier)
+
+				if files, err := obfuscatedFiles(epubdir); err != nil {
+					return err
+				} else if alg == "" {
+					for _, a := range files {
+						if alg = a; a == ObfuscationIDPF {
+							break
+						}
+					}
+				}
+
+				// keep the layout if everything is next to the package document
+				prefix := path.Dir(pkg.Path) + "/"
+				if prefix == "./" {
+					prefix = ""
+				}
+				for _, it := range pkg.Manifest {
+					if !strings.HasPrefix(it.Path, prefix) {
+						prefix = ""
+						break
+					}
+				}
+				dest := func(relpath string) string {
+					return path.Join(path.Dir(mergeOPF), ns, strings.TrimPrefix(relpath, prefix))
+				}
+
+				spine := map[string]bool{}
+				for _, id := range pkg.Spine {
+					spine[id] = true
+				}
+				ids := map[string]string{}
+				for _, it := range pkg.Manifest {
+					if it.MediaType == "application/x-dtbncx+xml" || (it.HasProperty("nav") && !spine[it.ID]) {
+						continue // replaced by the merged ones
+					}
+					fn := filepath.Join(td, filepath.FromSlash(dest(it.Path)))
+					if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+						return err
+					}
+					if err := util.CopyFile(filepath.Join(epubdir, filepath.FromSlash(it.Path)), fn); os.IsNotExist(err) {
+						continue
+					} else if err != nil {
+						return util.Wrap(err, "copy %#v", it.Path)
+					}
+					ids[it.ID] = ns + "-" + it.ID
+				}
+
+				for _, el := range src.FindElements("//package/manifest/item") {
+					id, ok := ids[el.SelectAttrValue("id", "")]
+					if !ok {
+						continue
+					}
+					item := mf.CreateElement("item")
+					item.CreateAttr("id", id)
+					item.CreateAttr("href", RelativeRef(mergeOPF, dest(resolveHref(pkg.Path, el.SelectAttrValue("href", ""))), ""))
+					item.CreateAttr("media-type", el.SelectAttrValue("media-type", ""))
+					var props []string
+					for _, p := range strings.Fields(el.SelectAttrValue("properties", "")) {
+						if p != "nav" && (p != "cover-image" || i == 0) {
+							props = append(props, p)
+						}
+					}
+					if len(props) != 0 {
+						item.CreateAttr("properties", strings.Join(props, " "))
+					}
+					for _, attr := range []string{"fallback", "fallback-style", "media-overlay"} {
+						if ref, ok := ids[el.SelectAttrValue(attr, "")]; ok {
+							item.CreateAttr(attr, ref)
+						}
+					}
+				}
+
+				var first string
+				for _, el := range src.FindElements("//package/spine/itemref") {
+					id, ok := ids[el.SelectAttrValue("idref", "")]
+					if !ok {
+						continue
+					}
+					ir := sp.CreateElement("itemref")
+					ir.CreateAttr("idref", id)
+					for _, attr := range []string{"linear", "properties"} {
+						if v := el.SelectAttrValue(attr, ""); v != "" {
+							ir.CreateAttr(attr, v)
+						}
+					}
+					if first == "" {
+						first = dest(pkg.Item(el.SelectAttrValue("idref", "")).Path)
+					}
+				}
+
+				e := TOCEntry{Title: pkg.Title, Path: first, Children: mapTOC(btoc, dest)}
+				if e.Title == "" {
+					e.Title = fmt.Sprintf("Book %d", i+1)
+				}
+				toc = append(toc, e)
+
+				if i == 0 {
+					if el := src.FindElement("//package/spine"); el != nil {
+						if ppd := el.SelectAttrValue("page-progression-direction", ""); ppd != "" {
+							sp.CreateAttr("page-progression-direction", ppd)
+						}
+					}
+					if el := src.FindElement("//package"); el != nil {
+						for _, a := range el.Attr {
+							if a.Space == "xmlns" || a.Space == "xml" || a.Key == "prefix" || a.Key == "dir" || a.Key == "unique-identifier" {
+								pe.CreateAttr(a.FullKey(), a.Value)
+							}
+						}
+					}
+					if sm := src.FindElement("//package/metadata"); sm != nil {
+						md = sm.Copy()
+					} else {
+						md = etree.NewElement("metadata")
+					}
+					for _, el := range md.SelectElements("meta") {
+						if el.SelectAttrValue("name", "") == "cover" {
+							if id, ok := ids[el.SelectAttrValue("content", "")]; ok {
+								el.CreateAttr("content", id)
+							} else {
+								md.RemoveChild(el)
+							}
+						}
+					}
+				}
+				return nil
+			},
+		}).Run(input, nil, false); err != nil {
+			return util.Wrap(err, "book %d", i+1)
+		}
+	}
+
+	if md.SelectAttr("xmlns:dc") == nil && pe.SelectAttr("xmlns:dc") == nil {
+		md.CreateAttr("xmlns:dc", "http://purl.org/dc/elements/1.1/")
+	}
+	if opts.Title != "" {
+		setMetadataElements(md, "title", []string{opts.Title})
+	}
+	if len(opts.Authors) != 0 {
+		setMetadataElements(md, "creator", opts.Authors)
+	}
+	if opts.Language != "" {
+		setMetadataElements(md, "language", []string{opts.Language})
+	}
+	pe.AddChild(md)
+	pe.AddChild(mf)
+	pe.AddChild(sp)
+
+	opf := etree.NewDocument()
+	opf.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	opf.AddChild(pe)
+	opf.Indent(2)
+	if err := opf.WriteToFile(filepath.Join(td, filepath.FromSlash(mergeOPF))); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, "mimetype"), []byte("application/epub+zip"), 0644); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(td, "META-INF"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, "META-INF", "container.xml"), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="`+mergeOPF+`" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`), 0644); err != nil {
+		return err
+	}
+
+	pkg, err := ReadPackage(td)
+	if err != nil {
+		return err
+	}
+	id := opts.Identifier
+	if id == "" {
+		id = derivedIdentifier(append([]string{"merge"}, uids...)...)
+	}
+	nav := Nav{
+		Title:      pkg.Title,
+		Language:   pkg.Language,
+		Identifier: id,
+		Authors:    pkg.Creators,
+		TOC:        toc,
+	}
+	if err := WriteNav(td, mergeNav, nav); err != nil {
+		return err
+	}
+	if err := WriteNCX(td, mergeNCX, nav); err != nil {
+		return err
+	}
+
+	transforms := []Transform{TransformIdentifier(id)}
+	if alg != "" {
+		transforms = append(transforms, TransformObfuscateFonts(alg))
+	}
+	return New(transforms...).Run(DirInput(td), output, false)
+}
+
+// mapTOC changes the paths in a table of contents.
+func mapTOC(toc []TOCEntry, fn func(string) string) []TOCEntry {
+	var res []TOCEntry
+	for _, e := range toc {
+		if e.Path != "" {
+			e.Path = fn(e.Path)
+		}
+		e.Children = mapTOC(e.Children, fn)
+		res = append(res, e)
+	}
+	return res
+}
+
+// setMetadataElements replaces the dc elements with the specified tag, along
+// with the meta elements refining them.
+func setMetadataElements(md *etree.Element, tag string, values []string) {
+	var pos *etree.Element
+	refined := map[string]bool{}
+	for _, el := range md.SelectElements(tag) {
+		if id := el.SelectAttrValue("id", ""); id != "" {
+			refined["#"+id] = true
+		}
+		if pos == nil {
+			pos = el
+			continue
+		}
+		removeElement(el)
+	}
+	for _, el := range md.SelectElements("meta") {
+		if refined[el.SelectAttrValue("refines", "")] {
+			removeElement(el)
+		}
+	}
+	for _, v := range values {
+		el := etree.NewElement("dc:" + tag)
+		el.SetText(v)
+		if pos != nil {
+			md.InsertChild(pos, el)
+		} else {
+			md.AddChild(el)
+		}
+	}
+	if pos != nil {
+		removeElement(pos)
+	}
+}
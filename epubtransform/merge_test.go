@@ -0,0 +1,227 @@
+package epubtransform
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/beevik/etree"
+)
+
+func TestSetMetadataElements(t *testing.T) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(`<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` +
+		`<dc:title>Title</dc:title>` +
+		`<dc:creator id="c1">One</dc:creator>` +
+		`<meta refines="#c1" property="role">aut</meta>` +
+		`<dc:creator>Two</dc:creator>` +
+		`<dc:language>en</dc:language>` +
+		`</metadata>`); err != nil {
+		panic(err)
+	}
+	setMetadataElements(doc.Root(), "creator", []string{"A", "B"})
+	setMetadataElements(doc.Root(), "publisher", []string{"P"})
+
+	exp := `<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` +
+		`<dc:title>Title</dc:title>` +
+		`<dc:creator>A</dc:creator>` +
+		`<dc:creator>B</dc:creator>` +
+		`<dc:language>en</dc:language>` +
+		`<dc:publisher>P</dc:publisher>` +
+		`</metadata>`
+	if res, err := doc.WriteToString(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if res != exp {
+		t.Errorf("expected %s, got %s", exp, res)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	font := append([]byte{0, 1, 0, 0}, bytes.Repeat([]byte("font"), 500)...)
+	obfuscated := append([]byte(nil), font...)
+	key, n, err := obfuscationKey(ObfuscationIDPF, &Package{UniqueIdentifier: "urn:uuid:b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obfuscate(obfuscated, key, n)
+
+	writeTestFiles(t, filepath.Join(td, "a"), map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:a</dc:identifier>
+    <dc:title>Book A</dc:title>
+    <dc:language>en</dc:language>
+    <meta name="cover" content="cover"/>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="cover" href="images/cover.png" media-type="image/png" properties="cover-image"/>
+    <item id="ch1" href="text/a.xhtml" media-type="application/xhtml+xml"/>
+    <item id="alt" href="text/a.xml" media-type="application/x-custom" fallback="ch1"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`,
+		"OEBPS/nav.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>Nav</title></head><body>
+<nav epub:type="toc"><ol><li><a href="text/a.xhtml">Chapter A</a><ol><li><a href="text/a.xhtml#s1">Section A1</a></li></ol></li></ol></nav>
+</body></html>`,
+		"OEBPS/images/cover.png": "png",
+		"OEBPS/text/a.xhtml":     `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>A</title></head><body><p>A</p><p id="s1">A1</p></body></html>`,
+		"OEBPS/text/a.xml":       `<x/>`,
+	})
+	writeTestFiles(t, filepath.Join(td, "b"), map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": testContainer("content.opf"),
+		"META-INF/encryption.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <enc:CipherData><enc:CipherReference URI="fonts/f.ttf"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`,
+		"content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:b</dc:identifier>
+    <dc:title>Book B</dc:title>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="ch1" href="ch.xhtml" media-type="application/xhtml+xml"/>
+    <item id="font" href="fonts/f.ttf" media-type="font/ttf"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="ch1" linear="yes"/>
+  </spine>
+</package>`,
+		"toc.ncx": `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1"><navMap>
+<navPoint id="p1" playOrder="1"><navLabel><text>Chapter B</text></navLabel><content src="ch.xhtml"/></navPoint>
+</navMap></ncx>`,
+		"ch.xhtml":    `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>B</title></head><body><p>B</p></body></html>`,
+		"fonts/f.ttf": string(obfuscated),
+	})
+
+	out := filepath.Join(td, "out")
+	if err := Merge([]InputFunc{DirInput(filepath.Join(td, "a")), DirInput(filepath.Join(td, "b"))}, DirOutput(out), MergeOptions{
+		Title:      "Omnibus",
+		Identifier: "urn:uuid:merged",
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pkg, err := ReadPackage(out)
+	if err != nil {
+		t.Fatalf("read merged package: %v", err)
+	}
+	if pkg.Title != "Omnibus" || pkg.Language != "en" || pkg.UniqueIdentifier != "urn:uuid:merged" {
+		t.Errorf("unexpected metadata: title=%q language=%q identifier=%q", pkg.Title, pkg.Language, pkg.UniqueIdentifier)
+	}
+	if exp := []ManifestItem{
+		{ID: "nav", Href: "nav.xhtml", Path: "OEBPS/nav.xhtml", MediaType: "application/xhtml+xml", Properties: "nav"},
+		{ID: "ncx", Href: "toc.ncx", Path: "OEBPS/toc.ncx", MediaType: "application/x-dtbncx+xml"},
+		{ID: "book1-cover", Href: "book1/images/cover.png", Path: "OEBPS/book1/images/cover.png", MediaType: "image/png", Properties: "cover-image"},
+		{ID: "book1-ch1", Href: "book1/text/a.xhtml", Path: "OEBPS/book1/text/a.xhtml", MediaType: "application/xhtml+xml"},
+		{ID: "book1-alt", Href: "book1/text/a.xml", Path: "OEBPS/book1/text/a.xml", MediaType: "application/x-custom"},
+		{ID: "book2-ch1", Href: "book2/ch.xhtml", Path: "OEBPS/book2/ch.xhtml", MediaType: "application/xhtml+xml"},
+		{ID: "book2-font", Href: "book2/fonts/f.ttf", Path: "OEBPS/book2/fonts/f.ttf", MediaType: "font/ttf"},
+	}; !reflect.DeepEqual(pkg.Manifest, exp) {
+		t.Errorf("expected manifest %+v, got %+v", exp, pkg.Manifest)
+	}
+	if exp := []string{"book1-ch1", "book2-ch1"}; !reflect.DeepEqual(pkg.Spine, exp) {
+		t.Errorf("expected spine %q, got %q", exp, pkg.Spine)
+	}
+
+	opf := etree.NewDocument()
+	if err := opf.ReadFromFile(filepath.Join(out, "OEBPS", "content.opf")); err != nil {
+		t.Fatal(err)
+	}
+	if el := opf.FindElement("//manifest/item[@id='book1-alt']"); el == nil || el.SelectAttrValue("fallback", "") != "book1-ch1" {
+		t.Errorf("expected fallback to be remapped to book1-ch1")
+	}
+	if el := opf.FindElement("//metadata/meta[@name='cover']"); el == nil || el.SelectAttrValue("content", "") != "book1-cover" {
+		t.Errorf("expected cover meta to be remapped to book1-cover")
+	}
+	if el := opf.FindElement("//spine/itemref[@idref='book2-ch1']"); el == nil || el.SelectAttrValue("linear", "") != "yes" {
+		t.Errorf("expected itemref attributes to be kept")
+	}
+
+	for _, fn := range []string{"OEBPS/nav.xhtml", "OEBPS/toc.ncx"} {
+		var toc []TOCEntry
+		if fn == "OEBPS/nav.xhtml" {
+			toc, err = readNavTOC(out, fn)
+		} else {
+			toc, err = readNCXTOC(out, fn)
+		}
+		if err != nil {
+			t.Fatalf("read %s: %v", fn, err)
+		}
+		if exp := []TOCEntry{
+			{Title: "Book A", Path: "OEBPS/book1/text/a.xhtml", Children: []TOCEntry{
+				{Title: "Chapter A", Path: "OEBPS/book1/text/a.xhtml", Children: []TOCEntry{
+					{Title: "Section A1", Path: "OEBPS/book1/text/a.xhtml", Fragment: "s1"},
+				}},
+			}},
+			{Title: "Book B", Path: "OEBPS/book2/ch.xhtml", Children: []TOCEntry{
+				{Title: "Chapter B", Path: "OEBPS/book2/ch.xhtml"},
+			}},
+		}; !reflect.DeepEqual(toc, exp) {
+			t.Errorf("%s: expected toc %+v, got %+v", fn, exp, toc)
+		}
+	}
+
+	if files, err := obfuscatedFiles(out); err != nil {
+		t.Errorf("read encryption.xml: %v", err)
+	} else if exp := map[string]string{"OEBPS/book2/fonts/f.ttf": ObfuscationIDPF}; !reflect.DeepEqual(files, exp) {
+		t.Errorf("expected obfuscated files %v, got %v", exp, files)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(out, "OEBPS", "book2", "fonts", "f.ttf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, n, err = obfuscationKey(ObfuscationIDPF, pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obfuscate(buf, key, n); !bytes.Equal(buf, font) {
+		t.Errorf("expected font to be obfuscated with the new identifier")
+	}
+}
+
+// writeTestFiles writes files (slash-separated paths relative to dir).
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for relpath, contents := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(relpath))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testContainer returns a container.xml pointing to the specified OPF.
+func testContainer(opf string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="` + opf + `" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+}
@@ -0,0 +1,277 @@
+package epubtransform
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// Font obfuscation algorithms.
+const (
+	ObfuscationIDPF  = "http://www.idpf.org/2008/embedding"
+	ObfuscationAdobe = "http://ns.adobe.com/pdf/enc#RC"
+)
+
+// ObfuscationAlgorithms are the names of the supported font obfuscation
+// algorithms.
+var ObfuscationAlgorithms = map[string]string{
+	"idpf":  ObfuscationIDPF,
+	"adobe": ObfuscationAdobe,
+}
+
+// The pipeline de-obfuscates the fonts listed in META-INF/encryption.xml after
+// the input is opened, and obfuscates the fonts listed in it (using the current
+// identifier) before the output is written. This means transforms always see
+// plain fonts, and only need to update encryption.xml to change which fonts are
+// obfuscated.
+
+// obfuscatedFiles returns the slash-separated paths relative to the epub root
+// of the files obfuscated with a supported algorithm, and the algorithm for
+// each.
+func obfuscatedFiles(epubdir string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(epubdir, "META-INF", "encryption.xml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return nil, util.Wrap(err, "parse encryption.xml")
+	}
+
+	files := map[string]string{}
+	for _, el := range doc.FindElements("//EncryptedData") {
+		em, cr := el.FindElement("EncryptionMethod"), el.FindElement(".//CipherReference")
+		if em == nil || cr == nil {
+			continue
+		}
+		switch alg := em.SelectAttrValue("Algorithm", ""); alg {
+		case ObfuscationIDPF, ObfuscationAdobe:
+			if target, _, ok := splitRef("", cr.SelectAttrValue("URI", "")); ok {
+				files[target] = alg
+			}
+		}
+	}
+	return files, nil
+}
+
+// obfuscationKey gets the key for an obfuscation algorithm from the package
+// identifiers.
+func obfuscationKey(alg string, pkg *Package) ([]byte, int, error) {
+	switch alg {
+	case ObfuscationIDPF:
+		if pkg.UniqueIdentifier == "" {
+			return nil, 0, errors.New("no unique identifier for idpf font obfuscation")
+		}
+		key := sha1.Sum([]byte(strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, pkg.UniqueIdentifier)))
+		return key[:], 1040, nil
+	case ObfuscationAdobe:
+		for _, id := range append([]string{pkg.UniqueIdentifier}, pkg.Identifiers...) {
+			if key, ok := parseUUID(id); ok {
+				return key, 1024, nil
+			}
+		}
+		return nil, 0, errors.New("no uuid identifier for adobe font obfuscation")
+	}
+	return nil, 0, fmt.Errorf("unsupported obfuscation algorithm %#v", alg)
+}
+
+// parseUUID parses a UUID, optionally prefixed with urn:uuid:.
+func parseUUID(s string) ([]byte, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) > 9 && strings.EqualFold(s[:9], "urn:uuid:") {
+		s = s[9:]
+	}
+	s = strings.Replace(s, "-", "", -1)
+	if len(s) != 32 {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// obfuscate XORs the first n bytes of buf with the key (this is its own
+// inverse).
+func obfuscate(buf, key []byte, n int) {
+	for i := 0; i < n && i < len(buf); i++ {
+		buf[i] ^= key[i%len(key)]
+	}
+}
+
+// isFontData checks if buf starts with a known font signature.
+func isFontData(buf []byte) bool {
+	for _, sig := range [][]byte{{0, 1, 0, 0}, []byte("OTTO"), []byte("true"), []byte("ttcf"), []byte("wOFF"), []byte("wOF2")} {
+		if bytes.HasPrefix(buf, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// deobfuscateFonts de-obfuscates the fonts listed in encryption.xml. The
+// returned files were not de-obfuscated since they weren't actually obfuscated
+// (or were obfuscated with a different key), and should be left as-is when
+// re-obfuscating.
+func deobfuscateFonts(epubdir string) (map[string]bool, error) {
+	files, err := obfuscatedFiles(epubdir)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for relpath, alg := range files {
+		file := filepath.Join(epubdir, filepath.FromSlash(relpath))
+		buf, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if isFontData(buf) {
+			skip[relpath] = true
+			continue
+		}
+		key, n, err := obfuscationKey(alg, pkg)
+		if err != nil {
+			skip[relpath] = true
+			continue
+		}
+		obfuscate(buf, key, n)
+		if !isFontData(buf) {
+			skip[relpath] = true
+			continue
+		}
+		if err := ioutil.WriteFile(file, buf, 0644); err != nil {
+			return nil, util.Wrap(err, "write %#v", relpath)
+		}
+	}
+	return skip, nil
+}
+
+// obfuscateFonts obfuscates the fonts listed in encryption.xml using the current
+// identifier, except for the skipped ones.
+func obfuscateFonts(epubdir string, skip map[string]bool) error {
+	files, err := obfuscatedFiles(epubdir)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return err
+	}
+	for relpath, alg := range files {
+		if skip[relpath] {
+			continue
+		}
+		file := filepath.Join(epubdir, filepath.FromSlash(relpath))
+		buf, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		key, n, err := obfuscationKey(alg, pkg)
+		if err != nil {
+			return util.Wrap(err, "obfuscate %#v", relpath)
+		}
+		obfuscate(buf, key, n)
+		if err := ioutil.WriteFile(file, buf, 0644); err != nil {
+			return util.Wrap(err, "write %#v", relpath)
+		}
+	}
+	return nil
+}
+
+// TransformObfuscateFonts obfuscates all fonts in the manifest using the
+// specified algorithm (see ObfuscationAlgorithms) when the epub is written. If
+// the algorithm is empty, font obfuscation is removed instead. Fonts which were
+// listed in encryption.xml but weren't de-obfuscated (e.g. since they were
+// already plain) are obfuscated too.
+func TransformObfuscateFonts(alg string) Transform {
+	desc := "remove font obfuscation"
+	if alg != "" {
+		desc = "obfuscate fonts"
+	}
+	return Transform{
+		Desc: desc,
+		fonts: func(epubdir string, skip map[string]bool) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			if alg != "" {
+				if _, _, err := obfuscationKey(alg, pkg); err != nil {
+					return err
+				}
+			}
+
+			fn := filepath.Join(epubdir, "META-INF", "encryption.xml")
+			doc := etree.NewDocument()
+			if err := doc.ReadFromFile(fn); os.IsNotExist(err) {
+				if alg == "" {
+					return nil
+				}
+				doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+				doc.CreateElement("encryption").CreateAttr("xmlns", "urn:oasis:names:tc:opendocument:xmlns:container")
+			} else if err != nil {
+				return util.Wrap(err, "parse encryption.xml")
+			}
+			root := doc.Root()
+			if root == nil {
+				return errors.New("parse encryption.xml: no root element")
+			}
+
+			// remove the existing obfuscation
+			for _, el := range doc.FindElements("//EncryptedData") {
+				if em := el.FindElement("EncryptionMethod"); em != nil {
+					switch em.SelectAttrValue("Algorithm", "") {
+					case ObfuscationIDPF, ObfuscationAdobe:
+						removeElement(el)
+					}
+				}
+			}
+
+			if alg != "" {
+				for _, it := range pkg.Manifest {
+					if !isFont(it) {
+						continue
+					}
+					ed := root.CreateElement("EncryptedData")
+					ed.CreateAttr("xmlns", "http://www.w3.org/2001/04/xmlenc#")
+					ed.CreateElement("EncryptionMethod").CreateAttr("Algorithm", alg)
+					ed.CreateElement("CipherData").CreateElement("CipherReference").CreateAttr("URI", RelativeRef("", it.Path, ""))
+					delete(skip, it.Path)
+				}
+			}
+
+			if len(root.ChildElements()) == 0 {
+				return os.Remove(fn)
+			}
+			doc.Indent(2)
+			return doc.WriteToFile(fn)
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package epubtransform
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestObfuscationKey(t *testing.T) {
+	pkg := &Package{
+		UniqueIdentifier: " urn:uuid:12345678-1234-1234-1234-123456789abc\n",
+		Identifiers:      []string{"isbn:9780000000000", "urn:uuid:12345678-1234-1234-1234-123456789abc"},
+	}
+
+	key, n, err := obfuscationKey(ObfuscationIDPF, pkg)
+	if err != nil {
+		t.Fatalf("idpf: unexpected error: %v", err)
+	}
+	if n != 1040 || len(key) != 20 {
+		t.Errorf("idpf: expected 20 byte key for 1040 bytes, got %d for %d", len(key), n)
+	}
+	key2, _, _ := obfuscationKey(ObfuscationIDPF, &Package{UniqueIdentifier: "urn:uuid:12345678-1234-1234-1234-123456789abc"})
+	if !bytes.Equal(key, key2) {
+		t.Errorf("idpf: expected whitespace to be ignored")
+	}
+
+	key, n, err = obfuscationKey(ObfuscationAdobe, pkg)
+	if err != nil {
+		t.Fatalf("adobe: unexpected error: %v", err)
+	}
+	if n != 1024 || !bytes.Equal(key, []byte{0x12, 0x34, 0x56, 0x78, 0x12, 0x34, 0x12, 0x34, 0x12, 0x34, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}) {
+		t.Errorf("adobe: incorrect key %x for %d bytes", key, n)
+	}
+	if _, _, err := obfuscationKey(ObfuscationAdobe, &Package{UniqueIdentifier: "isbn:9780000000000"}); err == nil {
+		t.Errorf("adobe: expected error without uuid identifier")
+	}
+
+	font := append([]byte{0, 1, 0, 0}, bytes.Repeat([]byte{0xAA}, 2000)...)
+	buf := append([]byte(nil), font...)
+	obfuscate(buf, key, n)
+	if isFontData(buf) || !bytes.Equal(buf[n:], font[n:]) {
+		t.Errorf("expected only the first %d bytes to be obfuscated", n)
+	}
+	obfuscate(buf, key, n)
+	if !bytes.Equal(buf, font) {
+		t.Errorf("expected obfuscation to be reversible")
+	}
+}
+
+func TestTransformObfuscateFonts(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	font := append([]byte{0, 1, 0, 0}, bytes.Repeat([]byte("font"), 500)...)
+	key, n, err := obfuscationKey(ObfuscationIDPF, &Package{UniqueIdentifier: "urn:uuid:a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obfuscated := append([]byte(nil), font...)
+	obfuscate(obfuscated, key, n)
+
+	in, out := filepath.Join(td, "in"), filepath.Join(td, "out")
+	writeTestFiles(t, in, map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": testContainer("content.opf"),
+		"META-INF/encryption.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <enc:CipherData><enc:CipherReference URI="fonts/plain.ttf"/></enc:CipherData>
+  </enc:EncryptedData>
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <enc:CipherData><enc:CipherReference URI="fonts/obfuscated.ttf"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`,
+		"content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:a</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="plain" href="fonts/plain.ttf" media-type="font/ttf"/>
+    <item id="obfuscated" href="fonts/obfuscated.ttf" media-type="font/ttf"/>
+    <item id="new" href="fonts/new.ttf" media-type="font/ttf"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`,
+		"ch1.xhtml":            `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Test</title></head><body><p>a</p></body></html>`,
+		"fonts/plain.ttf":      string(font),
+		"fonts/obfuscated.ttf": string(obfuscated),
+		"fonts/new.ttf":        string(font),
+	})
+
+	if err := New(TransformObfuscateFonts(ObfuscationIDPF)).Run(DirInput(in), DirOutput(out), false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if files, err := obfuscatedFiles(out); err != nil {
+		t.Errorf("read encryption.xml: %v", err)
+	} else if exp := map[string]string{"fonts/plain.ttf": ObfuscationIDPF, "fonts/obfuscated.ttf": ObfuscationIDPF, "fonts/new.ttf": ObfuscationIDPF}; !reflect.DeepEqual(files, exp) {
+		t.Errorf("expected obfuscated files %v, got %v", exp, files)
+	}
+	for _, fn := range []string{"plain.ttf", "obfuscated.ttf", "new.ttf"} {
+		buf, err := ioutil.ReadFile(filepath.Join(out, "fonts", fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obfuscate(buf, key, n); !bytes.Equal(buf, font) {
+			t.Errorf("%s: expected font to be obfuscated", fn)
+		}
+	}
+}
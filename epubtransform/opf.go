@@ -0,0 +1,235 @@
+package epubtransform
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// Package contains information about the OPF document of an unpacked epub.
+type Package struct {
+	Path             string // the slash-separated path to the OPF document relative to the epub root
+	Version          string
+	UniqueIdentifier string
+	Identifiers      []string // all dc:identifier values, in order
+	Title            string   // the first dc:title
+	Language         string   // the first dc:language
+	Creators         []string // all dc:creator values, in order
+	Manifest         []ManifestItem
+	Spine            []string // manifest item ids
+}
+
+// ManifestItem is an item from the OPF manifest.
+type ManifestItem struct {
+	ID         string
+	Href       string // as written in the OPF document
+	Path       string // the slash-separated path relative to the epub root
+	MediaType  string
+	Properties string
+}
+
+// ReadPackage reads the OPF document of an unpacked epub.
+func ReadPackage(epubdir string) (*Package, error) {
+	op, err := getOPFPath(epubdir)
+	if err != nil {
+		return nil, util.Wrap(err, "could not get opf path")
+	}
+
+	opf := etree.NewDocument()
+	if err := opf.ReadFromFile(op); err != nil {
+		return nil, util.Wrap(err, "could not parse opf")
+	}
+
+	rel, err := filepath.Rel(epubdir, op)
+	if err != nil {
+		return nil, err
+	}
+	return parsePackage(filepath.ToSlash(rel), opf)
+}
+
+func parsePackage(opfPath string, opf *etree.Document) (*Package, error) {
+	pe := opf.FindElement("//package")
+	if pe == nil {
+		return nil, errors.New("could not find package element")
+	}
+
+	pkg := &Package{
+		Path:    opfPath,
+		Version: pe.SelectAttrValue("version", ""),
+	}
+
+	uid := pe.SelectAttrValue("unique-identifier", "")
+	for _, el := range opf.FindElements("//package/metadata/identifier") {
+		id := strings.TrimSpace(el.Text())
+		if uid != "" && el.SelectAttrValue("id", "") == uid && pkg.UniqueIdentifier == "" {
+			pkg.UniqueIdentifier = id
+		}
+		pkg.Identifiers = append(pkg.Identifiers, id)
+	}
+	if el := opf.FindElement("//package/metadata/title"); el != nil {
+		pkg.Title = strings.TrimSpace(el.Text())
+	}
+	if el := opf.FindElement("//package/metadata/language"); el != nil {
+		pkg.Language = strings.TrimSpace(el.Text())
+	}
+	for _, el := range opf.FindElements("//package/metadata/creator") {
+		pkg.Creators = append(pkg.Creators, strings.TrimSpace(el.Text()))
+	}
+
+	for _, el := range opf.FindElements("//package/manifest/item") {
+		href := el.SelectAttrValue("href", "")
+		pkg.Manifest = append(pkg.Manifest, ManifestItem{
+			ID:         el.SelectAttrValue("id", ""),
+			Href:       href,
+			Path:       resolveHref(opfPath, href),
+			MediaType:  el.SelectAttrValue("media-type", ""),
+			Properties: el.SelectAttrValue("properties", ""),
+		})
+	}
+
+	for _, el := range opf.FindElements("//package/spine/itemref") {
+		pkg.Spine = append(pkg.Spine, el.SelectAttrValue("idref", ""))
+	}
+
+	return pkg, nil
+}
+
+// Item gets a manifest item by id, returning nil if it does not exist.
+func (p *Package) Item(id string) *ManifestItem {
+	for i := range p.Manifest {
+		if p.Manifest[i].ID == id {
+			return &p.Manifest[i]
+		}
+	}
+	return nil
+}
+
+// ItemByPath gets a manifest item by its path relative to the epub root,
+// returning nil if it does not exist.
+func (p *Package) ItemByPath(path string) *ManifestItem {
+	for i := range p.Manifest {
+		if p.Manifest[i].Path == path {
+			return &p.Manifest[i]
+		}
+	}
+	return nil
+}
+
+// SpineItems gets the manifest items referenced by the spine, in order.
+// Missing items are skipped.
+func (p *Package) SpineItems() []ManifestItem {
+	var items []ManifestItem
+	for _, id := range p.Spine {
+		if it := p.Item(id); it != nil {
+			items = append(items, *it)
+		}
+	}
+	return items
+}
+
+// HasProperty checks if the item has the specified property.
+func (it ManifestItem) HasProperty(property string) bool {
+	for _, p := range strings.Fields(it.Properties) {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// UnlistedFiles returns the slash-separated paths relative to the epub root of
+// the regular files in an unpacked epub which are not listed in the manifest.
+// The mimetype, META-INF, and the OPF document are not included.
+func UnlistedFiles(epubdir string) ([]string, error) {
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := map[string]bool{
+		"mimetype": true,
+		pkg.Path:   true,
+	}
+	for _, it := range pkg.Manifest {
+		listed[it.Path] = true
+	}
+
+	var unlisted []string
+	if err := filepath.Walk(epubdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(epubdir, path)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); !listed[rel] && !strings.HasPrefix(rel, "META-INF/") {
+			unlisted = append(unlisted, rel)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return unlisted, nil
+}
+
+// removeFiles deletes files (slash-separated paths relative to the epub root)
+// and removes them from the manifest and META-INF/encryption.xml.
+func removeFiles(epubdir string, remove map[string]bool) error {
+	if len(remove) == 0 {
+		return nil
+	}
+	for relpath := range remove {
+		if err := os.Remove(filepath.Join(epubdir, filepath.FromSlash(relpath))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return err
+	}
+	if err := transformOPFDoc(epubdir, func(opf *etree.Document) error {
+		removed := map[string]bool{}
+		for _, el := range opf.FindElements("//package/manifest/item") {
+			if remove[resolveHref(pkg.Path, el.SelectAttrValue("href", ""))] {
+				removed[el.SelectAttrValue("id", "")] = true
+				removeElement(el)
+			}
+		}
+		for _, el := range opf.FindElements("//package/spine/itemref") {
+			if removed[el.SelectAttrValue("idref", "")] {
+				removeElement(el)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	enc := filepath.Join(epubdir, "META-INF", "encryption.xml")
+	if _, err := os.Stat(enc); os.IsNotExist(err) {
+		return nil
+	}
+	return transformFile(enc, func(str string) (string, error) {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(str); err != nil {
+			return str, err
+		}
+		for _, el := range doc.FindElements("//EncryptedData") {
+			if cr := el.FindElement(".//CipherReference"); cr != nil {
+				if target, _, ok := splitRef("", cr.SelectAttrValue("URI", "")); ok && remove[target] {
+					removeElement(el)
+				}
+			}
+		}
+		return doc.WriteToString()
+	})
+}
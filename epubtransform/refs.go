@@ -0,0 +1,314 @@
+package epubtransform
+
+import (
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pgaskin/epubtool/util"
+)
+
+// reference is a URL referencing a file in the epub.
+type reference struct {
+	start, end int    // byte offsets of the raw URL value
+	raw        string // the unescaped URL
+	escape     func(string) string
+}
+
+var (
+	refAttrRe     = regexp.MustCompile(`(?i)\s(?:href|src|xlink:href|poster|data|full-path|uri)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	refSrcsetRe   = regexp.MustCompile(`(?i)\ssrcset\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	refParamRe    = regexp.MustCompile(`(?i)<param\s[^>]*?\bvalue\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	refImageSetRe = regexp.MustCompile(`(?i)image-set\(`)
+)
+
+// CSSURLRe matches url() values and @import rules in CSS. The first non-empty
+// submatch is the (still escaped) URL, and the url() forms are submatches 1-3.
+var CSSURLRe = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)|@import\s+(?:"([^"]*)"|'([^']*)')`)
+
+// RefSchemeRe matches URLs starting with a scheme (i.e. references which are
+// not to local files).
+var RefSchemeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// isReferenceFile checks if a file may contain references to other files.
+func isReferenceFile(relpath string) (markup, stylesheet bool) {
+	switch strings.ToLower(path.Ext(relpath)) {
+	case ".xhtml", ".html", ".htm", ".xml", ".opf", ".ncx", ".svg", ".smil":
+		return true, false
+	case ".css":
+		return false, true
+	}
+	return false, false
+}
+
+// findReferences finds the references in a markup or stylesheet file.
+func findReferences(relpath, str string) []reference {
+	markup, stylesheet := isReferenceFile(relpath)
+	if !markup && !stylesheet {
+		return nil
+	}
+
+	var refs []reference
+	span := func(start, end int, unescape bool, escape func(string) string) {
+		raw := str[start:end]
+		if unescape {
+			raw = html.UnescapeString(raw)
+		}
+		refs = append(refs, reference{start, end, raw, escape})
+	}
+	add := func(m []int, unescape bool, escape func(string) string) {
+		for i := 2; i+1 < len(m); i += 2 {
+			if m[i] != -1 {
+				span(m[i], m[i+1], unescape, escape)
+				return
+			}
+		}
+	}
+	cssEscape := func(s string) string {
+		if markup {
+			s = escapeAttr(s)
+		}
+		return strings.NewReplacer(`"`, `\"`, `'`, `\'`, `(`, `\(`, `)`, `\)`).Replace(s)
+	}
+	if markup {
+		for _, m := range refAttrRe.FindAllStringSubmatchIndex(str, -1) {
+			add(m, true, escapeAttr)
+		}
+		for _, m := range refParamRe.FindAllStringSubmatchIndex(str, -1) {
+			add(m, true, escapeAttr)
+		}
+		for _, m := range refSrcsetRe.FindAllStringSubmatchIndex(str, -1) {
+			for i := 2; i+1 < len(m); i += 2 {
+				if m[i] != -1 {
+					for _, c := range srcsetURLs(str[m[i]:m[i+1]]) {
+						span(m[i]+c[0], m[i]+c[1], true, escapeAttr)
+					}
+					break
+				}
+			}
+		}
+	}
+	// stylesheets and style elements/attributes
+	for _, m := range CSSURLRe.FindAllStringSubmatchIndex(str, -1) {
+		add(m, markup, cssEscape)
+	}
+	for _, m := range refImageSetRe.FindAllStringIndex(str, -1) {
+		for _, c := range imageSetStrings(str[m[1]:]) {
+			span(m[1]+c[0], m[1]+c[1], markup, cssEscape)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].start < refs[j].start
+	})
+	return refs
+}
+
+// srcsetURLs returns the byte offsets of the URLs in a srcset attribute value.
+func srcsetURLs(s string) [][2]int {
+	var urls [][2]int
+	for i := 0; i < len(s); {
+		for i < len(s) && (isSpaceByte(s[i]) || s[i] == ',') {
+			i++
+		}
+		start := i
+		for i < len(s) && !isSpaceByte(s[i]) {
+			i++
+		}
+		end := i
+		for end > start && s[end-1] == ',' {
+			end--
+		}
+		if end > start {
+			urls = append(urls, [2]int{start, end})
+		}
+		if end == i {
+			// skip the descriptors
+			for i < len(s) && s[i] != ',' {
+				i++
+			}
+		}
+	}
+	return urls
+}
+
+// imageSetStrings returns the byte offsets of the contents of the string
+// arguments of an image-set function, where s is everything after the opening
+// parenthesis. The url arguments are handled separately.
+func imageSetStrings(s string) [][2]int {
+	var strs [][2]int
+	var depth int
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return strs
+			}
+			depth--
+		case '"', '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j == -1 {
+				return strs
+			}
+			if depth == 0 {
+				strs = append(strs, [2]int{i + 1, i + 1 + j})
+			}
+			i += j + 1
+		case '<', '{', '}', ';':
+			return strs
+		}
+	}
+	return strs
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func escapeAttr(s string) string {
+	return strings.NewReplacer(`&`, `&amp;`, `<`, `&lt;`, `"`, `&quot;`, `'`, `&apos;`).Replace(s)
+}
+
+// refBase returns the slash-separated path references in relpath are relative
+// to. Files in META-INF are relative to the epub root.
+func refBase(relpath string) string {
+	if strings.HasPrefix(relpath, "META-INF/") {
+		return ""
+	}
+	return relpath
+}
+
+// splitRef splits a reference into the slash-separated path of the target
+// relative to the epub root and the fragment (without the #). If it is not a
+// reference to a local file, false is returned.
+func splitRef(from, raw string) (target, fragment string, ok bool) {
+	if raw == "" || RefSchemeRe.MatchString(raw) || strings.HasPrefix(raw, "/") {
+		return "", "", false
+	}
+	if i := strings.IndexByte(raw, '#'); i != -1 {
+		raw, fragment = raw[:i], raw[i+1:]
+	}
+	if raw == "" && from == "" {
+		return "", "", false
+	}
+	return resolveHref(from, raw), fragment, true
+}
+
+// RelativeRef makes a reference from a file to a target (both slash-separated
+// paths relative to the epub root or another common directory) and fragment.
+// References to a fragment in the same file only contain the fragment.
+func RelativeRef(from, target, fragment string) string {
+	var ref string
+	if from == "" || target != from || fragment == "" {
+		rel, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(target))
+		if err != nil {
+			rel = target
+		}
+		ref = (&url.URL{Path: filepath.ToSlash(rel)}).String()
+		if strings.Contains(strings.SplitN(ref, "/", 2)[0], ":") {
+			ref = "./" + ref // don't let it be parsed as a scheme
+		}
+	}
+	if fragment != "" {
+		ref += "#" + fragment
+	}
+	return ref
+}
+
+// walkReferenceFiles calls fn with the slash-separated path relative to the epub
+// root of every file which may contain references.
+func walkReferenceFiles(epubdir string, fn func(relpath, file string) error) error {
+	return filepath.Walk(epubdir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(epubdir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if markup, stylesheet := isReferenceFile(rel); !markup && !stylesheet {
+			return nil
+		}
+		return fn(rel, file)
+	})
+}
+
+// rewriteReferences calls fn for every reference to a local file. The from and
+// target paths are slash-separated and relative to the epub root, and the
+// fragment does not include the #. If fn returns true, the reference is replaced
+// with one to the new target and fragment.
+func rewriteReferences(epubdir string, fn func(from, target, fragment string) (newTarget, newFragment string, replace bool)) error {
+	return walkReferenceFiles(epubdir, func(relpath, file string) error {
+		if err := transformFile(file, func(str string) (string, error) {
+			var b strings.Builder
+			var last int
+			base := refBase(relpath)
+			for _, ref := range findReferences(relpath, str) {
+				target, fragment, ok := splitRef(base, ref.raw)
+				if !ok {
+					continue
+				}
+				nt, nf, replace := fn(relpath, target, fragment)
+				if !replace {
+					continue
+				}
+				b.WriteString(str[last:ref.start])
+				b.WriteString(ref.escape(RelativeRef(base, nt, nf)))
+				last = ref.end
+			}
+			if last == 0 {
+				return str, nil
+			}
+			b.WriteString(str[last:])
+			return b.String(), nil
+		}); err != nil {
+			return util.Wrap(err, "rewrite references in %#v", relpath)
+		}
+		return nil
+	})
+}
+
+// RewriteReferences updates references in all markup files (including the OPF,
+// NCX, and META-INF) and stylesheets to files which have been renamed. The keys
+// and values of renames are slash-separated paths relative to the epub root.
+func RewriteReferences(epubdir string, renames map[string]string) error {
+	return rewriteReferences(epubdir, func(from, target, fragment string) (string, string, bool) {
+		if nt, ok := renames[target]; ok {
+			return nt, fragment, true
+		}
+		return "", "", false
+	})
+}
+
+// FindReferences returns the slash-separated paths relative to the epub root of
+// the local files referenced by each markup file and stylesheet.
+func FindReferences(epubdir string) (map[string][]string, error) {
+	refs := map[string][]string{}
+	err := walkReferenceFiles(epubdir, func(relpath, file string) error {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		seen := map[string]bool{}
+		base := refBase(relpath)
+		for _, ref := range findReferences(relpath, string(buf)) {
+			if target, _, ok := splitRef(base, ref.raw); ok && target != relpath && !seen[target] {
+				seen[target] = true
+				refs[relpath] = append(refs[relpath], target)
+			}
+		}
+		return nil
+	})
+	return refs, err
+}
@@ -0,0 +1,59 @@
+package epubtransform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRefs(t *testing.T) {
+	for _, c := range []struct {
+		from, raw        string
+		target, fragment string
+		ok               bool
+		rel              string
+	}{
+		{"OEBPS/text/ch1.xhtml", "ch2.xhtml", "OEBPS/text/ch2.xhtml", "", true, "ch2.xhtml"},
+		{"OEBPS/text/ch1.xhtml", "../images/a%20b.png", "OEBPS/images/a b.png", "", true, "../images/a%20b.png"},
+		{"OEBPS/text/ch1.xhtml", "ch2.xhtml#sec", "OEBPS/text/ch2.xhtml", "sec", true, "ch2.xhtml#sec"},
+		{"OEBPS/text/ch1.xhtml", "#sec", "OEBPS/text/ch1.xhtml", "sec", true, "#sec"},
+		{"OEBPS/text/ch1.xhtml", "ch1.xhtml", "OEBPS/text/ch1.xhtml", "", true, "ch1.xhtml"},
+		{"OEBPS/content.opf", "text/ch1.xhtml", "OEBPS/text/ch1.xhtml", "", true, "text/ch1.xhtml"},
+		{"", "OEBPS/content.opf", "OEBPS/content.opf", "", true, "OEBPS/content.opf"},
+		{"OEBPS/text/ch1.xhtml", "https://example.com/", "", "", false, ""},
+		{"OEBPS/text/ch1.xhtml", "data:image/png;base64,AAAA", "", "", false, ""},
+		{"OEBPS/text/ch1.xhtml", "/absolute", "", "", false, ""},
+	} {
+		target, fragment, ok := splitRef(c.from, c.raw)
+		if target != c.target || fragment != c.fragment || ok != c.ok {
+			t.Errorf("splitRef(%#v, %#v): expected (%#v, %#v, %t), got (%#v, %#v, %t)", c.from, c.raw, c.target, c.fragment, c.ok, target, fragment, ok)
+		}
+		if ok {
+			if rel := RelativeRef(c.from, target, fragment); rel != c.rel {
+				t.Errorf("RelativeRef(%#v, %#v, %#v): expected %#v, got %#v", c.from, target, fragment, c.rel, rel)
+			}
+		}
+	}
+}
+
+func TestFindReferences(t *testing.T) {
+	for _, c := range []struct {
+		relpath, str string
+		refs         []string
+	}{
+		{"a.xhtml", `<a href="b.xhtml#x">b</a><img src='c.png' alt=""/>`, []string{"b.xhtml#x", "c.png"}},
+		{"a.xhtml", `<p style="background: url('bg.png')"></p><img src="a.png"/>`, []string{"bg.png", "a.png"}},
+		{"a.xhtml", `<img src="a.png" srcset="a-1x.png 1x, a&amp;2x.png 2x,a-3x.png,  a,4x.png 400w"/>`, []string{"a.png", "a-1x.png", "a&2x.png", "a-3x.png", "a,4x.png"}},
+		{"a.xhtml", `<object data="a.svg"><param name="src" value="b.svg"/><param name="autoplay" value="true"/></object>`, []string{"a.svg", "b.svg", "true"}},
+		{"a.css", `p { background-image: image-set("a.png" 1x, url(b.png) 2x, 'c.png' type("image/png")); }`, []string{"a.png", "b.png", "c.png"}},
+		{"a.css", `@import "b.css"; p { background: url( 'c d.png' ) }`, []string{"b.css", "c d.png"}},
+		{"a.png", `<img src="a.png"/>`, nil},
+	} {
+		var refs []string
+		for _, ref := range findReferences(c.relpath, c.str) {
+			refs = append(refs, ref.raw)
+		}
+		if !reflect.DeepEqual(refs, c.refs) {
+			t.Errorf("findReferences(%#v, %#v): expected %q, got %q", c.relpath, c.str, c.refs, refs)
+		}
+	}
+}
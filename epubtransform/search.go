@@ -0,0 +1,193 @@
+package epubtransform
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// SearchMatch is a match found by Search.
+type SearchMatch struct {
+	Path    string // the slash-separated path of the spine document relative to the epub root
+	Chapter string // the title of the table of contents entry the match is in, if any
+	Match   string
+	Before  string // up to the requested amount of context in the same paragraph
+	After   string
+}
+
+// Search finds matches of re in the visible text of the spine documents, in
+// order. Each paragraph (or other block) is searched separately, with the
+// whitespace collapsed. The context is the number of characters to include
+// before and after each match. The epub is not modified.
+func Search(input InputFunc, re *regexp.Regexp, context int) ([]SearchMatch, error) {
+	var matches []SearchMatch
+	err := New(Transform{
+		Desc: "search",
+		Raw: func(epubdir string) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			return spineText(epubdir, pkg, func(it ManifestItem, doc *html.Node, blocks, chapters []string) error {
+				for i, block := range blocks {
+					for _, m := range re.FindAllStringIndex(block, -1) {
+						if m[0] == m[1] {
+							continue
+						}
+						matches = append(matches, SearchMatch{
+							Path:    it.Path,
+							Chapter: chapters[i],
+							Match:   block[m[0]:m[1]],
+							Before:  searchContext(block[:m[0]], context, true),
+							After:   searchContext(block[m[1]:], context, false),
+						})
+					}
+				}
+				return nil
+			})
+		},
+	}).Run(input, nil, false)
+	return matches, err
+}
+
+// spineText extracts the visible text of the spine documents of an unpacked epub
+// in order, calling fn with the parsed document, the blocks of text, and the
+// title of the table of contents entry each block is in (with an extra one for
+// the end of the document).
+func spineText(epubdir string, pkg *Package, fn func(it ManifestItem, doc *html.Node, blocks, chapters []string) error) error {
+	toc, err := ReadTOC(epubdir, pkg)
+	if err != nil {
+		return err
+	}
+
+	// the toc entries for each file, in order
+	type chapter struct {
+		title, fragment string
+	}
+	chapters := map[string][]chapter{}
+	var flatten func([]TOCEntry)
+	flatten = func(entries []TOCEntry) {
+		for _, e := range entries {
+			if e.Path != "" {
+				chapters[e.Path] = append(chapters[e.Path], chapter{e.Title, e.Fragment})
+			}
+			flatten(e.Children)
+		}
+	}
+	flatten(toc)
+
+	var current string
+	for _, it := range pkg.SpineItems() {
+		if it.MediaType != "application/xhtml+xml" && it.MediaType != "text/html" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+		if err != nil {
+			return util.Wrap(err, "read %#v", it.Path)
+		}
+		doc, err := html.Parse(f)
+		f.Close()
+		if err != nil {
+			return util.Wrap(err, "parse %#v", it.Path)
+		}
+
+		st := searchText{ids: map[string]int{}}
+		if body := util.FindElement(doc, atom.Body); body != nil {
+			st.walk(body)
+			st.flush()
+		}
+
+		// the chapter each block is in (the most specific entry is last)
+		titles := make([]string, len(st.blocks)+1)
+		starts := map[int]string{}
+		for _, c := range chapters[it.Path] {
+			starts[st.ids[c.fragment]] = c.title
+		}
+		for i := range titles {
+			if t, ok := starts[i]; ok {
+				current = t
+			}
+			titles[i] = current
+		}
+
+		if err := fn(it, doc, st.blocks, titles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchContext gets up to n characters from the end (or start) of s, adding an
+// ellipsis if it was cut off.
+func searchContext(s string, n int, end bool) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	if end {
+		return "…" + string(r[len(r)-n:])
+	}
+	return string(r[:n]) + "…"
+}
+
+// searchText extracts the visible text from a document as blocks with the
+// whitespace collapsed.
+type searchText struct {
+	blocks []string
+	ids    map[string]int // the block each id is in (or before)
+	cur    strings.Builder
+}
+
+func (s *searchText) flush() {
+	if t := strings.Join(strings.Fields(s.cur.String()), " "); t != "" {
+		s.blocks = append(s.blocks, t)
+	}
+	s.cur.Reset()
+}
+
+func (s *searchText) walk(n *html.Node) {
+	util.Walk(n, func(n *html.Node) bool {
+		switch n.Type {
+		case html.TextNode:
+			s.cur.WriteString(n.Data)
+			return false
+		case html.ElementNode:
+			if isHiddenElement(n) {
+				return false
+			}
+		default:
+			return false
+		}
+		if isSearchBlock(n) {
+			s.flush()
+		}
+		if id, ok := util.LookupAttr(n, "id"); ok {
+			if _, ok := s.ids[id]; !ok {
+				s.ids[id] = len(s.blocks)
+			}
+		}
+		return true
+	}, func(n *html.Node) {
+		if isSearchBlock(n) {
+			s.flush()
+		}
+	})
+}
+
+func isSearchBlock(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Li, atom.Dt, atom.Dd, atom.Blockquote, atom.Pre, atom.Td, atom.Th,
+		atom.Tr, atom.Table, atom.Section, atom.Article, atom.Header, atom.Footer,
+		atom.Aside, atom.Nav, atom.Main, atom.Figure, atom.Figcaption, atom.Caption,
+		atom.Address, atom.Ol, atom.Ul, atom.Dl, atom.Br, atom.Hr:
+		return true
+	}
+	return false
+}
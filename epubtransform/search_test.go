@@ -0,0 +1,53 @@
+package epubtransform
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func TestSearchText(t *testing.T) {
+	const doc = `<html><head><title>x</title></head><body>
+<h1 id="a">Title <i>One</i></h1>
+<p>Some
+   text<br/>after <span id="b">a</span> break.</p>
+<div hidden="">Hidden</div>
+<script>var x;</script>
+<p><ruby>漢<rt>kan</rt>字<rt>ji</rt></ruby></p>
+<p id="c"></p>
+</body></html>`
+
+	n, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := searchText{ids: map[string]int{}}
+	st.walk(util.FindElement(n, atom.Body))
+	st.flush()
+
+	if exp := []string{"Title One", "Some text", "after a break.", "漢字"}; !reflect.DeepEqual(st.blocks, exp) {
+		t.Errorf("expected blocks %q, got %q", exp, st.blocks)
+	}
+	if exp := map[string]int{"a": 0, "b": 2, "c": 4}; !reflect.DeepEqual(st.ids, exp) {
+		t.Errorf("expected ids %v, got %v", exp, st.ids)
+	}
+
+	for _, c := range []struct {
+		s   string
+		n   int
+		end bool
+		exp string
+	}{
+		{"abcdef", 3, true, "…def"},
+		{"abcdef", 2, false, "ab…"},
+		{"abc", 3, true, "abc"},
+	} {
+		if res := searchContext(c.s, c.n, c.end); res != c.exp {
+			t.Errorf("searchContext(%q, %d, %t): expected %q, got %q", c.s, c.n, c.end, c.exp, res)
+		}
+	}
+}
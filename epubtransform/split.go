@@ -0,0 +1,345 @@
+package epubtransform
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// SplitOptions controls where Split divides a book.
+type SplitOptions struct {
+	// At are the spine items (manifest ids or slash-separated paths relative
+	// to the epub root) which start a new part. If empty, the book is split at
+	// the top-level entries of the table of contents.
+	At []string
+	// Link returns the URL to use for links to a document in another part
+	// (with the path and fragment from the original book). It is used as-is
+	// in documents at any depth, and relative URLs are resolved within the
+	// part, so it should usually be absolute (e.g. to where the parts are
+	// hosted). If nil, those links are removed.
+	Link func(part SplitPart, path, fragment string) string
+}
+
+// SplitPart is a part of a book divided by Split.
+type SplitPart struct {
+	Index int      // starting from 1
+	Title string   // of the top-level table of contents entry for the first spine item, if any
+	Spine []string // the slash-separated paths of the spine items relative to the epub root
+}
+
+// Split divides a book into parts, writing each one to the output returned by
+// output. Spine items before the first split point are included in the first
+// part (with the title of the first top-level table of contents entry if
+// splitting at them). Each part only has the resources its documents
+// reference, a table of contents with the entries for its documents, the
+// original title with the part title (or number) appended, a new identifier
+// derived from the original one, and calibre series metadata with the part
+// number as the index.
+func Split(input InputFunc, output func(part SplitPart) OutputFunc, opts SplitOptions) ([]SplitPart, error) {
+	var parts []SplitPart
+	var title, uid, series string
+	if err := New(Transform{
+		Desc: "find split points",
+		Raw: func(epubdir string) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			toc, err := ReadTOC(epubdir, pkg)
+			if err != nil {
+				return err
+			}
+			title, uid = pkg.Title, pkg.UniqueIdentifier
+
+			op, err := getOPFPath(epubdir)
+			if err != nil {
+				return err
+			}
+			opf := etree.NewDocument()
+			if err := opf.ReadFromFile(op); err != nil {
+				return err
+			}
+			for _, el := range opf.FindElements("//package/metadata/meta") {
+				if el.SelectAttrValue("name", "") == "calibre:series" {
+					series = el.SelectAttrValue("content", "")
+				}
+			}
+
+			parts, err = splitParts(pkg, toc, opts.At)
+			return err
+		},
+	}).Run(input, nil, false); err != nil {
+		return nil, err
+	}
+
+	for _, part := range parts {
+		name := part.Title
+		if name == "" {
+			name = fmt.Sprintf("Part %d", part.Index)
+		}
+		ptitle, pseries := name, series
+		if title != "" {
+			ptitle = title + " - " + name
+		}
+		if pseries == "" {
+			pseries = title
+		}
+		id := derivedIdentifier(uid, strconv.Itoa(part.Index))
+
+		if err := New(
+			transformSplitPart(parts, part.Index, ptitle, id, opts),
+			TransformTitle(ptitle),
+			TransformIdentifier(id),
+			TransformOPFMetaElementContent("set series", "calibre:series", pseries),
+			TransformOPFMetaElementContent("set series index", "calibre:series_index", strconv.Itoa(part.Index)),
+			TransformClean(CleanOptions{RemoveUnreferenced: true}, nil),
+		).Run(input, output(part), false); err != nil {
+			return nil, util.Wrap(err, "part %d", part.Index)
+		}
+	}
+	return parts, nil
+}
+
+// splitParts divides the spine at the specified items, or the top-level table
+// of contents entries.
+func splitParts(pkg *Package, toc []TOCEntry, at []string) ([]SplitPart, error) {
+	spine := pkg.SpineItems()
+	if len(spine) == 0 {
+		return nil, errors.New("spine is empty")
+	}
+	index := map[string]int{}
+	for i, it := range spine {
+		if _, ok := index[it.Path]; !ok {
+			index[it.Path] = i
+		}
+	}
+
+	// the title for each spine item which starts a top-level entry
+	titles := map[int]string{}
+	var first func(TOCEntry) string
+	first = func(e TOCEntry) string {
+		if e.Path != "" {
+			return e.Path
+		}
+		for _, c := range e.Children {
+			if p := first(c); p != "" {
+				return p
+			}
+		}
+		return ""
+	}
+	for _, e := range toc {
+		if i, ok := index[first(e)]; ok {
+			if _, ok := titles[i]; !ok {
+				titles[i] = e.Title
+			}
+		}
+	}
+
+	starts := map[int]bool{0: true}
+	if len(at) == 0 {
+		// the spine items before the first entry (e.g. the cover) are part of
+		// it rather than a part of their own
+		start := len(spine)
+		for i := range titles {
+			if i < start {
+				start = i
+			}
+		}
+		for i := range titles {
+			starts[i] = true
+		}
+		if start != 0 && start != len(spine) {
+			delete(starts, start)
+			titles[0] = titles[start]
+		}
+	} else {
+		for _, a := range at {
+			i, ok := index[a]
+			if it := pkg.Item(a); it != nil && !ok {
+				i, ok = index[it.Path]
+			}
+			if !ok {
+				return nil, fmt.Errorf("could not find spine item %#v", a)
+			}
+			starts[i] = true
+		}
+	}
+	if len(starts) < 2 {
+		return nil, errors.New("nothing to split at")
+	}
+
+	var parts []SplitPart
+	for i, it := range spine {
+		if starts[i] {
+			parts = append(parts, SplitPart{
+				Index: len(parts) + 1,
+				Title: titles[i],
+			})
+		}
+		parts[len(parts)-1].Spine = append(parts[len(parts)-1].Spine, it.Path)
+	}
+	return parts, nil
+}
+
+// derivedIdentifier derives a UUID URN from other values (e.g. the identifier
+// of the original book).
+func derivedIdentifier(values ...string) string {
+	h := sha1.Sum([]byte(strings.Join(values, "\x00")))
+	h[6] = (h[6] & 0x0f) | 0x50 // version 5
+	h[8] = (h[8] & 0x3f) | 0x80 // variant
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// filterTOC removes entries pointing to removed files. Their children are kept.
+func filterTOC(toc []TOCEntry, removed map[string]bool) []TOCEntry {
+	var res []TOCEntry
+	for _, e := range toc {
+		e.Children = filterTOC(e.Children, removed)
+		switch {
+		case e.Path != "" && removed[e.Path]:
+			res = append(res, e.Children...)
+		case e.Path == "" && len(e.Children) == 0:
+		default:
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// transformSplitPart removes the spine items which aren't in a part, updates
+// or removes the links to them, and regenerates the navigation documents.
+func transformSplitPart(parts []SplitPart, index int, title, id string, opts SplitOptions) Transform {
+	part := parts[index-1]
+	return Transform{
+		Desc: fmt.Sprintf("extract part %d", index),
+		Raw: func(epubdir string) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			toc, err := ReadTOC(epubdir, pkg)
+			if err != nil {
+				return err
+			}
+
+			partOf := map[string]SplitPart{}
+			for _, p := range parts {
+				for _, relpath := range p.Spine {
+					partOf[relpath] = p
+				}
+			}
+			remove := map[string]bool{}
+			for relpath, p := range partOf {
+				if it := pkg.ItemByPath(relpath); p.Index != index && (it == nil || !it.HasProperty("nav")) {
+					remove[relpath] = true
+				}
+			}
+			if err := removeFiles(epubdir, remove); err != nil {
+				return err
+			}
+
+			if err := transformOPFDoc(epubdir, func(opf *etree.Document) error {
+				for _, el := range opf.FindElements("//package/guide/reference") {
+					if target, _, ok := splitRef(pkg.Path, el.SelectAttrValue("href", "")); ok && remove[target] {
+						removeElement(el)
+					}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			// links to other parts (the navigation documents are regenerated)
+			skip := map[string]bool{pkg.Path: true}
+			for _, it := range pkg.Manifest {
+				if it.HasProperty("nav") || it.MediaType == "application/x-dtbncx+xml" {
+					skip[it.Path] = true
+				}
+			}
+			if err := walkReferenceFiles(epubdir, func(relpath, file string) error {
+				if markup, _ := isReferenceFile(relpath); !markup || skip[relpath] {
+					return nil
+				}
+				return transformFile(file, func(str string) (string, error) {
+					return splitLinks(str, refBase(relpath), func(target, fragment string) (string, bool) {
+						if !remove[target] {
+							return "", false
+						}
+						if opts.Link == nil {
+							return "", true
+						}
+						return opts.Link(partOf[target], target, fragment), true
+					}), nil
+				})
+			}); err != nil {
+				return err
+			}
+
+			nav := Nav{
+				Title:      title,
+				Language:   pkg.Language,
+				Identifier: id,
+				Authors:    pkg.Creators,
+				TOC:        filterTOC(toc, remove),
+			}
+			if len(part.Spine) != 0 {
+				nav.Landmarks = []Landmark{{Type: "bodymatter", Title: "Start", Path: part.Spine[0]}}
+				if len(nav.TOC) != 0 && nav.TOC[0].Path != "" {
+					nav.Landmarks[0].Path, nav.Landmarks[0].Fragment = nav.TOC[0].Path, nav.TOC[0].Fragment
+				}
+			}
+			for _, it := range pkg.Manifest {
+				switch {
+				case it.HasProperty("nav"):
+					err = WriteNav(epubdir, it.Path, nav)
+				case it.MediaType == "application/x-dtbncx+xml":
+					err = WriteNCX(epubdir, it.Path, nav)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// splitLinks replaces the values of link attributes in markup from base. If fn
+// returns true and a blank URL, the attribute is removed.
+func splitLinks(str, base string, fn func(target, fragment string) (string, bool)) string {
+	var b strings.Builder
+	var last int
+	for _, m := range refAttrRe.FindAllStringSubmatchIndex(str, -1) {
+		vs, ve := m[2], m[3]
+		if vs == -1 {
+			vs, ve = m[4], m[5]
+		}
+		target, fragment, ok := splitRef(base, html.UnescapeString(str[vs:ve]))
+		if !ok {
+			continue
+		}
+		u, replace := fn(target, fragment)
+		if !replace {
+			continue
+		}
+		if u == "" {
+			b.WriteString(str[last:m[0]])
+		} else {
+			b.WriteString(str[last:vs])
+			b.WriteString(escapeAttr(u))
+		}
+		last = m[1]
+		if u != "" {
+			last = ve
+		}
+	}
+	b.WriteString(str[last:])
+	return b.String()
+}
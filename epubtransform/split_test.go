@@ -0,0 +1,60 @@
+package epubtransform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitParts(t *testing.T) {
+	pkg := &Package{
+		Manifest: []ManifestItem{
+			{ID: "cover", Path: "OEBPS/cover.xhtml"},
+			{ID: "b1", Path: "OEBPS/b1.xhtml"},
+			{ID: "b1c2", Path: "OEBPS/b1c2.xhtml"},
+			{ID: "b2", Path: "OEBPS/b2.xhtml"},
+		},
+		Spine: []string{"cover", "b1", "b1c2", "b2"},
+	}
+	toc := []TOCEntry{
+		{Title: "Book 1", Children: []TOCEntry{
+			{Title: "Chapter 1", Path: "OEBPS/b1.xhtml"},
+			{Title: "Chapter 2", Path: "OEBPS/b1c2.xhtml"},
+		}},
+		{Title: "Book 2", Path: "OEBPS/b2.xhtml", Fragment: "start"},
+	}
+
+	for _, c := range []struct {
+		at  []string
+		exp []SplitPart
+	}{
+		{nil, []SplitPart{
+			{1, "Book 1", []string{"OEBPS/cover.xhtml", "OEBPS/b1.xhtml", "OEBPS/b1c2.xhtml"}},
+			{2, "Book 2", []string{"OEBPS/b2.xhtml"}},
+		}},
+		{[]string{"b1c2", "OEBPS/b2.xhtml"}, []SplitPart{
+			{1, "", []string{"OEBPS/cover.xhtml", "OEBPS/b1.xhtml"}},
+			{2, "", []string{"OEBPS/b1c2.xhtml"}},
+			{3, "Book 2", []string{"OEBPS/b2.xhtml"}},
+		}},
+	} {
+		if parts, err := splitParts(pkg, toc, c.at); err != nil {
+			t.Errorf("%q: unexpected error: %v", c.at, err)
+		} else if !reflect.DeepEqual(parts, c.exp) {
+			t.Errorf("%q: expected %+v, got %+v", c.at, c.exp, parts)
+		}
+	}
+	if _, err := splitParts(pkg, toc, []string{"missing"}); err == nil {
+		t.Errorf("expected error for missing spine item")
+	}
+	if _, err := splitParts(pkg, toc[:1], nil); err == nil {
+		t.Errorf("expected error for a single top-level entry")
+	}
+
+	if res, exp := filterTOC(toc, map[string]bool{"OEBPS/b1.xhtml": true, "OEBPS/b2.xhtml": true}), []TOCEntry{
+		{Title: "Book 1", Children: []TOCEntry{
+			{Title: "Chapter 2", Path: "OEBPS/b1c2.xhtml"},
+		}},
+	}; !reflect.DeepEqual(res, exp) {
+		t.Errorf("filterTOC: expected %+v, got %+v", exp, res)
+	}
+}
@@ -0,0 +1,211 @@
+package epubtransform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// StatsOptions controls the estimates made by ReadStats.
+type StatsOptions struct {
+	// WordsPerMinute is the reading speed for text other than Chinese and
+	// Japanese.
+	WordsPerMinute int
+	// CJKCharactersPerMinute is the reading speed for Chinese and Japanese
+	// text.
+	CJKCharactersPerMinute int
+	// CharactersPerPage is the number of characters (not including
+	// whitespace) on a page.
+	CharactersPerPage int
+}
+
+// Stats contains statistics about an epub. Chinese and Japanese characters are
+// counted as one word each.
+type Stats struct {
+	Words          int `json:"words"`
+	Characters     int `json:"characters"` // not including whitespace
+	Images         int `json:"images"`     // the number of images in the spine documents
+	ReadingMinutes int `json:"reading_minutes"`
+	Pages          int `json:"pages"`
+	// Chapters contains the text in each spine document by table of contents
+	// entry, in order.
+	Chapters []ChapterStats `json:"chapters"`
+	// Size is the total size of the manifest items, and MediaTypes is the
+	// size by media type.
+	Size       int64            `json:"size"`
+	MediaTypes map[string]int64 `json:"media_types"`
+}
+
+// ChapterStats contains statistics about the part of a spine document in a
+// table of contents entry.
+type ChapterStats struct {
+	Path       string `json:"path"`  // the slash-separated path relative to the epub root
+	Title      string `json:"title"` // empty if before the first table of contents entry
+	Words      int    `json:"words"`
+	Characters int    `json:"characters"`
+}
+
+// ReadStats counts the words, characters, and images in the visible text of
+// the spine documents (in the same way as Search), estimates the reading time
+// and number of pages, and gets the size of the manifest items. The epub is
+// not modified.
+func ReadStats(input InputFunc, opts StatsOptions) (*Stats, error) {
+	if opts.WordsPerMinute <= 0 || opts.CJKCharactersPerMinute <= 0 || opts.CharactersPerPage <= 0 {
+		return nil, errors.New("reading speeds and characters per page must be positive")
+	}
+	stats := &Stats{
+		Chapters:   []ChapterStats{},
+		MediaTypes: map[string]int64{},
+	}
+	err := New(Transform{
+		Desc: "read stats",
+		Raw: func(epubdir string) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+
+			for _, it := range pkg.Manifest {
+				fi, err := os.Stat(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return util.Wrap(err, "stat %#v", it.Path)
+				}
+				stats.Size += fi.Size()
+				stats.MediaTypes[it.MediaType] += fi.Size()
+			}
+
+			var cjk int
+			if err := spineText(epubdir, pkg, func(it ManifestItem, doc *html.Node, blocks, chapters []string) error {
+				stats.Images += countImages(doc)
+				if len(blocks) == 0 {
+					stats.Chapters = append(stats.Chapters, ChapterStats{Path: it.Path, Title: chapters[0]})
+				}
+				for i, block := range blocks {
+					if i == 0 || chapters[i] != chapters[i-1] {
+						stats.Chapters = append(stats.Chapters, ChapterStats{Path: it.Path, Title: chapters[i]})
+					}
+					c := &stats.Chapters[len(stats.Chapters)-1]
+					w, n, k := countText(block)
+					c.Words += w
+					c.Characters += n
+					stats.Words += w
+					stats.Characters += n
+					cjk += k
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			stats.ReadingMinutes = ceilDiv(stats.Words-cjk, opts.WordsPerMinute) + ceilDiv(cjk, opts.CJKCharactersPerMinute)
+			stats.Pages = ceilDiv(stats.Characters, opts.CharactersPerPage)
+			return nil
+		},
+	}).Run(input, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// TransformCalibreColumn sets a calibre integer custom column (e.g. #words) in
+// the calibre:user_metadata format used by calibre when saving to disk.
+func TransformCalibreColumn(label, name string, value int) Transform {
+	return Transform{
+		Desc: fmt.Sprintf("set calibre column #%s to %d", label, value),
+		OPFDoc: func(opf *etree.Document) error {
+			if label == "" {
+				return errors.New("no column label provided")
+			}
+			buf, err := json.Marshal(struct {
+				Label       string          `json:"label"`
+				Name        string          `json:"name"`
+				Datatype    string          `json:"datatype"`
+				Kind        string          `json:"kind"`
+				IsCustom    bool            `json:"is_custom"`
+				IsCategory  bool            `json:"is_category"`
+				IsEditable  bool            `json:"is_editable"`
+				IsMultiple  struct{}        `json:"is_multiple"`
+				IsMultiple2 struct{}        `json:"is_multiple2"`
+				SearchTerms []string        `json:"search_terms"`
+				Display     json.RawMessage `json:"display"`
+				Value       int             `json:"#value#"`
+				Extra       json.RawMessage `json:"#extra#"`
+			}{
+				Label:       label,
+				Name:        name,
+				Datatype:    "int",
+				Kind:        "field",
+				IsCustom:    true,
+				IsEditable:  true,
+				SearchTerms: []string{"#" + label},
+				Display:     json.RawMessage(`{"number_format": null}`),
+				Value:       value,
+				Extra:       json.RawMessage(`null`),
+			})
+			if err != nil {
+				return err
+			}
+			return TransformOPFMetaElementContent("", "calibre:user_metadata:#"+label, string(buf)).OPFDoc(opf)
+		},
+	}
+}
+
+// countText counts the words, the characters which aren't whitespace, and the
+// Chinese and Japanese characters (which are also counted as words) in s.
+func countText(s string) (words, chars, cjk int) {
+	var inWord bool
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			inWord = false
+			continue
+		case unicode.Is(unicode.Cf, r):
+			continue // e.g. soft hyphens, zero-width spaces
+		case isCJK(r):
+			words++
+			cjk++
+			inWord = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if !inWord {
+				words++
+				inWord = true
+			}
+		}
+		chars++
+	}
+	return
+}
+
+// isCJK checks if r is a Chinese or Japanese character, which are written
+// without spaces between words.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// countImages counts the img and svg image elements in a document.
+func countImages(n *html.Node) int {
+	var c int
+	util.Walk(n, func(n *html.Node) bool {
+		if n.Type == html.ElementNode && (n.DataAtom == atom.Img || (n.Namespace == "svg" && n.Data == "image")) {
+			c++
+		}
+		return true
+	}, nil)
+	return c
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
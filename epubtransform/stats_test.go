@@ -0,0 +1,22 @@
+package epubtransform
+
+import "testing"
+
+func TestCountText(t *testing.T) {
+	for _, c := range []struct {
+		s                 string
+		words, chars, cjk int
+	}{
+		{"", 0, 0, 0},
+		{"Hello, world!", 2, 12, 0},
+		{"It's a well-known fact — isn't it?", 6, 28, 0},
+		{"hy\u00adphen\u00adation 42", 2, 13, 0},
+		{"日本語のテキスト", 8, 8, 8},
+		{"Go言語 is fun", 5, 9, 2},
+		{"한국어 텍스트", 2, 6, 0},
+	} {
+		if words, chars, cjk := countText(c.s); words != c.words || chars != c.chars || cjk != c.cjk {
+			t.Errorf("%q: expected %d words, %d chars, %d cjk, got %d, %d, %d", c.s, c.words, c.chars, c.cjk, words, chars, cjk)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package epubtransform
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// TOCEntry is an entry in the table of contents.
+type TOCEntry struct {
+	Title    string
+	Path     string // the slash-separated path relative to the epub root (blank for headings without a link)
+	Fragment string
+	Children []TOCEntry
+}
+
+// Nav contains the information used to write navigation documents.
+type Nav struct {
+	Title      string
+	Language   string
+	Identifier string   // only used for the NCX
+	Authors    []string // only used for the NCX
+	TOC        []TOCEntry
+	Landmarks  []Landmark // only used for the EPUB 3 navigation document
+	PageList   []PageTarget
+}
+
+// Landmark is an entry in the landmarks of an EPUB 3 navigation document.
+type Landmark struct {
+	Type     string // the epub:type (e.g. cover, toc, bodymatter)
+	Title    string
+	Path     string // the slash-separated path relative to the epub root
+	Fragment string
+}
+
+// PageTarget is an entry in the page list.
+type PageTarget struct {
+	Name     string // the page number (e.g. 12 or xiv)
+	Path     string // the slash-separated path relative to the epub root
+	Fragment string
+}
+
+// ReadTOC reads the table of contents from the EPUB 3 navigation document, or
+// the NCX if there isn't one. If neither exist, nil is returned.
+func ReadTOC(epubdir string, pkg *Package) ([]TOCEntry, error) {
+	for _, it := range pkg.Manifest {
+		if it.HasProperty("nav") {
+			toc, err := readNavTOC(epubdir, it.Path)
+			if err != nil {
+				return nil, util.Wrap(err, "read nav %#v", it.Path)
+			}
+			return toc, nil
+		}
+	}
+	for _, it := range pkg.Manifest {
+		if it.MediaType == "application/x-dtbncx+xml" {
+			toc, err := readNCXTOC(epubdir, it.Path)
+			if err != nil {
+				return nil, util.Wrap(err, "read ncx %#v", it.Path)
+			}
+			return toc, nil
+		}
+	}
+	return nil, nil
+}
+
+func readNavTOC(epubdir, relpath string) ([]TOCEntry, error) {
+	f, err := os.Open(filepath.Join(epubdir, filepath.FromSlash(relpath)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc, err := html.Parse(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var navs []*html.Node
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Nav {
+			navs = append(navs, n)
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(doc)
+	if len(navs) == 0 {
+		return nil, nil
+	}
+	nav := navs[0]
+	for _, n := range navs {
+		if t, _ := util.LookupAttr(n, "epub:type"); strings.Contains(" "+t+" ", " toc ") {
+			nav = n
+			break
+		}
+	}
+
+	var list func(ol *html.Node) []TOCEntry
+	list = func(ol *html.Node) []TOCEntry {
+		var toc []TOCEntry
+		for li := ol.FirstChild; li != nil; li = li.NextSibling {
+			if li.Type != html.ElementNode || li.DataAtom != atom.Li {
+				continue
+			}
+			var e TOCEntry
+			for c := li.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type != html.ElementNode {
+					continue
+				}
+				switch c.DataAtom {
+				case atom.A:
+					href, _ := util.LookupAttr(c, "href")
+					if target, fragment, ok := splitRef(relpath, href); ok {
+						e.Path, e.Fragment = target, fragment
+					}
+					fallthrough
+				case atom.Span:
+					e.Title = strings.Join(strings.Fields(util.TextContent(c)), " ")
+				case atom.Ol:
+					e.Children = list(c)
+				}
+			}
+			toc = append(toc, e)
+		}
+		return toc
+	}
+	if ol := util.FindElement(nav, atom.Ol); ol != nil {
+		return list(ol), nil
+	}
+	return nil, nil
+}
+
+func readNCXTOC(epubdir, relpath string) ([]TOCEntry, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(filepath.Join(epubdir, filepath.FromSlash(relpath))); err != nil {
+		return nil, err
+	}
+	var points func(*etree.Element) []TOCEntry
+	points = func(parent *etree.Element) []TOCEntry {
+		var toc []TOCEntry
+		for _, np := range parent.SelectElements("navPoint") {
+			var e TOCEntry
+			if el := np.FindElement("navLabel/text"); el != nil {
+				e.Title = strings.Join(strings.Fields(el.Text()), " ")
+			}
+			if el := np.SelectElement("content"); el != nil {
+				if target, fragment, ok := splitRef(relpath, el.SelectAttrValue("src", "")); ok {
+					e.Path, e.Fragment = target, fragment
+				}
+			}
+			e.Children = points(np)
+			toc = append(toc, e)
+		}
+		return toc
+	}
+	if nm := doc.FindElement("//navMap"); nm != nil {
+		return points(nm), nil
+	}
+	return nil, nil
+}
+
+// WriteNav writes an EPUB 3 navigation document to relpath (slash-separated,
+// relative to the epub root).
+func WriteNav(epubdir, relpath string, nav Nav) error {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="utf-8"`)
+	doc.CreateDirective("DOCTYPE html")
+	root := doc.CreateElement("html")
+	root.CreateAttr("xmlns", "http://www.w3.org/1999/xhtml")
+	root.CreateAttr("xmlns:epub", "http://www.idpf.org/2007/ops")
+	if nav.Language != "" {
+		root.CreateAttr("lang", nav.Language)
+		root.CreateAttr("xml:lang", nav.Language)
+	}
+	root.CreateElement("head").CreateElement("title").SetText(nav.Title)
+	body := root.CreateElement("body")
+
+	el := body.CreateElement("nav")
+	el.CreateAttr("epub:type", "toc")
+	el.CreateAttr("id", "toc")
+	el.CreateElement("h1").SetText("Contents")
+	var list func(*etree.Element, []TOCEntry)
+	list = func(parent *etree.Element, entries []TOCEntry) {
+		ol := parent.CreateElement("ol")
+		for _, e := range entries {
+			li := ol.CreateElement("li")
+			if e.Path != "" {
+				a := li.CreateElement("a")
+				a.CreateAttr("href", RelativeRef(relpath, e.Path, e.Fragment))
+				a.SetText(e.Title)
+			} else {
+				li.CreateElement("span").SetText(e.Title)
+			}
+			if len(e.Children) != 0 {
+				list(li, e.Children)
+			}
+		}
+	}
+	list(el, nav.TOC)
+
+	if len(nav.Landmarks) != 0 {
+		el := body.CreateElement("nav")
+		el.CreateAttr("epub:type", "landmarks")
+		el.CreateAttr("hidden", "hidden")
+		ol := el.CreateElement("ol")
+		for _, l := range nav.Landmarks {
+			a := ol.CreateElement("li").CreateElement("a")
+			a.CreateAttr("epub:type", l.Type)
+			a.CreateAttr("href", RelativeRef(relpath, l.Path, l.Fragment))
+			a.SetText(l.Title)
+		}
+	}
+
+	if len(nav.PageList) != 0 {
+		createNavPageList(body, relpath, nav.PageList)
+	}
+
+	doc.Indent(2)
+	return doc.WriteToFile(filepath.Join(epubdir, filepath.FromSlash(relpath)))
+}
+
+// WriteNCX writes an NCX document for EPUB 2 reading systems to relpath
+// (slash-separated, relative to the epub root). Entries without a link use the
+// link of their first descendant which has one, and are skipped otherwise. If
+// there is a page list, the package and content documents must already exist
+// so the playOrder can follow the reading order.
+func WriteNCX(epubdir, relpath string, nav Nav) error {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	root := doc.CreateElement("ncx")
+	root.CreateAttr("xmlns", "http://www.daisy.org/z3986/2005/ncx/")
+	root.CreateAttr("version", "2005-1")
+	if nav.Language != "" {
+		root.CreateAttr("xml:lang", nav.Language)
+	}
+
+	var depth func([]TOCEntry) int
+	depth = func(entries []TOCEntry) int {
+		var d int
+		for _, e := range entries {
+			if c := depth(e.Children) + 1; c > d {
+				d = c
+			}
+		}
+		return d
+	}
+	d := depth(nav.TOC)
+	if d == 0 {
+		d = 1
+	}
+	total, maxPage := ncxPageCounts(nav.PageList)
+	head := root.CreateElement("head")
+	for _, m := range [][2]string{
+		{"dtb:uid", nav.Identifier},
+		{"dtb:depth", fmt.Sprint(d)},
+		{"dtb:totalPageCount", fmt.Sprint(total)},
+		{"dtb:maxPageNumber", fmt.Sprint(maxPage)},
+	} {
+		el := head.CreateElement("meta")
+		el.CreateAttr("name", m[0])
+		el.CreateAttr("content", m[1])
+	}
+	root.CreateElement("docTitle").CreateElement("text").SetText(nav.Title)
+	for _, a := range nav.Authors {
+		root.CreateElement("docAuthor").CreateElement("text").SetText(a)
+	}
+
+	var first func(TOCEntry) (TOCEntry, bool)
+	first = func(e TOCEntry) (TOCEntry, bool) {
+		if e.Path != "" {
+			return e, true
+		}
+		for _, c := range e.Children {
+			if t, ok := first(c); ok {
+				return t, true
+			}
+		}
+		return e, false
+	}
+
+	var n int
+	var points func(*etree.Element, []TOCEntry)
+	points = func(parent *etree.Element, entries []TOCEntry) {
+		for _, e := range entries {
+			t, ok := first(e)
+			if !ok {
+				continue
+			}
+			n++
+			np := parent.CreateElement("navPoint")
+			np.CreateAttr("id", fmt.Sprintf("navpoint-%d", n))
+			np.CreateAttr("playOrder", fmt.Sprint(n))
+			np.CreateElement("navLabel").CreateElement("text").SetText(e.Title)
+			np.CreateElement("content").CreateAttr("src", RelativeRef(relpath, t.Path, t.Fragment))
+			points(np, e.Children)
+		}
+	}
+	points(root.CreateElement("navMap"), nav.TOC)
+
+	if len(nav.PageList) != 0 {
+		createNCXPageList(root, relpath, nav.PageList)
+		if err := ncxPlayOrder(epubdir, relpath, root); err != nil {
+			return err
+		}
+	}
+
+	doc.Indent(2)
+	return doc.WriteToFile(filepath.Join(epubdir, filepath.FromSlash(relpath)))
+}
+
+// createNavPageList adds a page-list nav element to an EPUB 3 navigation
+// document.
+func createNavPageList(parent *etree.Element, relpath string, pages []PageTarget) *etree.Element {
+	el := parent.CreateElement("nav")
+	el.CreateAttr("epub:type", "page-list")
+	el.CreateAttr("hidden", "hidden")
+	ol := el.CreateElement("ol")
+	for _, p := range pages {
+		a := ol.CreateElement("li").CreateElement("a")
+		a.CreateAttr("href", RelativeRef(relpath, p.Path, p.Fragment))
+		a.SetText(p.Name)
+	}
+	return el
+}
+
+// createNCXPageList adds a pageList element to an NCX document. The playOrder
+// of the page targets must be set afterwards with ncxPlayOrder.
+func createNCXPageList(parent *etree.Element, relpath string, pages []PageTarget) *etree.Element {
+	el := etree.NewElement("pageList")
+	el.CreateElement("navLabel").CreateElement("text").SetText("Pages")
+	for i, p := range pages {
+		pt := el.CreateElement("pageTarget")
+		pt.CreateAttr("id", fmt.Sprintf("pagetarget-%d", i+1))
+		if v, err := strconv.Atoi(p.Name); err == nil && v > 0 {
+			pt.CreateAttr("type", "normal")
+			pt.CreateAttr("value", p.Name)
+		} else if ncxRomanRe.MatchString(p.Name) {
+			pt.CreateAttr("type", "front")
+		} else {
+			pt.CreateAttr("type", "special")
+		}
+		pt.CreateElement("navLabel").CreateElement("text").SetText(p.Name)
+		pt.CreateElement("content").CreateAttr("src", RelativeRef(relpath, p.Path, p.Fragment))
+	}
+	// the pageList goes before any navLists
+	if nl := parent.SelectElement("navList"); nl != nil {
+		parent.InsertChild(nl, el)
+	} else {
+		parent.AddChild(el)
+	}
+	return el
+}
+
+var ncxRomanRe = regexp.MustCompile(`^(?i)[ivxlcdm]+$`)
+
+// ncxPlayOrder sets the playOrder of the navPoints, pageTargets, and navTargets
+// in an NCX document to the reading order of their targets (the spine, then the
+// position in the document). Entries with the same target share a playOrder,
+// and entries with a target outside the spine stay after the previous entry of
+// the same kind.
+func ncxPlayOrder(epubdir, relpath string, root *etree.Element) error {
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return err
+	}
+	spine := map[string]int{}
+	for i, it := range pkg.SpineItems() {
+		if _, ok := spine[it.Path]; !ok {
+			spine[it.Path] = i
+		}
+	}
+
+	ids := map[string]map[string]int{} // path -> id -> element index
+	position := func(target, fragment string) ([2]int, bool) {
+		i, ok := spine[target]
+		if !ok {
+			return [2]int{}, false
+		}
+		if fragment == "" {
+			return [2]int{i, 0}, true
+		}
+		m, ok := ids[target]
+		if !ok {
+			m = map[string]int{}
+			ids[target] = m
+			if buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(target))); err == nil {
+				if doc, err := html.Parse(bytes.NewReader(buf)); err == nil {
+					var n int
+					util.Walk(doc, func(c *html.Node) bool {
+						if c.Type == html.ElementNode {
+							n++
+							if id, ok := util.LookupAttr(c, "id"); ok {
+								if _, ok := m[id]; !ok {
+									m[id] = n
+								}
+							}
+						}
+						return true
+					}, nil)
+				}
+			}
+		}
+		return [2]int{i, m[fragment]}, true
+	}
+
+	type entry struct {
+		el     *etree.Element
+		target string
+		pos    [2]int
+	}
+	var entries []entry
+	prev := map[string][2]int{} // tag -> position of the previous entry
+	var walk func(*etree.Element)
+	walk = func(el *etree.Element) {
+		for _, c := range el.ChildElements() {
+			switch c.Tag {
+			case "navPoint", "pageTarget", "navTarget":
+				e := entry{el: c, pos: prev[c.Tag]}
+				if ct := c.SelectElement("content"); ct != nil {
+					src := ct.SelectAttrValue("src", "")
+					e.target = src
+					if target, fragment, ok := splitRef(relpath, src); ok {
+						e.target = target + "#" + fragment
+						if pos, ok := position(target, fragment); ok {
+							e.pos = pos
+						}
+					}
+				}
+				prev[c.Tag] = e.pos
+				entries = append(entries, e)
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].pos, entries[j].pos
+		return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+	})
+	order := map[string]int{}
+	for _, e := range entries {
+		n, ok := order[e.target]
+		if !ok {
+			n = len(order) + 1
+			order[e.target] = n
+		}
+		e.el.CreateAttr("playOrder", strconv.Itoa(n))
+	}
+	return nil
+}
+
+// ncxPageCounts gets the dtb:totalPageCount and dtb:maxPageNumber for a page
+// list.
+func ncxPageCounts(pages []PageTarget) (total, maxPage int) {
+	for _, p := range pages {
+		if v, err := strconv.Atoi(p.Name); err == nil && v > maxPage {
+			maxPage = v
+		}
+	}
+	return len(pages), maxPage
+}
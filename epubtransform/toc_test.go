@@ -0,0 +1,78 @@
+package epubtransform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/beevik/etree"
+)
+
+func TestWriteNCXPlayOrder(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	writeTestFiles(t, td, map[string]string{
+		"META-INF/container.xml": testContainer("content.opf"),
+		"content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>`,
+		"ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>1</title></head><body><span id="p1"/><p>a</p><span id="p2"/><p>b</p></body></html>`,
+		"ch2.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>2</title></head><body><p>c</p><h2 id="s1">S</h2><span id="p4"/><p>d</p></body></html>`,
+	})
+
+	if err := WriteNCX(td, "toc.ncx", Nav{
+		Title: "Test",
+		TOC: []TOCEntry{
+			{Title: "One", Path: "ch1.xhtml"},
+			{Title: "Two", Path: "ch2.xhtml", Children: []TOCEntry{
+				{Title: "Section", Path: "ch2.xhtml", Fragment: "s1"},
+			}},
+		},
+		PageList: []PageTarget{
+			{Name: "1", Path: "ch1.xhtml", Fragment: "p1"},
+			{Name: "2", Path: "ch1.xhtml", Fragment: "p2"},
+			{Name: "3", Path: "ch2.xhtml"},
+			{Name: "4", Path: "ch2.xhtml", Fragment: "p4"},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(filepath.Join(td, "toc.ncx")); err != nil {
+		t.Fatal(err)
+	}
+	order := map[string]string{}
+	for _, el := range append(doc.FindElements("//navPoint"), doc.FindElements("//pageTarget")...) {
+		order[el.SelectElement("content").SelectAttrValue("src", "")+" "+el.Tag] = el.SelectAttrValue("playOrder", "")
+	}
+	if exp := map[string]string{
+		"ch1.xhtml navPoint":      "1",
+		"ch1.xhtml#p1 pageTarget": "2",
+		"ch1.xhtml#p2 pageTarget": "3",
+		"ch2.xhtml navPoint":      "4",
+		"ch2.xhtml pageTarget":    "4",
+		"ch2.xhtml#s1 navPoint":   "5",
+		"ch2.xhtml#p4 pageTarget": "6",
+	}; !reflect.DeepEqual(order, exp) {
+		t.Errorf("expected playOrder %v, got %v", exp, order)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -11,7 +12,9 @@ import (
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/css"
 	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
 )
 
 // Pipeline represents a series of transformations.
@@ -30,7 +33,10 @@ type Transform struct {
 	OPFDoc      func(opf *etree.Document) error
 	Raw         func(epubdir string) error
 	ContentFile func(relpath, html string) (newHTML string, err error)
-	ContentDoc  func(relpath string, doc *goquery.Document) error // warning: don't use this with badly structured html (i.e. unclosed tags)
+	ContentDoc  func(relpath string, doc *goquery.Document) error      // warning: don't use this with badly structured html (i.e. unclosed tags)
+	CSS         func(relpath, css string) (newCSS string, err error)   // called for text/css manifest items and the style elements in manifest content documents (with the relpath of the document)
+	CSSDoc      func(relpath string, stylesheet *css.Stylesheet) error // warning: comments will be removed
+	fonts       func(epubdir string, skip map[string]bool) error       // like Raw, but can also change which fonts are left as-is when re-obfuscating
 	// TODO: NCXDoc, NCX
 }
 
@@ -58,6 +64,11 @@ func (p Pipeline) Run(input InputFunc, output OutputFunc, verbose bool) error {
 		return errors.New("could not access META-INF/container.xml")
 	}
 
+	skip, err := deobfuscateFonts(epubdir)
+	if err != nil {
+		return util.Wrap(err, "could not de-obfuscate fonts")
+	}
+
 	for i, transform := range p {
 		if verbose {
 			if transform.Desc != "" {
@@ -81,6 +92,11 @@ func (p Pipeline) Run(input InputFunc, output OutputFunc, verbose bool) error {
 				return util.Wrap(err, "could not run raw transform (%s)", transform.Desc)
 			}
 		}
+		if transform.fonts != nil {
+			if err := transform.fonts(epubdir, skip); err != nil {
+				return util.Wrap(err, "could not run fonts transform (%s)", transform.Desc)
+			}
+		}
 		if transform.ContentFile != nil {
 			if err := transformContent(epubdir, transform.ContentFile); err != nil {
 				return util.Wrap(err, "could not run content transform (%s)", transform.Desc)
@@ -91,6 +107,16 @@ func (p Pipeline) Run(input InputFunc, output OutputFunc, verbose bool) error {
 				return util.Wrap(err, "could not run contentdoc transform (%s)", transform.Desc)
 			}
 		}
+		if transform.CSS != nil {
+			if err := transformCSS(epubdir, transform.CSS); err != nil {
+				return util.Wrap(err, "could not run css transform (%s)", transform.Desc)
+			}
+		}
+		if transform.CSSDoc != nil {
+			if err := transformCSSDoc(epubdir, transform.CSSDoc); err != nil {
+				return util.Wrap(err, "could not run cssdoc transform (%s)", transform.Desc)
+			}
+		}
 	}
 
 	if output == nil {
@@ -100,6 +126,10 @@ func (p Pipeline) Run(input InputFunc, output OutputFunc, verbose bool) error {
 		return nil
 	}
 
+	if err := obfuscateFonts(epubdir, skip); err != nil {
+		return util.Wrap(err, "could not obfuscate fonts")
+	}
+
 	if verbose {
 		fmt.Printf("Writing output\n")
 	}
@@ -177,13 +207,128 @@ func transformContentDoc(epubdir string, fn func(string, *goquery.Document) erro
 		if err != nil {
 			return str, err
 		}
+		orig, err := renderDocument(doc.Nodes[0], str)
+		if err != nil {
+			return str, err
+		}
 		if err := fn(relpath, doc); err != nil {
 			return str, err
 		}
-		nstr, err := doc.Html()
+		nstr, err := renderDocument(doc.Nodes[0], str)
 		if err != nil {
 			return str, err
 		}
+		if nstr == orig {
+			return str, nil // don't re-serialize unchanged documents
+		}
 		return nstr, nil
 	})
 }
+
+// transformCSS calls fn for the text/css manifest items and the style elements
+// in the content documents in the manifest.
+func transformCSS(epubdir string, fn func(string, string) (string, error)) error {
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return err
+	}
+	for _, it := range pkg.Manifest {
+		var inline bool
+		switch it.MediaType {
+		case "text/css":
+		case "application/xhtml+xml", "text/html":
+			inline = true
+		default:
+			continue
+		}
+		relpath, file := filepath.FromSlash(it.Path), filepath.Join(epubdir, filepath.FromSlash(it.Path))
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		if err := transformFile(file, func(str string) (string, error) {
+			if inline {
+				return transformStyleElements(str, func(style string) (string, error) {
+					nstyle, err := fn(relpath, style)
+					return nstyle, util.Wrap(err, "inline style")
+				})
+			}
+			return fn(relpath, str)
+		}); err != nil {
+			return util.Wrap(err, "transform %#v", file)
+		}
+	}
+	return nil
+}
+
+// transformStyleElements calls fn with the contents of each style element in a
+// document (without the CDATA section it may be wrapped in), and replaces them.
+// The rest of the document is left as-is.
+func transformStyleElements(str string, fn func(string) (string, error)) (string, error) {
+	var b strings.Builder
+	var last, off int
+	var inStyle bool
+	z := html.NewTokenizer(strings.NewReader(str))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return str, z.Err()
+			}
+			break
+		}
+		start := off
+		off += len(z.Raw())
+		switch tt {
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			inStyle = string(name) == "style"
+			continue
+		case html.SelfClosingTagToken:
+			z.NextIsNotRawText() // e.g. <script src="..."/> in XHTML
+		case html.TextToken:
+			if !inStyle {
+				break
+			}
+			style := str[start:off]
+			pre, post := "", ""
+			if t := strings.TrimSpace(style); strings.HasPrefix(t, "<![CDATA[") && strings.HasSuffix(t, "]]>") {
+				i, j := strings.Index(style, "<![CDATA[")+9, strings.LastIndex(style, "]]>")
+				pre, style, post = str[start:start+i], style[i:j], style[j:]
+			}
+			nstyle, err := fn(style)
+			if err != nil {
+				return str, err
+			}
+			if nstyle != style {
+				b.WriteString(str[last:start])
+				b.WriteString(pre)
+				b.WriteString(nstyle)
+				b.WriteString(post)
+				last = off
+			}
+		}
+		inStyle = false
+	}
+	if last == 0 {
+		return str, nil
+	}
+	b.WriteString(str[last:])
+	return b.String(), nil
+}
+
+func transformCSSDoc(epubdir string, fn func(string, *css.Stylesheet) error) error {
+	return transformCSS(epubdir, func(relpath string, str string) (string, error) {
+		ss, err := css.Parse(str)
+		if err != nil {
+			return str, err
+		}
+		ostr := ss.String()
+		if err := fn(relpath, ss); err != nil {
+			return str, err
+		}
+		if nstr := ss.String(); nstr != ostr {
+			return nstr, nil
+		}
+		return str, nil
+	})
+}
@@ -0,0 +1,142 @@
+package epubtransform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pgaskin/epubtool/css"
+)
+
+func TestTransformContentDoc(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	changed := `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Test</title></head>
+<body><p>teh cat<br/></p></body></html>`
+	unchanged := `<?xml version='1.0' encoding='utf-8'?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+  <head><title>Test</title></head>
+  <body><p>the cat<br/><img src="a.png" alt=""/></p></body>
+</html>
+`
+	writeTestFiles(t, td, map[string]string{
+		"changed.xhtml":   changed,
+		"unchanged.xhtml": unchanged,
+	})
+
+	tr := TransformReplace(ReplaceOptions{Rules: []ReplaceRule{{Find: `\bteh\b`, Replace: "the"}}}, nil)
+	if err := tr.Raw(td); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := transformContentDoc(td, tr.ContentDoc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "changed.xhtml")); err != nil {
+		t.Fatal(err)
+	} else if exp := `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title>Test</title></head>
+<body><p>the cat<br/></p></body></html>`; string(buf) != exp {
+		t.Errorf("changed: expected:\n%s\ngot:\n%s", exp, buf)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "unchanged.xhtml")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != unchanged {
+		t.Errorf("unchanged: expected file to be left as-is, got:\n%s", buf)
+	}
+}
+
+func TestTransformCSS(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	files := map[string]string{
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="css" href="style.css" media-type="text/css"/>
+    <item id="missing" href="missing.css" media-type="text/css"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.html" media-type="text/html"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>`,
+		"OEBPS/style.css": `p { color: red; }`,
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head>
+<script src="a.js"/>
+<!-- <style>p { color: red; }</style> -->
+<style type="text/css">
+  <![CDATA[ a > b { color: red; } ]]>
+</style>
+<STYLE></STYLE>
+</head><body><p style="color: red">red</p></body></html>`,
+		"OEBPS/ch2.html":      `<html><head><style>p { color: red; }</style><title>red</title></head><body><style>i { color: red; }</style></body></html>`,
+		"OEBPS/unlisted.html": `<html><head><style>p { color: red; }</style></head></html>`,
+	}
+	writeTestFiles(t, td, files)
+
+	var calls []string
+	if err := transformCSS(td, func(relpath, str string) (string, error) {
+		calls = append(calls, filepath.ToSlash(relpath)+": "+str)
+		return strings.Replace(str, "red", "green", -1), nil
+	}); err != nil {
+		t.Fatalf("css: unexpected error: %v", err)
+	}
+	if exp := []string{
+		"OEBPS/style.css: p { color: red; }",
+		"OEBPS/ch1.xhtml:  a > b { color: red; } ",
+		"OEBPS/ch2.html: p { color: red; }",
+		"OEBPS/ch2.html: i { color: red; }",
+	}; !reflect.DeepEqual(calls, exp) {
+		t.Errorf("css: expected calls %q, got %q", exp, calls)
+	}
+
+	if err := transformCSSDoc(td, func(relpath string, ss *css.Stylesheet) error {
+		ss.Walk(func(r *css.Rule) bool {
+			if d := r.Get("color"); d != nil && filepath.Ext(relpath) == ".html" {
+				d.Value = "blue"
+			}
+			return true
+		})
+		return nil
+	}); err != nil {
+		t.Fatalf("cssdoc: unexpected error: %v", err)
+	}
+
+	for relpath, exp := range map[string]string{
+		"OEBPS/style.css":     `p { color: green; }`,
+		"OEBPS/ch1.xhtml":     strings.Replace(files["OEBPS/ch1.xhtml"], "<![CDATA[ a > b { color: red; } ]]>", "<![CDATA[ a > b { color: green; } ]]>", 1),
+		"OEBPS/ch2.html":      "<html><head><style>p {\n    color: blue;\n}\n</style><title>red</title></head><body><style>i {\n    color: blue;\n}\n</style></body></html>",
+		"OEBPS/unlisted.html": files["OEBPS/unlisted.html"],
+	} {
+		if buf, err := ioutil.ReadFile(filepath.Join(td, filepath.FromSlash(relpath))); err != nil {
+			t.Errorf("read %s: %v", relpath, err)
+		} else if string(buf) != exp {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", relpath, exp, buf)
+		}
+	}
+
+	writeTestFiles(t, td, map[string]string{"OEBPS/style.css": `p { color: red`})
+	if err := transformCSSDoc(td, func(string, *css.Stylesheet) error { return nil }); err == nil {
+		t.Errorf("cssdoc: expected error for invalid stylesheet")
+	}
+}
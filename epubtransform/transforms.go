@@ -3,8 +3,11 @@ package epubtransform
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
 )
 
 // TransformTitle sets the epub opf dc:title.
@@ -27,6 +30,67 @@ func TransformPublisher(publisher string) Transform {
 	return TransformOPFMetadataElementContent(fmt.Sprintf("set publisher to %#v", publisher), "dc:publisher", publisher)
 }
 
+// TransformIdentifier sets the unique identifier of the epub (and the NCX uid).
+// Obfuscated fonts will be re-obfuscated using the new identifier.
+func TransformIdentifier(id string) Transform {
+	return Transform{
+		Desc: fmt.Sprintf("set identifier to %#v", id),
+		OPFDoc: func(opf *etree.Document) error {
+			pe := opf.FindElement("//package")
+			me := opf.FindElement("//package/metadata")
+			if pe == nil || me == nil {
+				return errors.New("could not find package>metadata element")
+			}
+			uid := pe.SelectAttrValue("unique-identifier", "")
+			for _, el := range me.FindElements("identifier") {
+				if uid != "" && el.SelectAttrValue("id", "") == uid {
+					el.SetText(id)
+					return nil
+				}
+			}
+			if uid == "" {
+				uid = "uid"
+				pe.CreateAttr("unique-identifier", uid)
+			}
+			el := me.CreateElement("dc:identifier")
+			el.CreateAttr("id", uid)
+			el.SetText(id)
+			return nil
+		},
+		Raw: func(epubdir string) error {
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			for _, it := range pkg.Manifest {
+				if it.MediaType != "application/x-dtbncx+xml" {
+					continue
+				}
+				file := filepath.Join(epubdir, filepath.FromSlash(it.Path))
+				if _, err := os.Stat(file); os.IsNotExist(err) {
+					continue
+				}
+				if err := transformFile(file, func(ncx string) (string, error) {
+					doc := etree.NewDocument()
+					if err := doc.ReadFromString(ncx); err != nil {
+						return ncx, err
+					}
+					for _, el := range doc.FindElements("//head/meta") {
+						if el.SelectAttrValue("name", "") == "dtb:uid" {
+							el.CreateAttr("content", id)
+							return doc.WriteToString()
+						}
+					}
+					return ncx, nil
+				}); err != nil {
+					return util.Wrap(err, "update ncx uid")
+				}
+			}
+			return nil
+		},
+	}
+}
+
 // TransformOPFMetadataElementContent sets the text content of the first instance of an element in package>metadata>element.
 func TransformOPFMetadataElementContent(desc, tag, content string) Transform {
 	return Transform{
@@ -0,0 +1,356 @@
+package epubtransform
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/pgaskin/epubtool/css"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// TransformCSSRemoveUnused removes selectors from stylesheets which do not match
+// any element in the content documents, and rules which no longer have any
+// selectors. Selectors which can't be checked (e.g. unsupported pseudo-classes)
+// are kept.
+func TransformCSSRemoveUnused() Transform {
+	return Transform{
+		Desc: "remove unused css selectors",
+		Raw: func(epubdir string) error {
+			docs, err := readContentDocs(epubdir)
+			if err != nil {
+				return err
+			}
+			used := map[string]bool{}
+			return transformCSSDoc(epubdir, func(relpath string, ss *css.Stylesheet) error {
+				ss.Rules = cssRemoveUnused(ss.Rules, func(sel string) bool {
+					if u, ok := used[sel]; ok {
+						return u
+					}
+					used[sel] = cssSelectorUsed(sel, docs)
+					return used[sel]
+				})
+				return nil
+			})
+		},
+	}
+}
+
+// TransformCSSMergeRules removes duplicate declarations and rules, and merges
+// adjacent rules with the same selectors or declarations.
+func TransformCSSMergeRules() Transform {
+	return Transform{
+		Desc: "merge css rules",
+		CSSDoc: func(relpath string, ss *css.Stylesheet) error {
+			ss.Rules = cssMergeRules(ss.Rules)
+			return nil
+		},
+	}
+}
+
+// TransformCSSMinify removes unnecessary whitespace from stylesheets.
+func TransformCSSMinify() Transform {
+	return Transform{
+		Desc: "minify css",
+		CSS: func(relpath, str string) (string, error) {
+			ss, err := css.Parse(str)
+			if err != nil {
+				return str, err
+			}
+			return ss.Minified(), nil
+		},
+	}
+}
+
+// readContentDocs parses all content documents.
+func readContentDocs(epubdir string) ([]*goquery.Document, error) {
+	files, err := util.MultiGlob(epubdir, "**/*.html", "**/*.xhtml", "**/*.htm")
+	if err != nil {
+		return nil, err
+	}
+	var docs []*goquery.Document
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := goquery.NewDocumentFromReader(f)
+		f.Close()
+		if err != nil {
+			return nil, util.Wrap(err, "parse %#v", filepath.Base(file))
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// cssGroupingRules are the at-rules which contain style rules which apply to
+// the document.
+var cssGroupingRules = map[string]bool{
+	"media":         true,
+	"supports":      true,
+	"document":      true,
+	"-moz-document": true,
+}
+
+func cssRemoveUnused(rules []*css.Rule, used func(sel string) bool) []*css.Rule {
+	res := rules[:0]
+	for _, r := range rules {
+		switch {
+		case r.AtRule == "":
+			var sels []string
+			for _, sel := range r.Selectors() {
+				if used(sel) {
+					sels = append(sels, sel)
+				}
+			}
+			if len(sels) == 0 {
+				continue
+			}
+			r.SetSelectors(sels)
+		case cssGroupingRules[r.AtRule]:
+			if r.Rules = cssRemoveUnused(r.Rules, used); len(r.Rules) == 0 && len(r.Declarations) == 0 {
+				continue
+			}
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// cssDynamicPseudoRe matches pseudo-elements and pseudo-classes which depend on
+// user interaction or are vendor-specific.
+var cssDynamicPseudoRe = regexp.MustCompile(`::?(?:-[a-zA-Z-]+|before|after|first-line|first-letter|selection|marker|placeholder|backdrop|hover|active|focus|focus-within|focus-visible|visited|link|target|checked|disabled|enabled)\b(?:\([^)]*\))?`)
+
+// cssCompileSelector compiles a selector for matching against a document,
+// ignoring the parts which depend on user interaction. If it can't be compiled,
+// false is returned.
+func cssCompileSelector(sel string) (cascadia.Selector, bool) {
+	sel = strings.TrimSpace(cssDynamicPseudoRe.ReplaceAllString(sel, ""))
+	if sel == "" || strings.ContainsAny(sel[len(sel)-1:], ">+~") {
+		sel += "*"
+	}
+	m, err := cascadia.Compile(sel)
+	if err != nil {
+		return nil, false
+	}
+	return m, true
+}
+
+// cssSelectorUsed checks if a selector matches anything in docs. If it can't be
+// checked, it is assumed to be used.
+func cssSelectorUsed(sel string, docs []*goquery.Document) bool {
+	m, ok := cssCompileSelector(sel)
+	if !ok {
+		return true
+	}
+	for _, doc := range docs {
+		if doc.FindMatcher(m).Length() != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func cssMergeRules(rules []*css.Rule) []*css.Rule {
+	for _, r := range rules {
+		if cssGroupingRules[r.AtRule] {
+			r.Rules = cssMergeRules(r.Rules)
+		}
+		r.Declarations = cssDedupeDeclarations(r.Declarations)
+	}
+
+	// remove rules identical to a later one
+	last := map[string]int{}
+	for i, r := range rules {
+		if r.AtRule == "" && len(r.Rules) == 0 {
+			last[cssRuleKey(r)] = i
+		}
+	}
+	res := rules[:0]
+	for i, r := range rules {
+		if r.AtRule == "" && len(r.Rules) == 0 && last[cssRuleKey(r)] != i {
+			continue
+		}
+		res = append(res, r)
+	}
+
+	// merge adjacent rules
+	merged := res[:0]
+	for _, r := range res {
+		if len(merged) != 0 {
+			p := merged[len(merged)-1]
+			if p.AtRule == "" && r.AtRule == "" && len(p.Rules) == 0 && len(r.Rules) == 0 {
+				if p.Prelude == r.Prelude {
+					p.Declarations = cssDedupeDeclarations(append(p.Declarations, r.Declarations...))
+					continue
+				}
+				if css.FormatDeclarations(p.Declarations, true) == css.FormatDeclarations(r.Declarations, true) && cssSafeToGroup(p) && cssSafeToGroup(r) {
+					p.SetSelectors(append(p.Selectors(), r.Selectors()...))
+					continue
+				}
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// cssSafeToGroup checks if the selectors of a rule can be safely grouped with
+// another rule without causing the group to be invalid in some readers.
+func cssSafeToGroup(r *css.Rule) bool {
+	for _, sel := range r.Selectors() {
+		if strings.Contains(sel, ":-") {
+			return false
+		}
+		if _, ok := cssCompileSelector(sel); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func cssRuleKey(r *css.Rule) string {
+	return r.Prelude + "{" + css.FormatDeclarations(r.Declarations, true) + "}"
+}
+
+// cssDedupeDeclarations removes declarations identical to a later one.
+func cssDedupeDeclarations(decls []*css.Declaration) []*css.Declaration {
+	last := map[string]int{}
+	for i, d := range decls {
+		last[d.String()] = i
+	}
+	res := decls[:0]
+	for i, d := range decls {
+		if last[d.String()] == i {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// StyleFilter is called for each declaration in style rules and style
+// attributes by TransformStripStyles. The selector is the tag name for style
+// attributes. The declaration can be modified in-place, and will be removed if
+// false is returned.
+type StyleFilter func(selector string, d *css.Declaration) (keep bool)
+
+// cssAbsoluteLengthRe matches a CSS length with an absolute unit.
+var cssAbsoluteLengthRe = regexp.MustCompile(`(?i)(?:^|[\s/])[+-]?[0-9.]+(?:px|pt|pc|cm|mm|in|q)\b`)
+
+// StylePresets are the predefined filters for TransformStripStyles.
+var StylePresets = map[string]StyleFilter{
+	// respect-font removes font families (except monospace ones) so the reader's
+	// font is used.
+	"respect-font": func(selector string, d *css.Declaration) bool {
+		return d.Property != "font-family" || strings.Contains(strings.ToLower(d.Value), "monospace")
+	},
+	// remove-fixed-sizes removes font sizes and line heights with absolute units.
+	"remove-fixed-sizes": func(selector string, d *css.Declaration) bool {
+		return (d.Property != "font-size" && d.Property != "line-height") || !cssAbsoluteLengthRe.MatchString(d.Value)
+	},
+	// line-height removes all line heights.
+	"line-height": func(selector string, d *css.Declaration) bool {
+		return d.Property != "line-height"
+	},
+	// no-justify removes justified text alignment.
+	"no-justify": func(selector string, d *css.Declaration) bool {
+		return d.Property != "text-align" || strings.ToLower(d.Value) != "justify"
+	},
+	// body-margins removes margins and padding on the body and html elements.
+	"body-margins": func(selector string, d *css.Declaration) bool {
+		if !strings.HasPrefix(d.Property, "margin") && !strings.HasPrefix(d.Property, "padding") {
+			return true
+		}
+		for _, sel := range (&css.Rule{Prelude: selector}).Selectors() {
+			if sel = strings.ToLower(sel); sel != "body" && sel != "html" {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// StyleFilterProperties returns a StyleFilter which removes the specified
+// properties.
+func StyleFilterProperties(properties ...string) StyleFilter {
+	return func(selector string, d *css.Declaration) bool {
+		for _, p := range properties {
+			if strings.EqualFold(d.Property, p) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// TransformStripStyles removes or modifies declarations in stylesheets and style
+// attributes using the provided filters (see StylePresets). Only style rules are
+// affected (i.e. not @font-face or @page).
+func TransformStripStyles(filters ...StyleFilter) Transform {
+	apply := func(selector string, decls []*css.Declaration) []*css.Declaration {
+		res := decls[:0]
+	decl:
+		for _, d := range decls {
+			for _, f := range filters {
+				if !f(selector, d) {
+					continue decl
+				}
+			}
+			res = append(res, d)
+		}
+		return res
+	}
+	return Transform{
+		Desc: "strip styles",
+		CSSDoc: func(relpath string, ss *css.Stylesheet) error {
+			var strip func(rules []*css.Rule) []*css.Rule
+			strip = func(rules []*css.Rule) []*css.Rule {
+				res := rules[:0]
+				for _, r := range rules {
+					if r.AtRule == "" {
+						n := len(r.Declarations)
+						r.Declarations = apply(r.Prelude, r.Declarations)
+						r.Rules = strip(r.Rules)
+						if n != 0 && len(r.Declarations) == 0 && len(r.Rules) == 0 {
+							continue // remove rules which are now empty
+						}
+					} else if cssGroupingRules[r.AtRule] {
+						if r.Rules = strip(r.Rules); len(r.Rules) == 0 {
+							continue
+						}
+					}
+					res = append(res, r)
+				}
+				return res
+			}
+			ss.Rules = strip(ss.Rules)
+			return nil
+		},
+		ContentDoc: func(relpath string, doc *goquery.Document) error {
+			var err error
+			doc.Find("[style]").EachWithBreak(func(_ int, sel *goquery.Selection) bool {
+				name := goquery.NodeName(sel)
+				decls, perr := css.ParseDeclarations(sel.AttrOr("style", ""))
+				if perr != nil {
+					err = util.Wrap(perr, "parse style attribute on %s", name)
+					return false
+				}
+				ostyle := css.FormatDeclarations(decls, false)
+				switch nstyle := css.FormatDeclarations(apply(name, decls), false); nstyle {
+				case ostyle:
+					// leave it as-is
+				case "":
+					sel.RemoveAttr("style")
+				default:
+					sel.SetAttr("style", nstyle)
+				}
+				return true
+			})
+			return err
+		},
+	}
+}
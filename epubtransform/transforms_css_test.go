@@ -0,0 +1,79 @@
+package epubtransform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransformStripStyles(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	unchanged := `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+  <head><title>Test</title></head>
+  <body><p class="a">text<br/></p></body>
+</html>
+`
+	writeTestFiles(t, td, map[string]string{
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="css" href="style.css" media-type="text/css"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>`,
+		"OEBPS/style.css": `@font-face { font-family: Foo; src: url(foo.ttf); }
+body { margin: 1em; }
+p { font-family: Foo; }
+pre { font-family: Bar, monospace; }`,
+		"OEBPS/ch1.xhtml": `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Test</title></head>
+<body><p style="font-family: Foo; color: red">a</p><p style='font-family:"Foo"'>b</p><pre style="font-family: monospace">c</pre></body></html>`,
+		"OEBPS/ch2.xhtml": unchanged,
+	})
+
+	tr := TransformStripStyles(StylePresets["respect-font"], StylePresets["body-margins"])
+	if err := transformCSSDoc(td, tr.CSSDoc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := transformContentDoc(td, tr.ContentDoc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for fn, exp := range map[string]string{
+		"OEBPS/style.css": `@font-face {
+    font-family: Foo;
+    src: url(foo.ttf);
+}
+pre {
+    font-family: Bar, monospace;
+}
+`,
+		"OEBPS/ch1.xhtml": `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title>Test</title></head>
+<body><p style="color: red">a</p><p>b</p><pre style="font-family: monospace">c</pre></body></html>`,
+		"OEBPS/ch2.xhtml": unchanged,
+	} {
+		if buf, err := ioutil.ReadFile(filepath.Join(td, filepath.FromSlash(fn))); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != exp {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", fn, exp, buf)
+		}
+	}
+}
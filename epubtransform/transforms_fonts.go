@@ -0,0 +1,406 @@
+package epubtransform
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pgaskin/epubtool/css"
+	"github.com/pgaskin/epubtool/fontsubset"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+)
+
+// FontMediaTypes are the media types used for fonts in epubs.
+var FontMediaTypes = []string{
+	"application/vnd.ms-opentype",
+	"application/font-sfnt",
+	"application/x-font-ttf",
+	"application/x-font-truetype",
+	"application/x-font-otf",
+	"application/x-font-opentype",
+	"application/font-woff",
+	"application/x-font-woff",
+	"font/ttf",
+	"font/otf",
+	"font/sfnt",
+	"font/woff",
+	"font/woff2",
+}
+
+// isFont checks if a manifest item is a font.
+func isFont(it ManifestItem) bool {
+	for _, mt := range FontMediaTypes {
+		if strings.EqualFold(it.MediaType, mt) {
+			return true
+		}
+	}
+	switch strings.ToLower(path.Ext(it.Path)) {
+	case ".ttf", ".otf", ".woff", ".woff2":
+		return true
+	}
+	return false
+}
+
+// TransformRemoveUnusedFonts removes @font-face rules for font families which
+// are not used by any element, and font files which are not referenced by the
+// remaining @font-face rules or any content document.
+func TransformRemoveUnusedFonts() Transform {
+	return Transform{
+		Desc: "remove unused fonts",
+		Raw: func(epubdir string) error {
+			fu, err := analyzeFonts(epubdir)
+			if err != nil {
+				return err
+			}
+
+			if err := transformCSSDoc(epubdir, func(relpath string, ss *css.Stylesheet) error {
+				ss.Filter(func(r *css.Rule) bool {
+					if r.AtRule != "font-face" {
+						return true
+					}
+					family := cssFontFaceFamily(r)
+					return family == "" || fu.used[family]
+				})
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			remove := map[string]bool{}
+			for _, it := range pkg.Manifest {
+				if isFont(it) && !fu.referenced(it.Path) {
+					remove[it.Path] = true
+				}
+			}
+			return removeFiles(epubdir, remove)
+		},
+	}
+}
+
+// TransformSubsetFonts removes the glyphs for characters which are not used
+// from fonts referenced by @font-face rules. The characters used by each font
+// family are determined from the elements matched by the style rules and style
+// attributes using it (including upper and lower case variants). Only fonts
+// with TrueType outlines are subset; other fonts (e.g. CFF-based OpenType or
+// WOFF) are left as-is.
+func TransformSubsetFonts() Transform {
+	return Transform{
+		Desc: "subset fonts",
+		Raw: func(epubdir string) error {
+			fu, err := analyzeFonts(epubdir)
+			if err != nil {
+				return err
+			}
+
+			// a font file may be used by more than one family
+			runes := map[string]map[rune]bool{}
+			for family, files := range fu.faces {
+				for _, file := range files {
+					if runes[file] == nil {
+						runes[file] = map[rune]bool{}
+					}
+					for r := range fu.runes[family] {
+						runes[file][r] = true
+					}
+				}
+			}
+
+			for relpath, rs := range runes {
+				file := filepath.Join(epubdir, filepath.FromSlash(relpath))
+				buf, err := ioutil.ReadFile(file)
+				if os.IsNotExist(err) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				if !isFontData(buf) {
+					continue // still obfuscated (e.g. with a different key)
+				}
+				nbuf, err := fontsubset.Subset(buf, rs)
+				if errors.Is(err, fontsubset.ErrUnsupported) {
+					continue // e.g. CFF-based OpenType or WOFF
+				} else if err != nil {
+					return util.Wrap(err, "subset %#v", relpath)
+				}
+				if len(nbuf) < len(buf) {
+					if err := ioutil.WriteFile(file, nbuf, 0644); err != nil {
+						return util.Wrap(err, "write %#v", relpath)
+					}
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// fontUsage contains information about the fonts used in an epub. Families are
+// lowercase, and paths are slash-separated and relative to the epub root.
+type fontUsage struct {
+	faces map[string][]string      // the files referenced by the @font-face rules for each family
+	used  map[string]bool          // whether each family is used by any element
+	runes map[string]map[rune]bool // the characters used for each family
+	other map[string]bool          // files referenced outside of @font-face rules
+}
+
+// referenced checks if a file is referenced by a used @font-face rule or
+// elsewhere.
+func (fu *fontUsage) referenced(relpath string) bool {
+	if fu.other[relpath] {
+		return true
+	}
+	for family, files := range fu.faces {
+		for _, file := range files {
+			if file == relpath && fu.used[family] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// use marks a family as used by the text of the selection.
+func (fu *fontUsage) use(family string, sel *goquery.Selection) {
+	fu.used[family] = true
+	if fu.runes[family] == nil {
+		fu.runes[family] = map[rune]bool{}
+	}
+	for _, n := range sel.Nodes {
+		walkTextNodes(n, func(t *html.Node) {
+			fu.addRunes(family, t.Data)
+		})
+	}
+}
+
+// addRunes adds the characters in s (and their case variants, for
+// text-transform) to a family.
+func (fu *fontUsage) addRunes(family, s string) {
+	rs := fu.runes[family]
+	for _, r := range s {
+		rs[r] = true
+		rs[unicode.ToUpper(r)] = true
+		rs[unicode.ToLower(r)] = true
+		rs[unicode.ToTitle(r)] = true
+	}
+}
+
+// analyzeFonts finds the @font-face rules in the manifest stylesheets and
+// inline style elements, and the elements using each font family.
+func analyzeFonts(epubdir string) (*fontUsage, error) {
+	fu := &fontUsage{
+		faces: map[string][]string{},
+		used:  map[string]bool{},
+		runes: map[string]map[rune]bool{},
+		other: map[string]bool{},
+	}
+
+	// the style rules and declarations, which are checked after all @font-face
+	// rules have been found
+	var rules []*css.Rule
+	var attrs []*goquery.Selection
+	addStylesheet := func(relpath, str string) error {
+		ss, err := css.Parse(str)
+		if err != nil {
+			return util.Wrap(err, "parse css in %#v", relpath)
+		}
+		ss.Walk(func(r *css.Rule) bool {
+			switch {
+			case r.AtRule == "font-face":
+				if family := cssFontFaceFamily(r); family != "" {
+					fu.faces[family] = append(fu.faces[family], cssFontFaceFiles(relpath, r)...)
+				}
+			case r.AtRule == "":
+				rules = append(rules, r)
+			}
+			return r.AtRule == "" || cssGroupingRules[r.AtRule]
+		})
+		return nil
+	}
+
+	pkg, err := ReadPackage(epubdir)
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range pkg.Manifest {
+		if it.MediaType != "text/css" {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := addStylesheet(it.Path, string(buf)); err != nil {
+			return nil, err
+		}
+	}
+
+	var docs []*goquery.Document
+	for _, it := range pkg.Manifest {
+		if it.MediaType != "application/xhtml+xml" && it.MediaType != "text/html" {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(buf)))
+		if err != nil {
+			return nil, util.Wrap(err, "parse %#v", it.Path)
+		}
+		docs = append(docs, doc)
+
+		if _, err := transformStyleElements(string(buf), func(style string) (string, error) {
+			return style, addStylesheet(it.Path, style)
+		}); err != nil {
+			return nil, err
+		}
+		doc.Find("[style]").Each(func(_ int, s *goquery.Selection) {
+			attrs = append(attrs, s)
+		})
+	}
+
+	// references from outside stylesheets (e.g. svg or object elements)
+	if err := walkReferenceFiles(epubdir, func(relpath, file string) error {
+		if markup, _ := isReferenceFile(relpath); !markup || relpath == pkg.Path || strings.HasPrefix(relpath, "META-INF/") {
+			return nil
+		}
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		str, err := transformStyleElements(string(buf), func(string) (string, error) {
+			return "", nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, ref := range findReferences(relpath, str) {
+			if target, _, ok := splitRef(relpath, ref.raw); ok {
+				fu.other[target] = true
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// the elements using each family
+	for _, r := range rules {
+		families := cssFontFamilies(r.Declarations, fu.faces)
+		if len(families) == 0 {
+			continue
+		}
+		for _, sel := range r.Selectors() {
+			m, ok := cssCompileSelector(sel)
+			for _, doc := range docs {
+				s := doc.Selection
+				if ok {
+					s = doc.FindMatcher(m)
+				}
+				if s.Length() == 0 {
+					continue
+				}
+				for _, family := range families {
+					fu.use(family, s)
+				}
+			}
+		}
+		// generated content
+		if d := r.Get("content"); d != nil {
+			for _, family := range families {
+				if fu.used[family] {
+					fu.addRunes(family, d.Value)
+				}
+			}
+		}
+	}
+	for _, s := range attrs {
+		decls, err := css.ParseDeclarations(s.AttrOr("style", ""))
+		if err != nil {
+			continue
+		}
+		for _, family := range cssFontFamilies(decls, fu.faces) {
+			fu.use(family, s)
+		}
+	}
+
+	return fu, nil
+}
+
+// cssFontFaceFamily returns the lowercase font family of a @font-face rule.
+func cssFontFaceFamily(r *css.Rule) string {
+	if d := r.Get("font-family"); d != nil {
+		return cssUnquote(d.Value)
+	}
+	return ""
+}
+
+// cssFontFaceFiles returns the slash-separated paths relative to the epub root
+// of the local files referenced by the src of a @font-face rule in relpath.
+func cssFontFaceFiles(relpath string, r *css.Rule) []string {
+	var files []string
+	if d := r.Get("src"); d != nil {
+		for _, m := range CSSURLRe.FindAllStringSubmatch(d.Value, -1) {
+			for _, raw := range m[1:] {
+				if raw == "" {
+					continue
+				}
+				if target, _, ok := splitRef(relpath, raw); ok {
+					files = append(files, target)
+				}
+				break
+			}
+		}
+	}
+	return files
+}
+
+// cssFontFamilies returns the families in faces used by the font-family or
+// font declarations.
+func cssFontFamilies(decls []*css.Declaration, faces map[string][]string) []string {
+	var families []string
+	seen := map[string]bool{}
+	for _, d := range decls {
+		switch d.Property {
+		case "font-family":
+			for _, family := range strings.Split(d.Value, ",") {
+				if family = cssUnquote(family); faces[family] != nil && !seen[family] {
+					seen[family] = true
+					families = append(families, family)
+				}
+			}
+		case "font":
+			// the family list is at the end of the shorthand, after the size
+			v := cssUnquote(strings.Replace(strings.Replace(d.Value, `"`, "", -1), `'`, "", -1))
+			for family := range faces {
+				if !seen[family] && strings.Contains(v, family) {
+					seen[family] = true
+					families = append(families, family)
+				}
+			}
+		}
+	}
+	return families
+}
+
+// cssUnquote trims, unquotes, and lowercases a font family name.
+func cssUnquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
@@ -0,0 +1,176 @@
+package epubtransform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pgaskin/epubtool/fontsubset"
+)
+
+func TestFonts(t *testing.T) {
+	files := map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+    <dc:title>Test</dc:title>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+    <item id="used" href="fonts/used.ttf" media-type="font/ttf"/>
+    <item id="inline" href="fonts/inline.ttf" media-type="font/ttf"/>
+    <item id="unused" href="fonts/unused.ttf" media-type="font/ttf"/>
+    <item id="cff" href="fonts/cff.otf" media-type="font/otf"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`,
+		"OEBPS/style.css": `@font-face { font-family: "Used Font"; src: url(fonts/used.ttf) format("truetype"); }
+@font-face { font-family: Unused; src: url("fonts/unused.ttf"); }
+@font-face { font-family: CFF; src: url(fonts/cff.otf); }
+h1 { font-family: "Used Font", serif; }
+.cff { font: bold 1em/1.2 CFF, sans-serif; }
+.none { font-family: Unused; }`,
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head>
+<link rel="stylesheet" href="style.css"/>
+<style><![CDATA[ @font-face { font-family: Inline; src: url(fonts/inline.ttf); } ]]></style>
+</head><body><h1>Ab<span>c</span></h1><p>xyz</p><p class="cff">q</p><p style="font-family: 'Inline'">d</p></body></html>`,
+		"OEBPS/fonts/used.ttf":   string(testTrueTypeFont("ABCDabcdxyz")),
+		"OEBPS/fonts/inline.ttf": string(testTrueTypeFont("ABCDabcdxyz")),
+		"OEBPS/fonts/unused.ttf": string(testTrueTypeFont("ABCDabcdxyz")),
+		"OEBPS/fonts/cff.otf":    "OTTO" + strings.Repeat("\x00", 64),
+	}
+
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+	writeTestFiles(t, td, files)
+
+	fu, err := analyzeFonts(td)
+	if err != nil {
+		t.Fatalf("analyze: unexpected error: %v", err)
+	}
+	if exp := map[string][]string{
+		"used font": {"OEBPS/fonts/used.ttf"},
+		"unused":    {"OEBPS/fonts/unused.ttf"},
+		"cff":       {"OEBPS/fonts/cff.otf"},
+		"inline":    {"OEBPS/fonts/inline.ttf"},
+	}; !reflect.DeepEqual(fu.faces, exp) {
+		t.Errorf("analyze: expected faces %v, got %v", exp, fu.faces)
+	}
+	if exp := map[string]bool{"used font": true, "cff": true, "inline": true}; !reflect.DeepEqual(fu.used, exp) {
+		t.Errorf("analyze: expected used %v, got %v", exp, fu.used)
+	}
+	for family, exp := range map[string]string{"used font": "ABCabc", "cff": "Qq", "inline": "Dd"} {
+		var rs []rune
+		for r := range fu.runes[family] {
+			rs = append(rs, r)
+		}
+		sort.Slice(rs, func(i, j int) bool { return rs[i] < rs[j] })
+		if string(rs) != exp {
+			t.Errorf("analyze: expected runes %q for %q, got %q", exp, family, string(rs))
+		}
+	}
+
+	if err := TransformRemoveUnusedFonts().Raw(td); err != nil {
+		t.Fatalf("remove unused: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(td, "OEBPS", "fonts", "unused.ttf")); !os.IsNotExist(err) {
+		t.Errorf("remove unused: expected unused font to be removed")
+	}
+	if pkg, err := ReadPackage(td); err != nil {
+		t.Fatalf("read package: %v", err)
+	} else if pkg.Item("unused") != nil || pkg.Item("used") == nil || pkg.Item("inline") == nil || pkg.Item("cff") == nil {
+		t.Errorf("remove unused: expected only the unused font to be removed from the manifest, got %+v", pkg.Manifest)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "style.css")); err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(string(buf), "unused.ttf") || !strings.Contains(string(buf), "used.ttf") {
+		t.Errorf("remove unused: expected only the unused @font-face rule to be removed, got:\n%s", buf)
+	}
+
+	if err := TransformSubsetFonts().Raw(td); err != nil {
+		t.Fatalf("subset: unexpected error: %v", err)
+	}
+	for name, exp := range map[string]string{"used.ttf": "ABCabc", "inline.ttf": "Dd"} {
+		buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "fonts", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs, err := fontsubset.Runes(buf); err != nil {
+			t.Errorf("subset: %s: unexpected error: %v", name, err)
+		} else if string(rs) != exp {
+			t.Errorf("subset: %s: expected runes %q, got %q", name, exp, string(rs))
+		}
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "fonts", "cff.otf")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != files["OEBPS/fonts/cff.otf"] {
+		t.Errorf("subset: expected unsupported font to be left as-is")
+	}
+
+	writeTestFiles(t, td, map[string]string{"OEBPS/fonts/used.ttf": "\x00\x01\x00\x00" + strings.Repeat("\xFF", 64)})
+	if err := TransformSubsetFonts().Raw(td); err == nil {
+		t.Errorf("subset: expected error for invalid font")
+	}
+}
+
+// testTrueTypeFont builds a minimal TrueType font with a glyph for each
+// character.
+func testTrueTypeFont(chars string) []byte {
+	rs := []rune(chars)
+	put := func(b *bytes.Buffer, vs ...interface{}) {
+		for _, v := range vs {
+			binary.Write(b, binary.BigEndian, v)
+		}
+	}
+
+	var glyf, loca bytes.Buffer
+	for i := 0; i <= len(rs); i++ {
+		put(&loca, uint32(glyf.Len()))
+		glyf.Write([]byte{0, 1, 0, 0, 0, 0, 0, 10, 0, 10, byte(i), byte(i), byte(i), byte(i)})
+	}
+	put(&loca, uint32(glyf.Len()))
+
+	var head, maxp bytes.Buffer
+	head.Write(make([]byte, 50))
+	put(&head, uint16(1), uint16(0))
+	put(&maxp, uint32(0x00005000), uint16(len(rs)+1))
+
+	// a format 12 subtable for platform 3 encoding 10
+	var cmap bytes.Buffer
+	put(&cmap, uint16(0), uint16(1), uint16(3), uint16(10), uint32(12))
+	put(&cmap, uint16(12), uint16(0), uint32(16+12*len(rs)), uint32(0), uint32(len(rs)))
+	for i, r := range rs {
+		put(&cmap, uint32(r), uint32(r), uint32(i+1))
+	}
+
+	tags := []string{"cmap", "glyf", "head", "loca", "maxp"}
+	tables := [][]byte{cmap.Bytes(), glyf.Bytes(), head.Bytes(), loca.Bytes(), maxp.Bytes()}
+	var b bytes.Buffer
+	put(&b, uint32(0x00010000), uint16(len(tags)), uint16(0), uint16(0), uint16(0))
+	off := 12 + 16*len(tags)
+	for i, tag := range tags {
+		b.WriteString(tag)
+		put(&b, uint32(0), uint32(off), uint32(len(tables[i])))
+		off += (len(tables[i]) + 3) &^ 3
+	}
+	for _, table := range tables {
+		b.Write(table)
+		b.Write(make([]byte, (4-len(table)%4)%4))
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,313 @@
+package epubtransform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+)
+
+// ImageOptions controls how TransformOptimizeImages processes images.
+type ImageOptions struct {
+	// MaxWidth and MaxHeight are the maximum dimensions of images. Larger images
+	// are scaled down, preserving the aspect ratio. Zero means no limit.
+	MaxWidth, MaxHeight int
+	// JPEGQuality is the quality (1-100) to re-encode JPEG images with. If it is
+	// zero, JPEG images are only re-encoded (with quality 85) if they need to be
+	// modified for another option.
+	JPEGQuality int
+	// PNGToJPEG converts PNG images without transparency to JPEG.
+	PNGToJPEG bool
+	// Grayscale converts images to grayscale (e.g. for e-ink readers).
+	Grayscale bool
+}
+
+// TransformOptimizeImages scales down and re-encodes the PNG and JPEG images in
+// the manifest. Images are only replaced if they were modified or the result is
+// smaller. If the format of an image changes, the manifest and all references
+// to it are updated.
+func TransformOptimizeImages(opts ImageOptions) Transform {
+	return Transform{
+		Desc: "optimize images",
+		Raw: func(epubdir string) error {
+			if opts.JPEGQuality < 0 || opts.JPEGQuality > 100 {
+				return fmt.Errorf("invalid jpeg quality %d", opts.JPEGQuality)
+			}
+
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+
+			renames := map[string]string{}
+			for _, it := range pkg.Manifest {
+				if it.MediaType != "image/png" && it.MediaType != "image/jpeg" {
+					continue
+				}
+				npath, err := optimizeImage(epubdir, it, opts)
+				if err != nil {
+					return util.Wrap(err, "optimize %#v", it.Path)
+				}
+				if npath != it.Path {
+					renames[it.Path] = npath
+				}
+			}
+
+			if len(renames) == 0 {
+				return nil
+			}
+			if err := RewriteReferences(epubdir, renames); err != nil {
+				return err
+			}
+			converted := map[string]bool{}
+			for _, npath := range renames {
+				converted[npath] = true
+			}
+			return transformOPFDoc(epubdir, func(opf *etree.Document) error {
+				for _, el := range opf.FindElements("//package/manifest/item") {
+					if converted[resolveHref(pkg.Path, el.SelectAttrValue("href", ""))] {
+						el.CreateAttr("media-type", "image/jpeg")
+					}
+				}
+				return nil
+			})
+		},
+	}
+}
+
+// optimizeImage optimizes a single image, returning the new path relative to the
+// epub root if it was changed.
+func optimizeImage(epubdir string, it ManifestItem, opts ImageOptions) (string, error) {
+	file := filepath.Join(epubdir, filepath.FromSlash(it.Path))
+
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return it.Path, nil
+	} else if err != nil {
+		return it.Path, err
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return it.Path, util.Wrap(err, "decode image")
+	}
+
+	w, h := fitSize(cfg.Width, cfg.Height, opts.MaxWidth, opts.MaxHeight)
+	resize := w != cfg.Width || h != cfg.Height
+	if !resize && !opts.Grayscale && !(format == "png" && opts.PNGToJPEG) && !(format == "jpeg" && opts.JPEGQuality != 0) {
+		return it.Path, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return it.Path, util.Wrap(err, "decode image")
+	}
+
+	modified := resize || (opts.Grayscale && !isGray(img))
+	if resize {
+		img = resizeImage(img, w, h)
+	}
+	if opts.Grayscale {
+		img = toGray(img)
+	}
+
+	encode := func(format string) ([]byte, error) {
+		var b bytes.Buffer
+		var err error
+		switch format {
+		case "jpeg":
+			q := opts.JPEGQuality
+			if q == 0 {
+				q = 85
+			}
+			err = jpeg.Encode(&b, img, &jpeg.Options{Quality: q})
+		case "png":
+			err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&b, img)
+		default:
+			err = errors.New("unsupported format " + format)
+		}
+		if err != nil {
+			return nil, util.Wrap(err, "encode %s image", format)
+		}
+		return b.Bytes(), nil
+	}
+
+	nformat := format
+	nbuf, err := encode(format)
+	if err != nil {
+		return it.Path, err
+	}
+
+	// only convert to jpeg if it's actually smaller
+	if format == "png" && opts.PNGToJPEG && isOpaque(img) {
+		jbuf, err := encode("jpeg")
+		if err != nil {
+			return it.Path, err
+		}
+		if len(jbuf) < len(nbuf) && (modified || len(jbuf) < len(buf)) {
+			nformat, nbuf = "jpeg", jbuf
+		}
+	}
+
+	if !modified && nformat == format && len(nbuf) >= len(buf) {
+		return it.Path, nil
+	}
+
+	npath := it.Path
+	if nformat != format {
+		base, _ := util.SplitExt(it.Path)
+		npath = base + ".jpg"
+		for i := 1; ; i++ {
+			if _, err := os.Stat(filepath.Join(epubdir, filepath.FromSlash(npath))); os.IsNotExist(err) {
+				break
+			}
+			npath = fmt.Sprintf("%s-%d.jpg", base, i)
+		}
+	}
+
+	nfile := filepath.Join(epubdir, filepath.FromSlash(npath))
+	if err := ioutil.WriteFile(nfile, nbuf, 0644); err != nil {
+		return it.Path, err
+	}
+	if nfile != file {
+		if err := os.Remove(file); err != nil {
+			return it.Path, err
+		}
+	}
+	return path.Clean(npath), nil
+}
+
+// fitSize scales w and h down to fit within mw and mh (if nonzero), preserving
+// the aspect ratio.
+func fitSize(w, h, mw, mh int) (int, int) {
+	if mw > 0 && w > mw {
+		w, h = mw, h*mw/w
+	}
+	if mh > 0 && h > mh {
+		w, h = w*mh/h, mh
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// resizeImage scales an image to the specified size using area averaging, which
+// gives good results for downscaling.
+func resizeImage(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	// horizontal pass
+	tmp := make([]float32, w*b.Dy()*4)
+	resample(b.Dx(), w, func(dx, sx int, weight float32) {
+		for y := 0; y < b.Dy(); y++ {
+			si, di := y*rgba.Stride+sx*4, (y*w+dx)*4
+			for c := 0; c < 4; c++ {
+				tmp[di+c] += float32(rgba.Pix[si+c]) * weight
+			}
+		}
+	})
+
+	// vertical pass
+	res := make([]float32, w*h*4)
+	resample(b.Dy(), h, func(dy, sy int, weight float32) {
+		for x := 0; x < w; x++ {
+			si, di := (sy*w+x)*4, (dy*w+x)*4
+			for c := 0; c < 4; c++ {
+				res[di+c] += tmp[si+c] * weight
+			}
+		}
+	})
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i, v := range res {
+		if v > 255 {
+			v = 255
+		}
+		dst.Pix[i] = uint8(v + 0.5)
+	}
+	return dst
+}
+
+// resample calls fn with the weight of each source index (of sn) covered by each
+// destination index (of dn).
+func resample(sn, dn int, fn func(d, s int, weight float32)) {
+	scale := float64(sn) / float64(dn)
+	for d := 0; d < dn; d++ {
+		start, end := float64(d)*scale, float64(d+1)*scale
+		for s := int(start); s < sn && float64(s) < end; s++ {
+			cov := 1.0
+			if fs := float64(s); fs < start {
+				cov -= start - fs
+			}
+			if fe := float64(s + 1); fe > end {
+				cov -= fe - end
+			}
+			if cov > 0 {
+				fn(d, s, float32(cov/scale))
+			}
+		}
+	}
+}
+
+func toGray(src image.Image) image.Image {
+	if g, ok := src.(*image.Gray); ok {
+		return g
+	}
+	if !isOpaque(src) {
+		// keep the alpha channel
+		b := src.Bounds()
+		dst := image.NewNRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+				g := color.GrayModel.Convert(color.RGBA{c.R, c.G, c.B, 255}).(color.Gray)
+				dst.SetNRGBA(x, y, color.NRGBA{g.Y, g.Y, g.Y, c.A})
+			}
+		}
+		return dst
+	}
+	b := src.Bounds()
+	dst := image.NewGray(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+	return dst
+}
+
+func isGray(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
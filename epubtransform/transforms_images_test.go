@@ -0,0 +1,172 @@
+package epubtransform
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransformOptimizeImages(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	large := testImage(t, "png", 40, 20, 0)
+	photo := testImage(t, "jpeg", 16, 16, 100)
+	small := testImage(t, "jpeg", 16, 16, 5)
+	tiny := testImage(t, "png", 8, 8, 0)
+	writeTestFiles(t, td, map[string]string{
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="large" href="large.png" media-type="image/png"/>
+    <item id="photo" href="photo.jpg" media-type="image/jpeg"/>
+    <item id="small" href="small.jpg" media-type="image/jpeg"/>
+    <item id="tiny" href="tiny.png" media-type="image/png"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`,
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><img src="large.png"/><img src="photo.jpg"/><img src="small.jpg"/><img src="tiny.png"/></body></html>`,
+		"OEBPS/large.png": string(large),
+		"OEBPS/photo.jpg": string(photo),
+		"OEBPS/small.jpg": string(small),
+		"OEBPS/tiny.png":  string(tiny),
+	})
+
+	if err := TransformOptimizeImages(ImageOptions{MaxWidth: 16, JPEGQuality: 50}).Raw(td); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// resized (and kept as png since it wasn't converted)
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "large.png")); err != nil {
+		t.Fatal(err)
+	} else if cfg, format, err := image.DecodeConfig(bytes.NewReader(buf)); err != nil {
+		t.Fatalf("decode resized image: %v", err)
+	} else if format != "png" || cfg.Width != 16 || cfg.Height != 8 {
+		t.Errorf("resized: expected 16x8 png, got %dx%d %s", cfg.Width, cfg.Height, format)
+	}
+
+	// recompressed since it's smaller with the new quality
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "photo.jpg")); err != nil {
+		t.Fatal(err)
+	} else if len(buf) >= len(photo) {
+		t.Errorf("recompressed: expected image to be smaller than %d bytes, got %d", len(photo), len(buf))
+	} else if _, err := jpeg.Decode(bytes.NewReader(buf)); err != nil {
+		t.Errorf("decode recompressed image: %v", err)
+	}
+
+	// left as-is since it would be larger after re-encoding, or doesn't need to be
+	// re-encoded at all
+	for fn, exp := range map[string][]byte{"small.jpg": small, "tiny.png": tiny} {
+		if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", fn)); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, exp) {
+			t.Errorf("%s: expected image to be left as-is", fn)
+		}
+	}
+}
+
+func TestTransformOptimizeImagesConvert(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtransform-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	writeTestFiles(t, td, map[string]string{
+		"META-INF/container.xml": testContainer("OEBPS/content.opf"),
+		"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">test</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="photo" href="photo.png" media-type="image/png"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`,
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><img src="photo.png"/></body></html>`,
+		"OEBPS/photo.png": string(testImage(t, "png", 64, 64, 0)),
+	})
+
+	if err := TransformOptimizeImages(ImageOptions{PNGToJPEG: true}).Raw(td); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(td, "OEBPS", "photo.png")); !os.IsNotExist(err) {
+		t.Errorf("expected original image to be removed")
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "photo.jpg")); err != nil {
+		t.Fatalf("read converted image: %v", err)
+	} else if _, format, err := image.DecodeConfig(bytes.NewReader(buf)); err != nil || format != "jpeg" {
+		t.Errorf("expected converted image to be a jpeg, got %s (err: %v)", format, err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "ch1.xhtml")); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(buf), `src="photo.jpg"`) {
+		t.Errorf("expected reference to be updated, got:\n%s", buf)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(td, "OEBPS", "content.opf")); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(buf), `<item id="photo" href="photo.jpg" media-type="image/jpeg"/>`) {
+		t.Errorf("expected manifest item to be updated, got:\n%s", buf)
+	}
+}
+
+// testImage encodes an opaque image with deterministic noise (so it doesn't
+// compress well) as a png, or a jpeg with the specified quality.
+func testImage(t *testing.T, format string, w, h, quality int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	seed := uint32(1)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			seed = seed*1664525 + 1013904223
+			img.SetRGBA(x, y, color.RGBA{uint8(seed >> 24), uint8(seed >> 16), uint8(seed >> 8), 255})
+		}
+	}
+	var b bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&b, img)
+	case "jpeg":
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestFitSize(t *testing.T) {
+	for _, c := range [][6]int{
+		{40, 20, 16, 0, 16, 8},
+		{40, 20, 0, 10, 20, 10},
+		{40, 20, 16, 4, 8, 4},
+		{10, 10, 16, 16, 10, 10},
+		{1000, 1, 10, 0, 10, 1},
+	} {
+		if w, h := fitSize(c[0], c[1], c[2], c[3]); w != c[4] || h != c[5] {
+			t.Errorf("fitSize(%d, %d, %d, %d): expected %dx%d, got %dx%d", c[0], c[1], c[2], c[3], c[4], c[5], w, h)
+		}
+	}
+}
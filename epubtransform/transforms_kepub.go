@@ -0,0 +1,176 @@
+package epubtransform
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// KepubOptions controls how TransformKepub converts content documents.
+type KepubOptions struct {
+	// SkipPreformatted leaves pre elements (and everything in them) as-is.
+	SkipPreformatted bool
+}
+
+// KepubStyleHacks is the stylesheet added to content documents by
+// TransformKepub to undo the margins the Kobo renderer adds to book-inner.
+const KepubStyleHacks = `div#book-inner { margin-top: 0; margin-bottom: 0; }`
+
+// TransformKepub converts the content documents for Kobo's kepub renderer by
+// wrapping each sentence and image in a koboSpan (with ids of the form
+// kobo.paragraph.segment), wrapping the body contents in the book-columns and
+// book-inner divs, and adding KepubStyleHacks. Content documents which have
+// already been converted are left as-is.
+func TransformKepub(opts KepubOptions) Transform {
+	return Transform{
+		Desc: "convert to kepub",
+		ContentFile: func(relpath, str string) (string, error) {
+			doc, err := html.Parse(strings.NewReader(str))
+			if err != nil {
+				return str, err
+			}
+			if !kepubify(doc, opts) {
+				return str, nil
+			}
+			return renderDocument(doc, str)
+		},
+	}
+}
+
+// kepubSentenceRe matches the end of a sentence, including the closing
+// punctuation and whitespace after it.
+var kepubSentenceRe = regexp.MustCompile(`[.!?…]+['"”’»)\]]*\s+|[。！？]+[」』”’）]*\s*`)
+
+// kepubify converts a content document, returning false if it has already been
+// converted or doesn't have a body.
+func kepubify(doc *html.Node, opts KepubOptions) bool {
+	body := util.FindElement(doc, atom.Body)
+	if body == nil {
+		return false
+	}
+	converted := false
+	var check func(n *html.Node)
+	check = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if id, _ := util.LookupAttr(n, "id"); id == "book-columns" {
+				converted = true
+			}
+			if class, _ := util.LookupAttr(n, "class"); n.DataAtom == atom.Span && strings.Contains(" "+class+" ", " koboSpan ") {
+				converted = true
+			}
+		}
+		for c := n.FirstChild; c != nil && !converted; c = c.NextSibling {
+			check(c)
+		}
+	}
+	if check(body); converted {
+		return false
+	}
+
+	(&kepubSpanner{skipPre: opts.SkipPreformatted}).walk(body)
+
+	inner := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div, Attr: []html.Attribute{{Key: "id", Val: "book-inner"}}}
+	for c := body.FirstChild; c != nil; {
+		next := c.NextSibling
+		body.RemoveChild(c)
+		inner.AppendChild(c)
+		c = next
+	}
+	columns := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div, Attr: []html.Attribute{{Key: "id", Val: "book-columns"}}}
+	columns.AppendChild(inner)
+	body.AppendChild(columns)
+
+	if head := util.FindElement(doc, atom.Head); head != nil {
+		style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style, Attr: []html.Attribute{
+			{Key: "type", Val: "text/css"},
+			{Key: "class", Val: "kobostylehacks"},
+		}}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: KepubStyleHacks})
+		head.AppendChild(style)
+	}
+	return true
+}
+
+// kepubSpanner adds koboSpans to a document.
+type kepubSpanner struct {
+	skipPre bool
+	para    int
+	seg     int
+}
+
+func (k *kepubSpanner) span(children ...*html.Node) *html.Node {
+	k.seg++
+	span := &html.Node{Type: html.ElementNode, Data: "span", DataAtom: atom.Span, Attr: []html.Attribute{
+		{Key: "class", Val: "koboSpan"},
+		{Key: "id", Val: "kobo." + strconv.Itoa(k.para) + "." + strconv.Itoa(k.seg)},
+	}}
+	for _, c := range children {
+		span.AppendChild(c)
+	}
+	return span
+}
+
+func (k *kepubSpanner) nextPara() {
+	k.para++
+	k.seg = 0
+}
+
+func (k *kepubSpanner) walk(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.TextNode:
+			k.text(c)
+		case html.ElementNode:
+			if c.Namespace != "" {
+				break // svg and math
+			}
+			switch c.DataAtom {
+			case atom.Script, atom.Style, atom.Textarea, atom.Select, atom.Video, atom.Audio, atom.Object:
+			case atom.Img:
+				k.nextPara()
+				span := k.span()
+				n.InsertBefore(span, c)
+				n.RemoveChild(c)
+				span.AppendChild(c)
+			case atom.Pre:
+				if !k.skipPre {
+					k.nextPara()
+					k.walk(c)
+				}
+			case atom.P, atom.Ol, atom.Ul, atom.Table, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				k.nextPara()
+				k.walk(c)
+			default:
+				k.walk(c)
+			}
+		}
+		c = next
+	}
+}
+
+// text splits a text node into sentences.
+func (k *kepubSpanner) text(n *html.Node) {
+	s := n.Data
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+	parent := n.Parent
+	if t := strings.TrimLeft(s, " \t\n\f\r"); len(t) != len(s) {
+		parent.InsertBefore(&html.Node{Type: html.TextNode, Data: s[:len(s)-len(t)]}, n)
+		s = t
+	}
+	for s != "" {
+		seg := s
+		if m := kepubSentenceRe.FindStringIndex(s); m != nil && m[1] != len(s) {
+			seg = s[:m[1]]
+		}
+		parent.InsertBefore(k.span(&html.Node{Type: html.TextNode, Data: seg}), n)
+		s = s[len(seg):]
+	}
+	parent.RemoveChild(n)
+}
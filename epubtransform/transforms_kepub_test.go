@@ -0,0 +1,27 @@
+package epubtransform
+
+import "testing"
+
+func TestTransformKepub(t *testing.T) {
+	const doc = "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><title>x</title></head><body>\n<p>One. Two? <i>Three</i></p><img src=\"a.png\"/><pre>a. b</pre></body></html>"
+
+	for _, c := range []struct {
+		opts KepubOptions
+		exp  string
+	}{
+		{KepubOptions{}, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><title>x</title><style type=\"text/css\" class=\"kobostylehacks\">" + KepubStyleHacks + "</style></head><body><div id=\"book-columns\"><div id=\"book-inner\">\n<p><span class=\"koboSpan\" id=\"kobo.1.1\">One. </span><span class=\"koboSpan\" id=\"kobo.1.2\">Two? </span><i><span class=\"koboSpan\" id=\"kobo.1.3\">Three</span></i></p><span class=\"koboSpan\" id=\"kobo.2.1\"><img src=\"a.png\"/></span><pre><span class=\"koboSpan\" id=\"kobo.3.1\">a. </span><span class=\"koboSpan\" id=\"kobo.3.2\">b</span></pre></div></div></body></html>"},
+		{KepubOptions{SkipPreformatted: true}, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><title>x</title><style type=\"text/css\" class=\"kobostylehacks\">" + KepubStyleHacks + "</style></head><body><div id=\"book-columns\"><div id=\"book-inner\">\n<p><span class=\"koboSpan\" id=\"kobo.1.1\">One. </span><span class=\"koboSpan\" id=\"kobo.1.2\">Two? </span><i><span class=\"koboSpan\" id=\"kobo.1.3\">Three</span></i></p><span class=\"koboSpan\" id=\"kobo.2.1\"><img src=\"a.png\"/></span><pre>a. b</pre></div></div></body></html>"},
+	} {
+		fn := TransformKepub(c.opts).ContentFile
+		res, err := fn("ch1.xhtml", doc)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res != c.exp {
+			t.Errorf("%+v: expected:\n%s\ngot:\n%s", c.opts, c.exp, res)
+		}
+		if again, err := fn("ch1.xhtml", res); err != nil || again != res {
+			t.Errorf("%+v: expected converted document to be left as-is", c.opts)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package epubtransform
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// PageListOptions controls how TransformPageList finds or inserts page breaks.
+type PageListOptions struct {
+	// CharactersPerPage is the number of characters (not including whitespace)
+	// between generated page breaks.
+	CharactersPerPage int
+	// Selector, if not empty, is a CSS selector for elements marking the pages
+	// of the source (e.g. span.pagenum), which are converted into page breaks.
+	Selector string
+}
+
+// PageListReport contains the pages added by TransformPageList.
+type PageListReport struct {
+	Pages []PageTarget
+	// Source is how the page breaks were found: existing, selector, or
+	// generated.
+	Source string
+}
+
+// TransformPageList adds a page list to the EPUB 3 navigation document and the
+// NCX, replacing any existing one. If the spine documents already have page
+// breaks (elements with an epub:type of pagebreak or a role of
+// doc-pagebreak), they are used as-is. Otherwise, the elements matching the
+// selector are used if there are any, and if not, page breaks are inserted at
+// the start of the word after every CharactersPerPage characters of visible
+// text. The page number is taken from the aria-label or title attribute, the
+// text, or the number at the end of the id of the page break, and is
+// sequential otherwise. If report is not nil, the pages are added to it.
+func TransformPageList(opts PageListOptions, report *PageListReport) Transform {
+	return Transform{
+		Desc: "add page list",
+		Raw: func(epubdir string) error {
+			var sel cascadia.Selector
+			if opts.Selector != "" {
+				var err error
+				if sel, err = cascadia.Compile(opts.Selector); err != nil {
+					return util.Wrap(err, "compile selector %#v", opts.Selector)
+				}
+			}
+
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			epub3 := strings.HasPrefix(pkg.Version, "3")
+
+			var navPath, ncxPath string
+			for _, it := range pkg.Manifest {
+				switch {
+				case it.HasProperty("nav") && navPath == "":
+					navPath = it.Path
+				case it.MediaType == "application/x-dtbncx+xml" && ncxPath == "":
+					ncxPath = it.Path
+				}
+			}
+			if navPath == "" && ncxPath == "" {
+				return errors.New("no navigation document or ncx to add the page list to")
+			}
+
+			type document struct {
+				path, orig string
+				doc        *html.Node
+				breaks     []*html.Node
+			}
+			var docs []*document
+			for _, it := range pkg.SpineItems() {
+				if (it.MediaType != "application/xhtml+xml" && it.MediaType != "text/html") || it.HasProperty("nav") {
+					continue
+				}
+				buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+				if err != nil {
+					return util.Wrap(err, "read %#v", it.Path)
+				}
+				doc, err := html.Parse(strings.NewReader(string(buf)))
+				if err != nil {
+					return util.Wrap(err, "parse %#v", it.Path)
+				}
+				docs = append(docs, &document{path: it.Path, orig: string(buf), doc: doc})
+			}
+
+			var source string
+			for _, d := range docs {
+				if d.breaks = findPageBreaks(d.doc); len(d.breaks) != 0 {
+					source = "existing"
+				}
+			}
+			if source == "" && sel != nil {
+				for _, d := range docs {
+					if d.breaks = sel.MatchAll(d.doc); len(d.breaks) != 0 {
+						source = "selector"
+					}
+				}
+			}
+			if source == "" {
+				if opts.CharactersPerPage <= 0 {
+					return fmt.Errorf("invalid number of characters per page %d", opts.CharactersPerPage)
+				}
+				pb := &pageBreaker{per: opts.CharactersPerPage, epub3: epub3, space: true}
+				for _, d := range docs {
+					pb.breaks = nil
+					pb.walk(d.doc)
+					d.breaks = pb.breaks
+				}
+				source = "generated"
+			}
+
+			var pages []PageTarget
+			for _, d := range docs {
+				if len(d.breaks) == 0 {
+					continue
+				}
+				ids := map[string]bool{}
+				util.Walk(d.doc, func(n *html.Node) bool {
+					if id, ok := util.LookupAttr(n, "id"); ok {
+						ids[id] = true
+					}
+					return true
+				}, nil)
+				var changed bool
+				for _, n := range d.breaks {
+					name := pageBreakName(n)
+					if name == "" {
+						name = strconv.Itoa(len(pages) + 1)
+					}
+					if source != "existing" && epub3 {
+						if v, _ := util.LookupAttr(n, "epub:type"); !hasField(v, "pagebreak") {
+							util.SetAttr(n, "epub:type", strings.TrimSpace(v+" pagebreak"))
+						}
+						util.SetAttr(n, "role", "doc-pagebreak")
+						changed = true
+					}
+					id, ok := util.LookupAttr(n, "id")
+					if !ok || id == "" {
+						id = pageBreakID(name, ids)
+						util.SetAttr(n, "id", id)
+						changed = true
+					}
+					pages = append(pages, PageTarget{Name: name, Path: d.path, Fragment: id})
+				}
+				if !changed {
+					continue
+				}
+				if epub3 {
+					if root := util.FindElement(d.doc, atom.Html); root != nil {
+						if _, ok := util.LookupAttr(root, "xmlns:epub"); !ok {
+							util.SetAttr(root, "xmlns:epub", "http://www.idpf.org/2007/ops")
+						}
+					}
+				}
+				str, err := renderDocument(d.doc, d.orig)
+				if err != nil {
+					return util.Wrap(err, "render %#v", d.path)
+				}
+				if err := ioutil.WriteFile(filepath.Join(epubdir, filepath.FromSlash(d.path)), []byte(str), 0644); err != nil {
+					return util.Wrap(err, "write %#v", d.path)
+				}
+			}
+
+			if report != nil {
+				report.Pages, report.Source = pages, source
+			}
+			if navPath != "" {
+				if err := writeNavPageList(epubdir, navPath, pages); err != nil {
+					return util.Wrap(err, "update nav %#v", navPath)
+				}
+			}
+			if ncxPath != "" {
+				if err := writeNCXPageList(epubdir, ncxPath, pages); err != nil {
+					return util.Wrap(err, "update ncx %#v", ncxPath)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// writeNavPageList replaces the page list in an existing EPUB 3 navigation
+// document.
+func writeNavPageList(epubdir, relpath string, pages []PageTarget) error {
+	fn := filepath.Join(epubdir, filepath.FromSlash(relpath))
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(fn); err != nil {
+		return err
+	}
+	body := doc.FindElement("//html/body")
+	if body == nil {
+		return errors.New("could not find body element")
+	}
+	for _, el := range body.FindElements("//nav") {
+		if hasField(el.SelectAttrValue("epub:type", ""), "page-list") {
+			el.Parent().RemoveChild(el)
+		}
+	}
+	if len(pages) != 0 {
+		// created separately so only the new elements are indented
+		tmp := etree.NewDocument()
+		el := createNavPageList(tmp.CreateElement("html").CreateElement("body"), relpath, pages)
+		tmp.Indent(2)
+		el.Parent().RemoveChild(el)
+		insertChildIndented(body, el, nil)
+	}
+	return doc.WriteToFile(fn)
+}
+
+// writeNCXPageList replaces the page list in an existing NCX document.
+func writeNCXPageList(epubdir, relpath string, pages []PageTarget) error {
+	fn := filepath.Join(epubdir, filepath.FromSlash(relpath))
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(fn); err != nil {
+		return err
+	}
+	root := doc.SelectElement("ncx")
+	if root == nil {
+		return errors.New("could not find ncx element")
+	}
+	for _, el := range root.SelectElements("pageList") {
+		root.RemoveChild(el)
+	}
+
+	total, maxPage := ncxPageCounts(pages)
+	if head := root.SelectElement("head"); head != nil {
+		for _, m := range []struct {
+			name  string
+			value int
+		}{
+			{"dtb:totalPageCount", total},
+			{"dtb:maxPageNumber", maxPage},
+		} {
+			var mel *etree.Element
+			for _, el := range head.SelectElements("meta") {
+				if el.SelectAttrValue("name", "") == m.name {
+					mel = el
+					break
+				}
+			}
+			if mel == nil {
+				mel = etree.NewElement("meta")
+				mel.CreateAttr("name", m.name)
+				insertChildIndented(head, mel, nil)
+			}
+			mel.CreateAttr("content", strconv.Itoa(m.value))
+		}
+	}
+
+	if len(pages) != 0 {
+		// created separately so only the new elements are indented
+		tmp := etree.NewDocument()
+		el := createNCXPageList(tmp.CreateElement("ncx"), relpath, pages)
+		tmp.Indent(2)
+		el.Parent().RemoveChild(el)
+		insertChildIndented(root, el, root.SelectElement("navList"))
+		if err := ncxPlayOrder(epubdir, relpath, root); err != nil {
+			return err
+		}
+	}
+	return doc.WriteToFile(fn)
+}
+
+// findPageBreaks finds the existing page breaks in a document.
+func findPageBreaks(n *html.Node) []*html.Node {
+	var breaks []*html.Node
+	util.Walk(n, func(n *html.Node) bool {
+		if n.Type == html.ElementNode {
+			t, _ := util.LookupAttr(n, "epub:type")
+			r, _ := util.LookupAttr(n, "role")
+			if hasField(t, "pagebreak") || hasField(r, "doc-pagebreak") {
+				breaks = append(breaks, n)
+			}
+		}
+		return true
+	}, nil)
+	return breaks
+}
+
+// hasField checks if a space-separated list (e.g. an epub:type) contains v.
+func hasField(list, v string) bool {
+	for _, f := range strings.Fields(list) {
+		if f == v {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	pageBreakPrefixRe = regexp.MustCompile(`(?i)^(?:page|pg\.?|p\.)\s*`)
+	pageBreakIDRe     = regexp.MustCompile(`(?i)(?:\d+|\b[ivxlcdm]+)$`)
+	pageBreakIDCharRe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// pageBreakName gets the page number from a page break.
+func pageBreakName(n *html.Node) string {
+	for _, k := range []string{"aria-label", "title"} {
+		if v, ok := util.LookupAttr(n, k); ok {
+			if v = pageBreakPrefixRe.ReplaceAllString(strings.TrimSpace(v), ""); v != "" {
+				return v
+			}
+		}
+	}
+	if v := strings.TrimFunc(util.TextContent(n), func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("[]{}()", r)
+	}); v != "" {
+		if v = pageBreakPrefixRe.ReplaceAllString(v, ""); v != "" {
+			return v
+		}
+	}
+	if id, ok := util.LookupAttr(n, "id"); ok {
+		if v := pageBreakIDRe.FindString(id); v != "" {
+			return strings.TrimLeft(v, "0")
+		}
+	}
+	return ""
+}
+
+// pageBreakID generates a unique id for a page break.
+func pageBreakID(name string, ids map[string]bool) string {
+	base := "page" + pageBreakIDCharRe.ReplaceAllString(name, "_")
+	id := base
+	for i := 2; ids[id]; i++ {
+		id = base + "_" + strconv.Itoa(i)
+	}
+	ids[id] = true
+	return id
+}
+
+// pageBreaker inserts page breaks into documents.
+type pageBreaker struct {
+	per    int  // the number of characters per page
+	epub3  bool // whether to add the epub:type and role
+	chars  int  // the number of characters so far
+	pages  int  // the number of page breaks so far
+	space  bool // if the last character was whitespace, or the start of a block
+	prev   rune
+	breaks []*html.Node
+}
+
+func (p *pageBreaker) walk(n *html.Node) {
+	util.Walk(n, func(n *html.Node) bool {
+		switch n.Type {
+		case html.TextNode:
+			p.text(n)
+			return false
+		case html.ElementNode:
+			if n.Namespace != "" || isHiddenElement(n) {
+				return false
+			}
+		case html.DocumentNode:
+		default:
+			return false
+		}
+		if isSearchBlock(n) {
+			p.space = true
+		}
+		return true
+	}, func(n *html.Node) {
+		if isSearchBlock(n) {
+			p.space = true
+		}
+	})
+}
+
+// text counts the characters in a text node, inserting a page break (and
+// splitting the node) at the start of the first word after the end of the
+// page.
+func (p *pageBreaker) text(n *html.Node) {
+	for i, r := range n.Data {
+		switch {
+		case unicode.IsSpace(r):
+			p.space = true
+			continue
+		case unicode.Is(unicode.Cf, r):
+			continue
+		}
+		if p.chars >= p.pages*p.per && (p.space || isCJK(r) || isCJK(p.prev)) {
+			pb := p.pageBreak()
+			if i == 0 {
+				n.Parent.InsertBefore(pb, n)
+			} else {
+				rest := &html.Node{Type: html.TextNode, Data: n.Data[i:]}
+				n.Data = n.Data[:i]
+				n.Parent.InsertBefore(rest, n.NextSibling)
+				n.Parent.InsertBefore(pb, rest)
+				return // the rest is handled by walk
+			}
+		}
+		p.chars++
+		p.space = false
+		p.prev = r
+	}
+}
+
+// pageBreak creates a page break for the next page.
+func (p *pageBreaker) pageBreak() *html.Node {
+	p.pages++
+	pb := &html.Node{Type: html.ElementNode, Data: "span", DataAtom: atom.Span}
+	if p.epub3 {
+		util.SetAttr(pb, "epub:type", "pagebreak")
+		util.SetAttr(pb, "role", "doc-pagebreak")
+	}
+	util.SetAttr(pb, "title", strconv.Itoa(p.pages))
+	p.breaks = append(p.breaks, pb)
+	return pb
+}
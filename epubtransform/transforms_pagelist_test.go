@@ -0,0 +1,64 @@
+package epubtransform
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestPageBreaker(t *testing.T) {
+	n, err := html.Parse(strings.NewReader(`<html><head><title>Title text</title></head><body>` +
+		`<h1>One two</h1><p>three <i>four</i>five six<script>seven</script></p><p hidden="">eight</p><p>日本語</p></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb := &pageBreaker{per: 8, epub3: true, space: true}
+	pb.walk(n)
+
+	var b strings.Builder
+	if err := html.Render(&b, n); err != nil {
+		t.Fatal(err)
+	}
+	span := func(n string) string {
+		return `<span epub:type="pagebreak" role="doc-pagebreak" title="` + n + `"></span>`
+	}
+	if exp := `<html><head><title>Title text</title></head><body>` +
+		`<h1>` + span("1") + `One two</h1><p>three <i>` + span("2") + `four</i>five ` + span("3") + `six<script>seven</script></p><p hidden="">eight</p><p>日本` + span("4") + `語</p></body></html>`; b.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b.String())
+	}
+	if len(pb.breaks) != 4 {
+		t.Errorf("expected 4 page breaks, got %d", len(pb.breaks))
+	}
+}
+
+func TestPageBreakName(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		exp string
+	}{
+		{`<span epub:type="pagebreak" aria-label="Page 12"></span>`, "12"},
+		{`<span role="doc-pagebreak" title="xiv"></span>`, "xiv"},
+		{`<span class="pagenum">[p. 7]</span>`, "7"},
+		{`<a id="Page_012"></a>`, "12"},
+		{`<a id="pgxiv"></a>`, ""},
+		{`<span></span>`, ""},
+	} {
+		n, err := html.Parse(strings.NewReader(c.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := n.FirstChild.LastChild
+		if res := pageBreakName(body.FirstChild); res != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.in, c.exp, res)
+		}
+	}
+
+	ids := map[string]bool{"page1": true}
+	if id := pageBreakID("1", ids); id != "page1_2" {
+		t.Errorf("expected unique id page1_2, got %q", id)
+	}
+	if id := pageBreakID("x 1", ids); id != "pagex_1" {
+		t.Errorf("expected sanitized id pagex_1, got %q", id)
+	}
+}
@@ -0,0 +1,216 @@
+package epubtransform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mattn/go-zglob"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"gopkg.in/yaml.v2"
+)
+
+// ReplaceRule is a substitution applied by TransformReplace.
+type ReplaceRule struct {
+	Find       string `yaml:"find" toml:"find"`
+	Replace    string `yaml:"replace" toml:"replace"` // $1 and ${name} are expanded to submatches unless Literal is set
+	Literal    bool   `yaml:"literal" toml:"literal"` // Find and Replace are plain strings instead of a regular expression and template
+	IgnoreCase bool   `yaml:"ignore_case" toml:"ignore_case"`
+}
+
+// ReplaceOptions controls what TransformReplace changes.
+type ReplaceOptions struct {
+	// Rules are applied in order to each text node.
+	Rules []ReplaceRule
+	// Scope limits the content documents which are changed to the ones with
+	// the specified manifest ids or matching the specified globs (with
+	// slash-separated paths relative to the epub root or the package
+	// document). If empty, all content documents are changed.
+	Scope []string
+}
+
+// ReplaceReport contains the changes made by TransformReplace. All paths are
+// slash-separated and relative to the epub root.
+type ReplaceReport struct {
+	Counts  map[string]int // the number of replacements in each file
+	Changes []ReplaceChange
+}
+
+// ReplaceChange is a single replacement made by TransformReplace.
+type ReplaceChange struct {
+	Path     string
+	Rule     int // the index of the rule
+	Old, New string
+	Before   string // up to 30 characters of context from the same text node, with the whitespace collapsed
+	After    string
+}
+
+// ReadReplaceRules reads replacement rules from a YAML or TOML file with a
+// list of rules (with the find, replace, literal, and ignore_case keys) under
+// the rules key.
+func ReadReplaceRules(fn string) ([]ReplaceRule, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Rules []ReplaceRule `yaml:"rules" toml:"rules"`
+	}
+	switch ext := strings.ToLower(filepath.Ext(fn)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(buf, &f); err != nil {
+			return nil, util.Wrap(err, "parse %#v", fn)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(buf), &f)
+		if err != nil {
+			return nil, util.Wrap(err, "parse %#v", fn)
+		}
+		if u := md.Undecoded(); len(u) != 0 {
+			keys := make([]string, len(u))
+			for i, k := range u {
+				keys[i] = k.String()
+			}
+			sort.Strings(keys)
+			return nil, fmt.Errorf("parse %#v: unknown keys %s", fn, strings.Join(keys, ", "))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rules file extension %#v", ext)
+	}
+	if _, err := compileReplaceRules(f.Rules); err != nil {
+		return nil, util.Wrap(err, "parse %#v", fn)
+	}
+	return f.Rules, nil
+}
+
+func compileReplaceRules(rules []ReplaceRule) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(rules))
+	for i, r := range rules {
+		if r.Find == "" {
+			return nil, fmt.Errorf("rule %d: find is empty", i+1)
+		}
+		expr := r.Find
+		if r.Literal {
+			expr = regexp.QuoteMeta(expr)
+		}
+		if r.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, util.Wrap(err, "rule %d", i+1)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// TransformReplace applies substitutions to the text of content documents
+// (tags, attributes, the head, scripts, and stylesheets are not changed). Since
+// each text node is changed separately, matches can't span elements. If report
+// is not nil, the changes are added to it.
+func TransformReplace(opts ReplaceOptions, report *ReplaceReport) Transform {
+	var res []*regexp.Regexp
+	var scope map[string]bool
+	return Transform{
+		Desc: "replace text",
+		Raw: func(epubdir string) error {
+			var err error
+			if res, err = compileReplaceRules(opts.Rules); err != nil {
+				return err
+			}
+			if report != nil && report.Counts == nil {
+				report.Counts = map[string]int{}
+			}
+			if len(opts.Scope) == 0 {
+				return nil
+			}
+
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			scope = map[string]bool{}
+			for _, s := range opts.Scope {
+				if it := pkg.Item(s); it != nil {
+					scope[it.Path] = true
+					continue
+				}
+				var found bool
+				for _, it := range pkg.Manifest {
+					for _, p := range []string{it.Path, strings.TrimPrefix(it.Path, path.Dir(pkg.Path)+"/")} {
+						if m, err := zglob.Match(s, p); err != nil {
+							return util.Wrap(err, "match %#v", s)
+						} else if m {
+							scope[it.Path], found = true, true
+						}
+					}
+				}
+				if !found {
+					return fmt.Errorf("no manifest items matching %#v", s)
+				}
+			}
+			return nil
+		},
+		ContentDoc: func(relpath string, doc *goquery.Document) error {
+			relpath = filepath.ToSlash(relpath)
+			if scope != nil && !scope[relpath] {
+				return nil
+			}
+			for _, n := range doc.Nodes {
+				walkTextNodes(n, func(n *html.Node) {
+					n.Data = replaceText(n.Data, opts.Rules, res, func(c ReplaceChange) {
+						if report != nil {
+							c.Path = relpath
+							report.Counts[relpath]++
+							report.Changes = append(report.Changes, c)
+						}
+					})
+				})
+			}
+			return nil
+		},
+	}
+}
+
+var replaceSpaceRe = regexp.MustCompile(`\s+`)
+
+// replaceText applies the rules to s.
+func replaceText(s string, rules []ReplaceRule, res []*regexp.Regexp, change func(ReplaceChange)) string {
+	for i, re := range res {
+		ms := re.FindAllStringSubmatchIndex(s, -1)
+		if len(ms) == 0 {
+			continue
+		}
+		var b strings.Builder
+		var last int
+		for _, m := range ms {
+			var repl []byte
+			if rules[i].Literal {
+				repl = []byte(rules[i].Replace)
+			} else {
+				repl = re.ExpandString(nil, rules[i].Replace, s, m)
+			}
+			change(ReplaceChange{
+				Rule:   i,
+				Old:    s[m[0]:m[1]],
+				New:    string(repl),
+				Before: searchContext(replaceSpaceRe.ReplaceAllString(s[:m[0]], " "), 30, true),
+				After:  searchContext(replaceSpaceRe.ReplaceAllString(s[m[1]:], " "), 30, false),
+			})
+			b.WriteString(s[last:m[0]])
+			b.Write(repl)
+			last = m[1]
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package epubtransform
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestReplaceText(t *testing.T) {
+	rules := []ReplaceRule{
+		{Find: `\bteh\b`, Replace: "the"},
+		{Find: `(\w)- (\w)`, Replace: "${1}${2}"},
+		{Find: "A.B", Replace: "$1", Literal: true, IgnoreCase: true},
+	}
+	res, err := compileReplaceRules(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n, err := html.Parse(strings.NewReader(`<html><head><title>teh</title><style>teh{}</style></head><body>` +
+		`<p title="teh">teh cat, a.b and   ex- ample</p><script>teh</script><p>teh<i>teh</i></p></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []ReplaceChange
+	walkTextNodes(n, func(n *html.Node) {
+		n.Data = replaceText(n.Data, rules, res, func(c ReplaceChange) {
+			changes = append(changes, c)
+		})
+	})
+
+	var b strings.Builder
+	if err := html.Render(&b, n); err != nil {
+		t.Fatal(err)
+	}
+	if exp := `<html><head><title>teh</title><style>teh{}</style></head><body>` +
+		`<p title="teh">the cat, $1 and   example</p><script>teh</script><p>the<i>the</i></p></body></html>`; b.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, b.String())
+	}
+
+	if exp := []ReplaceChange{
+		{Rule: 0, Old: "teh", New: "the", After: " cat, a.b and ex- ample"},
+		{Rule: 1, Old: "x- a", New: "xa", Before: "the cat, a.b and e", After: "mple"},
+		{Rule: 2, Old: "a.b", New: "$1", Before: "the cat, ", After: " and example"},
+		{Rule: 0, Old: "teh", New: "the"},
+		{Rule: 0, Old: "teh", New: "the"},
+	}; !reflect.DeepEqual(changes, exp) {
+		t.Errorf("expected changes %+v, got %+v", exp, changes)
+	}
+
+	if _, err := compileReplaceRules([]ReplaceRule{{Find: ""}}); err == nil {
+		t.Errorf("expected error for empty rule")
+	}
+}
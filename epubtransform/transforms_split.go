@@ -0,0 +1,308 @@
+package epubtransform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// TransformSplitDocuments splits spine documents larger than maxSize bytes into
+// multiple files (e.g. chapter.xhtml, chapter_split1.xhtml, ...) at heading or
+// paragraph boundaries. Each new file has a copy of the original head (e.g. the
+// title and stylesheets), and is added to the manifest and spine after the
+// original one. Links to fragments which were moved to a new file are updated.
+func TransformSplitDocuments(maxSize int) Transform {
+	return Transform{
+		Desc: "split large documents",
+		Raw: func(epubdir string) error {
+			if maxSize <= 0 {
+				return fmt.Errorf("invalid maximum size %d", maxSize)
+			}
+
+			pkg, err := ReadPackage(epubdir)
+			if err != nil {
+				return err
+			}
+			epub3 := strings.HasPrefix(pkg.Version, "3")
+
+			split := map[string][]string{}          // original path -> part paths (starting with the original)
+			moved := map[string]map[string]string{} // original path -> id -> part path
+			group := map[string]string{}            // part path -> original path
+			props := map[string][]string{}          // part path -> detected properties
+			for _, it := range pkg.SpineItems() {
+				if (it.MediaType != "application/xhtml+xml" && it.MediaType != "text/html") || it.HasProperty("nav") || split[it.Path] != nil {
+					continue
+				}
+				buf, err := ioutil.ReadFile(filepath.Join(epubdir, filepath.FromSlash(it.Path)))
+				if err != nil {
+					return err
+				}
+				if len(buf) <= maxSize {
+					continue
+				}
+				parts, ids, err := splitDocument(string(buf), maxSize)
+				if err != nil {
+					return util.Wrap(err, "split %#v", it.Path)
+				}
+				if len(parts) < 2 {
+					continue
+				}
+
+				paths := []string{it.Path}
+				ext := path.Ext(it.Path)
+				for n := 1; len(paths) < len(parts); n++ {
+					p := fmt.Sprintf("%s_split%d%s", strings.TrimSuffix(it.Path, ext), n, ext)
+					if pkg.ItemByPath(p) != nil {
+						continue
+					}
+					if _, err := os.Stat(filepath.Join(epubdir, filepath.FromSlash(p))); !os.IsNotExist(err) {
+						continue
+					}
+					paths = append(paths, p)
+				}
+
+				moved[it.Path] = map[string]string{}
+				for i, p := range paths {
+					if err := ioutil.WriteFile(filepath.Join(epubdir, filepath.FromSlash(p)), []byte(parts[i]), 0644); err != nil {
+						return util.Wrap(err, "write %#v", p)
+					}
+					for _, id := range ids[i] {
+						if _, ok := moved[it.Path][id]; !ok {
+							moved[it.Path][id] = p
+						}
+					}
+					group[p] = it.Path
+					props[p] = DetectProperties(it.MediaType, []byte(parts[i]))
+				}
+				split[it.Path] = paths
+			}
+			if len(split) == 0 {
+				return nil
+			}
+
+			if err := rewriteReferences(epubdir, func(from, target, fragment string) (string, string, bool) {
+				if orig, ok := group[target]; ok && fragment != "" {
+					if p, ok := moved[orig][fragment]; ok && p != target {
+						return p, fragment, true
+					}
+				}
+				return "", "", false
+			}); err != nil {
+				return err
+			}
+
+			return transformOPFDoc(epubdir, func(opf *etree.Document) error {
+				ids := map[string]bool{}
+				for _, el := range opf.FindElements("//*[@id]") {
+					ids[el.SelectAttrValue("id", "")] = true
+				}
+				added := map[string][]string{} // original id -> new ids
+				for _, el := range opf.FindElements("//package/manifest/item") {
+					paths, ok := split[resolveHref(pkg.Path, el.SelectAttrValue("href", ""))]
+					if !ok {
+						continue
+					}
+					if epub3 {
+						// only replace the properties which can be detected
+						var p []string
+						for _, v := range strings.Fields(el.SelectAttrValue("properties", "")) {
+							switch v {
+							case "scripted", "svg", "mathml", "remote-resources":
+							default:
+								p = append(p, v)
+							}
+						}
+						if p = append(p, props[paths[0]]...); len(p) != 0 {
+							el.CreateAttr("properties", strings.Join(p, " "))
+						} else {
+							el.RemoveAttr("properties")
+						}
+					}
+					id, next := el.SelectAttrValue("id", ""), nextElement(el)
+					for _, p := range paths[1:] {
+						nid := manifestID(p, ids)
+						added[id] = append(added[id], nid)
+
+						nel := etree.NewElement("item")
+						nel.CreateAttr("id", nid)
+						nel.CreateAttr("href", RelativeRef(pkg.Path, p, ""))
+						nel.CreateAttr("media-type", el.SelectAttrValue("media-type", ""))
+						if epub3 && len(props[p]) != 0 {
+							nel.CreateAttr("properties", strings.Join(props[p], " "))
+						}
+						insertChildIndented(el.Parent(), nel, next)
+					}
+				}
+				for _, el := range opf.FindElements("//package/spine/itemref") {
+					next := nextElement(el)
+					for _, id := range added[el.SelectAttrValue("idref", "")] {
+						nel := etree.NewElement("itemref")
+						nel.CreateAttr("idref", id)
+						if linear := el.SelectAttrValue("linear", ""); linear != "" {
+							nel.CreateAttr("linear", linear)
+						}
+						insertChildIndented(el.Parent(), nel, next)
+					}
+				}
+				return nil
+			})
+		},
+	}
+}
+
+// splitDocument splits a content document into parts which are smaller than
+// maxSize bytes (if possible), returning the parts and the ids in each one. The
+// document is split between the children of the body, or of the innermost
+// wrapper element containing everything in it (which is copied to each part).
+// New parts are started at headings once a part is at least half the maximum
+// size, or at other elements if the part would be too large otherwise. If the
+// document can't be split, nil is returned.
+func splitDocument(str string, maxSize int) ([]string, [][]string, error) {
+	doc, err := html.Parse(strings.NewReader(str))
+	if err != nil {
+		return nil, nil, err
+	}
+	body := util.FindElement(doc, atom.Body)
+	if body == nil {
+		return nil, nil, nil
+	}
+
+	container, wrappers := body, []*html.Node{body}
+	for {
+		var el *html.Node
+		var n int
+		for c := container.FirstChild; c != nil; c = c.NextSibling {
+			switch {
+			case c.Type == html.ElementNode:
+				el, n = c, n+1
+			case c.Type == html.TextNode && strings.TrimSpace(c.Data) != "":
+				n += 2
+			}
+		}
+		if n != 1 || (el.DataAtom != atom.Div && el.DataAtom != atom.Section && el.DataAtom != atom.Article && el.DataAtom != atom.Main) {
+			break
+		}
+		container = el
+		wrappers = append(wrappers, el)
+	}
+
+	var full countWriter
+	if err := html.Render(&full, doc); err != nil {
+		return nil, nil, err
+	}
+	var children []*html.Node
+	var sizes []int
+	var content int
+	for c := container.FirstChild; c != nil; c = c.NextSibling {
+		var cw countWriter
+		if err := html.Render(&cw, c); err != nil {
+			return nil, nil, err
+		}
+		children, sizes = append(children, c), append(sizes, int(cw))
+		content += int(cw)
+	}
+	budget := maxSize - (int(full) - content)
+	if budget < maxSize/4 {
+		budget = maxSize / 4 // the head is too large to fit anyways
+	}
+
+	var groups [][]*html.Node
+	var cur int
+	var empty bool
+	for i, c := range children {
+		if len(groups) == 0 || (c.Type == html.ElementNode && !empty && (cur+sizes[i] > budget || (isSplitHeading(c) && cur >= budget/2))) {
+			groups, cur, empty = append(groups, nil), 0, true
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], c)
+		cur += sizes[i]
+		if c.Type == html.ElementNode || (c.Type == html.TextNode && strings.TrimSpace(c.Data) != "") {
+			empty = false
+		}
+	}
+	if len(groups) < 2 {
+		return nil, nil, nil
+	}
+
+	var wids []string
+	for _, w := range wrappers {
+		if id, ok := util.LookupAttr(w, "id"); ok {
+			wids = append(wids, id)
+		}
+	}
+	for _, c := range children {
+		container.RemoveChild(c)
+	}
+
+	var parts []string
+	var ids [][]string
+	for i, g := range groups {
+		var gids []string
+		if i == 0 {
+			gids = wids
+		} else if i == 1 {
+			for _, w := range wrappers {
+				var attr []html.Attribute
+				for _, a := range w.Attr {
+					if a.Namespace != "" || a.Key != "id" {
+						attr = append(attr, a)
+					}
+				}
+				w.Attr = attr
+			}
+		}
+		for _, c := range g {
+			container.AppendChild(c)
+			gids = appendNodeIDs(gids, c)
+		}
+		s, err := renderDocument(doc, str)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range g {
+			container.RemoveChild(c)
+		}
+		parts, ids = append(parts, s), append(ids, gids)
+	}
+	return parts, ids, nil
+}
+
+// isSplitHeading checks if a node is a good place to start a new part.
+func isSplitHeading(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Hgroup, atom.Header, atom.Section, atom.Article:
+		return n.Namespace == ""
+	}
+	return false
+}
+
+// appendNodeIDs appends the ids (and a names) of n and its descendants.
+func appendNodeIDs(ids []string, n *html.Node) []string {
+	if n.Type == html.ElementNode {
+		if id, ok := util.LookupAttr(n, "id"); ok {
+			ids = append(ids, id)
+		}
+		if name, ok := util.LookupAttr(n, "name"); ok && n.DataAtom == atom.A {
+			ids = append(ids, name)
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		ids = appendNodeIDs(ids, c)
+	}
+	return ids
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int
+
+func (w *countWriter) Write(buf []byte) (int, error) {
+	*w += countWriter(len(buf))
+	return len(buf), nil
+}
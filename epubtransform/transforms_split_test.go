@@ -0,0 +1,43 @@
+package epubtransform
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitDocument(t *testing.T) {
+	para := "<p>" + strings.Repeat("x", 90) + "</p>\n"
+	doc := `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>T</title><link rel="stylesheet" href="s.css"/></head><body class="b"><div id="wrap">
+<h1 id="a">A</h1>
+` + strings.Repeat(para, 4) + `<h2 id="b">B</h2>
+` + strings.Repeat(para, 2) + `<p id="c">` + strings.Repeat("y", 90) + `</p>
+` + strings.Repeat(para, 6) + `</div></body></html>`
+
+	parts, ids, err := splitDocument(doc, 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := [][]string{{"wrap", "a"}, {"b", "c"}, nil}; !reflect.DeepEqual(ids, exp) {
+		t.Errorf("expected ids %q, got %q", exp, ids)
+	}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, `<?xml version="1.0" encoding="utf-8"?>`+"\n") {
+			t.Errorf("part %d: expected xml declaration", i+1)
+		}
+		if !strings.Contains(part, `<head><title>T</title><link rel="stylesheet" href="s.css"/></head><body class="b">`) {
+			t.Errorf("part %d: expected head and body to be copied", i+1)
+		}
+		if i != 0 && strings.Contains(part, `id="wrap"`) {
+			t.Errorf("part %d: expected wrapper id to be removed", i+1)
+		}
+		if len(part) > 1000 {
+			t.Errorf("part %d: too large (%d bytes)", i+1, len(part))
+		}
+	}
+
+	if parts, _, err := splitDocument(doc, 10000); err != nil || parts != nil {
+		t.Errorf("expected small document not to be split, got %d parts (err: %v)", len(parts), err)
+	}
+}
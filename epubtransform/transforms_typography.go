@@ -0,0 +1,282 @@
+package epubtransform
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// TypographyOptions controls what TransformTypography fixes.
+type TypographyOptions struct {
+	// Quotes converts straight quotes to curly ones (or guillemets) for the
+	// language of the text, and apostrophes to right single quotes.
+	Quotes bool
+	// Dashes converts -- and --- to em dashes.
+	Dashes bool
+	// Ellipses converts ... and . . . to ellipses.
+	Ellipses bool
+	// FrenchSpacing uses non-breaking spaces instead of normal ones before ; !
+	// ? : and », and after «, in French text.
+	FrenchSpacing bool
+	// Whitespace collapses repeated spaces and tabs after other characters.
+	Whitespace bool
+	// RemoveSoftHyphens removes soft hyphens.
+	RemoveSoftHyphens bool
+	// Hyphenator, if not nil, is used to insert soft hyphens into words which
+	// don't already have any.
+	Hyphenator *Hyphenator
+	// Language overrides the language of the content documents (which is
+	// otherwise taken from the lang attributes or the package document).
+	Language string
+}
+
+// TypographyReport contains the changes made by TransformTypography. All paths
+// are slash-separated and relative to the epub root.
+type TypographyReport struct {
+	Counts map[string]int // the number of text nodes changed in each file
+}
+
+// TransformTypography fixes common typographical issues in the text of content
+// documents (tags, attributes, the head, scripts, stylesheets, and code are not
+// changed). If report is not nil, the changes are added to it.
+func TransformTypography(opts TypographyOptions, report *TypographyReport) Transform {
+	var lang string
+	return Transform{
+		Desc: "fix typography",
+		Raw: func(epubdir string) error {
+			if report != nil && report.Counts == nil {
+				report.Counts = map[string]int{}
+			}
+			if lang = opts.Language; lang == "" {
+				pkg, err := ReadPackage(epubdir)
+				if err != nil {
+					return err
+				}
+				lang = pkg.Language
+			}
+			return nil
+		},
+		ContentDoc: func(relpath string, doc *goquery.Document) error {
+			relpath = filepath.ToSlash(relpath)
+			t := &typographer{opts: opts, prev: ' '}
+			for _, n := range doc.Nodes {
+				t.walk(n, lang, func() {
+					if report != nil {
+						report.Counts[relpath]++
+					}
+				})
+			}
+			return nil
+		},
+	}
+}
+
+// quoteStyle is the primary and secondary quotes for a language.
+type quoteStyle struct {
+	open, close, open2, close2 string
+}
+
+// typographyQuotes gets the quotes for a language.
+func typographyQuotes(lang string) quoteStyle {
+	switch strings.ToLower(strings.SplitN(strings.SplitN(lang, "-", 2)[0], "_", 2)[0]) {
+	case "de", "cs", "sk", "sl", "is", "lt":
+		return quoteStyle{"„", "“", "‚", "‘"}
+	case "fr":
+		return quoteStyle{"«\u00a0", "\u00a0»", "“", "”"}
+	case "es", "it", "pt", "ru", "uk", "be", "el", "ca", "no", "nb", "nn":
+		return quoteStyle{"«", "»", "“", "”"}
+	case "pl", "ro", "hu", "hr", "nl":
+		return quoteStyle{"„", "”", "‚", "’"}
+	case "sv", "fi":
+		return quoteStyle{"”", "”", "’", "’"}
+	case "ja", "zh":
+		return quoteStyle{"「", "」", "『", "』"}
+	default:
+		return quoteStyle{"“", "”", "‘", "’"}
+	}
+}
+
+var (
+	typographyDashRe      = regexp.MustCompile(`---?`)
+	typographyEllipsisRe  = regexp.MustCompile(`\.\.\.|\. \. \.`)
+	typographySpaceRe     = regexp.MustCompile(`(\S)[ \t]{2,}`)
+	typographyFrenchRe    = regexp.MustCompile(`[ \t\n\x{a0}\x{202f}]+([;!?»:])|(«)[ \t\n\x{a0}\x{202f}]+`)
+	typographyWordRe      = regexp.MustCompile(`[\pL\x{ad}]+`)
+	typographySkipElement = map[atom.Atom]bool{
+		atom.Head: true, atom.Script: true, atom.Style: true, atom.Template: true, atom.Textarea: true,
+		atom.Pre: true, atom.Code: true, atom.Kbd: true, atom.Samp: true, atom.Var: true, atom.Tt: true,
+	}
+)
+
+// typographer fixes the text nodes in a document.
+type typographer struct {
+	opts      TypographyOptions
+	prev      rune // the last character of the previous text
+	prevQuote int  // if the last character was a converted quote, 1 if it was an opening one, or 2 if closing
+	inQuote   bool // if there is an unclosed double quote in the current block
+}
+
+func (t *typographer) walk(n *html.Node, lang string, changed func()) {
+	switch n.Type {
+	case html.TextNode:
+		if s := t.text(n.Data, lang); s != n.Data {
+			n.Data = s
+			changed()
+		}
+		return
+	case html.ElementNode:
+		if typographySkipElement[n.DataAtom] || n.Namespace != "" {
+			t.prev, t.prevQuote = 'x', 0 // a quote after code is probably a closing one
+			return
+		}
+		if t.opts.Language == "" {
+			for _, a := range n.Attr {
+				if a.Namespace == "" && (a.Key == "lang" || a.Key == "xml:lang") && a.Val != "" {
+					lang = a.Val
+				}
+			}
+		}
+		if isSearchBlock(n) {
+			t.prev, t.prevQuote, t.inQuote = ' ', 0, false
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		t.walk(c, lang, changed)
+	}
+	if n.Type == html.ElementNode && isSearchBlock(n) {
+		t.prev, t.prevQuote, t.inQuote = ' ', 0, false
+	}
+}
+
+func (t *typographer) text(s, lang string) string {
+	french := strings.HasPrefix(strings.ToLower(lang), "fr")
+	if t.opts.RemoveSoftHyphens {
+		s = strings.Replace(s, "\u00ad", "", -1)
+	}
+	if t.opts.Whitespace {
+		s = typographySpaceRe.ReplaceAllString(s, "$1 ")
+	}
+	if t.opts.Ellipses {
+		s = typographyEllipsisRe.ReplaceAllLiteralString(s, "…")
+	}
+	if t.opts.Dashes {
+		s = typographyDashRe.ReplaceAllLiteralString(s, "—")
+	}
+	if t.opts.Quotes {
+		s = t.quotes(s, typographyQuotes(lang))
+	}
+	if t.opts.FrenchSpacing && french {
+		s = typographyFrenchRe.ReplaceAllStringFunc(s, func(m string) string {
+			switch m = strings.TrimFunc(m, unicode.IsSpace); m {
+			case "«":
+				return "«\u00a0"
+			case ":", "»":
+				return "\u00a0" + m
+			default:
+				return "\u202f" + m // narrow
+			}
+		})
+	}
+	if t.opts.Hyphenator != nil {
+		s = typographyWordRe.ReplaceAllStringFunc(s, func(w string) string {
+			if strings.ContainsRune(w, '\u00ad') {
+				return w
+			}
+			points := t.opts.Hyphenator.Points(w)
+			if len(points) == 0 {
+				return w
+			}
+			var b strings.Builder
+			rs := []rune(w)
+			var last int
+			for _, p := range points {
+				b.WriteString(string(rs[last:p]))
+				b.WriteString("\u00ad")
+				last = p
+			}
+			b.WriteString(string(rs[last:]))
+			return b.String()
+		})
+	}
+	if s != "" {
+		r := []rune(s)
+		t.prev = r[len(r)-1]
+	}
+	return s
+}
+
+// quotes converts straight quotes. Quotes are opening ones if they are after
+// whitespace, opening punctuation, or another opening quote, and closing ones
+// otherwise. Double quotes with whitespace on both sides are matched with the
+// previous one.
+func (t *typographer) quotes(s string, q quoteStyle) string {
+	if !strings.ContainsAny(s, `"'`) {
+		t.prevQuote = 0
+		return s
+	}
+	rs := []rune(s)
+	out := make([]rune, 0, len(rs))
+	prev, prevQuote := t.prev, t.prevQuote
+	var skipSpace bool
+	for i, r := range rs {
+		if i != 0 {
+			prev = rs[i-1]
+		}
+		var next rune
+		if i+1 < len(rs) {
+			next = rs[i+1]
+		}
+		if skipSpace && unicode.IsSpace(r) {
+			continue // replaced by the non-breaking space after the opening quote
+		}
+		skipSpace = false
+
+		opening := prev == 0 || unicode.IsSpace(prev) || strings.ContainsRune("([{<-–—/«‹„‚「『", prev)
+		if prevQuote != 0 {
+			opening = prevQuote == 1
+		}
+		prevQuote = 0
+
+		switch r {
+		case '"':
+			if opening && (next == 0 || unicode.IsSpace(next)) {
+				opening = !t.inQuote
+			}
+			if t.inQuote = opening; opening {
+				out = append(out, []rune(q.open)...)
+				skipSpace = strings.HasSuffix(q.open, "\u00a0")
+				prevQuote = 1
+				continue
+			}
+			if strings.HasPrefix(q.close, "\u00a0") {
+				for len(out) != 0 && unicode.IsSpace(out[len(out)-1]) {
+					out = out[:len(out)-1] // replaced by the non-breaking space
+				}
+			}
+			out = append(out, []rune(q.close)...)
+			prevQuote = 2
+		case '\'':
+			switch {
+			case opening && unicode.IsDigit(next):
+				out = append(out, '’') // e.g. '90s
+			case opening:
+				out = append(out, []rune(q.open2)...)
+				prevQuote = 1
+			case unicode.IsLetter(next):
+				out = append(out, '’') // apostrophe
+			default:
+				out = append(out, []rune(q.close2)...)
+				prevQuote = 2
+			}
+		default:
+			out = append(out, r)
+		}
+	}
+	t.prevQuote = prevQuote
+	return string(out)
+}
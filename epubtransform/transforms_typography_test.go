@@ -0,0 +1,81 @@
+package epubtransform
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+)
+
+func TestTypography(t *testing.T) {
+	opts := TypographyOptions{
+		Quotes:        true,
+		Dashes:        true,
+		Ellipses:      true,
+		FrenchSpacing: true,
+		Whitespace:    true,
+	}
+	for _, c := range []struct {
+		lang string
+		in   string
+		exp  string
+	}{
+		{"en", `<p>"It's the '90s," she said -- "wait..."  <i>'really'</i>?</p><pre>"code"</pre>`,
+			`<p>“It’s the ’90s,” she said — “wait…” <i>‘really’</i>?</p><pre>&#34;code&#34;</pre>`},
+		{"en", `<p>He said "<i>hi</i>" and left.</p><p>'Tis <code>x</code>'s</p>`,
+			`<p>He said “<i>hi</i>” and left.</p><p>‘Tis <code>x</code>’s</p>`},
+		{"fr", `<p>Il a dit " bonjour " ; vraiment ? Oui : non !</p>`,
+			"<p>Il a dit «\u00a0bonjour\u00a0»\u202f; vraiment\u202f? Oui\u00a0: non\u202f!</p>"},
+		{"de", `<p>Er sagte "Hallo 'Welt'".</p><p lang="en">"Hi"</p>`,
+			`<p>Er sagte „Hallo ‚Welt‘“.</p><p lang="en">“Hi”</p>`},
+	} {
+		n, err := html.Parse(strings.NewReader(`<html><head><title>"x"</title></head><body>` + c.in + `</body></html>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		(&typographer{opts: opts, prev: ' '}).walk(n, c.lang, func() {})
+
+		var b strings.Builder
+		if err := html.Render(&b, n); err != nil {
+			t.Fatal(err)
+		}
+		if exp := `<html><head><title>&#34;x&#34;</title></head><body>` + c.exp + `</body></html>`; b.String() != exp {
+			t.Errorf("%s: %s: expected:\n%s\ngot:\n%s", c.lang, c.in, exp, b.String())
+		}
+	}
+}
+
+func TestHyphenator(t *testing.T) {
+	h := &Hyphenator{patterns: map[string][]int{}, exceptions: map[string][]int{}}
+	for _, p := range []string{"hy3ph", "he2n", "hena4", "hen5at", "1na", "n2at", "1tio", "2io", "o2n"} {
+		if err := h.addPattern(p); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	h.addException("ta-ble")
+
+	for _, c := range []struct {
+		word string
+		exp  []int
+	}{
+		{"hyphenation", []int{2, 6}},
+		{"Hyphenation", []int{2, 6}},
+		{"table", []int{2}},
+		{"hyp", nil},
+	} {
+		if res := h.Points(c.word); !reflect.DeepEqual(res, c.exp) {
+			t.Errorf("%s: expected %v, got %v", c.word, c.exp, res)
+		}
+	}
+
+	n, err := html.Parse(strings.NewReader("<p>hyphenation hy\u00adphenation</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&typographer{opts: TypographyOptions{Hyphenator: h}}).walk(n, "en", func() {})
+	if res, exp := util.TextContent(n), "hy\u00adphen\u00adation hy\u00adphenation"; res != exp {
+		t.Errorf("expected %q, got %q", exp, res)
+	}
+}
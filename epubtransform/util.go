@@ -2,11 +2,17 @@ package epubtransform
 
 import (
 	"errors"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/beevik/etree"
 	"github.com/pgaskin/epubtool/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 func getOPFPath(epubdir string) (string, error) {
@@ -31,3 +37,137 @@ func getOPFPath(epubdir string) (string, error) {
 
 	return filepath.Join(epubdir, rootfile), nil
 }
+
+// resolveHref resolves a relative URL from a file (with a slash-separated path
+// relative to the epub root), returning the slash-separated path relative to the
+// epub root. The fragment and query are removed.
+func resolveHref(from, href string) string {
+	if i := strings.IndexAny(href, "#?"); i != -1 {
+		href = href[:i]
+	}
+	if u, err := url.PathUnescape(href); err == nil {
+		href = u
+	}
+	if href == "" {
+		return from
+	}
+	return path.Join(path.Dir(from), href)
+}
+
+// removeElement removes an element along with the whitespace before it.
+func removeElement(el *etree.Element) {
+	p := el.Parent()
+	if p == nil {
+		return
+	}
+	if i := el.Index(); i > 0 {
+		if cd, ok := p.Child[i-1].(*etree.CharData); ok && cd.IsWhitespace() {
+			p.RemoveChildAt(i - 1)
+		}
+	}
+	p.RemoveChild(el)
+}
+
+// insertChildIndented inserts el into parent before another child element (or
+// at the end if before is nil), using the same indentation as the existing
+// children.
+func insertChildIndented(parent, el, before *etree.Element) {
+	indent := "\n"
+	for i, c := range parent.Child {
+		if _, ok := c.(*etree.Element); ok {
+			if i > 0 {
+				if cd, ok := parent.Child[i-1].(*etree.CharData); ok && cd.IsWhitespace() {
+					indent = cd.Data
+				}
+			}
+			break
+		}
+	}
+	if before != nil {
+		i := before.Index()
+		parent.InsertChildAt(i, el)
+		parent.InsertChildAt(i+1, etree.NewText(indent))
+		return
+	}
+	i := len(parent.Child)
+	if i != 0 {
+		if cd, ok := parent.Child[i-1].(*etree.CharData); ok && cd.IsWhitespace() {
+			i-- // keep the whitespace before the end tag
+		}
+	}
+	parent.InsertChildAt(i, etree.NewText(indent))
+	parent.InsertChildAt(i+1, el)
+}
+
+// nextElement returns the next sibling element of el, if any.
+func nextElement(el *etree.Element) *etree.Element {
+	if p := el.Parent(); p != nil {
+		for _, c := range p.Child[el.Index()+1:] {
+			if n, ok := c.(*etree.Element); ok {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// isContentElement checks if the text in an element is part of the content of
+// a document (i.e. it isn't in the head, a script, or a stylesheet).
+func isContentElement(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template:
+		return false
+	}
+	return true
+}
+
+// isHiddenElement checks if an element and its text are never displayed as
+// part of the text of a document (e.g. scripts, ruby annotations, and form
+// controls).
+func isHiddenElement(n *html.Node) bool {
+	if !isContentElement(n) {
+		return true
+	}
+	switch n.DataAtom {
+	case atom.Noscript, atom.Rt, atom.Rp, atom.Textarea, atom.Select:
+		return true
+	}
+	_, hidden := util.LookupAttr(n, "hidden")
+	return hidden
+}
+
+// walkTextNodes calls fn for each text node in n which isn't in the head, a
+// script, or a stylesheet.
+func walkTextNodes(n *html.Node, fn func(*html.Node)) {
+	util.Walk(n, func(n *html.Node) bool {
+		switch n.Type {
+		case html.TextNode:
+			fn(n)
+		case html.ElementNode:
+			return isContentElement(n)
+		}
+		return true
+	}, nil)
+}
+
+var xmlDeclRe = regexp.MustCompile(`^\s*<\?xml[^>]*\?>`)
+
+// renderDocument renders a document parsed from orig, keeping the original XML
+// declaration (which the parser turns into a comment).
+func renderDocument(doc *html.Node, orig string) (string, error) {
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.CommentNode && strings.HasPrefix(c.Data, "?xml") {
+			doc.RemoveChild(c)
+			break
+		}
+	}
+	var b strings.Builder
+	if m := xmlDeclRe.FindString(orig); m != "" {
+		b.WriteString(m)
+		b.WriteString("\n")
+	}
+	if err := html.Render(&b, doc); err != nil {
+		return orig, err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,194 @@
+package fontsubset
+
+import (
+	"errors"
+	"sort"
+)
+
+// cmap parses the best Unicode subtable of the cmap table.
+func (f *font) cmap() (map[rune]uint16, error) {
+	b := f.tables["cmap"]
+	if len(b) < 4 {
+		return nil, errors.New("invalid cmap table")
+	}
+
+	// find the best unicode subtable (full repertoire over bmp only)
+	var best uint32
+	var bestScore int
+	for i, n := 0, int(be.Uint16(b[2:])); i < n; i++ {
+		rec := b[4+8*i:]
+		if len(rec) < 8 {
+			return nil, errors.New("invalid cmap table")
+		}
+		platform, encoding, off := be.Uint16(rec), be.Uint16(rec[2:]), be.Uint32(rec[4:])
+		var score int
+		switch {
+		case platform == 3 && encoding == 10, platform == 0 && (encoding == 4 || encoding == 6):
+			score = 3
+		case platform == 3 && encoding == 1, platform == 0:
+			score = 2
+		}
+		if score > bestScore && int(off) < len(b) {
+			best, bestScore = off, score
+		}
+	}
+	if bestScore == 0 {
+		return nil, errors.New("no unicode cmap subtable")
+	}
+
+	st := b[best:]
+	if len(st) < 2 {
+		return nil, errors.New("invalid cmap subtable")
+	}
+	m := map[rune]uint16{}
+	switch format := be.Uint16(st); format {
+	case 4:
+		if len(st) < 14 {
+			return nil, errors.New("invalid cmap format 4 subtable")
+		}
+		segs := int(be.Uint16(st[6:])) / 2
+		if len(st) < 16+8*segs {
+			return nil, errors.New("invalid cmap format 4 subtable")
+		}
+		ends, starts, deltas, ros := 14, 16+2*segs, 16+4*segs, 16+6*segs
+		for i := 0; i < segs; i++ {
+			end, start := be.Uint16(st[ends+2*i:]), be.Uint16(st[starts+2*i:])
+			delta, ro := be.Uint16(st[deltas+2*i:]), be.Uint16(st[ros+2*i:])
+			for c := uint32(start); c <= uint32(end) && c != 0xFFFF; c++ {
+				var g uint16
+				if ro == 0 {
+					g = uint16(c) + delta
+				} else {
+					p := ros + 2*i + int(ro) + 2*int(c-uint32(start))
+					if p+2 > len(st) {
+						continue
+					}
+					if g = be.Uint16(st[p:]); g != 0 {
+						g += delta
+					}
+				}
+				if g != 0 {
+					m[rune(c)] = g
+				}
+			}
+		}
+	case 12:
+		if len(st) < 16 {
+			return nil, errors.New("invalid cmap format 12 subtable")
+		}
+		n := int(be.Uint32(st[12:]))
+		if len(st) < 16+12*n {
+			return nil, errors.New("invalid cmap format 12 subtable")
+		}
+		for i := 0; i < n; i++ {
+			grp := st[16+12*i:]
+			start, end, g := be.Uint32(grp), be.Uint32(grp[4:]), be.Uint32(grp[8:])
+			if end > 0x10FFFF || end < start {
+				continue
+			}
+			for c := start; c <= end; c++ {
+				m[rune(c)] = uint16(g + c - start)
+			}
+		}
+	case 6:
+		if len(st) < 10 {
+			return nil, errors.New("invalid cmap format 6 subtable")
+		}
+		first, n := int(be.Uint16(st[6:])), int(be.Uint16(st[8:]))
+		if len(st) < 10+2*n {
+			return nil, errors.New("invalid cmap format 6 subtable")
+		}
+		for i := 0; i < n; i++ {
+			if g := be.Uint16(st[10+2*i:]); g != 0 {
+				m[rune(first+i)] = g
+			}
+		}
+	default:
+		return nil, ErrUnsupported
+	}
+	return m, nil
+}
+
+// buildCmap builds a cmap table with a format 4 subtable for the BMP and a
+// format 12 subtable if there are characters outside it.
+func buildCmap(m map[rune]uint16) []byte {
+	rs := make([]rune, 0, len(m))
+	var full bool
+	for r := range m {
+		rs = append(rs, r)
+		if r > 0xFFFF {
+			full = true
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i] < rs[j] })
+
+	// format 4: one segment per run of consecutive characters and glyphs
+	type seg struct{ start, end, delta uint16 }
+	var segs []seg
+	for _, r := range rs {
+		if r >= 0xFFFF {
+			break
+		}
+		g := m[r]
+		if n := len(segs); n != 0 && rune(segs[n-1].end)+1 == r && uint16(r)+segs[n-1].delta == g {
+			segs[n-1].end++
+			continue
+		}
+		segs = append(segs, seg{uint16(r), uint16(r), g - uint16(r)})
+	}
+	segs = append(segs, seg{0xFFFF, 0xFFFF, 1})
+
+	n := len(segs)
+	var es uint16
+	for 1<<(es+1) <= n {
+		es++
+	}
+	sr := uint16(2 * (1 << es))
+
+	f4 := make([]byte, 16+8*n)
+	be.PutUint16(f4, 4)
+	be.PutUint16(f4[2:], uint16(len(f4)))
+	be.PutUint16(f4[6:], uint16(2*n))
+	be.PutUint16(f4[8:], sr)
+	be.PutUint16(f4[10:], es)
+	be.PutUint16(f4[12:], uint16(2*n)-sr)
+	for i, s := range segs {
+		be.PutUint16(f4[14+2*i:], s.end)
+		be.PutUint16(f4[16+2*n+2*i:], s.start)
+		be.PutUint16(f4[16+4*n+2*i:], s.delta)
+	}
+
+	subtables := [][]byte{f4}
+	if full {
+		// format 12: one group per run of consecutive characters and glyphs
+		var grps [][3]uint32
+		for _, r := range rs {
+			g := uint32(m[r])
+			if n := len(grps); n != 0 && grps[n-1][1]+1 == uint32(r) && grps[n-1][2]+uint32(r)-grps[n-1][0] == g {
+				grps[n-1][1]++
+				continue
+			}
+			grps = append(grps, [3]uint32{uint32(r), uint32(r), g})
+		}
+		f12 := make([]byte, 16+12*len(grps))
+		be.PutUint16(f12, 12)
+		be.PutUint32(f12[4:], uint32(len(f12)))
+		be.PutUint32(f12[12:], uint32(len(grps)))
+		for i, grp := range grps {
+			be.PutUint32(f12[16+12*i:], grp[0])
+			be.PutUint32(f12[20+12*i:], grp[1])
+			be.PutUint32(f12[24+12*i:], grp[2])
+		}
+		subtables = append(subtables, f12)
+	}
+
+	buf := make([]byte, 4+8*len(subtables))
+	be.PutUint16(buf[2:], uint16(len(subtables)))
+	for i, st := range subtables {
+		be.PutUint16(buf[4+8*i:], 3)
+		be.PutUint16(buf[6+8*i:], []uint16{1, 10}[i])
+		be.PutUint32(buf[8+8*i:], uint32(len(buf)))
+		buf = append(buf, st...)
+	}
+	return buf
+}
@@ -0,0 +1,301 @@
+// Package fontsubset removes unused glyphs from TrueType fonts.
+//
+// Glyph IDs are preserved (unused glyphs are replaced with empty ones), so
+// tables which reference glyphs (e.g. hmtx, kern, GPOS) remain valid without
+// being rewritten. Glyphs reachable through GSUB substitutions and composite
+// glyphs are kept. Fonts with CFF outlines, WOFF/WOFF2 fonts, and font
+// collections are not supported.
+package fontsubset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrUnsupported is returned if the font format is not supported.
+var ErrUnsupported = errors.New("unsupported font format")
+
+var be = binary.BigEndian
+
+type font struct {
+	version uint32
+	tables  map[string][]byte
+}
+
+// Runes returns the characters mapped by the font's cmap.
+func Runes(buf []byte) ([]rune, error) {
+	f, err := parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	cmap, err := f.cmap()
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]rune, 0, len(cmap))
+	for r := range cmap {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i] < rs[j] })
+	return rs, nil
+}
+
+// Subset returns a copy of the font with only the glyphs needed to display the
+// specified characters.
+func Subset(buf []byte, runes map[rune]bool) ([]byte, error) {
+	f, err := parse(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range []string{"head", "maxp", "loca", "glyf", "cmap"} {
+		if _, ok := f.tables[t]; !ok {
+			if t == "loca" || t == "glyf" {
+				return nil, fmt.Errorf("%w (no TrueType outlines)", ErrUnsupported)
+			}
+			return nil, fmt.Errorf("missing %s table", t)
+		}
+	}
+
+	head := f.tables["head"]
+	if len(head) < 54 {
+		return nil, errors.New("invalid head table")
+	}
+	if len(f.tables["maxp"]) < 6 {
+		return nil, errors.New("invalid maxp table")
+	}
+	numGlyphs := int(be.Uint16(f.tables["maxp"][4:]))
+
+	loca, err := parseLoca(f.tables["loca"], be.Uint16(head[50:]) != 0, numGlyphs)
+	if err != nil {
+		return nil, err
+	}
+	glyf := f.tables["glyf"]
+
+	cmap, err := f.cmap()
+	if err != nil {
+		return nil, err
+	}
+
+	// find the glyphs to keep
+	keep := map[uint16]bool{0: true}
+	ncmap := map[rune]uint16{}
+	for r := range runes {
+		if g, ok := cmap[r]; ok {
+			keep[g] = true
+			ncmap[r] = g
+		}
+	}
+	if gsub, ok := f.tables["GSUB"]; ok {
+		if err := gsubClosure(gsub, keep); err != nil {
+			return nil, fmt.Errorf("parse GSUB: %w", err)
+		}
+	}
+	if err := compositeClosure(glyf, loca, keep); err != nil {
+		return nil, err
+	}
+
+	// rebuild the glyf and loca tables
+	nglyf := make([]byte, 0, len(glyf))
+	offsets := make([]uint32, numGlyphs+1)
+	for g := 0; g < numGlyphs; g++ {
+		offsets[g] = uint32(len(nglyf))
+		if keep[uint16(g)] {
+			nglyf = append(nglyf, glyf[loca[g]:loca[g+1]]...)
+			for len(nglyf)%4 != 0 {
+				nglyf = append(nglyf, 0)
+			}
+		}
+	}
+	offsets[numGlyphs] = uint32(len(nglyf))
+
+	var nloca []byte
+	long := len(nglyf)/2 > 0xFFFF
+	if long {
+		nloca = make([]byte, 4*len(offsets))
+		for i, off := range offsets {
+			be.PutUint32(nloca[4*i:], off)
+		}
+	} else {
+		nloca = make([]byte, 2*len(offsets))
+		for i, off := range offsets {
+			be.PutUint16(nloca[2*i:], uint16(off/2))
+		}
+	}
+
+	nhead := append([]byte(nil), head...)
+	if long {
+		be.PutUint16(nhead[50:], 1) // indexToLocFormat
+	} else {
+		be.PutUint16(nhead[50:], 0)
+	}
+	be.PutUint32(nhead[8:], 0) // checkSumAdjustment (updated later)
+
+	f.tables["glyf"] = nglyf
+	f.tables["loca"] = nloca
+	f.tables["head"] = nhead
+	f.tables["cmap"] = buildCmap(ncmap)
+	delete(f.tables, "DSIG") // the signature is no longer valid
+
+	// remove the glyph names, which can be a significant part of the font
+	if post := f.tables["post"]; len(post) >= 32 && be.Uint32(post) == 0x00020000 {
+		npost := append([]byte(nil), post[:32]...)
+		be.PutUint32(npost, 0x00030000)
+		f.tables["post"] = npost
+	}
+
+	return f.write(), nil
+}
+
+func parse(buf []byte) (*font, error) {
+	if len(buf) < 12 {
+		return nil, errors.New("font too short")
+	}
+	switch v := be.Uint32(buf); v {
+	case 0x00010000, 0x74727565: // TrueType, 'true'
+	case 0x4F54544F, 0x774F4646, 0x774F4632, 0x74746366: // 'OTTO', 'wOFF', 'wOF2', 'ttcf'
+		return nil, ErrUnsupported
+	default:
+		return nil, fmt.Errorf("invalid font (version %08x)", v)
+	}
+	f := &font{
+		version: be.Uint32(buf),
+		tables:  map[string][]byte{},
+	}
+	n := int(be.Uint16(buf[4:]))
+	if len(buf) < 12+16*n {
+		return nil, errors.New("font too short")
+	}
+	for i := 0; i < n; i++ {
+		rec := buf[12+16*i:]
+		off, length := be.Uint32(rec[8:]), be.Uint32(rec[12:])
+		if uint64(off)+uint64(length) > uint64(len(buf)) {
+			return nil, fmt.Errorf("table %q out of bounds", rec[:4])
+		}
+		f.tables[string(rec[:4])] = buf[off : off+length]
+	}
+	return f, nil
+}
+
+func (f *font) write() []byte {
+	tags := make([]string, 0, len(f.tables))
+	for t := range f.tables {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+
+	n := len(tags)
+	var es, sr uint16
+	for 1<<(es+1) <= n {
+		es++
+	}
+	sr = (1 << es) * 16
+
+	buf := make([]byte, 12+16*n)
+	be.PutUint32(buf, f.version)
+	be.PutUint16(buf[4:], uint16(n))
+	be.PutUint16(buf[6:], sr)
+	be.PutUint16(buf[8:], es)
+	be.PutUint16(buf[10:], uint16(n*16)-sr)
+
+	var headOff int
+	for i, t := range tags {
+		data := f.tables[t]
+		rec := buf[12+16*i:]
+		copy(rec, t)
+		be.PutUint32(rec[4:], checksum(data))
+		be.PutUint32(rec[8:], uint32(len(buf)))
+		be.PutUint32(rec[12:], uint32(len(data)))
+		if t == "head" {
+			headOff = len(buf)
+		}
+		buf = append(buf, data...)
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+	if headOff != 0 {
+		be.PutUint32(buf[headOff+8:], 0xB1B0AFBA-checksum(buf))
+	}
+	return buf
+}
+
+func checksum(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(b); i += 4 {
+		var v [4]byte
+		copy(v[:], b[i:])
+		sum += be.Uint32(v[:])
+	}
+	return sum
+}
+
+func parseLoca(b []byte, long bool, numGlyphs int) ([]uint32, error) {
+	loca := make([]uint32, numGlyphs+1)
+	for i := range loca {
+		if long {
+			if len(b) < 4*(i+1) {
+				return nil, errors.New("invalid loca table")
+			}
+			loca[i] = be.Uint32(b[4*i:])
+		} else {
+			if len(b) < 2*(i+1) {
+				return nil, errors.New("invalid loca table")
+			}
+			loca[i] = uint32(be.Uint16(b[2*i:])) * 2
+		}
+		if i != 0 && loca[i] < loca[i-1] {
+			return nil, errors.New("invalid loca table")
+		}
+	}
+	return loca, nil
+}
+
+// compositeClosure adds the components of composite glyphs to keep.
+func compositeClosure(glyf []byte, loca []uint32, keep map[uint16]bool) error {
+	queue := make([]uint16, 0, len(keep))
+	for g := range keep {
+		queue = append(queue, g)
+	}
+	for len(queue) != 0 {
+		g := queue[0]
+		queue = queue[1:]
+		if int(g)+1 >= len(loca) {
+			continue
+		}
+		if loca[g+1] > uint32(len(glyf)) {
+			return errors.New("glyph out of bounds")
+		}
+		data := glyf[loca[g]:loca[g+1]]
+		if len(data) < 10 || int16(be.Uint16(data)) >= 0 {
+			continue // empty or simple glyph
+		}
+		for p := 10; p+4 <= len(data); {
+			flags, c := be.Uint16(data[p:]), be.Uint16(data[p+2:])
+			if !keep[c] {
+				keep[c] = true
+				queue = append(queue, c)
+			}
+			p += 4
+			if flags&0x0001 != 0 { // ARG_1_AND_2_ARE_WORDS
+				p += 4
+			} else {
+				p += 2
+			}
+			switch {
+			case flags&0x0008 != 0: // WE_HAVE_A_SCALE
+				p += 2
+			case flags&0x0040 != 0: // WE_HAVE_AN_X_AND_Y_SCALE
+				p += 4
+			case flags&0x0080 != 0: // WE_HAVE_A_TWO_BY_TWO
+				p += 8
+			}
+			if flags&0x0020 == 0 { // MORE_COMPONENTS
+				break
+			}
+		}
+	}
+	return nil
+}
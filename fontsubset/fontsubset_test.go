@@ -0,0 +1,95 @@
+package fontsubset
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSubset(t *testing.T) {
+	simple := func(b byte) []byte {
+		return []byte{0, 1, 0, 0, 0, 0, 0, 10, 0, 10, b, b, b, b}
+	}
+	composite := func(c uint16) []byte {
+		g := []byte{0xFF, 0xFF, 0, 0, 0, 0, 0, 10, 0, 10, 0, 0, 0, 0, 0, 0}
+		be.PutUint16(g[12:], c)
+		return g
+	}
+	glyphs := [][]byte{
+		simple(0),    // .notdef
+		simple(1),    // A
+		composite(3), // B
+		simple(3),    // component of B
+		simple(4),    // C
+	}
+
+	var glyf, loca []byte
+	for _, g := range glyphs {
+		loca = append(loca, 0, 0, 0, 0)
+		be.PutUint32(loca[len(loca)-4:], uint32(len(glyf)))
+		glyf = append(glyf, g...)
+	}
+	loca = append(loca, 0, 0, 0, 0)
+	be.PutUint32(loca[len(loca)-4:], uint32(len(glyf)))
+
+	head := make([]byte, 54)
+	be.PutUint16(head[50:], 1)
+	maxp := make([]byte, 6)
+	be.PutUint16(maxp[4:], uint16(len(glyphs)))
+
+	buf := (&font{
+		version: 0x00010000,
+		tables: map[string][]byte{
+			"head": head,
+			"maxp": maxp,
+			"glyf": glyf,
+			"loca": loca,
+			"cmap": buildCmap(map[rune]uint16{'A': 1, 'B': 2, 'C': 4, '😀': 1}),
+			"DSIG": {0, 0, 0, 1},
+		},
+	}).write()
+
+	if rs, err := Runes(buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if string(rs) != "ABC😀" {
+		t.Errorf("expected runes ABC😀, got %q", string(rs))
+	}
+
+	nbuf, err := Subset(buf, map[rune]bool{'B': true, 'x': true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := checksum(nbuf); c != 0xB1B0AFBA {
+		t.Errorf("incorrect checksum %08x", c)
+	}
+
+	f, err := parse(nbuf)
+	if err != nil {
+		t.Fatalf("parse subset: %v", err)
+	}
+	if _, ok := f.tables["DSIG"]; ok {
+		t.Errorf("expected DSIG to be removed")
+	}
+	if cmap, err := f.cmap(); err != nil {
+		t.Errorf("parse subset cmap: %v", err)
+	} else if len(cmap) != 1 || cmap['B'] != 2 {
+		t.Errorf("expected only B in cmap, got %v", cmap)
+	}
+
+	nloca, err := parseLoca(f.tables["loca"], be.Uint16(f.tables["head"][50:]) != 0, len(glyphs))
+	if err != nil {
+		t.Fatalf("parse subset loca: %v", err)
+	}
+	for i, g := range glyphs {
+		keep := i == 0 || i == 2 || i == 3
+		ng := f.tables["glyf"][nloca[i]:nloca[i+1]]
+		if keep && !bytes.Equal(bytes.TrimRight(ng, "\x00"), bytes.TrimRight(g, "\x00")) {
+			t.Errorf("glyph %d: expected it to be kept", i)
+		} else if !keep && len(ng) != 0 {
+			t.Errorf("glyph %d: expected it to be removed", i)
+		}
+	}
+
+	if _, err := Subset([]byte("OTTO\x00\x00\x00\x00\x00\x00\x00\x00"), nil); err != ErrUnsupported {
+		t.Errorf("expected ErrUnsupported for CFF font, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package fontsubset
+
+import "errors"
+
+var errInvalidGSUB = errors.New("invalid table")
+
+// gsubClosure adds the glyphs which can be produced by substitutions of the
+// glyphs in keep. Contextual lookups only apply other lookups, so they don't
+// need to be followed since every lookup is checked.
+func gsubClosure(b []byte, keep map[uint16]bool) error {
+	if len(b) < 10 {
+		return errInvalidGSUB
+	}
+	ll := b[be.Uint16(b[8:]):]
+	if len(ll) < 2 {
+		return errInvalidGSUB
+	}
+
+	type subtable struct {
+		typ uint16
+		b   []byte
+	}
+	var subtables []subtable
+	for i, n := 0, int(be.Uint16(ll)); i < n; i++ {
+		if len(ll) < 2+2*(i+1) {
+			return errInvalidGSUB
+		}
+		l := ll[min(len(ll), int(be.Uint16(ll[2+2*i:]))):]
+		if len(l) < 6 {
+			return errInvalidGSUB
+		}
+		typ, sn := be.Uint16(l), int(be.Uint16(l[4:]))
+		for j := 0; j < sn; j++ {
+			if len(l) < 6+2*(j+1) {
+				return errInvalidGSUB
+			}
+			st := l[min(len(l), int(be.Uint16(l[6+2*j:]))):]
+			t := typ
+			if t == 7 { // extension
+				if len(st) < 8 {
+					return errInvalidGSUB
+				}
+				t = be.Uint16(st[2:])
+				st = st[min(len(st), int(be.Uint32(st[4:]))):]
+			}
+			if t >= 1 && t <= 4 {
+				subtables = append(subtables, subtable{t, st})
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		add := func(g uint16) {
+			if !keep[g] {
+				keep[g] = true
+				changed = true
+			}
+		}
+		for _, st := range subtables {
+			if err := gsubApply(st.typ, st.b, keep, add); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gsubApply calls add for each glyph produced by a single, multiple, alternate,
+// or ligature substitution subtable from the glyphs in keep.
+func gsubApply(typ uint16, st []byte, keep map[uint16]bool, add func(uint16)) error {
+	if len(st) < 6 {
+		return errInvalidGSUB
+	}
+	format := be.Uint16(st)
+	cov, err := coverage(st[min(len(st), int(be.Uint16(st[2:]))):])
+	if err != nil {
+		return err
+	}
+	// sequence calls fn with the glyphs in the array at off in st
+	sequence := func(off int, fn func(uint16)) error {
+		s := st[min(len(st), off):]
+		if len(s) < 2 || len(s) < 2+2*int(be.Uint16(s)) {
+			return errInvalidGSUB
+		}
+		for i, n := 0, int(be.Uint16(s)); i < n; i++ {
+			fn(be.Uint16(s[2+2*i:]))
+		}
+		return nil
+	}
+	switch {
+	case typ == 1 && format == 1:
+		delta := be.Uint16(st[4:])
+		for _, g := range cov {
+			if keep[g] {
+				add(g + delta)
+			}
+		}
+	case typ == 1 && format == 2:
+		i := 0
+		return sequence(4, func(g uint16) {
+			if i < len(cov) && keep[cov[i]] {
+				add(g)
+			}
+			i++
+		})
+	case typ == 2 || typ == 3:
+		if len(st) < 6+2*len(cov) {
+			return errInvalidGSUB
+		}
+		for i, g := range cov {
+			if keep[g] {
+				if err := sequence(int(be.Uint16(st[6+2*i:])), add); err != nil {
+					return err
+				}
+			}
+		}
+	case typ == 4:
+		if len(st) < 6+2*len(cov) {
+			return errInvalidGSUB
+		}
+		for i, g := range cov {
+			if !keep[g] {
+				continue
+			}
+			ls := st[min(len(st), int(be.Uint16(st[6+2*i:]))):]
+			if len(ls) < 2+2*int(be.Uint16(ls)) {
+				return errInvalidGSUB
+			}
+			for j, n := 0, int(be.Uint16(ls)); j < n; j++ {
+				lig := ls[min(len(ls), int(be.Uint16(ls[2+2*j:]))):]
+				if len(lig) < 4 {
+					return errInvalidGSUB
+				}
+				cc := int(be.Uint16(lig[2:]))
+				if cc == 0 || len(lig) < 4+2*(cc-1) {
+					return errInvalidGSUB
+				}
+				ok := true
+				for k := 0; k < cc-1; k++ {
+					if !keep[be.Uint16(lig[4+2*k:])] {
+						ok = false
+						break
+					}
+				}
+				if ok {
+					add(be.Uint16(lig))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// coverage parses a coverage table.
+func coverage(b []byte) ([]uint16, error) {
+	if len(b) < 4 {
+		return nil, errInvalidGSUB
+	}
+	n := int(be.Uint16(b[2:]))
+	switch be.Uint16(b) {
+	case 1:
+		if len(b) < 4+2*n {
+			return nil, errInvalidGSUB
+		}
+		gs := make([]uint16, n)
+		for i := range gs {
+			gs[i] = be.Uint16(b[4+2*i:])
+		}
+		return gs, nil
+	case 2:
+		if len(b) < 4+6*n {
+			return nil, errInvalidGSUB
+		}
+		var gs []uint16
+		for i := 0; i < n; i++ {
+			r := b[4+6*i:]
+			for g := uint32(be.Uint16(r)); g <= uint32(be.Uint16(r[2:])); g++ {
+				gs = append(gs, uint16(g))
+			}
+		}
+		return gs, nil
+	}
+	return nil, errInvalidGSUB
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -3,8 +3,13 @@ module github.com/pgaskin/epubtool
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/PuerkitoBio/goquery v1.5.1
+	github.com/andybalholm/cascadia v1.1.0
 	github.com/beevik/etree v1.1.0
 	github.com/mattn/go-zglob v0.0.2
 	github.com/spf13/pflag v1.0.5
+	github.com/yuin/goldmark v1.2.1
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffEdits is the maximum number of edits to search for before giving up
+// and replacing everything which differs.
+const maxDiffEdits = 2000
+
+type diffOp struct {
+	kind byte // ' ', '-', or '+'
+	line string
+}
+
+// UnifiedDiff returns the hunks of a unified diff between two lists of lines
+// with the specified number of lines of context, or an empty string if they are
+// the same.
+func UnifiedDiff(a, b []string, context int) string {
+	ops := diffLines(a, b)
+
+	var sb strings.Builder
+	var ai, bi int // the current line in a and b
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			ai, bi, i = ai+1, bi+1, i+1
+			continue
+		}
+
+		// find the end of the hunk (the last change followed by more than
+		// 2*context unchanged lines)
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j, eq := i, 0; j < len(ops); j++ {
+			if ops[j].kind == ' ' {
+				if eq++; eq > 2*context {
+					break
+				}
+			} else {
+				end, eq = j+1, 0
+			}
+		}
+		if end += context; end > len(ops) {
+			end = len(ops)
+		}
+
+		// count the lines
+		as, bs := ai-(i-start), bi-(i-start)
+		var al, bl int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				al++
+			}
+			if op.kind != '-' {
+				bl++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(as, al), hunkRange(bs, bl))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				ai++
+			}
+			if op.kind != '-' {
+				bi++
+			}
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// diffLines computes the shortest edit script between a and b using Myers'
+// algorithm.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+
+	// common prefix and suffix
+	var pre, suf int
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	ops = append(ops, myers(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
+
+func myers(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+
+	maxEdits := n + m
+	if maxEdits > maxDiffEdits {
+		maxEdits = maxDiffEdits
+	}
+	off := maxEdits + 1
+	v := make([]int, 2*maxEdits+3)
+	var trace [][]int
+	for d := 0; d <= maxEdits; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...)) // k = -d-1..d+1
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(a, b, trace)
+			}
+		}
+	}
+
+	// too many differences, so replace everything
+	ops := make([]diffOp, 0, n+m)
+	for _, l := range a {
+		ops = append(ops, diffOp{'-', l})
+	}
+	for _, l := range b {
+		ops = append(ops, diffOp{'+', l})
+	}
+	return ops
+}
+
+func myersBacktrack(a, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v, off := trace[d], d+1
+		k := x - y
+		var pk int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := v[off+pk]
+		py := px - pk
+		for x > px && y > py {
+			x, y = x-1, y-1
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if d > 0 {
+			if x == px {
+				ops = append(ops, diffOp{'+', b[py]})
+			} else {
+				ops = append(ops, diffOp{'-', a[px]})
+			}
+		}
+		x, y = px, py
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
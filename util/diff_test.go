@@ -0,0 +1,23 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, c := range []struct {
+		a, b, diff string
+	}{
+		{"a b c", "a b c", ""},
+		{"", "a", "@@ -0,0 +1 @@\n+a\n"},
+		{"a", "", "@@ -1 +0,0 @@\n-a\n"},
+		{"a b c d e f g h i j", "a b x d e f g h i j", "@@ -1,5 +1,5 @@\n a\n b\n-c\n+x\n d\n e\n"},
+		{"1 2 3 4 5 6 7 8 9 10 11 12", "0 1 2 3 4 5 6 7 8 9 10 12", "@@ -1,2 +1,3 @@\n+0\n 1\n 2\n@@ -9,4 +10,3 @@\n 9\n 10\n-11\n 12\n"},
+		{"a b c d", "a c b d", "@@ -1,4 +1,4 @@\n a\n-b\n c\n+b\n d\n"},
+	} {
+		if diff := UnifiedDiff(strings.Fields(c.a), strings.Fields(c.b), 2); diff != c.diff {
+			t.Errorf("%q -> %q: expected:\n%s\ngot:\n%s", c.a, c.b, c.diff, diff)
+		}
+	}
+}
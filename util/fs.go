@@ -1,11 +1,13 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/mattn/go-zglob"
 )
@@ -64,6 +66,49 @@ func CopyDir(src, dst string) error {
 
 // CopyFile copies a file and its permissions. The destination must not exist.
 func CopyFile(src, dst string) error {
+	return copyFile(src, dst, false)
+}
+
+// CopyFileSync is like CopyFile, but it also flushes the destination to disk
+// before returning.
+func CopyFileSync(src, dst string) error {
+	return copyFile(src, dst, true)
+}
+
+// Move moves a file to a nonexistent destination. An atomic rename is used if
+// possible, falling back to copying, syncing, then deleting the source if the
+// destination is on another filesystem.
+func Move(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("destination %#v already exists", dst)
+	} else if !os.IsNotExist(err) {
+		return Wrap(err, "could not stat destination")
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	var le *os.LinkError
+	if !errors.As(err, &le) || !errors.Is(err, syscall.EXDEV) {
+		return err // only fall back if the destination is on another filesystem
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.Mode().IsRegular() {
+		return le // can't fall back if the source is gone or isn't a file
+	}
+
+	if err := CopyFileSync(src, dst); err != nil {
+		os.Remove(dst)
+		return Wrap(err, "could not copy file (rename failed: %v)", le.Err)
+	}
+	if err := os.Remove(src); err != nil {
+		return Wrap(err, "could not remove source after copying")
+	}
+	return nil
+}
+
+func copyFile(src, dst string, sync bool) error {
 	fi, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -85,7 +130,13 @@ func CopyFile(src, dst string) error {
 		return err
 	}
 
-	return nil
+	if sync {
+		if err = df.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return df.Close()
 }
 
 // MultiGlob globs for multiple patterns.
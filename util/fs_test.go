@@ -0,0 +1,78 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	td, err := ioutil.TempDir("", "epubtool-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	a, b := filepath.Join(td, "a"), filepath.Join(td, "b")
+	if err := ioutil.WriteFile(a, []byte("test"), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	if err := Move(a, b); err != nil {
+		t.Fatalf("move: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("move: expected source to be gone, got err=%v", err)
+	}
+	if buf, err := ioutil.ReadFile(b); err != nil || string(buf) != "test" {
+		t.Errorf("move: expected destination to have contents %q, got %q (err=%v)", "test", buf, err)
+	}
+
+	if err := ioutil.WriteFile(a, []byte("test2"), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if err := Move(a, b); err == nil {
+		t.Errorf("move: expected error when destination exists")
+	}
+	if buf, _ := ioutil.ReadFile(b); string(buf) != "test" {
+		t.Errorf("move: expected destination to be unchanged, got %q", buf)
+	}
+}
+
+func TestMoveNoFallback(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("requires unix permissions")
+	}
+
+	td, err := ioutil.TempDir("", "epubtool-test-*")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	src, dst := filepath.Join(td, "src"), filepath.Join(td, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("create dir: %v", err)
+		}
+	}
+	a, b := filepath.Join(src, "a"), filepath.Join(dst, "b")
+	if err := ioutil.WriteFile(a, []byte("test"), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	if err := os.Chmod(src, 0555); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	defer os.Chmod(src, 0755)
+
+	// the rename fails with EACCES, which shouldn't fall back to a copy
+	// (which would succeed, then leave both files when the remove fails)
+	if err := Move(a, b); err == nil {
+		t.Errorf("move: expected error")
+	}
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Errorf("move: expected destination to not exist, got err=%v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// FindElement finds the first element with the specified atom in n or its
+// descendants.
+func FindElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := FindElement(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// LookupAttr gets an attribute without a namespace, and whether it exists.
+func LookupAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// GetAttr gets an attribute without a namespace, or an empty string if it
+// doesn't exist.
+func GetAttr(n *html.Node, key string) string {
+	v, _ := LookupAttr(n, key)
+	return v
+}
+
+// SetAttr sets an attribute without a namespace.
+func SetAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+// TextContent returns the text of n and its descendants.
+func TextContent(n *html.Node) string {
+	var b strings.Builder
+	var fn func(*html.Node)
+	fn = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			fn(c)
+		}
+	}
+	fn(n)
+	return b.String()
+}
+
+// Walk calls enter for n and its descendants in document order. If enter
+// returns false, the children of the node are skipped. Otherwise, leave (if not
+// nil) is called for the node after its children.
+func Walk(n *html.Node, enter func(*html.Node) bool, leave func(*html.Node)) {
+	if !enter(n) {
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		Walk(c, enter, leave)
+	}
+	if leave != nil {
+		leave(n)
+	}
+}
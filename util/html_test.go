@@ -0,0 +1,64 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func TestHTML(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<p hidden>One <b id="x">two</b></p><p id="y">three</p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := FindElement(doc, atom.P)
+	if p == nil || FindElement(doc, atom.Table) != nil {
+		t.Fatalf("incorrect FindElement result")
+	}
+	if v, ok := LookupAttr(p, "hidden"); !ok || v != "" {
+		t.Errorf("expected empty hidden attribute, got %q (ok=%t)", v, ok)
+	}
+	if _, ok := LookupAttr(p, "id"); ok {
+		t.Errorf("expected no id attribute")
+	}
+	if v := GetAttr(FindElement(p, atom.B), "id"); v != "x" {
+		t.Errorf("expected id x, got %q", v)
+	}
+
+	SetAttr(p, "id", "a")
+	SetAttr(p, "id", "b")
+	if v := GetAttr(p, "id"); v != "b" || len(p.Attr) != 2 {
+		t.Errorf("expected id to be set once, got %+v", p.Attr)
+	}
+
+	if v := TextContent(FindElement(doc, atom.Body)); v != "One twothree" {
+		t.Errorf("expected text %q, got %q", "One twothree", v)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<p>One <b>two</b></p><p>three</p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	Walk(doc.FirstChild.LastChild, func(n *html.Node) bool {
+		if n.Type == html.ElementNode {
+			order = append(order, "<"+n.Data+">")
+		} else {
+			order = append(order, n.Data)
+		}
+		return n.DataAtom != atom.B
+	}, func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			order = append(order, "</"+n.Data+">")
+		}
+	})
+	if exp := "<body> <p> One  <b> </p> <p> three </p> </body>"; strings.Join(order, " ") != exp {
+		t.Errorf("expected walk order %q, got %q", exp, strings.Join(order, " "))
+	}
+}
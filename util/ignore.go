@@ -0,0 +1,146 @@
+package util
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Ignore matches slash-separated relative paths against patterns using the same
+// syntax as .gitignore files.
+type Ignore struct {
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewIgnore creates a new Ignore from the specified patterns.
+func NewIgnore(patterns ...string) (*Ignore, error) {
+	ig := &Ignore{}
+	for _, p := range patterns {
+		if err := ig.AddPattern(p); err != nil {
+			return nil, err
+		}
+	}
+	return ig, nil
+}
+
+// AddPattern adds a pattern. Later patterns take precedence over earlier ones.
+// Blank lines and comments are ignored.
+func (ig *Ignore) AddPattern(pattern string) error {
+	pattern = strings.TrimRight(pattern, "\r")
+	for strings.HasSuffix(pattern, " ") && !strings.HasSuffix(pattern, "\\ ") {
+		pattern = strings.TrimSuffix(pattern, " ")
+	}
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+
+	var r ignoreRule
+	if strings.HasPrefix(pattern, "!") {
+		r.negate, pattern = true, pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly, pattern = true, strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return nil
+	}
+
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**") && i+2 == len(pattern) && (i == 0 || pattern[i-1] == '/'):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '[':
+			if j := strings.IndexByte(pattern[i+1:], ']'); j > 0 {
+				class := pattern[i+1 : i+1+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+				i += j + 1
+			} else {
+				b.WriteString(regexp.QuoteMeta("["))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return Wrap(err, "invalid pattern %#v", pattern)
+	}
+	r.re = re
+
+	ig.rules = append(ig.rules, r)
+	return nil
+}
+
+// AddFile adds the patterns from a file.
+func (ig *Ignore) AddFile(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if err := ig.AddPattern(sc.Text()); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// Match checks if a slash-separated relative path is ignored. Like git, a path
+// is also ignored if any of its parent directories are.
+func (ig *Ignore) Match(relpath string, isDir bool) bool {
+	relpath = strings.Trim(path.Clean(relpath), "/")
+	for i := 0; i < len(relpath); i++ {
+		if relpath[i] == '/' && ig.match(relpath[:i], true) {
+			return true
+		}
+	}
+	return ig.match(relpath, isDir)
+}
+
+func (ig *Ignore) match(relpath string, isDir bool) bool {
+	var ignored bool
+	for _, r := range ig.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(relpath) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
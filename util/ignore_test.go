@@ -0,0 +1,53 @@
+package util
+
+import "testing"
+
+func TestIgnore(t *testing.T) {
+	ig, err := NewIgnore(
+		"# comment",
+		"",
+		"*.bak",
+		"/root.txt",
+		"build/",
+		"docs/**/*.md",
+		"!docs/keep.md",
+		"**/tmp",
+		"a/**",
+		"file[0-9].txt",
+		"\\#*#",
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"test.bak", false, true},
+		{"dir/test.bak", false, true},
+		{"test.bak.txt", false, false},
+		{"root.txt", false, true},
+		{"dir/root.txt", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/file.txt", false, true},
+		{"dir/build/file.txt", false, true},
+		{"docs/file.md", false, true},
+		{"docs/a/b/file.md", false, true},
+		{"docs/keep.md", false, false},
+		{"tmp", false, true},
+		{"x/y/tmp", true, true},
+		{"a", true, false},
+		{"a/b/c", false, true},
+		{"file1.txt", false, true},
+		{"fileA.txt", false, false},
+		{"#file#", false, true},
+		{"comment", false, false},
+	} {
+		if ignored := ig.Match(c.path, c.isDir); ignored != c.ignored {
+			t.Errorf("%#v (dir=%t): expected ignored=%t, got %t", c.path, c.isDir, c.ignored, ignored)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"archive/zip"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"os"
@@ -82,3 +83,14 @@ func UnzipReader(r io.ReaderAt, l int64, dst string) error {
 
 	return nil
 }
+
+// NewUUID generates a random (version 4) UUID.
+func NewUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}